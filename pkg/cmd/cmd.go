@@ -6,23 +6,35 @@ import (
 
 	"github.com/brevdev/brev-cli/pkg/auth"
 	"github.com/brevdev/brev-cli/pkg/cmd/approve"
+	"github.com/brevdev/brev-cli/pkg/cmd/cp"
 	"github.com/brevdev/brev-cli/pkg/cmd/delete"
+	"github.com/brevdev/brev-cli/pkg/cmd/dockercontext"
+	"github.com/brevdev/brev-cli/pkg/cmd/doctor"
+	"github.com/brevdev/brev-cli/pkg/cmd/events"
+	"github.com/brevdev/brev-cli/pkg/cmd/exec"
+	"github.com/brevdev/brev-cli/pkg/cmd/forward"
 	"github.com/brevdev/brev-cli/pkg/cmd/healthcheck"
+	"github.com/brevdev/brev-cli/pkg/cmd/kubeconfig"
 	"github.com/brevdev/brev-cli/pkg/cmd/login"
 	"github.com/brevdev/brev-cli/pkg/cmd/logout"
+	"github.com/brevdev/brev-cli/pkg/cmd/logs"
 	"github.com/brevdev/brev-cli/pkg/cmd/ls"
 	"github.com/brevdev/brev-cli/pkg/cmd/open"
 	"github.com/brevdev/brev-cli/pkg/cmd/portforward"
 	"github.com/brevdev/brev-cli/pkg/cmd/profile"
 	"github.com/brevdev/brev-cli/pkg/cmd/proxy"
+	"github.com/brevdev/brev-cli/pkg/cmd/proxyagent"
 	"github.com/brevdev/brev-cli/pkg/cmd/refresh"
 	"github.com/brevdev/brev-cli/pkg/cmd/reset"
 	"github.com/brevdev/brev-cli/pkg/cmd/runtasks"
 	"github.com/brevdev/brev-cli/pkg/cmd/secret"
 	"github.com/brevdev/brev-cli/pkg/cmd/set"
+	"github.com/brevdev/brev-cli/pkg/cmd/socks"
+	"github.com/brevdev/brev-cli/pkg/cmd/ssh"
 	"github.com/brevdev/brev-cli/pkg/cmd/sshkeys"
 	"github.com/brevdev/brev-cli/pkg/cmd/start"
 	"github.com/brevdev/brev-cli/pkg/cmd/stop"
+	"github.com/brevdev/brev-cli/pkg/cmd/sync"
 	"github.com/brevdev/brev-cli/pkg/cmd/test"
 	"github.com/brevdev/brev-cli/pkg/cmd/up"
 	"github.com/brevdev/brev-cli/pkg/cmd/version"
@@ -129,15 +141,25 @@ func NewBrevCommand() *cobra.Command {
 
 	cmds.PersistentFlags().BoolVar(&printVersion, "version", false, "Print version output")
 
-	createCmdTree(cmds, t, loginCmdStore, noLoginCmdStore, loginAuth)
+	createCmdTree(cmds, t, loginCmdStore, noLoginCmdStore, loginAuth, noLoginAuth)
 
 	return cmds
 }
 
-func createCmdTree(cmd *cobra.Command, t *terminal.Terminal, loginCmdStore *store.AuthHTTPStore, noLoginCmdStore *store.AuthHTTPStore, loginAuth *auth.LoginAuth) {
+func createCmdTree(cmd *cobra.Command, t *terminal.Terminal, loginCmdStore *store.AuthHTTPStore, noLoginCmdStore *store.AuthHTTPStore, loginAuth *auth.LoginAuth, noLoginAuth *auth.NoLoginAuth) {
 	cmd.AddCommand(set.NewCmdSet(t, loginCmdStore, noLoginCmdStore))
 	cmd.AddCommand(ls.NewCmdLs(t, loginCmdStore, noLoginCmdStore))
-	cmd.AddCommand(portforward.NewCmdPortForward(loginCmdStore, t))
+	cmd.AddCommand(portforward.NewCmdPortForward(loginCmdStore, t, loginAuth))
+	cmd.AddCommand(forward.NewCmdForward(t, loginCmdStore, loginAuth))
+	cmd.AddCommand(socks.NewCmdSocks(t, loginCmdStore, loginAuth))
+	cmd.AddCommand(cp.NewCmdCp(t, loginCmdStore, loginAuth))
+	cmd.AddCommand(sync.NewCmdSync(t, loginCmdStore, loginAuth))
+	cmd.AddCommand(exec.NewCmdExec(t, loginCmdStore, loginAuth))
+	cmd.AddCommand(logs.NewCmdLogs(t, loginCmdStore))
+	cmd.AddCommand(events.NewCmdEvents(t, loginCmdStore))
+	cmd.AddCommand(ssh.NewCmdSSH(t, loginCmdStore, loginAuth))
+	cmd.AddCommand(kubeconfig.NewCmdKubeconfig(t, loginCmdStore))
+	cmd.AddCommand(dockercontext.NewCmdDockerContext(t, loginCmdStore))
 	cmd.AddCommand(login.NewCmdLogin(t, noLoginCmdStore, loginAuth))
 	cmd.AddCommand(logout.NewCmdLogout(loginAuth))
 
@@ -161,9 +183,11 @@ func createCmdTree(cmd *cobra.Command, t *terminal.Terminal, loginCmdStore *stor
 	cmd.AddCommand(profile.NewCmdProfile(t, loginCmdStore, noLoginCmdStore))
 	cmd.AddCommand(up.NewCmdJetbrains(loginCmdStore, t, true))
 	cmd.AddCommand(refresh.NewCmdRefresh(t, loginCmdStore))
-	cmd.AddCommand(runtasks.NewCmdRunTasks(t, noLoginCmdStore))
-	cmd.AddCommand(proxy.NewCmdProxy(t, noLoginCmdStore))
+	cmd.AddCommand(runtasks.NewCmdRunTasks(t, noLoginCmdStore, noLoginAuth))
+	cmd.AddCommand(proxy.NewCmdProxy(t, noLoginCmdStore, noLoginAuth))
+	cmd.AddCommand(proxyagent.NewCmdProxyAgent(t, noLoginCmdStore, noLoginAuth))
 	cmd.AddCommand(healthcheck.NewCmdHealthcheck(t, noLoginCmdStore))
+	cmd.AddCommand(doctor.NewCmdDoctor(t, noLoginCmdStore, noLoginAuth))
 }
 
 func runHelp(cmd *cobra.Command, _ []string) {
@@ -0,0 +1,166 @@
+// Package cp copies files between this machine and a workspace
+package cp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/brevdev/brev-cli/pkg/cmd/completions"
+	"github.com/brevdev/brev-cli/pkg/cmd/proxy"
+	"github.com/brevdev/brev-cli/pkg/compat"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/huproxyclient"
+	"github.com/brevdev/brev-cli/pkg/portforward"
+	"github.com/brevdev/brev-cli/pkg/terminal"
+	"github.com/brevdev/brev-cli/pkg/transfer"
+	"github.com/spf13/cobra"
+)
+
+type CpStore interface {
+	proxy.ProxyStore
+	completions.CompletionStore
+}
+
+func NewCmdCp(t *terminal.Terminal, store CpStore, auth huproxyclient.HubProxyAuth) *cobra.Command {
+	var recursive bool
+
+	cmd := &cobra.Command{
+		Annotations:           map[string]string{"ssh": ""},
+		Use:                   "cp <source>... <destination>",
+		DisableFlagsInUseLine: true,
+		Short:                 "Copy files to and from a workspace",
+		Long:                  "Copy files and directories between this machine and a workspace. Workspace paths are written <workspace>:<path> and are relative to the workspace's home directory. Sources can be globs. Permissions are kept, and an interrupted copy resumes where it stopped when run again.",
+		Example:               "brev cp ./data my-ws:workspace/data -r\nbrev cp 'my-ws:workspace/logs/*.log' .\nbrev cp a.txt b.txt my-ws:/tmp",
+		Args:                  cobra.MinimumNArgs(2),
+		ValidArgsFunction:     completions.GetAllWorkspaceNameCompletionHandler(store, t),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := RunCp(t, store, auth, args[:len(args)-1], args[len(args)-1], recursive)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVarP(&recursive, "recursive", "r", false, "copy directories")
+	return cmd
+}
+
+// remotePath is a <workspace>:<path> argument
+type remotePath struct {
+	workspace string
+	path      string
+}
+
+// parseRemotePath splits <workspace>:<path>. Arguments without a colon,
+// that start with a path, or whose prefix is a windows drive letter are
+// local.
+func parseRemotePath(arg string) (remotePath, bool) {
+	i := strings.Index(arg, ":")
+	if i < 1 || strings.ContainsAny(arg[:i], `/\`) || strings.HasPrefix(arg, ".") || isDrivePath(arg, i) {
+		return remotePath{}, false
+	}
+	p := arg[i+1:]
+	if p == "" {
+		p = "."
+	}
+	return remotePath{workspace: arg[:i], path: p}, true
+}
+
+// isDrivePath is whether arg, with a colon at i, is a windows path like
+// C:\Users, which on windows includes C:/Users. One letter workspace names
+// are otherwise fine.
+func isDrivePath(arg string, i int) bool {
+	if i != 1 {
+		return false
+	}
+	rest := arg[i+1:]
+	return strings.HasPrefix(rest, `\`) || runtime.GOOS == "windows" && strings.HasPrefix(rest, "/")
+}
+
+// direction works out which side of the copy is the workspace
+func direction(srcs []string, dst string) (workspace string, remoteSrcs []string, remoteDst string, download bool, err error) {
+	var remoteSources []remotePath
+	for _, src := range srcs {
+		if r, ok := parseRemotePath(src); ok {
+			remoteSources = append(remoteSources, r)
+		}
+	}
+	r, dstIsRemote := parseRemotePath(dst)
+
+	switch {
+	case dstIsRemote && len(remoteSources) > 0:
+		return "", nil, "", false, fmt.Errorf("copying between workspaces is not supported, copy to this machine first")
+	case dstIsRemote:
+		return r.workspace, nil, r.path, false, nil
+	case len(remoteSources) == 0:
+		return "", nil, "", false, fmt.Errorf("one side of the copy needs to be a workspace, like my-ws:path")
+	case len(remoteSources) != len(srcs):
+		return "", nil, "", false, fmt.Errorf("sources need to all be on this machine or all on one workspace")
+	}
+	for _, s := range remoteSources {
+		if s.workspace != remoteSources[0].workspace {
+			return "", nil, "", false, fmt.Errorf("sources need to all be on one workspace")
+		}
+		remoteSrcs = append(remoteSrcs, s.path)
+	}
+	return remoteSources[0].workspace, remoteSrcs, "", true, nil
+}
+
+func RunCp(t *terminal.Terminal, store CpStore, auth huproxyclient.HubProxyAuth, srcs []string, dst string, recursive bool) error {
+	workspaceNameOrID, remoteSrcs, remoteDst, download, err := direction(srcs, dst)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	workspace, err := proxy.NewWorkspaceProxy(store, compat.DefaultMatrix, 0).ResolveWorkspace(workspaceNameOrID)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if workspace.Status != "RUNNING" {
+		return fmt.Errorf("workspace %s is %s, start it with `brev start %s`", workspace.Name, workspace.Status, workspace.Name)
+	}
+	keys, err := store.GetCurrentUserKeys()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	tunnel, err := portforward.NewSSHPortForwarder(auth, keys.PrivateKey).Connect(ctx, workspace.GetProxyURL())
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer tunnel.Close() //nolint:errcheck // the copy is done
+	client, err := tunnel.SFTP()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer client.Close() //nolint:errcheck // the copy is done
+
+	bar := t.NewProgressBar("copying", func() {
+		t.Vprint("")
+	})
+	copier := transfer.NewCopier(client).WithRecursive(recursive).WithProgress(func(done, total int64) {
+		if total > 0 {
+			bar.AdvanceTo(int(done * 100 / total))
+		}
+	})
+	if download {
+		err = copier.Download(remoteSrcs, dst)
+	} else {
+		err = copier.Upload(srcs, remoteDst)
+	}
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	bar.AdvanceTo(100)
+	for _, s := range copier.Skipped() {
+		t.Vprint(t.Yellow("skipped %s, only files and directories are copied", s))
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package cp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRemotePath(t *testing.T) {
+	r, ok := parseRemotePath("my-ws:workspace/data")
+	assert.True(t, ok)
+	assert.Equal(t, remotePath{workspace: "my-ws", path: "workspace/data"}, r)
+
+	r, ok = parseRemotePath("my-ws:")
+	assert.True(t, ok)
+	assert.Equal(t, ".", r.path)
+
+	r, ok = parseRemotePath("w:data")
+	assert.True(t, ok, "one letter workspace names are remote")
+	assert.Equal(t, remotePath{workspace: "w", path: "data"}, r)
+
+	for _, local := range []string{"file.txt", `C:\Users\me`, "./a:b", "dir/a:b", ":x"} {
+		_, ok = parseRemotePath(local)
+		assert.False(t, ok, local)
+	}
+}
+
+func TestDirection(t *testing.T) {
+	ws, srcs, dst, download, err := direction([]string{"ws:a", "ws:b"}, ".")
+	assert.Nil(t, err)
+	assert.Equal(t, "ws", ws)
+	assert.Equal(t, []string{"a", "b"}, srcs)
+	assert.Equal(t, "", dst)
+	assert.True(t, download)
+
+	ws, _, dst, download, err = direction([]string{"a", "b"}, "ws:/tmp")
+	assert.Nil(t, err)
+	assert.Equal(t, "ws", ws)
+	assert.Equal(t, "/tmp", dst)
+	assert.False(t, download)
+
+	_, _, _, _, err = direction([]string{"a"}, "b")
+	assert.NotNil(t, err)
+	_, _, _, _, err = direction([]string{"ws:a"}, "other:b")
+	assert.NotNil(t, err)
+	_, _, _, _, err = direction([]string{"ws:a", "b"}, ".")
+	assert.NotNil(t, err)
+	_, _, _, _, err = direction([]string{"ws:a", "other:b"}, ".")
+	assert.NotNil(t, err)
+}
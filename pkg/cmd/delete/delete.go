@@ -6,7 +6,9 @@ import (
 	"github.com/brevdev/brev-cli/pkg/cmd/completions"
 	"github.com/brevdev/brev-cli/pkg/entity"
 	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/ssh"
 	"github.com/brevdev/brev-cli/pkg/store"
+	"github.com/brevdev/brev-cli/pkg/tasks"
 	"github.com/brevdev/brev-cli/pkg/terminal"
 	"github.com/spf13/cobra"
 )
@@ -56,6 +58,7 @@ func deleteWorkspace(workspaceName string, t *terminal.Terminal, deleteStore Del
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
 	}
+	tasks.Nudge(ssh.ConfigUpdaterTaskName)
 
 	t.Vprintf("Deleting workspace %s. This can take a few minutes. Run 'brev ls' to check status\n", deletedWorkspace.Name)
 
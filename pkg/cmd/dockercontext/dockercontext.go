@@ -0,0 +1,240 @@
+// Package dockercontext manages the docker contexts of workspaces
+package dockercontext
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/brevdev/brev-cli/pkg/cmd/completions"
+	"github.com/brevdev/brev-cli/pkg/dockercontext"
+	"github.com/brevdev/brev-cli/pkg/entity"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/ssh"
+	"github.com/brevdev/brev-cli/pkg/terminal"
+	"github.com/spf13/cobra"
+)
+
+type DockerContextStore interface {
+	ssh.ConfigUpdaterStore
+	ssh.SSHConfigurerV2Store
+	completions.CompletionStore
+}
+
+func NewCmdDockerContext(t *terminal.Terminal, store DockerContextStore) *cobra.Command {
+	cmd := &cobra.Command{
+		Annotations:           map[string]string{"ssh": ""},
+		Use:                   "docker-context",
+		DisableFlagsInUseLine: true,
+		Short:                 "Run docker commands on a workspace",
+		Long:                  "Register a docker context brev-<workspace> that runs docker on the workspace over ssh. The context exists while the workspace is running and is kept up to date by brev run-tasks.",
+		Example:               "brev docker-context create my-ws\ndocker --context brev-my-ws build .\nbrev docker-context rm my-ws",
+		Args:                  cobra.NoArgs,
+	}
+	cmd.AddCommand(newCmdCreate(t, store))
+	cmd.AddCommand(newCmdRm(t, store))
+	cmd.AddCommand(newCmdLs(t, store))
+	return cmd
+}
+
+func newCmdCreate(t *terminal.Terminal, store DockerContextStore) *cobra.Command {
+	return &cobra.Command{
+		Use:                   "create <workspace>",
+		DisableFlagsInUseLine: true,
+		Short:                 "Create the docker context of a workspace",
+		Args:                  cobra.ExactArgs(1),
+		ValidArgsFunction:     completions.GetAllWorkspaceNameCompletionHandler(store, t),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := RunCreate(t, store, args[0])
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+}
+
+func newCmdRm(t *terminal.Terminal, store DockerContextStore) *cobra.Command {
+	return &cobra.Command{
+		Use:                   "rm <workspace>",
+		DisableFlagsInUseLine: true,
+		Short:                 "Remove the docker context of a workspace",
+		Args:                  cobra.ExactArgs(1),
+		ValidArgsFunction:     completions.GetAllWorkspaceNameCompletionHandler(store, t),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := RunRm(t, store, args[0])
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+}
+
+func newCmdLs(t *terminal.Terminal, store DockerContextStore) *cobra.Command {
+	return &cobra.Command{
+		Use:                   "ls",
+		DisableFlagsInUseLine: true,
+		Short:                 "List the docker contexts of workspaces",
+		Args:                  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := RunLs(t, store)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+}
+
+func RunCreate(t *terminal.Terminal, store DockerContextStore, workspaceNameOrID string) error {
+	workspaces, err := store.GetContextWorkspaces()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	workspace, err := findWorkspace(workspaces, workspaceNameOrID)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	configurer, err := dockercontext.NewDefaultConfigurer()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	selection, err := dockercontext.NewDefaultSelectionStore()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	sel, err := selection.Load()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if sel.Add(workspace.ID) {
+		err = selection.Save(sel)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+	}
+
+	// the context connects with the workspace's ssh config entry, so that
+	// has to be up to date too
+	err = ssh.ConfigUpdater{
+		Store:   store,
+		Configs: []ssh.Config{ssh.NewSSHConfigurerV2(store), configurer},
+	}.Run()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	if workspace.Status != "RUNNING" {
+		t.Vprintf("workspace %s is %s, its docker context will be created when it is running\n", workspace.Name, workspace.Status)
+		return nil
+	}
+	name := dockercontext.ContextName(string(workspace.GetLocalIdentifier(running(workspaces))))
+	t.Vprintf("created docker context %s, use it with\n", t.Green("%s", name))
+	t.Vprintf("\tdocker --context %s ps\n", name)
+	return nil
+}
+
+func RunRm(t *terminal.Terminal, store DockerContextStore, workspaceNameOrID string) error {
+	workspaces, err := store.GetContextWorkspaces()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	workspace, err := findWorkspace(workspaces, workspaceNameOrID)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	selection, err := dockercontext.NewDefaultSelectionStore()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	sel, err := selection.Load()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if !sel.Remove(workspace.ID) {
+		return fmt.Errorf("workspace %s has no docker context", workspace.Name)
+	}
+	err = selection.Save(sel)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	configurer, err := dockercontext.NewDefaultConfigurer()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = configurer.Update(running(workspaces))
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	t.Vprintf("removed the docker context of %s\n", workspace.Name)
+	return nil
+}
+
+func RunLs(t *terminal.Terminal, store DockerContextStore) error {
+	workspaces, err := store.GetContextWorkspaces()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	selection, err := dockercontext.NewDefaultSelectionStore()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	sel, err := selection.Load()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if len(sel.WorkspaceIDs) == 0 {
+		t.Vprint("no docker contexts, create one with brev docker-context create <workspace>")
+		return nil
+	}
+	t.Vprint(formatContexts(workspaces, *sel))
+	return nil
+}
+
+func formatContexts(workspaces []entity.Workspace, sel dockercontext.Selection) string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "WORKSPACE\tCONTEXT\tHOST")
+	for _, id := range sel.WorkspaceIDs {
+		workspace, err := findWorkspace(workspaces, id)
+		if err != nil {
+			_, _ = fmt.Fprintf(w, "%s\t-\tworkspace not found\n", id)
+			continue
+		}
+		if workspace.Status != "RUNNING" {
+			_, _ = fmt.Fprintf(w, "%s\t-\tcreated when the workspace is running, it is %s\n", workspace.Name, workspace.Status)
+			continue
+		}
+		ctx := dockercontext.NewContext(*workspace, string(workspace.GetLocalIdentifier(running(workspaces))))
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", workspace.Name, ctx.Name, ctx.Host)
+	}
+	_ = w.Flush()
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func findWorkspace(workspaces []entity.Workspace, nameOrID string) (*entity.Workspace, error) {
+	for i, w := range workspaces {
+		if w.ID == nameOrID {
+			return &workspaces[i], nil
+		}
+	}
+	for i, w := range workspaces {
+		if w.Name == nameOrID {
+			return &workspaces[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no workspace named %s", nameOrID)
+}
+
+// running filters workspaces the way ssh.ConfigUpdater does, so aliases
+// match the ssh config's
+func running(workspaces []entity.Workspace) []entity.Workspace {
+	var res []entity.Workspace
+	for _, w := range workspaces {
+		if w.Status == "RUNNING" {
+			res = append(res, w)
+		}
+	}
+	return res
+}
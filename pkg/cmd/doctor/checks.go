@@ -0,0 +1,330 @@
+package doctor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/cmd/proxy"
+	"github.com/brevdev/brev-cli/pkg/compat"
+	"github.com/brevdev/brev-cli/pkg/entity"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
+	"github.com/brevdev/brev-cli/pkg/huproxyclient"
+	"github.com/brevdev/brev-cli/pkg/tasks"
+	"github.com/golang-jwt/jwt"
+	"github.com/spf13/afero"
+)
+
+type Status string
+
+const (
+	StatusPass Status = "pass"
+	StatusWarn Status = "warn"
+	StatusFail Status = "fail"
+	StatusSkip Status = "skip"
+)
+
+type Result struct {
+	Name        string `json:"name"`
+	Status      Status `json:"status"`
+	Message     string `json:"message"`
+	Remediation string `json:"remediation,omitempty"`
+}
+
+func pass(name, message string) Result {
+	return Result{Name: name, Status: StatusPass, Message: message}
+}
+
+func warn(name, message, remediation string) Result {
+	return Result{Name: name, Status: StatusWarn, Message: message, Remediation: remediation}
+}
+
+func fail(name, message, remediation string) Result {
+	return Result{Name: name, Status: StatusFail, Message: message, Remediation: remediation}
+}
+
+func skip(name, message string) Result {
+	return Result{Name: name, Status: StatusSkip, Message: message}
+}
+
+type Doctor struct {
+	store    DoctorStore
+	auth     huproxyclient.HubProxyAuth
+	fs       afero.Fs
+	brevHome string
+	now      func() time.Time
+}
+
+func NewDoctor(store DoctorStore, auth huproxyclient.HubProxyAuth, fs afero.Fs, brevHome string) *Doctor {
+	return &Doctor{
+		store:    store,
+		auth:     auth,
+		fs:       fs,
+		brevHome: brevHome,
+		now:      time.Now,
+	}
+}
+
+// Run runs every check. Checks that need the api are skipped once
+// authentication is known to be broken.
+func (d Doctor) Run(ctx context.Context) []Result {
+	results := []Result{d.checkAPI()}
+	authResult := d.checkAuthToken()
+	results = append(results, authResult)
+	loggedIn := authResult.Status != StatusFail
+	if loggedIn {
+		results = append(results, d.checkActiveOrg())
+	} else {
+		results = append(results, skip("active org", "not logged in"))
+	}
+	results = append(results,
+		d.checkSSHConfigInclude(),
+		d.checkPrivateKey(),
+		d.checkTaskDaemon(),
+	)
+	results = append(results, d.checkJetBrains()...)
+	if loggedIn {
+		results = append(results, d.checkWorkspaces(ctx)...)
+	} else {
+		results = append(results, skip("workspaces", "not logged in"))
+	}
+	return results
+}
+
+func (d Doctor) checkAPI() Result {
+	const name = "api"
+	err := d.store.Healthcheck()
+	if err != nil {
+		return fail(name, fmt.Sprintf("brev api is not healthy: %v", err), "check your internet connection")
+	}
+	return pass(name, "brev api is healthy")
+}
+
+func (d Doctor) checkAuthToken() Result {
+	const name = "auth token"
+	tokens, err := d.store.GetAuthTokens()
+	if err != nil || tokens == nil || tokens.AccessToken == "" {
+		return fail(name, "not logged in", "run `brev login`")
+	}
+	expiresAt, err := getTokenExpiry(tokens.AccessToken)
+	if err != nil {
+		return fail(name, fmt.Sprintf("access token can not be parsed: %v", err), "run `brev login`")
+	}
+	if expiresAt.Before(d.now()) {
+		if tokens.RefreshToken == "" {
+			return fail(name, fmt.Sprintf("access token expired at %s", expiresAt.Format(time.RFC3339)), "run `brev login`")
+		}
+		return warn(name, fmt.Sprintf("access token expired at %s and will be refreshed on the next command", expiresAt.Format(time.RFC3339)), "run `brev login` if commands keep failing with auth errors")
+	}
+	return pass(name, fmt.Sprintf("access token valid until %s", expiresAt.Format(time.RFC3339)))
+}
+
+func getTokenExpiry(token string) (time.Time, error) {
+	parser := jwt.Parser{}
+	claims := jwt.MapClaims{}
+	_, _, err := parser.ParseUnverified(token, claims)
+	if err != nil {
+		return time.Time{}, err //nolint:wrapcheck // shown to the user as is
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return time.Time{}, fmt.Errorf("no expiry claim")
+	}
+	return time.Unix(int64(exp), 0), nil
+}
+
+func (d Doctor) checkActiveOrg() Result {
+	const name = "active org"
+	org, err := d.store.GetActiveOrganizationOrDefault()
+	if err != nil {
+		return fail(name, fmt.Sprintf("could not resolve the active org: %v", err), "run `brev set <org>`")
+	}
+	if org == nil {
+		return fail(name, "you are not a member of any org", "ask to be invited to an org or create one in the console")
+	}
+	return pass(name, fmt.Sprintf("%s [id=%s]", org.Name, org.ID))
+}
+
+func (d Doctor) checkSSHConfigInclude() Result {
+	const name = "ssh config"
+	userConfigPath, err := d.store.GetUserSSHConfigPath()
+	if err != nil {
+		return fail(name, err.Error(), "")
+	}
+	brevConfigPath, err := d.store.GetBrevSSHConfigPath()
+	if err != nil {
+		return fail(name, err.Error(), "")
+	}
+	conf, err := d.store.GetUserSSHConfig()
+	if err != nil {
+		return fail(name, fmt.Sprintf("could not read %s: %v", userConfigPath, err), "")
+	}
+
+	found, beforeHosts := findInclude(conf, brevConfigPath)
+	if !found {
+		return fail(name, fmt.Sprintf("%s does not include %s", userConfigPath, brevConfigPath), "run `brev refresh`")
+	}
+	if !beforeHosts {
+		return fail(name, fmt.Sprintf("the Include of %s in %s comes after a Host or Match block, so it only applies to that block", brevConfigPath, userConfigPath),
+			fmt.Sprintf("move `Include %s` to the top of %s", brevConfigPath, userConfigPath))
+	}
+	return pass(name, fmt.Sprintf("%s includes %s", userConfigPath, brevConfigPath))
+}
+
+// findInclude reports whether conf includes path and whether that happens
+// before the first Host or Match block
+func findInclude(conf string, path string) (bool, bool) {
+	inBlock := false
+	for _, line := range strings.Split(conf, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch strings.ToLower(fields[0]) {
+		case "host", "match":
+			inBlock = true
+		case "include":
+			for _, included := range fields[1:] {
+				if sameSSHPath(included, path) {
+					return true, !inBlock
+				}
+			}
+		}
+	}
+	return false, false
+}
+
+func sameSSHPath(sshPath string, path string) bool {
+	if strings.HasPrefix(sshPath, "~/") {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			sshPath = filepath.Join(home, sshPath[2:])
+		}
+	}
+	return filepath.Clean(sshPath) == filepath.Clean(path)
+}
+
+func (d Doctor) checkPrivateKey() Result {
+	const name = "private key"
+	path := d.store.GetPrivateKeyPath()
+	info, err := d.fs.Stat(path)
+	if err != nil {
+		return warn(name, fmt.Sprintf("%s does not exist yet, it is written the first time you ssh to a workspace", path), "")
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		return fail(name, fmt.Sprintf("%s has permissions %04o, ssh refuses keys readable by others", path, perm), fmt.Sprintf("run `chmod 600 %s`", path))
+	}
+	return pass(name, fmt.Sprintf("%s has permissions %04o", path, info.Mode().Perm()))
+}
+
+func (d Doctor) checkTaskDaemon() Result {
+	const name = "run-tasks daemon"
+	logFile := tasks.GetDaemonLogFilePath(d.brevHome)
+	status := tasks.GetDaemonStatus(d.brevHome)
+	if status.Running {
+		return pass(name, fmt.Sprintf("running [pid=%d] [log=%s]", status.PID, logFile))
+	}
+	// run in the foreground, for example by the systemd service
+	if socketPath, err := files.GetDaemonSocketPath(); err == nil {
+		if _, err := tasks.ListTasks(socketPath); err == nil {
+			return pass(name, fmt.Sprintf("running [socket=%s]", socketPath))
+		}
+	}
+	if status.Stale {
+		return warn(name, fmt.Sprintf("not running, %s is stale [pid=%d] [log=%s]", tasks.GetDaemonPidFilePath(d.brevHome), status.PID, logFile), "run `brev run-tasks -d`")
+	}
+	return warn(name, "not running, your ssh config will not pick up new workspaces", "run `brev run-tasks -d` or `brev run-tasks install --systemd`")
+}
+
+// checkJetBrains checks the config of every installed Gateway, as brev
+// jetbrains writes them all
+func (d Doctor) checkJetBrains() []Result {
+	const name = "jetbrains gateway"
+	paths, err := d.store.GetJetBrainsConfigPaths()
+	if err != nil {
+		return []Result{skip(name, fmt.Sprintf("could not determine the config paths: %v", err))}
+	}
+	if len(paths) == 0 {
+		return []Result{skip(name, "not installed")}
+	}
+	var results []Result
+	for _, path := range paths {
+		// <config dir>/options/sshConfigs.xml
+		configDir := filepath.Dir(filepath.Dir(path))
+		checkName := name
+		if len(paths) > 1 {
+			checkName = fmt.Sprintf("%s %s", name, filepath.Base(configDir))
+		}
+		results = append(results, d.checkJetBrainsConfig(checkName, configDir, path))
+	}
+	return results
+}
+
+func (d Doctor) checkJetBrainsConfig(name, configDir, path string) Result {
+	if _, err := d.fs.Stat(configDir); err != nil {
+		return skip(name, fmt.Sprintf("not installed, %s does not exist", configDir))
+	}
+	if _, err := d.fs.Stat(path); err != nil {
+		return warn(name, fmt.Sprintf("installed but %s does not exist", path), "run `brev jetbrains`")
+	}
+	return pass(name, fmt.Sprintf("config found at %s", path))
+}
+
+func (d Doctor) checkWorkspaces(ctx context.Context) []Result {
+	workspaces, err := d.store.GetContextWorkspaces()
+	if err != nil {
+		return []Result{fail("workspaces", fmt.Sprintf("could not list workspaces: %v", err), "")}
+	}
+	if len(workspaces) == 0 {
+		return []Result{skip("workspaces", "no workspaces in the active org")}
+	}
+	matrix, err := compat.LoadDefaultMatrix()
+	if err != nil {
+		return []Result{fail("workspaces", err.Error(), "fix or remove the compatibility matrix override")}
+	}
+	wp := proxy.NewWorkspaceProxy(d.store, *matrix, 0)
+
+	var results []Result
+	for i := range workspaces {
+		results = append(results, d.checkWorkspace(ctx, wp, &workspaces[i]))
+	}
+	return results
+}
+
+func (d Doctor) checkWorkspace(ctx context.Context, wp *proxy.WorkspaceProxy, workspace *entity.Workspace) Result {
+	name := fmt.Sprintf("workspace %s", workspace.Name)
+	if workspace.Status != "RUNNING" {
+		return skip(name, fmt.Sprintf("status is %s", workspace.Status))
+	}
+	strategy, err := wp.GetStrategy(workspace)
+	if err != nil {
+		return failWithDirective(name, err)
+	}
+	if strategy != compat.StrategyHuproxy {
+		return pass(name, fmt.Sprintf("compatible, connects by %s", strategy))
+	}
+
+	opts := huproxyclient.DefaultOptions()
+	opts.DialRetries = 0
+	opts.DialTimeout = 10 * time.Second
+	conn, err := huproxyclient.NewClient(proxy.MakeProxyURL(workspace), d.auth).WithOptions(opts).Dial(ctx)
+	if err != nil {
+		return failWithDirective(name, err)
+	}
+	_ = conn.Close()
+	return pass(name, fmt.Sprintf("compatible and reachable at %s", proxy.MakeProxyURL(workspace)))
+}
+
+func failWithDirective(name string, err error) Result {
+	remediation := ""
+	var brevErr breverrors.BrevError
+	if errors.As(err, &brevErr) {
+		remediation = brevErr.Directive()
+	}
+	return fail(name, err.Error(), remediation)
+}
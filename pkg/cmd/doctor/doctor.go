@@ -0,0 +1,125 @@
+// Package doctor diagnoses why brev, and ssh to workspaces in particular,
+// is not working
+package doctor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+
+	"github.com/brevdev/brev-cli/pkg/cmd/proxy"
+	"github.com/brevdev/brev-cli/pkg/cmd/version"
+	"github.com/brevdev/brev-cli/pkg/entity"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
+	"github.com/brevdev/brev-cli/pkg/huproxyclient"
+	"github.com/brevdev/brev-cli/pkg/terminal"
+	"github.com/spf13/cobra"
+)
+
+type DoctorStore interface {
+	proxy.ProxyStore
+	Healthcheck() error
+	GetAuthTokens() (*entity.AuthTokens, error)
+	GetActiveOrganizationOrDefault() (*entity.Organization, error)
+	GetUserSSHConfig() (string, error)
+	GetUserSSHConfigPath() (string, error)
+	GetBrevSSHConfigPath() (string, error)
+	GetPrivateKeyPath() string
+	GetJetBrainsConfigPaths() ([]string, error)
+}
+
+type Report struct {
+	CLIVersion string   `json:"cliVersion"`
+	OS         string   `json:"os"`
+	Arch       string   `json:"arch"`
+	Checks     []Result `json:"checks"`
+}
+
+func (r Report) Failed() int {
+	failed := 0
+	for _, c := range r.Checks {
+		if c.Status == StatusFail {
+			failed++
+		}
+	}
+	return failed
+}
+
+func NewCmdDoctor(t *terminal.Terminal, store DoctorStore, auth huproxyclient.HubProxyAuth) *cobra.Command {
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Annotations:           map[string]string{"housekeeping": ""},
+		Use:                   "doctor",
+		DisableFlagsInUseLine: true,
+		Short:                 "Diagnose problems with brev and ssh to workspaces",
+		Long:                  "Runs a series of checks on your login, ssh config, keys, background daemon and workspaces and tells you how to fix what is broken. Use --json to attach the output to a support ticket.",
+		Example:               "brev doctor\nbrev doctor --json > brev-doctor.json",
+		Args:                  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := RunDoctor(cmd.Context(), t, store, auth, jsonOutput)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "print the report as json")
+
+	return cmd
+}
+
+func RunDoctor(ctx context.Context, t *terminal.Terminal, store DoctorStore, auth huproxyclient.HubProxyAuth, jsonOutput bool) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	brevHome, err := files.GetBrevHome()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	report := Report{
+		CLIVersion: version.Version,
+		OS:         runtime.GOOS,
+		Arch:       runtime.GOARCH,
+		Checks:     NewDoctor(store, auth, files.AppFs, brevHome).Run(ctx),
+	}
+
+	if jsonOutput {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		t.Print(string(b))
+	} else {
+		printReport(t, report)
+	}
+
+	if failed := report.Failed(); failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+func printReport(t *terminal.Terminal, report Report) {
+	t.Vprintf("brev %s (%s/%s)\n\n", report.CLIVersion, report.OS, report.Arch)
+	for _, c := range report.Checks {
+		var status string
+		switch c.Status {
+		case StatusPass:
+			status = t.Green("✓ pass")
+		case StatusWarn:
+			status = t.Yellow("! warn")
+		case StatusFail:
+			status = t.Red("✗ fail")
+		default:
+			status = "- skip"
+		}
+		t.Vprintf("%s  %s: %s\n", status, c.Name, c.Message)
+		if c.Remediation != "" {
+			t.Vprintf("        %s\n", t.Yellow(c.Remediation))
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	"github.com/brevdev/brev-cli/pkg/store"
+	"github.com/golang-jwt/jwt"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+type dummyDoctorStore struct {
+	tokens               *entity.AuthTokens
+	sshConfig            string
+	jetBrainsConfigPaths []string
+}
+
+func (d dummyDoctorStore) GetWorkspace(_ string) (*entity.Workspace, error) {
+	return nil, fmt.Errorf("not found")
+}
+
+func (d dummyDoctorStore) GetWorkspaceMetaData(_ string) (*entity.WorkspaceMetaData, error) {
+	return &entity.WorkspaceMetaData{}, nil
+}
+
+func (d dummyDoctorStore) GetContextWorkspaces() ([]entity.Workspace, error) {
+	return nil, nil
+}
+
+func (d dummyDoctorStore) StartWorkspace(_ string) (*entity.Workspace, error) {
+	return nil, nil
+}
+
+func (d dummyDoctorStore) WritePrivateKey(_ string) error {
+	return nil
+}
+
+func (d dummyDoctorStore) GetCurrentUserKeys() (*entity.UserKeys, error) {
+	return &entity.UserKeys{}, nil
+}
+
+func (d dummyDoctorStore) GetLatestReleaseMetadata() (*store.GithubReleaseMetadata, error) {
+	return &store.GithubReleaseMetadata{}, nil
+}
+
+func (d dummyDoctorStore) Healthcheck() error {
+	return nil
+}
+
+func (d dummyDoctorStore) GetAuthTokens() (*entity.AuthTokens, error) {
+	if d.tokens == nil {
+		return nil, fmt.Errorf("credentials file not found")
+	}
+	return d.tokens, nil
+}
+
+func (d dummyDoctorStore) GetActiveOrganizationOrDefault() (*entity.Organization, error) {
+	return &entity.Organization{ID: "org-id", Name: "org"}, nil
+}
+
+func (d dummyDoctorStore) GetUserSSHConfig() (string, error) {
+	return d.sshConfig, nil
+}
+
+func (d dummyDoctorStore) GetUserSSHConfigPath() (string, error) {
+	return "/home/user/.ssh/config", nil
+}
+
+func (d dummyDoctorStore) GetBrevSSHConfigPath() (string, error) {
+	return "/home/user/.brev/ssh_config", nil
+}
+
+func (d dummyDoctorStore) GetPrivateKeyPath() string {
+	return "/home/user/.brev/brev.pem"
+}
+
+func (d dummyDoctorStore) GetJetBrainsConfigPaths() ([]string, error) {
+	return d.jetBrainsConfigPaths, nil
+}
+
+func makeToken(t *testing.T, expiresAt time.Time) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": expiresAt.Unix()}).SignedString([]byte("secret"))
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return token
+}
+
+func TestFindInclude(t *testing.T) {
+	path := "/home/user/.brev/ssh_config"
+
+	found, beforeHosts := findInclude("Include /home/user/.brev/ssh_config\nHost foo\n  User bar\n", path)
+	assert.True(t, found)
+	assert.True(t, beforeHosts)
+
+	found, beforeHosts = findInclude("Host foo\n  User bar\n  Include /home/user/.brev/ssh_config\n", path)
+	assert.True(t, found)
+	assert.False(t, beforeHosts)
+
+	found, _ = findInclude("# Include /home/user/.brev/ssh_config\nHost foo\n", path)
+	assert.False(t, found)
+
+	found, _ = findInclude("", path)
+	assert.False(t, found)
+}
+
+func TestCheckAuthToken(t *testing.T) {
+	now := time.Now()
+	d := NewDoctor(dummyDoctorStore{}, nil, afero.NewMemMapFs(), "/home/user/.brev")
+	assert.Equal(t, StatusFail, d.checkAuthToken().Status)
+
+	d = NewDoctor(dummyDoctorStore{tokens: &entity.AuthTokens{AccessToken: makeToken(t, now.Add(time.Hour))}}, nil, afero.NewMemMapFs(), "/home/user/.brev")
+	assert.Equal(t, StatusPass, d.checkAuthToken().Status)
+
+	d = NewDoctor(dummyDoctorStore{tokens: &entity.AuthTokens{AccessToken: makeToken(t, now.Add(-time.Hour)), RefreshToken: "refresh"}}, nil, afero.NewMemMapFs(), "/home/user/.brev")
+	assert.Equal(t, StatusWarn, d.checkAuthToken().Status)
+
+	d = NewDoctor(dummyDoctorStore{tokens: &entity.AuthTokens{AccessToken: makeToken(t, now.Add(-time.Hour))}}, nil, afero.NewMemMapFs(), "/home/user/.brev")
+	assert.Equal(t, StatusFail, d.checkAuthToken().Status)
+}
+
+func TestCheckPrivateKey(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	d := NewDoctor(dummyDoctorStore{}, nil, fs, "/home/user/.brev")
+	assert.Equal(t, StatusWarn, d.checkPrivateKey().Status)
+
+	err := afero.WriteFile(fs, "/home/user/.brev/brev.pem", []byte("key"), 0o644)
+	assert.Nil(t, err)
+	res := d.checkPrivateKey()
+	assert.Equal(t, StatusFail, res.Status)
+	assert.Contains(t, res.Remediation, "chmod 600")
+
+	err = fs.Chmod("/home/user/.brev/brev.pem", 0o600)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusPass, d.checkPrivateKey().Status)
+}
+
+func TestCheckJetBrains(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	d := NewDoctor(dummyDoctorStore{}, nil, fs, "/home/user/.brev")
+	results := d.checkJetBrains()
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, StatusSkip, results[0].Status)
+	}
+
+	d = NewDoctor(dummyDoctorStore{jetBrainsConfigPaths: []string{
+		"/home/user/.config/JetBrains/JetBrainsGateway2023.2/options/sshConfigs.xml",
+		"/home/user/.config/JetBrains/JetBrainsGateway2023.1/options/sshConfigs.xml",
+	}}, nil, fs, "/home/user/.brev")
+	assert.Nil(t, fs.MkdirAll("/home/user/.config/JetBrains/JetBrainsGateway2023.1/options", 0o755))
+	assert.Nil(t, afero.WriteFile(fs, "/home/user/.config/JetBrains/JetBrainsGateway2023.2/options/sshConfigs.xml", []byte("<application/>"), 0o644))
+	results = d.checkJetBrains()
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, "jetbrains gateway JetBrainsGateway2023.2", results[0].Name)
+		assert.Equal(t, StatusPass, results[0].Status)
+		assert.Equal(t, "jetbrains gateway JetBrainsGateway2023.1", results[1].Name)
+		assert.Equal(t, StatusWarn, results[1].Status)
+	}
+}
+
+func TestRunSkipsAPIChecksWhenLoggedOut(t *testing.T) {
+	d := NewDoctor(dummyDoctorStore{}, nil, afero.NewMemMapFs(), "/home/user/.brev")
+	results := d.Run(context.Background())
+	statuses := map[string]Status{}
+	for _, r := range results {
+		statuses[r.Name] = r.Status
+	}
+	assert.Equal(t, StatusPass, statuses["api"])
+	assert.Equal(t, StatusFail, statuses["auth token"])
+	assert.Equal(t, StatusSkip, statuses["active org"])
+	assert.Equal(t, StatusSkip, statuses["workspaces"])
+	assert.Equal(t, StatusFail, statuses["ssh config"])
+	assert.Equal(t, StatusWarn, statuses["run-tasks daemon"])
+	assert.Equal(t, StatusSkip, statuses["jetbrains gateway"])
+}
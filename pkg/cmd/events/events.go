@@ -0,0 +1,173 @@
+// Package events shows what the cluster says about a workspace
+package events
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/cmd/completions"
+	"github.com/brevdev/brev-cli/pkg/cmd/proxy"
+	"github.com/brevdev/brev-cli/pkg/compat"
+	"github.com/brevdev/brev-cli/pkg/entity"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/k8s"
+	"github.com/brevdev/brev-cli/pkg/terminal"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/duration"
+)
+
+type EventsStore interface {
+	proxy.ProxyStore
+	completions.CompletionStore
+}
+
+func NewCmdEvents(t *terminal.Terminal, store EventsStore) *cobra.Command {
+	cmd := &cobra.Command{
+		Annotations:           map[string]string{"workspace": ""},
+		Use:                   "events <workspace>",
+		DisableFlagsInUseLine: true,
+		Short:                 "Show the pod status and events of a workspace",
+		Long:                  "Show the pod phase, conditions, container states and events of a workspace, to find out why it is stuck deploying or has failed.",
+		Example:               "brev events my-ws",
+		Args:                  cobra.ExactArgs(1),
+		ValidArgsFunction:     completions.GetAllWorkspaceNameCompletionHandler(store, t),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := RunEvents(t, store, args[0])
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+	return cmd
+}
+
+func RunEvents(t *terminal.Terminal, store EventsStore, workspaceNameOrID string) error {
+	workspace, err := proxy.NewWorkspaceProxy(store, compat.DefaultMatrix, 0).ResolveWorkspace(workspaceNameOrID)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	meta, err := store.GetWorkspaceMetaData(workspace.ID)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	mapper, err := k8s.NewDefaultWorkspaceGroupClientMapper(store)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	client, err := mapper.GetK8sClient(workspace.WorkspaceGroupID)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	report, err := k8s.DescribePod(ctx, client.GetK8sClient(), *meta)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	t.Vprint(formatReport(*workspace, report, time.Now()))
+	return nil
+}
+
+func formatReport(workspace entity.Workspace, report *k8s.PodReport, now time.Time) string {
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "Workspace: %s (%s)\n", workspace.Name, workspace.Status)
+	if report.Deleted {
+		b.WriteString("Pod:       deleted")
+	} else {
+		_, _ = fmt.Fprintf(&b, "Pod:       %s", report.Phase)
+	}
+	if report.Reason != "" {
+		_, _ = fmt.Fprintf(&b, ", %s", report.Reason)
+	}
+	if report.Message != "" {
+		_, _ = fmt.Fprintf(&b, ": %s", report.Message)
+	}
+	b.WriteString("\n")
+
+	w := tabwriter.NewWriter(&b, 0, 0, 3, ' ', 0)
+	if len(report.Conditions) > 0 {
+		_, _ = fmt.Fprintln(w, "\nCONDITION\tSTATUS\tREASON\tMESSAGE")
+		for _, c := range report.Conditions {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Type, c.Status, dash(c.Reason), dash(c.Message))
+		}
+	}
+	if len(report.Containers) > 0 {
+		_, _ = fmt.Fprintln(w, "\nCONTAINER\tREADY\tRESTARTS\tSTATE")
+		for _, c := range report.Containers {
+			_, _ = fmt.Fprintf(w, "%s\t%t\t%d\t%s\n", c.Name, c.Ready, c.RestartCount, k8s.ContainerState(c))
+		}
+	}
+	_ = w.Flush()
+
+	w = tabwriter.NewWriter(&b, 0, 0, 3, ' ', 0)
+	if len(report.Events) == 0 {
+		b.WriteString("\nNo events, the cluster may have already expired them\n")
+	} else {
+		_, _ = fmt.Fprintln(w, "\nLAST SEEN\tTYPE\tREASON\tCOUNT\tMESSAGE")
+		for _, e := range report.Events {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", age(k8s.EventTime(e), now), e.Type, e.Reason, eventCount(e), strings.TrimSpace(e.Message))
+		}
+	}
+	_ = w.Flush()
+
+	if hint := hint(workspace, report); hint != "" {
+		_, _ = fmt.Fprintf(&b, "\n%s\n", hint)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// hint points at the likely cause of a workspace that is not coming up
+func hint(workspace entity.Workspace, report *k8s.PodReport) string {
+	if workspace.Status != "DEPLOYING" && workspace.Status != "FAILURE" {
+		return ""
+	}
+	for _, c := range report.Containers {
+		if c.State.Waiting != nil {
+			switch c.State.Waiting.Reason {
+			case "ImagePullBackOff", "ErrImagePull", "InvalidImageName":
+				return fmt.Sprintf("The image of container %s can not be pulled, check the workspace's template.", c.Name)
+			case "CrashLoopBackOff":
+				return fmt.Sprintf("Container %s keeps crashing, see why with `brev logs %s -c %s --previous`.", c.Name, workspace.Name, c.Name)
+			}
+		}
+	}
+	for _, c := range report.Conditions {
+		if c.Type == corev1.PodScheduled && c.Status == corev1.ConditionFalse {
+			return "The pod can not be scheduled, the cluster may be out of capacity for this workspace class."
+		}
+	}
+	return ""
+}
+
+func eventCount(e corev1.Event) int32 {
+	if e.Count > 0 {
+		return e.Count
+	}
+	if e.Series != nil {
+		return e.Series.Count
+	}
+	return 1
+}
+
+func age(at, now time.Time) string {
+	if at.IsZero() {
+		return "-"
+	}
+	return duration.HumanDuration(now.Sub(at))
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
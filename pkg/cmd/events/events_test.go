@@ -0,0 +1,41 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	"github.com/brevdev/brev-cli/pkg/k8s"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestFormatReport(t *testing.T) {
+	now := time.Now()
+	report := &k8s.PodReport{
+		Phase: corev1.PodPending,
+		Containers: []corev1.ContainerStatus{
+			{Name: "workspace", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}}, RestartCount: 4},
+		},
+		Events: []corev1.Event{
+			{Type: "Warning", Reason: "BackOff", Message: "Back-off restarting failed container", Count: 4, LastTimestamp: metav1.NewTime(now.Add(-2 * time.Minute))},
+		},
+	}
+	out := formatReport(entity.Workspace{Name: "ws", Status: "DEPLOYING"}, report, now)
+	assert.Contains(t, out, "Workspace: ws (DEPLOYING)")
+	assert.Contains(t, out, "Pod:       Pending")
+	assert.Regexp(t, `workspace\s+false\s+4\s+waiting: CrashLoopBackOff`, out)
+	assert.Regexp(t, `2m\s+Warning\s+BackOff\s+4\s+Back-off restarting failed container`, out)
+	assert.Contains(t, out, "brev logs ws -c workspace --previous")
+
+	out = formatReport(entity.Workspace{Name: "ws", Status: "RUNNING"}, &k8s.PodReport{Phase: corev1.PodRunning}, now)
+	assert.Contains(t, out, "No events")
+	assert.NotContains(t, out, "brev logs")
+}
+
+func TestHintUnschedulable(t *testing.T) {
+	report := &k8s.PodReport{Conditions: []corev1.PodCondition{{Type: corev1.PodScheduled, Status: corev1.ConditionFalse}}}
+	assert.Contains(t, hint(entity.Workspace{Status: "FAILURE"}, report), "can not be scheduled")
+	assert.Empty(t, hint(entity.Workspace{Status: "STOPPED"}, report))
+}
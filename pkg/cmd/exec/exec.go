@@ -0,0 +1,413 @@
+// Package exec runs a command on many workspaces at once
+package exec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/cmd/completions"
+	"github.com/brevdev/brev-cli/pkg/cmd/proxy"
+	"github.com/brevdev/brev-cli/pkg/compat"
+	"github.com/brevdev/brev-cli/pkg/entity"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/huproxyclient"
+	"github.com/brevdev/brev-cli/pkg/portforward"
+	"github.com/brevdev/brev-cli/pkg/terminal"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+// ExitCodeConnectionFailed is a workspace's exit code when the command could
+// not be run at all, as with ssh
+const ExitCodeConnectionFailed = 255
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+type ExecStore interface {
+	proxy.ProxyStore
+	completions.CompletionStore
+}
+
+type execOptions struct {
+	all      bool
+	selector string
+	output   string
+	parallel int
+}
+
+func NewCmdExec(t *terminal.Terminal, store ExecStore, auth huproxyclient.HubProxyAuth) *cobra.Command {
+	var opts execOptions
+
+	cmd := &cobra.Command{
+		Annotations:           map[string]string{"ssh": ""},
+		Use:                   "exec <workspace>... -- <command>",
+		DisableFlagsInUseLine: true,
+		Short:                 "Run a command on several workspaces",
+		Long:                  "Run a shell command on workspaces concurrently over ssh. Output is streamed with each line prefixed by its workspace, followed by a summary. The exit code is 0 if the command succeeded everywhere, otherwise the highest exit code, and 255 if a workspace could not be reached.\n\nSelect workspaces by name, with --all for all your running workspaces, or with --selector, a comma separated list of key=value filters on name, status, class, group, template and repo. Values can be globs.",
+		Example:               "brev exec api worker -- 'git pull && make deps'\nbrev exec --all -- uptime\nbrev exec --selector 'name=ml-*,class=4x16' --output json -- nvidia-smi",
+		ValidArgsFunction:     completions.GetAllWorkspaceNameCompletionHandler(store, t),
+		Run: func(cmd *cobra.Command, args []string) {
+			dash := cmd.ArgsLenAtDash()
+			if dash < 0 || dash == len(args) {
+				t.Errprint(fmt.Errorf("put the command to run after --, like `brev exec my-ws -- ls`"), "")
+				os.Exit(1)
+			}
+			code, err := RunExec(t, store, auth, args[:dash], strings.Join(args[dash:], " "), opts)
+			if err != nil {
+				t.Errprint(err, "")
+				os.Exit(1)
+			}
+			if code != 0 {
+				os.Exit(code)
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&opts.all, "all", false, "run on all of your running workspaces")
+	cmd.Flags().StringVarP(&opts.selector, "selector", "l", "", "run on the running workspaces matching key=value filters, like name=api-*,class=2x8")
+	cmd.Flags().StringVarP(&opts.output, "output", "o", outputText, "text streams prefixed output, json prints stdout, stderr and the exit code of each workspace")
+	cmd.Flags().IntVar(&opts.parallel, "parallel", 10, "how many workspaces to run on at once")
+	return cmd
+}
+
+// Result is how the command went on one workspace
+type Result struct {
+	Workspace string `json:"workspace"`
+	ExitCode  int    `json:"exitCode"`
+	Stdout    string `json:"stdout"`
+	Stderr    string `json:"stderr"`
+	Error     string `json:"error,omitempty"`
+	// DurationMs is how long the command ran in milliseconds
+	DurationMs int64 `json:"durationMs"`
+}
+
+// Runner runs a command on a workspace and returns its exit code, or an
+// error if it could not be run
+type Runner interface {
+	Run(ctx context.Context, workspace entity.Workspace, command string, stdout, stderr io.Writer) (int, error)
+}
+
+type sshRunner struct {
+	forwarder *portforward.SSHPortForwarder
+}
+
+func (r sshRunner) Run(ctx context.Context, workspace entity.Workspace, command string, stdout, stderr io.Writer) (int, error) {
+	tunnel, err := r.forwarder.Connect(ctx, workspace.GetProxyURL())
+	if err != nil {
+		return ExitCodeConnectionFailed, breverrors.WrapAndTrace(err)
+	}
+	defer tunnel.Close() //nolint:errcheck // the command is done
+	err = tunnel.Exec(command, nil, stdout, stderr)
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		return 0, nil
+	case errors.As(err, &exitErr):
+		return exitErr.ExitStatus(), nil
+	default:
+		return ExitCodeConnectionFailed, breverrors.WrapAndTrace(err)
+	}
+}
+
+func RunExec(t *terminal.Terminal, store ExecStore, auth huproxyclient.HubProxyAuth, names []string, command string, opts execOptions) (int, error) {
+	if opts.output != outputText && opts.output != outputJSON {
+		return 0, fmt.Errorf("unknown output %q, use %s or %s", opts.output, outputText, outputJSON)
+	}
+	if opts.parallel < 1 {
+		return 0, fmt.Errorf("--parallel must be at least 1")
+	}
+	workspaces, err := selectWorkspaces(store, names, opts)
+	if err != nil {
+		return 0, breverrors.WrapAndTrace(err)
+	}
+	if len(workspaces) == 0 {
+		return 0, fmt.Errorf("no running workspaces match")
+	}
+	keys, err := store.GetCurrentUserKeys()
+	if err != nil {
+		return 0, breverrors.WrapAndTrace(err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	runner := sshRunner{forwarder: portforward.NewSSHPortForwarder(auth, keys.PrivateKey)}
+	var out *output
+	if opts.output == outputText {
+		out = newOutput(t, workspaces)
+	}
+	results := runAll(ctx, runner, workspaces, command, opts.parallel, out)
+
+	if opts.output == outputJSON {
+		b, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return 0, breverrors.WrapAndTrace(err)
+		}
+		t.Print(string(b))
+	} else {
+		printSummary(t, results)
+	}
+	return aggregateExitCode(results), nil
+}
+
+// selectWorkspaces resolves named workspaces, which must be running, or the
+// running workspaces matching --all or --selector
+func selectWorkspaces(store ExecStore, names []string, opts execOptions) ([]entity.Workspace, error) {
+	if len(names) > 0 && (opts.all || opts.selector != "") {
+		return nil, fmt.Errorf("name workspaces or use --all or --selector, not both")
+	}
+	if len(names) > 0 {
+		wp := proxy.NewWorkspaceProxy(store, compat.DefaultMatrix, 0)
+		var workspaces []entity.Workspace
+		for _, name := range names {
+			workspace, err := wp.ResolveWorkspace(name)
+			if err != nil {
+				return nil, breverrors.WrapAndTrace(err)
+			}
+			if workspace.Status != "RUNNING" {
+				return nil, fmt.Errorf("workspace %s is %s, start it with `brev start %s`", workspace.Name, workspace.Status, workspace.Name)
+			}
+			workspaces = append(workspaces, *workspace)
+		}
+		return workspaces, nil
+	}
+	if !opts.all && opts.selector == "" {
+		return nil, fmt.Errorf("name the workspaces to run on, or use --all or --selector")
+	}
+
+	selector, err := ParseSelector(opts.selector)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	all, err := store.GetContextWorkspaces()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	var workspaces []entity.Workspace
+	for _, w := range all {
+		if w.Status == "RUNNING" && selector.Matches(w) {
+			workspaces = append(workspaces, w)
+		}
+	}
+	sort.Slice(workspaces, func(i, j int) bool {
+		return workspaces[i].Name < workspaces[j].Name
+	})
+	return workspaces, nil
+}
+
+// Selector filters workspaces by key=value pairs that must all match
+type Selector map[string]string
+
+var selectorFields = map[string]func(entity.Workspace) string{
+	"name":     func(w entity.Workspace) string { return w.Name },
+	"status":   func(w entity.Workspace) string { return w.Status },
+	"class":    func(w entity.Workspace) string { return w.WorkspaceClassID },
+	"group":    func(w entity.Workspace) string { return w.WorkspaceGroupID },
+	"template": func(w entity.Workspace) string { return w.WorkspaceTemplate.Name },
+	"repo":     func(w entity.Workspace) string { return w.GitRepo },
+}
+
+func ParseSelector(s string) (Selector, error) {
+	selector := Selector{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid selector %q, expected key=value", pair)
+		}
+		key := strings.TrimSpace(parts[0])
+		if _, ok := selectorFields[key]; !ok {
+			return nil, fmt.Errorf("unknown selector key %q, use name, status, class, group, template or repo", key)
+		}
+		value := strings.TrimSpace(parts[1])
+		if _, err := path.Match(value, ""); err != nil {
+			return nil, fmt.Errorf("invalid selector value %q: %w", value, err)
+		}
+		selector[key] = value
+	}
+	return selector, nil
+}
+
+func (s Selector) Matches(w entity.Workspace) bool {
+	for key, pattern := range s {
+		ok, _ := path.Match(pattern, selectorFields[key](w))
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// runAll runs the command on up to parallel workspaces at a time. With out
+// set, output is streamed to it as it arrives instead of kept in the results.
+func runAll(ctx context.Context, runner Runner, workspaces []entity.Workspace, command string, parallel int, out *output) []Result {
+	results := make([]Result, len(workspaces))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, w := range workspaces {
+		wg.Add(1)
+		go func(i int, w entity.Workspace) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			var stdout, stderr bytes.Buffer
+			var stdoutW, stderrW io.Writer = &stdout, &stderr
+			if out != nil {
+				stdoutW, stderrW = out.writer(w.Name, false), out.writer(w.Name, true)
+			}
+			start := time.Now()
+			code, err := runner.Run(ctx, w, command, stdoutW, stderrW)
+			if out != nil {
+				out.flush(stdoutW, stderrW)
+			}
+			results[i] = Result{
+				Workspace:  w.Name,
+				ExitCode:   code,
+				Stdout:     stdout.String(),
+				Stderr:     stderr.String(),
+				DurationMs: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}(i, w)
+	}
+	wg.Wait()
+	return results
+}
+
+// aggregateExitCode is 0 if every workspace succeeded, otherwise the highest
+// exit code
+func aggregateExitCode(results []Result) int {
+	code := 0
+	for _, r := range results {
+		if r.ExitCode > code {
+			code = r.ExitCode
+		}
+	}
+	return code
+}
+
+func printSummary(t *terminal.Terminal, results []Result) {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "WORKSPACE\tEXIT\tDURATION\tERROR")
+	failed := 0
+	for _, r := range results {
+		if r.ExitCode != 0 {
+			failed++
+		}
+		errMsg := r.Error
+		if errMsg == "" {
+			errMsg = "-"
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", r.Workspace, r.ExitCode, (time.Duration(r.DurationMs) * time.Millisecond).String(), firstLine(errMsg))
+	}
+	_ = w.Flush()
+	t.Vprint("")
+	t.Vprint(strings.TrimSuffix(b.String(), "\n"))
+	if failed == 0 {
+		t.Vprint(t.Green("succeeded on %d workspaces", len(results)))
+	} else {
+		t.Vprint(t.Red("failed on %d of %d workspaces", failed, len(results)))
+	}
+}
+
+func firstLine(s string) string {
+	return strings.SplitN(strings.TrimSpace(s), "\n", 2)[0]
+}
+
+// output interleaves whole lines from every workspace, each prefixed with
+// its workspace name padded to line up
+type output struct {
+	mu     sync.Mutex
+	stdout io.Writer
+	stderr io.Writer
+	width  int
+}
+
+func newOutput(t *terminal.Terminal, workspaces []entity.Workspace) *output {
+	width := 0
+	for _, w := range workspaces {
+		if len(w.Name) > width {
+			width = len(w.Name)
+		}
+	}
+	return &output{stdout: writerFunc(func(s string) { t.Vprintf("%s", s) }), stderr: writerFunc(func(s string) { t.Eprintf("%s", s) }), width: width}
+}
+
+func (o *output) writer(name string, isStderr bool) io.Writer {
+	dst := o.stdout
+	if isStderr {
+		dst = o.stderr
+	}
+	return &prefixWriter{out: o, dst: dst, prefix: fmt.Sprintf("%-*s | ", o.width, name)}
+}
+
+func (o *output) flush(writers ...io.Writer) {
+	for _, w := range writers {
+		if pw, ok := w.(*prefixWriter); ok {
+			pw.flush()
+		}
+	}
+}
+
+type prefixWriter struct {
+	out    *output
+	dst    io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		p.emit(p.buf[:i+1])
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+// flush writes a last line that did not end in a newline
+func (p *prefixWriter) flush() {
+	if len(p.buf) > 0 {
+		p.emit(append(p.buf, '\n'))
+		p.buf = nil
+	}
+}
+
+func (p *prefixWriter) emit(line []byte) {
+	p.out.mu.Lock()
+	defer p.out.mu.Unlock()
+	_, _ = io.WriteString(p.dst, p.prefix+string(line))
+}
+
+type writerFunc func(s string)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	f(string(b))
+	return len(b), nil
+}
@@ -0,0 +1,87 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRunner struct {
+	codes map[string]int
+}
+
+func (f fakeRunner) Run(_ context.Context, w entity.Workspace, command string, stdout, stderr io.Writer) (int, error) {
+	_, _ = fmt.Fprintf(stdout, "%s ran\n%s", w.Name, command)
+	code, ok := f.codes[w.Name]
+	if !ok {
+		return ExitCodeConnectionFailed, fmt.Errorf("unreachable")
+	}
+	if code != 0 {
+		_, _ = fmt.Fprintln(stderr, "boom")
+	}
+	return code, nil
+}
+
+func TestRunAllCapturesOutput(t *testing.T) {
+	workspaces := []entity.Workspace{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+	results := runAll(context.Background(), fakeRunner{codes: map[string]int{"a": 0, "b": 2}}, workspaces, "make", 2, nil)
+
+	assert.Equal(t, "a", results[0].Workspace)
+	assert.Equal(t, "a ran\nmake", results[0].Stdout)
+	assert.Equal(t, 0, results[0].ExitCode)
+	assert.Equal(t, 2, results[1].ExitCode)
+	assert.Equal(t, "boom\n", results[1].Stderr)
+	assert.Equal(t, ExitCodeConnectionFailed, results[2].ExitCode)
+	assert.Equal(t, "unreachable", results[2].Error)
+
+	assert.Equal(t, ExitCodeConnectionFailed, aggregateExitCode(results))
+	assert.Equal(t, 2, aggregateExitCode(results[:2]))
+	assert.Equal(t, 0, aggregateExitCode(results[:1]))
+}
+
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func TestRunAllStreamsPrefixedLines(t *testing.T) {
+	var stdout, stderr syncBuffer
+	out := &output{stdout: &stdout, stderr: &stderr, width: 4}
+	workspaces := []entity.Workspace{{Name: "a"}, {Name: "long"}}
+	results := runAll(context.Background(), fakeRunner{codes: map[string]int{"a": 1, "long": 0}}, workspaces, "make", 10, out)
+
+	lines := strings.Split(strings.TrimSuffix(stdout.b.String(), "\n"), "\n")
+	assert.ElementsMatch(t, []string{"a    | a ran", "a    | make", "long | long ran", "long | make"}, lines)
+	assert.Equal(t, "a    | boom\n", stderr.b.String())
+	assert.Empty(t, results[0].Stdout, "streamed output is not kept")
+}
+
+func TestSelector(t *testing.T) {
+	s, err := ParseSelector("name=api-*, class=2x8")
+	assert.Nil(t, err)
+	assert.True(t, s.Matches(entity.Workspace{Name: "api-1", WorkspaceClassID: "2x8"}))
+	assert.False(t, s.Matches(entity.Workspace{Name: "api-1", WorkspaceClassID: "4x16"}))
+	assert.False(t, s.Matches(entity.Workspace{Name: "web", WorkspaceClassID: "2x8"}))
+
+	s, err = ParseSelector("")
+	assert.Nil(t, err)
+	assert.True(t, s.Matches(entity.Workspace{Name: "anything"}))
+
+	_, err = ParseSelector("owner=me")
+	assert.NotNil(t, err)
+	_, err = ParseSelector("name")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,366 @@
+// Package forward manages named port forwards that the run-tasks daemon keeps
+// running in the background
+package forward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/cmd/completions"
+	"github.com/brevdev/brev-cli/pkg/cmd/proxy"
+	"github.com/brevdev/brev-cli/pkg/cmd/runtasks"
+	"github.com/brevdev/brev-cli/pkg/compat"
+	"github.com/brevdev/brev-cli/pkg/config"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/forwards"
+	"github.com/brevdev/brev-cli/pkg/huproxyclient"
+	"github.com/brevdev/brev-cli/pkg/localports"
+	"github.com/brevdev/brev-cli/pkg/portforward"
+	"github.com/brevdev/brev-cli/pkg/terminal"
+	"github.com/spf13/cobra"
+)
+
+type ForwardStore interface {
+	proxy.ProxyStore
+	completions.CompletionStore
+}
+
+type autoOptions struct {
+	address  string
+	interval time.Duration
+	ignore   []int
+}
+
+func NewCmdForward(t *terminal.Terminal, store ForwardStore, auth huproxyclient.HubProxyAuth) *cobra.Command {
+	var auto bool
+	var opts autoOptions
+
+	cmd := &cobra.Command{
+		Annotations:           map[string]string{"ssh": ""},
+		Use:                   "forward",
+		DisableFlagsInUseLine: true,
+		Short:                 "Manage port forwards that run in the background",
+		Long:                  "Add, list and remove named port forwards to your workspaces. Forwards are saved and kept running by the run-tasks daemon, so they survive closing the terminal and come back when a workspace restarts.\n\nWith --auto, watch a workspace in the foreground and forward every port it listens on to the same local port, like an editor's remote port detection.",
+		Example:               "brev forward add my-ws 8080:80 5432 --name db\nbrev forward ls\nbrev forward rm db\nbrev forward --auto my-ws",
+		Args:                  cobra.MaximumNArgs(1),
+		ValidArgsFunction:     completions.GetAllWorkspaceNameCompletionHandler(store, t),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !auto {
+				if len(args) > 0 {
+					return fmt.Errorf("unknown command %q, did you mean `brev forward --auto %s`?", args[0], args[0])
+				}
+				return cmd.Help()
+			}
+			if len(args) == 0 {
+				return fmt.Errorf("name the workspace to forward ports from")
+			}
+			err := RunAuto(t, store, auth, args[0], opts)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&auto, "auto", false, "forward every port the workspace listens on until interrupted")
+	cmd.Flags().StringVar(&opts.address, "address", forwards.DefaultAddress, "local address to listen on with --auto")
+	cmd.Flags().DurationVar(&opts.interval, "interval", 5*time.Second, "how often --auto checks the workspace for new ports")
+	cmd.Flags().IntSliceVar(&opts.ignore, "ignore", nil, "ports --auto does not forward, in addition to ssh")
+	cmd.AddCommand(newCmdAdd(t, store))
+	cmd.AddCommand(newCmdLs(t))
+	cmd.AddCommand(newCmdRm(t))
+	return cmd
+}
+
+type addOptions struct {
+	name    string
+	address string
+	via     string
+	reverse []string
+}
+
+func newCmdAdd(t *terminal.Terminal, store ForwardStore) *cobra.Command {
+	var opts addOptions
+
+	cmd := &cobra.Command{
+		Use:                   "add <workspace> <local:remote|port>...",
+		DisableFlagsInUseLine: true,
+		Short:                 "Add a port forward",
+		Long:                  "Forward one or more ports of a workspace. A single port forwards the same port locally. If a local port is taken by another forward or process, the next free port is used instead. Use --reverse to forward a workspace port to this machine, for example so webhooks sent to the workspace reach your laptop; reverse forwards go over ssh.",
+		Example:               "brev forward add my-ws 8080:80 5432 --name db --address 0.0.0.0\nbrev forward add my-ws --reverse 9000:3000 --name webhooks",
+		Args:                  cobra.MinimumNArgs(1),
+		ValidArgsFunction:     completions.GetAllWorkspaceNameCompletionHandler(store, t),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := RunAdd(t, store, args[0], args[1:], opts)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&opts.name, "name", "", "name of the forward, <workspace>-<first remote port> by default")
+	cmd.Flags().StringVar(&opts.address, "address", forwards.DefaultAddress, "local address to listen on, use 0.0.0.0 to share the ports on your network")
+	cmd.Flags().StringVar(&opts.via, "via", "", fmt.Sprintf("forward through the k8s api (%s) or over ssh (%s), defaults to $BREV_PORT_FORWARD_VIA or %s", portforward.ViaK8s, portforward.ViaSSH, portforward.ViaK8s))
+	cmd.Flags().StringSliceVarP(&opts.reverse, "reverse", "R", nil, "forward remote:local from the workspace to this machine")
+	return cmd
+}
+
+func newCmdLs(t *terminal.Terminal) *cobra.Command {
+	return &cobra.Command{
+		Use:                   "ls",
+		DisableFlagsInUseLine: true,
+		Short:                 "List port forwards",
+		Args:                  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := RunLs(t)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+}
+
+func newCmdRm(t *terminal.Terminal) *cobra.Command {
+	var all bool
+
+	cmd := &cobra.Command{
+		Use:                   "rm <name>...",
+		DisableFlagsInUseLine: true,
+		Short:                 "Remove port forwards",
+		Example:               "brev forward rm db\nbrev forward rm --all",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !all && len(args) == 0 {
+				return fmt.Errorf("name the forwards to remove or pass --all")
+			}
+			err := RunRm(t, args, all)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&all, "all", false, "remove every forward")
+	return cmd
+}
+
+func RunAdd(t *terminal.Terminal, store ForwardStore, workspaceNameOrID string, portArgs []string, opts addOptions) error {
+	var ports []forwards.PortMapping
+	for _, arg := range portArgs {
+		p, err := forwards.ParsePortMapping(arg)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		ports = append(ports, p)
+	}
+	var reverse []forwards.PortMapping
+	for _, arg := range opts.reverse {
+		p, err := forwards.ParseReversePortMapping(arg)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		reverse = append(reverse, p)
+	}
+	if len(ports) == 0 && len(reverse) == 0 {
+		return fmt.Errorf("give at least one port to forward or a --reverse port")
+	}
+	via, err := resolveVia(opts.via, len(reverse) > 0)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	workspace, err := proxy.NewWorkspaceProxy(store, compat.DefaultMatrix, 0).ResolveWorkspace(workspaceNameOrID)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	name := opts.name
+	if name == "" {
+		name = forwards.DefaultName(workspace.Name, ports, reverse)
+	}
+
+	forwardsConfig, err := forwards.NewDefaultStore()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	var reassignments []forwards.Reassignment
+	err = forwardsConfig.Update(func(c *forwards.Config) error {
+		reassignments, err = c.Add(forwards.Forward{
+			Name:          name,
+			WorkspaceID:   workspace.ID,
+			WorkspaceName: workspace.Name,
+			Address:       opts.address,
+			Ports:         ports,
+			Reverse:       reverse,
+			Via:           via,
+		}, localports.IsPortFree)
+		return err
+	})
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	for _, r := range reassignments {
+		t.Vprint(t.Yellow("local port %d is %s, using %d instead", r.From, r.Reason, r.To))
+	}
+	t.Vprintf("added forward %s to %s\n", t.Green(name), workspace.Name)
+	runtasks.WarnIfDaemonNotRunning(t, "forwards are run")
+	return nil
+}
+
+// resolveVia picks ssh for reverse forwards, which the k8s api can not do
+func resolveVia(via string, hasReverse bool) (string, error) {
+	if via == "" {
+		if hasReverse {
+			return portforward.ViaSSH, nil
+		}
+		via = config.GlobalConfig.GetPortForwardVia()
+	}
+	err := portforward.ValidateVia(via)
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	if hasReverse && via != portforward.ViaSSH {
+		return "", fmt.Errorf("reverse forwards are only supported over ssh, use --via %s", portforward.ViaSSH)
+	}
+	return via, nil
+}
+
+// RunAuto forwards the ports the workspace listens on over ssh until
+// interrupted. Nothing is saved, so the forwards end with the command.
+func RunAuto(t *terminal.Terminal, store ForwardStore, auth huproxyclient.HubProxyAuth, workspaceNameOrID string, opts autoOptions) error {
+	if opts.interval <= 0 {
+		return fmt.Errorf("--interval must be positive")
+	}
+	workspace, err := proxy.NewWorkspaceProxy(store, compat.DefaultMatrix, 0).ResolveWorkspace(workspaceNameOrID)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if workspace.Status != "RUNNING" {
+		return fmt.Errorf("workspace %s is %s, start it with `brev start %s`", workspace.Name, workspace.Status, workspace.Name)
+	}
+	keys, err := store.GetCurrentUserKeys()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	tunnel, err := portforward.NewSSHPortForwarder(auth, keys.PrivateKey).Connect(ctx, workspace.GetProxyURL())
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer tunnel.Close() //nolint:errcheck // the forwards are over
+
+	auto := forwards.NewAutoForwarder(tunnel, opts.address, forwards.PortNames(*workspace), localports.IsPortFree).Ignore(opts.ignore...)
+	t.Vprintf("watching %s for listening ports, press ctrl-c to stop\n", t.Green(workspace.Name))
+	err = auto.Run(ctx, opts.interval, func(e forwards.AutoEvent) {
+		switch {
+		case e.Err != nil:
+			t.Vprint(t.Yellow("%s", e.String()))
+		case e.Removed:
+			t.Vprint(e.String())
+		default:
+			t.Vprint(t.Green("%s", e.String()))
+		}
+	})
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func RunLs(t *terminal.Terminal) error {
+	forwardsConfig, err := forwards.NewDefaultStore()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	c, err := forwardsConfig.Load()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if len(c.Forwards) == 0 {
+		t.Vprint("no forwards, add one with `brev forward add <workspace> <port>`")
+		return nil
+	}
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "NAME\tWORKSPACE\tVIA\tADDRESS\tPORTS\tSTATUS")
+	for _, f := range c.Forwards {
+		via := f.Via
+		if via == "" {
+			via = portforward.ViaK8s
+		}
+		ports := f.PortStrings()
+		for _, r := range f.ReverseStrings() {
+			ports = append(ports, "R"+r)
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", f.Name, f.WorkspaceName, via, f.Address, strings.Join(ports, ","), probe(f))
+	}
+	_ = w.Flush()
+	t.Vprint(strings.TrimSuffix(b.String(), "\n"))
+	runtasks.WarnIfDaemonNotRunning(t, "forwards are run")
+	return nil
+}
+
+// probe reports whether every local port of the forward is accepting
+// connections. Reverse ports listen on the workspace so can not be probed.
+func probe(f forwards.Forward) string {
+	if len(f.Ports) == 0 {
+		return "-"
+	}
+	var down []string
+	for _, p := range f.Ports {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(dialAddress(f.Address), strconv.Itoa(p.Local)), time.Second)
+		if err != nil {
+			down = append(down, strconv.Itoa(p.Local))
+			continue
+		}
+		_ = conn.Close()
+	}
+	if len(down) == 0 {
+		return "listening"
+	}
+	if len(down) == len(f.Ports) {
+		return "down"
+	}
+	return fmt.Sprintf("down on %s", strings.Join(down, ","))
+}
+
+func dialAddress(address string) string {
+	if address == "0.0.0.0" || address == "::" || address == "*" {
+		return "localhost"
+	}
+	return address
+}
+
+func RunRm(t *terminal.Terminal, names []string, all bool) error {
+	forwardsConfig, err := forwards.NewDefaultStore()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = forwardsConfig.Update(func(c *forwards.Config) error {
+		if all {
+			c.Forwards = nil
+			return nil
+		}
+		return c.Remove(names...)
+	})
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if all {
+		t.Vprint("removed all forwards")
+	} else {
+		t.Vprintf("removed %s\n", strings.Join(names, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+// Package kubeconfig exports a kubeconfig for the user's workspace groups
+package kubeconfig
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
+	"github.com/brevdev/brev-cli/pkg/k8s"
+	"github.com/brevdev/brev-cli/pkg/terminal"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+type KubeconfigStore interface {
+	k8s.K8sStore
+	GetContextWorkspaces() ([]entity.Workspace, error)
+	GetWorkspaceMetaData(workspaceID string) (*entity.WorkspaceMetaData, error)
+}
+
+type kubeconfigOptions struct {
+	group      string
+	merge      bool
+	exec       bool
+	kubeconfig string
+}
+
+func NewCmdKubeconfig(t *terminal.Terminal, store KubeconfigStore) *cobra.Command {
+	var opts kubeconfigOptions
+
+	cmd := &cobra.Command{
+		Annotations:           map[string]string{"context": ""},
+		Use:                   "kubeconfig",
+		DisableFlagsInUseLine: true,
+		Short:                 "Export a kubeconfig for your workspace groups",
+		Long:                  "Print a kubeconfig with a context per workspace group, set to the namespace of your workspaces, so that kubectl and k9s can see your workspace pods. With --merge the contexts are added to your kubeconfig instead. With --exec kubectl asks brev for credentials whenever it needs them, so they never expire.",
+		Example:               "brev kubeconfig > brev.yaml\nbrev kubeconfig --merge --exec\nkubectl --context brev-<group> get pods",
+		Args:                  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := RunKubeconfig(t, store, opts)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&opts.group, "group", "", "only export this workspace group")
+	cmd.Flags().BoolVar(&opts.merge, "merge", false, "add the contexts to your kubeconfig instead of printing them")
+	cmd.Flags().BoolVar(&opts.exec, "exec", false, "get credentials from brev when kubectl needs them instead of embedding them")
+	cmd.Flags().StringVar(&opts.kubeconfig, "kubeconfig", "", "kubeconfig to merge into, the first file in $KUBECONFIG or ~/.kube/config by default")
+
+	cmd.AddCommand(newCmdCredential(store))
+	return cmd
+}
+
+// newCmdCredential is the exec plugin the --exec kubeconfig runs
+func newCmdCredential(store k8s.K8sStore) *cobra.Command {
+	return &cobra.Command{
+		Use:    "credential <workspace group id>",
+		Short:  "Print the kubectl exec credential of a workspace group",
+		Hidden: true,
+		Args:   cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cache, err := k8s.NewDefaultKeyCache(store)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			keys, err := cache.GetCurrentUserKeys()
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			b, err := k8s.ExecCredential(*keys, args[0])
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			_, err = os.Stdout.Write(b)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+}
+
+func RunKubeconfig(t *terminal.Terminal, store KubeconfigStore, opts kubeconfigOptions) error {
+	if opts.kubeconfig != "" && !opts.merge {
+		return fmt.Errorf("--kubeconfig is only used with --merge")
+	}
+	cache, err := k8s.NewDefaultKeyCache(store)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	keys, err := cache.GetCurrentUserKeys()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	groups, err := kubeconfigGroups(store, *keys, opts.group)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	kubeOpts := k8s.KubeconfigOptions{PrivateKey: keys.PrivateKey}
+	if opts.exec {
+		brev, err := os.Executable()
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		kubeOpts.Exec = []string{brev, "kubeconfig", "credential"}
+	}
+	config := k8s.Kubeconfig(groups, kubeOpts)
+
+	if !opts.merge {
+		b, err := clientcmd.Write(*config)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		t.Print(strings.TrimSuffix(string(b), "\n"))
+		return nil
+	}
+
+	path := opts.kubeconfig
+	if path == "" {
+		path = k8s.DefaultKubeconfigPath()
+	}
+	existing, err := k8s.LoadKubeconfig(files.AppFs, path)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	k8s.MergeKubeconfig(existing, config)
+	err = k8s.WriteKubeconfig(files.AppFs, path, existing)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	for _, g := range groups {
+		t.Vprintf("added context %s to %s\n", t.Green("%s", k8s.KubeconfigName(g.Keys.GroupID)), path)
+	}
+	return nil
+}
+
+// kubeconfigGroups pairs each workspace group with the namespace of one of
+// the user's workspaces in it. Groups the user has no workspaces in get no
+// namespace.
+func kubeconfigGroups(store KubeconfigStore, keys entity.UserKeys, only string) ([]k8s.KubeconfigGroup, error) {
+	var groups []k8s.KubeconfigGroup
+	for _, wk := range keys.WorkspaceGroups {
+		if only == "" || wk.GroupID == only {
+			groups = append(groups, k8s.KubeconfigGroup{Keys: wk})
+		}
+	}
+	if len(groups) == 0 {
+		if only != "" {
+			return nil, fmt.Errorf("you have no keys for workspace group %s", only)
+		}
+		return nil, fmt.Errorf("you have no keys for any workspace group")
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Keys.GroupID < groups[j].Keys.GroupID })
+
+	workspaces, err := store.GetContextWorkspaces()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	for i, g := range groups {
+		for _, w := range workspaces {
+			if w.WorkspaceGroupID != g.Keys.GroupID {
+				continue
+			}
+			meta, err := store.GetWorkspaceMetaData(w.ID)
+			if err != nil {
+				return nil, breverrors.WrapAndTrace(err)
+			}
+			if meta.NamespaceName != "" {
+				groups[i].Namespace = meta.NamespaceName
+				break
+			}
+		}
+	}
+	return groups, nil
+}
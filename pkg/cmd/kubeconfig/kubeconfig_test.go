@@ -0,0 +1,41 @@
+package kubeconfig
+
+import (
+	"testing"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeStore struct{}
+
+func (fakeStore) GetCurrentUserKeys() (*entity.UserKeys, error) {
+	return &entity.UserKeys{}, nil
+}
+
+func (fakeStore) GetContextWorkspaces() ([]entity.Workspace, error) {
+	return []entity.Workspace{{ID: "w1", WorkspaceGroupID: "g2"}, {ID: "w2", WorkspaceGroupID: "g1"}}, nil
+}
+
+func (fakeStore) GetWorkspaceMetaData(workspaceID string) (*entity.WorkspaceMetaData, error) {
+	return &entity.WorkspaceMetaData{NamespaceName: "ns-" + workspaceID}, nil
+}
+
+func TestKubeconfigGroups(t *testing.T) {
+	keys := entity.UserKeys{WorkspaceGroups: []entity.WorkspaceGroupKeys{{GroupID: "g3"}, {GroupID: "g2"}, {GroupID: "g1"}}}
+	groups, err := kubeconfigGroups(fakeStore{}, keys, "")
+	assert.Nil(t, err)
+	if assert.Len(t, groups, 3) {
+		assert.Equal(t, "g1", groups[0].Keys.GroupID)
+		assert.Equal(t, "ns-w2", groups[0].Namespace)
+		assert.Equal(t, "ns-w1", groups[1].Namespace)
+		assert.Empty(t, groups[2].Namespace, "no workspaces in g3")
+	}
+
+	groups, err = kubeconfigGroups(fakeStore{}, keys, "g2")
+	assert.Nil(t, err)
+	assert.Len(t, groups, 1)
+
+	_, err = kubeconfigGroups(fakeStore{}, keys, "g4")
+	assert.NotNil(t, err)
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/brevdev/brev-cli/pkg/auth"
 	"github.com/brevdev/brev-cli/pkg/entity"
 	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/k8s"
 	"github.com/brevdev/brev-cli/pkg/store"
 	"github.com/brevdev/brev-cli/pkg/terminal"
 	"github.com/spf13/cobra"
@@ -68,6 +69,11 @@ func (o LoginOptions) RunLogin(t *terminal.Terminal) error {
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
 	}
+	// keys cached for a previous login may belong to someone else
+	err = k8s.ClearDefaultKeyCache()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
 
 	_, err = o.LoginStore.GetCurrentUser()
 	if err != nil {
@@ -7,6 +7,7 @@ import (
 	"github.com/spf13/cobra"
 
 	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/k8s"
 	cmdutil "k8s.io/kubectl/pkg/cmd/util"
 )
 
@@ -54,5 +55,10 @@ func (o *LogoutOptions) RunLogout() error {
 			return breverrors.WrapAndTrace(err)
 		}
 	}
+	// the cached keys belong to the user logging out
+	err = k8s.ClearDefaultKeyCache()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
 	return nil
 }
@@ -0,0 +1,78 @@
+// Package logs prints the container logs of a workspace
+package logs
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/brevdev/brev-cli/pkg/cmd/completions"
+	"github.com/brevdev/brev-cli/pkg/cmd/proxy"
+	"github.com/brevdev/brev-cli/pkg/compat"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/k8s"
+	"github.com/brevdev/brev-cli/pkg/terminal"
+	"github.com/spf13/cobra"
+)
+
+type LogsStore interface {
+	proxy.ProxyStore
+	completions.CompletionStore
+}
+
+func NewCmdLogs(t *terminal.Terminal, store LogsStore) *cobra.Command {
+	opts := k8s.LogOptions{Tail: -1}
+
+	cmd := &cobra.Command{
+		Annotations:           map[string]string{"workspace": ""},
+		Use:                   "logs <workspace>",
+		DisableFlagsInUseLine: true,
+		Short:                 "Print the logs of a workspace",
+		Long:                  "Print the container logs of a workspace from its Kubernetes api. Use -f to keep streaming new lines. Use --previous to see why a crashed container stopped.",
+		Example:               "brev logs my-ws --tail 100\nbrev logs my-ws -f --since 10m",
+		Args:                  cobra.ExactArgs(1),
+		ValidArgsFunction:     completions.GetAllWorkspaceNameCompletionHandler(store, t),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := RunLogs(store, args[0], opts)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVarP(&opts.Follow, "follow", "f", false, "keep streaming new lines")
+	cmd.Flags().DurationVar(&opts.Since, "since", 0, "only lines newer than this, like 5s, 2m or 3h")
+	cmd.Flags().Int64Var(&opts.Tail, "tail", opts.Tail, "number of lines from the end to show, -1 for all")
+	cmd.Flags().StringVarP(&opts.Container, "container", "c", "", "container to show, the workspace's main container by default")
+	cmd.Flags().BoolVar(&opts.Timestamps, "timestamps", false, "prefix each line with its timestamp")
+	cmd.Flags().BoolVarP(&opts.Previous, "previous", "p", false, "show the logs of the previous container, if it restarted")
+	return cmd
+}
+
+func RunLogs(store LogsStore, workspaceNameOrID string, opts k8s.LogOptions) error {
+	workspace, err := proxy.NewWorkspaceProxy(store, compat.DefaultMatrix, 0).ResolveWorkspace(workspaceNameOrID)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	meta, err := store.GetWorkspaceMetaData(workspace.ID)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	mapper, err := k8s.NewDefaultWorkspaceGroupClientMapper(store)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	client, err := mapper.GetK8sClient(workspace.WorkspaceGroupID)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	err = k8s.StreamLogs(ctx, client.GetK8sClient(), *meta, opts, os.Stdout)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
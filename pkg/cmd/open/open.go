@@ -2,21 +2,23 @@ package open
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
 	"strings"
 
+	"github.com/brevdev/brev-cli/pkg/editor"
 	"github.com/brevdev/brev-cli/pkg/entity"
 	breverrors "github.com/brevdev/brev-cli/pkg/errors"
 	"github.com/brevdev/brev-cli/pkg/store"
 	"github.com/brevdev/brev-cli/pkg/terminal"
 
-	"github.com/alessio/shellescape"
+	"github.com/pkg/browser"
 	"github.com/spf13/cobra"
 )
 
 var (
-	openLong    = "[command in beta] This will open VS Code SSH-ed in to your workspace. You must have 'code' installed in your path."
-	openExample = "brev open workspace_id_or_name\nbrev open my-app\nbrev open h9fp5vxwe"
+	openLong    = "Open an editor connected to your workspace, in the workspace's repo unless --path says otherwise. Editors connect with the workspace's host in the brev ssh config.\n\nEditors:\n" + editor.Help() + "\n\nThe default is " + editor.DefaultEditor + ", change it with --set-default."
+	openExample = "brev open my-app\nbrev open my-app --editor cursor --path src\nbrev open --set-default nvim"
 )
 
 type OpenStore interface {
@@ -27,49 +29,117 @@ type OpenStore interface {
 	GetWorkspaceMetaData(workspaceID string) (*entity.WorkspaceMetaData, error)
 }
 
+type openOptions struct {
+	editor     string
+	path       string
+	setDefault string
+}
+
 func NewCmdOpen(t *terminal.Terminal, store OpenStore) *cobra.Command {
+	var opts openOptions
+
 	cmd := &cobra.Command{
 		Annotations:           map[string]string{"ssh": ""},
-		Use:                   "open",
+		Use:                   "open <workspace>",
 		DisableFlagsInUseLine: true,
-		Short:                 "[beta] open VSCode to ",
+		Short:                 "Open an editor on your workspace",
 		Long:                  openLong,
 		Example:               openExample,
-		Args:                  cobra.ExactArgs(1),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if opts.setDefault != "" {
+				return cobra.MaximumNArgs(1)(cmd, args)
+			}
+			return cobra.ExactArgs(1)(cmd, args)
+		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := runOpenCommand(t, store, args[0])
+			err := runOpenCommand(t, store, args, opts)
 			if err != nil {
 				t.Errprint(err, "")
 			}
 		},
 	}
+	cmd.Flags().StringVarP(&opts.editor, "editor", "e", "", "editor to open, the default editor if empty: "+strings.Join(editor.Names(), ", "))
+	cmd.Flags().StringVarP(&opts.path, "path", "p", "", "directory to open, absolute or relative to "+editor.WorkspaceDir+", the workspace's repo if empty")
+	cmd.Flags().StringVar(&opts.setDefault, "set-default", "", "make this editor the default")
 
 	return cmd
 }
 
-func runOpenCommand(t *terminal.Terminal, tstore OpenStore, wsIDOrName string) error {
+func runOpenCommand(t *terminal.Terminal, tstore OpenStore, args []string, opts openOptions) error {
+	settingsStore := editor.NewDefaultSettingsStore()
+	settings, err := settingsStore.Load()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if opts.setDefault != "" {
+		_, err = editor.Get(opts.setDefault)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		settings.DefaultEditor = opts.setDefault
+		err = settingsStore.Save(settings)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		t.Vprintf("brev open now uses %s\n", t.Green("%s", opts.setDefault))
+		if len(args) == 0 {
+			return nil
+		}
+	}
+
+	editorName := opts.editor
+	if editorName == "" {
+		editorName = settings.GetDefaultEditor()
+	}
+	e, err := editor.Get(editorName)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
 	s := t.NewSpinner()
 	s.Suffix = " finding your workspace"
 	s.Start()
-
-	workspace, workspaces, err := getWorkspaceFromNameOrIDAndReturnWorkspacesPlusWorkspace(wsIDOrName, tstore)
+	workspace, workspaces, err := getWorkspaceFromNameOrIDAndReturnWorkspacesPlusWorkspace(args[0], tstore)
+	s.Stop()
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
 	}
+	if workspace.Status != "RUNNING" {
+		return fmt.Errorf("workspace %s is %s, start it with `brev start %s`", workspace.Name, workspace.Status, workspace.Name)
+	}
 
-	// Get base repo path
-	splitBySlash := strings.Split(workspace.GitRepo, "/")[1]
-	repoPath := strings.Split(splitBySlash, ".git")[0]
-
-	// note: intentional decision to just assume the parent folder and inner folder are the same
-	vscodeString := fmt.Sprintf("vscode-remote://ssh-remote+%s/home/brev/workspace/%s", workspace.GetLocalIdentifier(*workspaces), repoPath)
-	s.Stop()
-	t.Vprintf(t.Yellow("\nOpening VS Code to %s 🤙\n", repoPath))
+	target := editor.Target{
+		Alias: string(workspace.GetLocalIdentifier(*workspaces)),
+		Path:  editor.ResolvePath(workspace.Workspace, opts.path),
+	}
+	t.Vprintf("%s", t.Yellow("\nOpening %s to %s 🤙\n", e.Description, target.Path))
+	err = launch(e, target)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
 
-	vscodeString = shellescape.QuoteCommand([]string{vscodeString})
-	cmd := exec.Command("code", "--folder-uri", vscodeString) // #nosec G204
+func launch(e *editor.Editor, target editor.Target) error {
+	if e.URL != nil {
+		err := browser.OpenURL(e.URL(target))
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		return nil
+	}
+	argv := e.Command(target)
+	bin, err := exec.LookPath(argv[0])
+	if err != nil {
+		return fmt.Errorf("%s is not installed or not in your PATH", argv[0])
+	}
+	cmd := exec.Command(bin, argv[1:]...) // #nosec G204
+	if e.Interactive {
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
 	err = cmd.Run()
-
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
 	}
@@ -5,8 +5,10 @@ import (
 	"net/url"
 
 	"github.com/brevdev/brev-cli/pkg/cmd/completions"
+	"github.com/brevdev/brev-cli/pkg/config"
 	"github.com/brevdev/brev-cli/pkg/entity"
 	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/huproxyclient"
 	"github.com/brevdev/brev-cli/pkg/store"
 
 	"github.com/brevdev/brev-cli/pkg/k8s"
@@ -30,7 +32,10 @@ type PortforwardStore interface {
 	GetCurrentUser() (*entity.User, error)
 }
 
-func NewCmdPortForward(pfStore PortforwardStore, t *terminal.Terminal) *cobra.Command {
+func NewCmdPortForward(pfStore PortforwardStore, t *terminal.Terminal, auth huproxyclient.HubProxyAuth) *cobra.Command {
+	var address string
+	var via string
+	var reversePorts []string
 	cmd := &cobra.Command{
 		Annotations:           map[string]string{"ssh": ""},
 		Use:                   "port-forward",
@@ -41,28 +46,41 @@ func NewCmdPortForward(pfStore PortforwardStore, t *terminal.Terminal) *cobra.Co
 		Args:                  cobra.ExactArgs(1),
 		ValidArgsFunction:     completions.GetAllWorkspaceNameCompletionHandler(pfStore, t),
 		Run: func(cmd *cobra.Command, args []string) {
-			if Port == "" {
+			if Port == "" && len(reversePorts) == 0 {
 				startInput(t)
 			}
-
-			k8sClientMapper, err := k8s.NewDefaultWorkspaceGroupClientMapper(pfStore)
+			if via == "" {
+				via = config.GlobalConfig.GetPortForwardVia()
+			}
+			err := portforward.ValidateVia(via)
 			if err != nil {
-				switch err.(type) {
-				case *url.Error:
-					t.Errprint(err, "\n\ncheck your internet connection")
-					return
+				t.Errprint(err, "")
+				return
+			}
 
-				default:
-					t.Errprint(err, "")
+			var opts *portforward.PortForwardOptions
+			if via == portforward.ViaSSH {
+				// ssh only needs the user's key, not the workspace group's k8s clients
+				keys, err := pfStore.GetCurrentUserKeys()
+				if err != nil {
+					printFetchError(t, err)
+					return
+				}
+				opts = portforward.NewPortForwardOptions(
+					nil,
+					portforward.NewSSHPortForwarder(auth, keys.PrivateKey),
+				)
+			} else {
+				k8sClientMapper, err := k8s.NewDefaultWorkspaceGroupClientMapper(pfStore)
+				if err != nil {
+					printFetchError(t, err)
 					return
 				}
+				opts = portforward.NewPortForwardOptions(
+					k8sClientMapper,
+					portforward.NewDefaultPortForwarder(),
+				)
 			}
-			pf := portforward.NewDefaultPortForwarder()
-
-			opts := portforward.NewPortForwardOptions(
-				k8sClientMapper,
-				pf,
-			)
 
 			workspace, err := getWorkspaceFromNameOrID(args[0], pfStore)
 			if err != nil {
@@ -76,7 +94,10 @@ func NewCmdPortForward(pfStore PortforwardStore, t *terminal.Terminal) *cobra.Co
 				return
 			}
 
-			opts.WithPort(Port)
+			if Port != "" {
+				opts.WithPort(Port)
+			}
+			opts.WithAddress(address).WithReversePorts(reversePorts)
 
 			err = opts.RunPortforward()
 			if err != nil {
@@ -86,6 +107,9 @@ func NewCmdPortForward(pfStore PortforwardStore, t *terminal.Terminal) *cobra.Co
 		},
 	}
 	cmd.Flags().StringVarP(&Port, "port", "p", "", "port forward flag describe me better")
+	cmd.Flags().StringVar(&address, "address", "localhost", "local address to listen on, use 0.0.0.0 to share the port on your network")
+	cmd.Flags().StringVar(&via, "via", "", fmt.Sprintf("forward through the k8s api (%s) or over ssh (%s), defaults to $BREV_PORT_FORWARD_VIA or %s", portforward.ViaK8s, portforward.ViaSSH, portforward.ViaK8s))
+	cmd.Flags().StringSliceVarP(&reversePorts, "reverse", "R", nil, "forward remote:local from the workspace to this machine, needs --via ssh")
 	err := cmd.RegisterFlagCompletionFunc("port", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		return nil, cobra.ShellCompDirectiveNoSpace
 	})
@@ -96,6 +120,15 @@ func NewCmdPortForward(pfStore PortforwardStore, t *terminal.Terminal) *cobra.Co
 	return cmd
 }
 
+func printFetchError(t *terminal.Terminal, err error) {
+	switch err.(type) {
+	case *url.Error:
+		t.Errprint(err, "\n\ncheck your internet connection")
+	default:
+		t.Errprint(err, "")
+	}
+}
+
 func startInput(t *terminal.Terminal) {
 	t.Vprint(t.Yellow("\nPorts flag was omitted, running interactive mode!\n"))
 	remoteInput := terminal.PromptGetInput(terminal.PromptContent{
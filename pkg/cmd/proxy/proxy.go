@@ -1,96 +1,234 @@
 package proxy
 
 import (
-	"fmt"
-	"regexp"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/brevdev/brev-cli/pkg/compat"
 	"github.com/brevdev/brev-cli/pkg/entity"
 	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
 	"github.com/brevdev/brev-cli/pkg/huproxyclient"
 	"github.com/brevdev/brev-cli/pkg/k8s"
+	"github.com/brevdev/brev-cli/pkg/portforward"
+	"github.com/brevdev/brev-cli/pkg/proxyagent"
+	"github.com/brevdev/brev-cli/pkg/store"
 	"github.com/brevdev/brev-cli/pkg/terminal"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
-const (
-	allowedWorkspaceImage        = "brevdev/ubuntu-proxy:0.3.*"
-	allowedWorkspaceInfraVersion = "v1.7.*"
-)
+const workspaceSSHPort = "22"
 
 type ProxyStore interface {
-	GetAuthTokens() (*entity.AuthTokens, error)
 	GetWorkspace(workspaceID string) (*entity.Workspace, error)
+	GetWorkspaceMetaData(workspaceID string) (*entity.WorkspaceMetaData, error)
+	GetContextWorkspaces() ([]entity.Workspace, error)
+	StartWorkspace(workspaceID string) (*entity.Workspace, error)
 	WritePrivateKey(pem string) error
 	GetCurrentUserKeys() (*entity.UserKeys, error)
+	GetLatestReleaseMetadata() (*store.GithubReleaseMetadata, error)
+}
+
+type ProxyOptions struct {
+	huproxyclient.Options
+	Direct       bool // skip the proxy agent even if it is running
+	AutoStart    bool
+	StartTimeout time.Duration
 }
 
-func NewCmdProxy(t *terminal.Terminal, store ProxyStore) *cobra.Command {
+func NewCmdProxy(t *terminal.Terminal, store ProxyStore, auth huproxyclient.HubProxyAuth) *cobra.Command {
+	opts := ProxyOptions{
+		Options:      huproxyclient.DefaultOptions(),
+		StartTimeout: DefaultStartTimeout,
+	}
+
 	cmd := &cobra.Command{
 		Annotations:           map[string]string{"hidden": ""},
 		Use:                   "proxy",
 		DisableFlagsInUseLine: true,
 		Short:                 "http upgrade proxy",
-		Long:                  "http upgrade proxy for ssh ProxyCommand directive to use",
+		Long:                  "http upgrade proxy for ssh ProxyCommand directive to use. Accepts a workspace id, name or local alias.",
+		Example:               "ProxyCommand brev proxy --auto-start my-workspace",
 		Args:                  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			err := Proxy(t, store, args[0])
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			err := runProxy(ctx, t, store, auth, args[0], opts)
+			stop()
 			if err != nil {
-				log.Error(err.Error())
+				reportSessionEnded(err)
+				os.Exit(huproxyclient.ExitCode(err))
 			}
 		},
 	}
+	cmd.Flags().DurationVar(&opts.DialTimeout, "dial-timeout", opts.DialTimeout, "timeout for each attempt to connect to the workspace")
+	cmd.Flags().IntVar(&opts.DialRetries, "dial-retries", opts.DialRetries, "number of times to retry connecting if the workspace is unreachable")
+	cmd.Flags().DurationVar(&opts.PingInterval, "keepalive", opts.PingInterval, "interval between websocket keepalive pings")
+	cmd.Flags().BoolVar(&opts.Direct, "direct", false, "connect directly instead of through the proxy agent")
+	cmd.Flags().BoolVar(&opts.AutoStart, "auto-start", false, "start the workspace if it is stopped and wait until it is ready")
+	cmd.Flags().DurationVar(&opts.StartTimeout, "start-timeout", opts.StartTimeout, "how long to wait for a workspace started with --auto-start")
 
 	return cmd
 }
 
-func Proxy(_ *terminal.Terminal, store ProxyStore, workspaceID string) error {
-	workspace, err := store.GetWorkspace(workspaceID)
+// reportSessionEnded writes why the session ended to stderr, which ssh
+// passes through from the ProxyCommand
+func reportSessionEnded(err error) {
+	var sessionErr *huproxyclient.SessionEndedError
+	if errors.As(err, &sessionErr) {
+		log.WithFields(log.Fields{
+			"reason": sessionErr.Reason,
+			"status": sessionErr.StatusCode,
+		}).Error(sessionErr.Error())
+		if directive := sessionErr.Directive(); directive != "" {
+			log.Error(directive)
+		}
+		return
+	}
+	log.Error(err.Error())
+	var brevErr breverrors.BrevError
+	if errors.As(err, &brevErr) && brevErr.Directive() != "" {
+		log.Error(brevErr.Directive())
+	}
+}
+
+func runProxy(ctx context.Context, t *terminal.Terminal, store ProxyStore, auth huproxyclient.HubProxyAuth, nameOrID string, opts ProxyOptions) error {
+	if !opts.Direct {
+		err := ProxyThroughAgent(ctx, t, nameOrID, opts.AutoStart)
+		var notRunning *proxyagent.AgentNotRunningError
+		var directRequired *proxyagent.DirectRequiredError
+		if !errors.As(err, &notRunning) && !errors.As(err, &directRequired) {
+			return err
+		}
+	}
+	return Proxy(ctx, t, store, auth, nameOrID, opts)
+}
+
+// ProxyThroughAgent forwards stdio through the local proxy agent, returning
+// an AgentNotRunningError if there is no agent to connect to
+func ProxyThroughAgent(ctx context.Context, t *terminal.Terminal, nameOrID string, autoStart bool) error {
+	socketPath, err := files.GetProxyAgentSocketPath()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	req := proxyagent.ConnectRequest{WorkspaceID: nameOrID, AutoStart: autoStart}
+	conn, err := proxyagent.Connect(socketPath, req, t.Eprint)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer conn.Close() //nolint:errcheck // nothing to do once the stream is over
+
+	return pipeStdio(ctx, conn)
+}
+
+type halfCloser interface {
+	io.ReadWriteCloser
+	CloseWrite() error
+}
+
+// pipeStdio copies stdio to and from conn until the remote end is done or ctx
+// is canceled
+func pipeStdio(ctx context.Context, conn halfCloser) error {
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	go func() {
+		_, _ = io.Copy(conn, os.Stdin)
+		_ = conn.CloseWrite()
+	}()
+	_, err := io.Copy(os.Stdout, conn)
+	if ctx.Err() != nil {
+		return &huproxyclient.SessionEndedError{Reason: huproxyclient.CloseReasonCanceled, Err: ctx.Err()}
+	}
+	if err != nil {
+		return &huproxyclient.SessionEndedError{Reason: huproxyclient.CloseReasonNetwork, Err: err}
+	}
+	return nil
+}
+
+func Proxy(ctx context.Context, t *terminal.Terminal, store ProxyStore, auth huproxyclient.HubProxyAuth, nameOrID string, opts ProxyOptions) error {
+	matrix, err := compat.LoadDefaultMatrix()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	wp := NewWorkspaceProxy(store, *matrix, opts.StartTimeout)
+	workspace, err := wp.ResolveWorkspace(nameOrID)
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
 	}
 
-	err = CheckWorkspaceCanSSH(workspace)
+	if opts.AutoStart {
+		workspace, err = wp.EnsureWorkspaceRunning(ctx, workspace, t.Eprint)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+	}
+
+	strategy, err := wp.GetStrategy(workspace)
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
 	}
+	if strategy == compat.StrategyPortForward {
+		err = ProxyPortForward(ctx, store, workspace)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		return nil
+	}
 
 	err = WriteUserPrivateKey(store)
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
 	}
 
-	url := makeProxyURL(workspace)
-	err = huproxyclient.Run(url, store)
+	url := MakeProxyURL(workspace)
+	err = huproxyclient.Run(ctx, url, auth, opts.Options)
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
 	}
 	return nil
 }
 
-func makeProxyURL(w *entity.Workspace) string {
-	return fmt.Sprintf("wss://%s/proxy", w.GetSSHURL())
-}
-
-func CheckWorkspaceCanSSH(workspace *entity.Workspace) error {
-	allowedInfra, err := regexp.Match(allowedWorkspaceInfraVersion, []byte(workspace.Version))
+// ProxyPortForward forwards stdio to the workspace's ssh server through a k8s
+// port-forward, for workspaces that predate the proxy sidecar
+func ProxyPortForward(ctx context.Context, store ProxyStore, workspace *entity.Workspace) error {
+	workspaceGroupClientMapper, err := k8s.NewDefaultWorkspaceGroupClientMapper(store)
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
 	}
-	if !allowedInfra {
-		return fmt.Errorf("workspace of version %s is not supported with this cli version\n upgrade your workspace or downgrade your cli", workspace.Version)
+	err = store.WritePrivateKey(workspaceGroupClientMapper.GetPrivateKey())
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
 	}
-	allowedImage, err := regexp.Match(allowedWorkspaceImage, []byte(workspace.WorkspaceTemplate.Image))
+	workspaceMetaData, err := store.GetWorkspaceMetaData(workspace.ID)
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
 	}
-	if !allowedImage {
-		return fmt.Errorf("workspace image version %s is not supported with this cli version\n upgrade your workspace or downgrade your cli", workspace.WorkspaceTemplate.Image)
+
+	opts, err := portforward.NewPortForwardOptions(
+		workspaceGroupClientMapper,
+		portforward.NewDefaultPortForwarder(),
+	).WithWorkspace(entity.WorkspaceWithMeta{WorkspaceMetaData: *workspaceMetaData, Workspace: *workspace})
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
 	}
-	if workspace.Status != "RUNNING" {
-		return fmt.Errorf("workspace is not in RUNNING state, status: %s", workspace.Status)
+	conn, err := opts.DialPort(workspaceSSHPort)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
 	}
-	return nil
+	defer conn.Close() //nolint:errcheck // nothing to do once the stream is over
+
+	return pipeStdio(ctx, conn)
+}
+
+func MakeProxyURL(w *entity.Workspace) string {
+	return w.GetProxyURL()
 }
 
 func WriteUserPrivateKey(store ProxyStore) error {
@@ -1 +1,169 @@
 package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/compat"
+	"github.com/brevdev/brev-cli/pkg/entity"
+	"github.com/brevdev/brev-cli/pkg/proxyagent"
+	"github.com/brevdev/brev-cli/pkg/store"
+	resty "github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type dummyProxyStore struct {
+	releaseNotes string
+	workspaces   []entity.Workspace
+	statuses     []string // returned by successive GetWorkspace calls after a start
+	started      bool
+	getErr       error // returned by GetWorkspace for unknown ids instead of a 404
+}
+
+func (d *dummyProxyStore) GetWorkspace(workspaceID string) (*entity.Workspace, error) {
+	for _, w := range d.workspaces {
+		if w.ID == workspaceID {
+			if d.started && len(d.statuses) > 0 {
+				w.Status = d.statuses[0]
+				d.statuses = d.statuses[1:]
+			}
+			return &w, nil
+		}
+	}
+	if d.getErr != nil {
+		return nil, d.getErr
+	}
+	return nil, store.NewHTTPResponseError(&resty.Response{RawResponse: &http.Response{StatusCode: http.StatusNotFound}})
+}
+
+func (d *dummyProxyStore) GetWorkspaceMetaData(_ string) (*entity.WorkspaceMetaData, error) {
+	return &entity.WorkspaceMetaData{}, nil
+}
+
+func (d *dummyProxyStore) GetLatestReleaseMetadata() (*store.GithubReleaseMetadata, error) {
+	return &store.GithubReleaseMetadata{TagName: "v9.9.9", Body: d.releaseNotes}, nil
+}
+
+func (d *dummyProxyStore) GetContextWorkspaces() ([]entity.Workspace, error) {
+	return d.workspaces, nil
+}
+
+func (d *dummyProxyStore) StartWorkspace(_ string) (*entity.Workspace, error) {
+	d.started = true
+	return nil, nil
+}
+
+func (d *dummyProxyStore) WritePrivateKey(_ string) error {
+	return nil
+}
+
+func (d *dummyProxyStore) GetCurrentUserKeys() (*entity.UserKeys, error) {
+	return &entity.UserKeys{}, nil
+}
+
+var someWorkspaces = []entity.Workspace{
+	{ID: "id-1", Name: "my-ws", DNS: "test1-dns-org.brev.sh", Status: "STOPPED"},
+	{ID: "id-2", Name: "dup", DNS: "test2-dns-org.brev.sh", Status: "RUNNING"},
+	{ID: "id-3", Name: "dup", DNS: "test3-dns-org.brev.sh", Status: "RUNNING"},
+}
+
+func TestResolveWorkspace(t *testing.T) {
+	wp := NewWorkspaceProxy(&dummyProxyStore{workspaces: someWorkspaces}, compat.DefaultMatrix, time.Minute)
+
+	w, err := wp.ResolveWorkspace("id-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "id-1", w.ID)
+
+	w, err = wp.ResolveWorkspace("my-ws")
+	assert.Nil(t, err)
+	assert.Equal(t, "id-1", w.ID)
+
+	w, err = wp.ResolveWorkspace(string(someWorkspaces[2].GetLocalIdentifier(someWorkspaces)))
+	assert.Nil(t, err)
+	assert.Equal(t, "id-3", w.ID)
+
+	_, err = wp.ResolveWorkspace("dup")
+	assert.NotNil(t, err)
+
+	_, err = wp.ResolveWorkspace("nope")
+	assert.NotNil(t, err)
+}
+
+func TestResolveWorkspaceReturnsAPIErrors(t *testing.T) {
+	wp := NewWorkspaceProxy(&dummyProxyStore{workspaces: someWorkspaces, getErr: errors.New("unauthorized")}, compat.DefaultMatrix, time.Minute)
+	_, err := wp.ResolveWorkspace("my-ws")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unauthorized")
+}
+
+func TestEnsureWorkspaceRunning(t *testing.T) {
+	workspacePollInterval = time.Millisecond
+	store := &dummyProxyStore{workspaces: someWorkspaces, statuses: []string{"STARTING", "RUNNING"}}
+	wp := NewWorkspaceProxy(store, compat.DefaultMatrix, time.Minute)
+
+	var progress []string
+	w, err := wp.EnsureWorkspaceRunning(context.Background(), &someWorkspaces[0], func(p string) { progress = append(progress, p) })
+	assert.Nil(t, err)
+	assert.Equal(t, "RUNNING", w.Status)
+	assert.True(t, store.started)
+	assert.Len(t, progress, 4)
+}
+
+func TestEnsureWorkspaceRunningTimesOut(t *testing.T) {
+	workspacePollInterval = time.Millisecond
+	store := &dummyProxyStore{workspaces: someWorkspaces}
+	wp := NewWorkspaceProxy(store, compat.DefaultMatrix, 5*time.Millisecond)
+	_, err := wp.EnsureWorkspaceRunning(context.Background(), &someWorkspaces[0], func(string) {})
+	assert.NotNil(t, err)
+}
+
+func TestEnsureWorkspaceRunningCanceled(t *testing.T) {
+	workspacePollInterval = time.Hour
+	store := &dummyProxyStore{workspaces: someWorkspaces}
+	wp := NewWorkspaceProxy(store, compat.DefaultMatrix, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := wp.EnsureWorkspaceRunning(ctx, &someWorkspaces[0], func(string) {})
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestGetStrategy(t *testing.T) {
+	store := &dummyProxyStore{}
+	wp := NewWorkspaceProxy(store, compat.DefaultMatrix, time.Minute)
+
+	current := &entity.Workspace{Status: "RUNNING", Version: "v1.7.0", WorkspaceTemplate: entity.WorkspaceTemplate{Image: "brevdev/ubuntu-proxy:0.3.1"}}
+	strategy, err := wp.GetStrategy(current)
+	assert.Nil(t, err)
+	assert.Equal(t, compat.StrategyHuproxy, strategy)
+	assert.Nil(t, wp.CheckWorkspaceCanSSH(current))
+
+	legacy := &entity.Workspace{Status: "RUNNING", Version: "v1.6.2", WorkspaceTemplate: entity.WorkspaceTemplate{Image: "brevdev/ubuntu:0.1.0"}}
+	strategy, err = wp.GetStrategy(legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, compat.StrategyPortForward, strategy)
+	var directRequired *proxyagent.DirectRequiredError
+	assert.True(t, errors.As(wp.CheckWorkspaceCanSSH(legacy), &directRequired))
+
+	stopped := &entity.Workspace{Status: "STOPPED", Version: "v1.7.0", WorkspaceTemplate: entity.WorkspaceTemplate{Image: "brevdev/ubuntu-proxy:0.3.1"}}
+	_, err = wp.GetStrategy(stopped)
+	assert.NotNil(t, err)
+}
+
+func TestGetStrategyPointsAtRelease(t *testing.T) {
+	newer := &entity.Workspace{Status: "RUNNING", Version: "v1.8.0", WorkspaceTemplate: entity.WorkspaceTemplate{Image: "brevdev/ubuntu-proxy:0.4.0"}}
+
+	wp := NewWorkspaceProxy(&dummyProxyStore{}, compat.DefaultMatrix, time.Minute)
+	_, err := wp.GetStrategy(newer)
+	var cliTooOld *compat.CLITooOldError
+	assert.True(t, errors.As(err, &cliTooOld))
+	assert.Equal(t, "", cliTooOld.UpgradeTo)
+
+	notes := "```brev-compatibility\n{\"rules\":[{\"strategy\":\"huproxy\",\"infraVersion\":\"1.8.x\",\"image\":\"brevdev/ubuntu-proxy\",\"imageVersion\":\"0.4.x\"}]}\n```"
+	wp = NewWorkspaceProxy(&dummyProxyStore{releaseNotes: notes}, compat.DefaultMatrix, time.Minute)
+	_, err = wp.GetStrategy(newer)
+	assert.True(t, errors.As(err, &cliTooOld))
+	assert.Equal(t, "v9.9.9", cliTooOld.UpgradeTo)
+}
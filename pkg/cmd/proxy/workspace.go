@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/compat"
+	"github.com/brevdev/brev-cli/pkg/entity"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/proxyagent"
+	"github.com/brevdev/brev-cli/pkg/store"
+)
+
+const DefaultStartTimeout = 10 * time.Minute
+
+var workspacePollInterval = 5 * time.Second
+
+// WorkspaceProxy exposes the connection rules of this package to the proxy agent
+type WorkspaceProxy struct {
+	store        ProxyStore
+	matrix       compat.Matrix
+	startTimeout time.Duration
+}
+
+var _ proxyagent.WorkspaceProxy = WorkspaceProxy{}
+
+func NewWorkspaceProxy(store ProxyStore, matrix compat.Matrix, startTimeout time.Duration) *WorkspaceProxy {
+	return &WorkspaceProxy{
+		store:        store,
+		matrix:       matrix,
+		startTimeout: startTimeout,
+	}
+}
+
+// GetStrategy returns how to connect to the workspace, or why it can not be
+// connected to right now
+func (wp WorkspaceProxy) GetStrategy(workspace *entity.Workspace) (compat.Strategy, error) {
+	strategy, err := wp.matrix.Check(workspace)
+	if err != nil {
+		return "", wp.withUpgradeTarget(workspace, err)
+	}
+	if workspace.Status != "RUNNING" {
+		return "", fmt.Errorf("workspace is not in RUNNING state, status: %s", workspace.Status)
+	}
+	return strategy, nil
+}
+
+// CheckWorkspaceCanSSH tells the proxy agent to send clients elsewhere for
+// workspaces that are not reached through huproxy
+func (wp WorkspaceProxy) CheckWorkspaceCanSSH(workspace *entity.Workspace) error {
+	strategy, err := wp.GetStrategy(workspace)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if strategy != compat.StrategyHuproxy {
+		return &proxyagent.DirectRequiredError{Reason: fmt.Sprintf("workspace is reached by %s", strategy)}
+	}
+	return nil
+}
+
+// withUpgradeTarget names the latest release in the error if the matrix it
+// publishes supports the workspace
+func (wp WorkspaceProxy) withUpgradeTarget(workspace *entity.Workspace, err error) error {
+	var cliTooOld *compat.CLITooOldError
+	if !errors.As(err, &cliTooOld) {
+		return err
+	}
+	release, releaseErr := wp.store.GetLatestReleaseMetadata()
+	if releaseErr != nil {
+		return err
+	}
+	matrix, ok := compat.MatrixFromReleaseNotes(release.Body)
+	if !ok {
+		return err
+	}
+	if _, checkErr := matrix.Check(workspace); checkErr == nil {
+		cliTooOld.UpgradeTo = release.TagName
+	}
+	return err
+}
+
+func (wp WorkspaceProxy) MakeProxyURL(workspace *entity.Workspace) string {
+	return MakeProxyURL(workspace)
+}
+
+// ResolveWorkspace accepts a workspace id, a local alias as written in the
+// brev ssh config, or a workspace name. Ids are tried first since that is what
+// the generated ssh config uses, only a 404 falls through to the aliases and
+// names.
+func (wp WorkspaceProxy) ResolveWorkspace(nameOrID string) (*entity.Workspace, error) {
+	workspace, err := wp.store.GetWorkspace(nameOrID)
+	if err != nil && !store.IsNotFoundError(err) {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	if err == nil && workspace != nil && workspace.ID != "" {
+		return workspace, nil
+	}
+
+	workspaces, err := wp.store.GetContextWorkspaces()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+
+	for i, w := range workspaces {
+		if w.DNS == "" {
+			continue // no alias until the workspace has dns
+		}
+		if string(w.GetLocalIdentifier(workspaces)) == nameOrID {
+			return &workspaces[i], nil
+		}
+	}
+
+	var matches []entity.Workspace
+	for _, w := range workspaces {
+		if w.Name == nameOrID {
+			matches = append(matches, w)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no workspaces found with name, alias or id %s", nameOrID)
+	case 1:
+		return &matches[0], nil
+	default:
+		return nil, fmt.Errorf("multiple workspaces found with name %s\n\nuse the workspace id or alias instead", nameOrID)
+	}
+}
+
+// EnsureWorkspaceRunning starts a stopped workspace and waits until it is
+// running or ctx is done, reporting status changes to progress
+func (wp WorkspaceProxy) EnsureWorkspaceRunning(ctx context.Context, workspace *entity.Workspace, progress func(string)) (*entity.Workspace, error) {
+	deadline := time.Now().Add(wp.startTimeout)
+	started := false
+	lastStatus := ""
+	for {
+		if workspace.Status != lastStatus {
+			progress(fmt.Sprintf("workspace %s is %s", workspace.Name, workspace.Status))
+			lastStatus = workspace.Status
+		}
+		switch workspace.Status {
+		case "RUNNING":
+			return workspace, nil
+		case "STOPPED":
+			if !started {
+				progress(fmt.Sprintf("starting workspace %s, this can take a few minutes...", workspace.Name))
+				_, err := wp.store.StartWorkspace(workspace.ID)
+				if err != nil {
+					return nil, breverrors.WrapAndTrace(err)
+				}
+				started = true
+			}
+		case "FAILURE", "DELETING":
+			return nil, fmt.Errorf("workspace %s can not be started, status: %s", workspace.Name, workspace.Status)
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out after %s waiting for workspace %s to start, status: %s", wp.startTimeout, workspace.Name, workspace.Status)
+		}
+		timer := time.NewTimer(workspacePollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, breverrors.WrapAndTrace(ctx.Err())
+		case <-timer.C:
+		}
+
+		var err error
+		workspace, err = wp.store.GetWorkspace(workspace.ID)
+		if err != nil {
+			return nil, breverrors.WrapAndTrace(err)
+		}
+	}
+}
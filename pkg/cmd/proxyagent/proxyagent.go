@@ -0,0 +1,80 @@
+// Package proxyagent runs the local agent that brev proxy connects through
+package proxyagent
+
+import (
+	"github.com/brevdev/brev-cli/pkg/cmd/proxy"
+	"github.com/brevdev/brev-cli/pkg/compat"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
+	"github.com/brevdev/brev-cli/pkg/huproxyclient"
+	"github.com/brevdev/brev-cli/pkg/proxyagent"
+	"github.com/brevdev/brev-cli/pkg/terminal"
+	"github.com/spf13/cobra"
+)
+
+type ProxyAgentStore interface {
+	proxyagent.AgentStore
+	proxy.ProxyStore
+}
+
+func NewCmdProxyAgent(t *terminal.Terminal, store ProxyAgentStore, auth huproxyclient.HubProxyAuth) *cobra.Command {
+	var detached bool
+	opts := proxy.ProxyOptions{
+		Options:      huproxyclient.DefaultOptions(),
+		StartTimeout: proxy.DefaultStartTimeout,
+	}
+
+	cmd := &cobra.Command{
+		Annotations:           map[string]string{"housekeeping": ""},
+		Use:                   "proxy-agent",
+		DisableFlagsInUseLine: true,
+		Short:                 "Run a local agent that speeds up ssh connections",
+		Long:                  "Run a local agent that caches workspace lookups and keeps warm connections so that ssh to a workspace connects quickly. brev proxy uses it automatically when it is running and connects directly otherwise.",
+		Example:               "brev proxy-agent -d",
+		Args:                  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := RunProxyAgent(t, store, auth, opts, detached)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVarP(&detached, "detached", "d", false, "run the command in the background instead of blocking the shell")
+	cmd.Flags().DurationVar(&opts.DialTimeout, "dial-timeout", opts.DialTimeout, "timeout for each attempt to connect to a workspace")
+	cmd.Flags().DurationVar(&opts.StartTimeout, "start-timeout", opts.StartTimeout, "how long to wait for workspaces started by brev proxy --auto-start")
+
+	return cmd
+}
+
+func RunProxyAgent(_ *terminal.Terminal, store ProxyAgentStore, auth huproxyclient.HubProxyAuth, opts proxy.ProxyOptions, detached bool) error {
+	matrix, err := compat.LoadDefaultMatrix()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	agent := proxyagent.NewAgent(store, auth, proxy.NewWorkspaceProxy(store, *matrix, opts.StartTimeout), opts.Options)
+	socketPath, err := files.GetProxyAgentSocketPath()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if detached {
+		home, err := files.GetBrevHome()
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		err = agent.RunAsDaemon(socketPath, home)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		return nil
+	}
+	err = files.MakeBrevHome()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = agent.Run(socketPath)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
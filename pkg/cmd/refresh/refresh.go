@@ -2,11 +2,15 @@
 package refresh
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/brevdev/brev-cli/pkg/cmdcontext"
+	"github.com/brevdev/brev-cli/pkg/dockercontext"
 	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
 	"github.com/brevdev/brev-cli/pkg/ssh"
+	"github.com/brevdev/brev-cli/pkg/tasks"
 	"github.com/brevdev/brev-cli/pkg/terminal"
 
 	"github.com/spf13/cobra"
@@ -15,6 +19,7 @@ import (
 type RefreshStore interface {
 	ssh.ConfigUpdaterStore
 	ssh.SSHConfigurerV2Store
+	ssh.JetBrainsGatewayConfigurerStore
 }
 
 func NewCmdRefresh(t *terminal.Terminal, store RefreshStore) *cobra.Command {
@@ -22,7 +27,7 @@ func NewCmdRefresh(t *terminal.Terminal, store RefreshStore) *cobra.Command {
 		Annotations: map[string]string{"housekeeping": ""},
 		Use:         "refresh",
 		Short:       "Force a refresh to the ssh config",
-		Long:        "Force a refresh to the ssh config",
+		Long:        "Force a refresh to the ssh config. If the brev run-tasks daemon is running it does the refresh.",
 		Example:     `brev refresh`,
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 			err := cmdcontext.InvokeParentPersistentPreRun(cmd, args)
@@ -43,20 +48,52 @@ func NewCmdRefresh(t *terminal.Terminal, store RefreshStore) *cobra.Command {
 
 func refresh(t *terminal.Terminal, store RefreshStore) error {
 	fmt.Println("refreshing brev...")
+	err := refreshWithDaemon()
+	var notRunning *tasks.DaemonNotRunningError
+	if errors.As(err, &notRunning) {
+		err = refreshInProcess(store)
+	}
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	t.Vprintf(t.Green("\nbrev has been refreshed\n"))
+
+	return nil
+}
+
+// refreshWithDaemon has the run-tasks daemon update the configs, so they are
+// not written by two processes at once
+func refreshWithDaemon() error {
+	socketPath, err := files.GetDaemonSocketPath()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = tasks.TriggerTask(socketPath, ssh.ConfigUpdaterTaskName, true)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func refreshInProcess(store RefreshStore) error {
+	dockerContexts, err := dockercontext.NewDefaultConfigurer()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
 	cu := ssh.ConfigUpdater{
 		Store: store,
 		Configs: []ssh.Config{
 			ssh.NewSSHConfigurerV2(
 				store,
 			),
+			dockerContexts,
+			ssh.NewJetBrainsGatewayConfigurer(store),
 		},
 	}
 
-	err := cu.Run()
+	err = cu.Run()
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
 	}
-	t.Vprintf(t.Green("\nbrev has been refreshed\n"))
-
 	return nil
 }
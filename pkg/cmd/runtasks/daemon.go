@@ -0,0 +1,390 @@
+package runtasks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
+	"github.com/brevdev/brev-cli/pkg/huproxyclient"
+	"github.com/brevdev/brev-cli/pkg/tasks"
+	"github.com/brevdev/brev-cli/pkg/terminal"
+	"github.com/spf13/cobra"
+)
+
+// followInterval is how often logs -f checks the log for new lines
+const followInterval = 500 * time.Millisecond
+
+func newCmdStatus(t *terminal.Terminal) *cobra.Command {
+	return &cobra.Command{
+		Use:                   "status",
+		DisableFlagsInUseLine: true,
+		Short:                 "Show whether the daemon is running and what its tasks are doing",
+		Args:                  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			home, err := files.GetBrevHome()
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			_, unit, err := getSystemdStatus()
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			status := tasks.GetDaemonStatus(home)
+			if unit.Installed {
+				t.Vprint(formatUnitStatus(t, unit))
+			}
+			if !unit.Installed || status.Running {
+				t.Vprint(formatStatus(t, status, home))
+			}
+			if !status.Running && !unit.IsActive() {
+				return nil
+			}
+			socketPath, err := files.GetDaemonSocketPath()
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			statuses, err := tasks.ListTasks(socketPath)
+			if err != nil {
+				t.Vprint(t.Yellow("\ncould not list the daemon's tasks, restart it with brev run-tasks restart if it predates the daemon api: %v", err))
+				return nil
+			}
+			t.Vprint("\n" + formatTasks(statuses, time.Now()))
+			return nil
+		},
+	}
+}
+
+func formatTasks(statuses []tasks.TaskStatus, now time.Time) string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "TASK\tSCHEDULE\tRUNS\tFAILURES\tLAST RUN\tDURATION\tLAST ERROR")
+	for _, s := range statuses {
+		lastRun, duration := "-", "-"
+		if s.Running {
+			lastRun = "running"
+		} else if s.Runs > 0 {
+			lastRun = now.Sub(s.LastRun).Round(time.Second).String() + " ago"
+			duration = s.LastDuration.Round(time.Millisecond).String()
+		}
+		lastError := firstLine(s.LastError)
+		if s.RetryAt.After(now) {
+			lastError = fmt.Sprintf("%s (%d in a row, retrying in %s)", lastError, s.ConsecutiveFailures, s.RetryAt.Sub(now).Round(time.Second))
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\t%s\n", s.Name, dash(s.Cron), s.Runs, s.Failures, lastRun, duration, dash(lastError))
+	}
+	_ = w.Flush()
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// firstLine keeps wrapped errors, which span several lines, on one row
+func firstLine(s string) string {
+	return strings.TrimSpace(strings.SplitN(s, "\n", 2)[0])
+}
+
+func newCmdTrigger(t *terminal.Terminal) *cobra.Command {
+	var noWait bool
+
+	cmd := &cobra.Command{
+		Use:                   "trigger <task>",
+		DisableFlagsInUseLine: true,
+		Short:                 "Have the daemon run a task now",
+		Long:                  "Have the daemon run a task now instead of on its next scheduled run. brev run-tasks status lists the tasks.",
+		Example:               "brev run-tasks trigger ssh-config",
+		Args:                  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			socketPath, err := files.GetDaemonSocketPath()
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			err = tasks.TriggerTask(socketPath, args[0], !noWait)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			if noWait {
+				t.Vprintf("triggered %s\n", args[0])
+			} else {
+				t.Vprint(t.Green("ran %s", args[0]))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&noWait, "no-wait", false, "return once the task started instead of once it ran")
+	return cmd
+}
+
+func newCmdEvents(t *terminal.Terminal) *cobra.Command {
+	return &cobra.Command{
+		Use:                   "events",
+		DisableFlagsInUseLine: true,
+		Short:                 "Print the daemon's task runs as they happen",
+		Args:                  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			socketPath, err := files.GetDaemonSocketPath()
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer cancel()
+			err = tasks.SubscribeEvents(ctx, socketPath, func(e tasks.Event) {
+				t.Vprint(formatEvent(t, e))
+			})
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+}
+
+func formatEvent(t *terminal.Terminal, e tasks.Event) string {
+	line := fmt.Sprintf("%s %s %s", e.Time.Format(time.RFC3339), e.Task, e.Type)
+	if e.Type != tasks.EventFinished {
+		return line
+	}
+	line += fmt.Sprintf(" in %s", e.Duration.Round(time.Millisecond))
+	if e.Error != "" {
+		return line + ": " + t.Red(firstLine(e.Error))
+	}
+	return line
+}
+
+func formatStatus(t *terminal.Terminal, status tasks.DaemonStatus, home string) string {
+	var state string
+	switch {
+	case status.Running:
+		state = fmt.Sprintf("%s [pid=%d]", t.Green("running"), status.PID)
+	case status.Stale:
+		state = fmt.Sprintf("%s, the pid file of daemon %d is stale, start it with brev run-tasks -d", t.Red("not running"), status.PID)
+	default:
+		state = fmt.Sprintf("%s, start it with brev run-tasks -d", t.Yellow("not running"))
+	}
+	return fmt.Sprintf("%s\npid file: %s\nlog file: %s", state, tasks.GetDaemonPidFilePath(home), tasks.GetDaemonLogFilePath(home))
+}
+
+func newCmdStop(t *terminal.Terminal) *cobra.Command {
+	return &cobra.Command{
+		Use:                   "stop",
+		DisableFlagsInUseLine: true,
+		Short:                 "Stop the daemon",
+		Args:                  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			svc, unit, err := getSystemdStatus()
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			if unit.IsActive() {
+				err = svc.Stop()
+				if err != nil {
+					return breverrors.WrapAndTrace(err)
+				}
+				t.Vprintf("stopped %s, it starts again when you next log in unless removed with brev run-tasks uninstall\n", tasks.SystemdUnitName)
+				return nil
+			}
+			home, err := files.GetBrevHome()
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			pid, err := tasks.StopDaemon(home, tasks.DaemonStopTimeout)
+			if errors.Is(err, tasks.ErrDaemonNotRunning) {
+				t.Vprint("the daemon is not running")
+				return nil
+			}
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			t.Vprintf("stopped the daemon [pid=%d]\n", pid)
+			return nil
+		},
+	}
+}
+
+func newCmdRestart(t *terminal.Terminal, store RunTasksStore, auth huproxyclient.HubProxyAuth) *cobra.Command {
+	return &cobra.Command{
+		Use:                   "restart",
+		DisableFlagsInUseLine: true,
+		Short:                 "Restart the daemon, for example after upgrading brev",
+		Args:                  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			svc, unit, err := getSystemdStatus()
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			if unit.Installed {
+				err = svc.Restart()
+				if err != nil {
+					return breverrors.WrapAndTrace(err)
+				}
+				t.Vprintf("restarted %s\n", tasks.SystemdUnitName)
+				return nil
+			}
+			ts, err := getDefaultTasks(store, auth)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			home, err := files.GetBrevHome()
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			err = tasks.RestartDaemon(ts, home)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+}
+
+func newCmdLogs() *cobra.Command {
+	var follow bool
+	var lines int
+
+	cmd := &cobra.Command{
+		Use:                   "logs",
+		DisableFlagsInUseLine: true,
+		Short:                 "Print the daemon's log",
+		Example:               "brev run-tasks logs -n 100\nbrev run-tasks logs -f",
+		Args:                  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, unit, err := getSystemdStatus()
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			if unit.Installed {
+				_, _ = fmt.Fprintf(cmd.ErrOrStderr(), "the systemd service logs to the journal, read it with journalctl --user -u %s\n", tasks.SystemdUnitName)
+			}
+			home, err := files.GetBrevHome()
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			path := tasks.GetDaemonLogFilePath(home)
+			offset, err := printLastLines(cmd.OutOrStdout(), path, lines)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			if !follow {
+				return nil
+			}
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer cancel()
+			err = followLog(ctx, cmd.OutOrStdout(), path, offset, followInterval)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVarP(&follow, "follow", "f", false, "keep printing new lines as they are logged")
+	cmd.Flags().IntVarP(&lines, "lines", "n", 50, "number of lines to print, -1 for all")
+	return cmd
+}
+
+// printLastLines prints the last n lines of the log and returns the offset
+// its end is at
+func printLastLines(w io.Writer, path string, n int) (int64, error) {
+	b, err := os.ReadFile(path) //nolint:gosec // the daemon's own log
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, breverrors.WrapAndTrace(err)
+	}
+	out := b
+	if n >= 0 {
+		out = lastLines(b, n)
+	}
+	_, err = w.Write(out)
+	if err != nil {
+		return 0, breverrors.WrapAndTrace(err)
+	}
+	return int64(len(b)), nil
+}
+
+func lastLines(b []byte, n int) []byte {
+	if n == 0 {
+		return nil
+	}
+	end := len(b)
+	if end > 0 && b[end-1] == '\n' {
+		end--
+	}
+	for i := 0; i < n; i++ {
+		j := bytes.LastIndexByte(b[:end], '\n')
+		if j < 0 {
+			return b
+		}
+		end = j
+	}
+	return b[end+1:]
+}
+
+// followLog prints what is written to the log after offset until ctx is
+// done. When the log is rotated it starts again from its beginning.
+func followLog(ctx context.Context, w io.Writer, path string, offset int64, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		var err error
+		offset, err = copyFrom(w, path, offset)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+	}
+}
+
+func copyFrom(w io.Writer, path string, offset int64) (int64, error) {
+	f, err := os.Open(path) //nolint:gosec // the daemon's own log
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return offset, breverrors.WrapAndTrace(err)
+	}
+	defer f.Close() //nolint:errcheck // read only
+	info, err := f.Stat()
+	if err != nil {
+		return offset, breverrors.WrapAndTrace(err)
+	}
+	if info.Size() < offset {
+		offset = 0
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return offset, breverrors.WrapAndTrace(err)
+	}
+	n, err := io.Copy(w, f)
+	if err != nil {
+		return offset, breverrors.WrapAndTrace(err)
+	}
+	return offset + n, nil
+}
+
+// WarnIfDaemonNotRunning tells the user to start the daemon, what is what
+// the daemon does for the command, e.g. "forwards are run"
+func WarnIfDaemonNotRunning(t *terminal.Terminal, what string) {
+	home, err := files.GetBrevHome()
+	if err != nil || tasks.IsDaemonRunning(home) {
+		return
+	}
+	t.Vprint(t.Yellow("%s by the run-tasks daemon, which is not running. Start it with %s", what, t.Green("brev run-tasks -d")))
+}
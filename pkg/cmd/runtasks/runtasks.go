@@ -1,15 +1,21 @@
 package runtasks
 
 import (
+	"os"
+
+	"github.com/brevdev/brev-cli/pkg/dockercontext"
 	"github.com/brevdev/brev-cli/pkg/errors"
 	"github.com/brevdev/brev-cli/pkg/files"
+	"github.com/brevdev/brev-cli/pkg/filesync"
+	"github.com/brevdev/brev-cli/pkg/forwards"
+	"github.com/brevdev/brev-cli/pkg/huproxyclient"
 	"github.com/brevdev/brev-cli/pkg/ssh"
 	"github.com/brevdev/brev-cli/pkg/tasks"
 	"github.com/brevdev/brev-cli/pkg/terminal"
 	"github.com/spf13/cobra"
 )
 
-func NewCmdRunTasks(t *terminal.Terminal, store RunTasksStore) *cobra.Command {
+func NewCmdRunTasks(t *terminal.Terminal, store RunTasksStore, auth huproxyclient.HubProxyAuth) *cobra.Command {
 	var detached bool
 
 	cmd := &cobra.Command{
@@ -17,17 +23,25 @@ func NewCmdRunTasks(t *terminal.Terminal, store RunTasksStore) *cobra.Command {
 		Use:                   "run-tasks",
 		DisableFlagsInUseLine: true,
 		Short:                 "Run tasks keeps the ssh config up to date.",
-		Long:                  "Run tasks keeps the ssh config up to date. Run with -d to run as a detached daemon in the background. To force a refresh to your config use the refresh command.",
-		Example:               "brev run-tasks -d",
+		Long:                  "Run tasks keeps the ssh config and the docker contexts created with brev docker-context up to date, and runs the port forwards added with brev forward and the syncs added with brev sync --daemon. Run with -d to run as a detached daemon in the background, or install it as a systemd user service with brev run-tasks install --systemd, and manage it with the status, stop, restart and logs subcommands. The daemon serves a local api on ~/.brev/daemon.sock that the trigger and events subcommands and commands such as brev start and brev stop use. To force a refresh to your config use the refresh command.",
+		Example:               "brev run-tasks -d\nbrev run-tasks status\nbrev run-tasks logs -f\nbrev run-tasks trigger ssh-config\nbrev run-tasks install --systemd",
 		Args:                  cobra.ExactArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
-			err := RunTasks(t, store, detached)
+			err := RunTasks(t, store, auth, detached)
 			if err != nil {
 				t.Vprint(t.Red(err.Error()))
 			}
 		},
 	}
 	cmd.Flags().BoolVarP(&detached, "detached", "d", false, "run the command in the background instead of blocking the shell")
+	cmd.AddCommand(newCmdStatus(t))
+	cmd.AddCommand(newCmdStop(t))
+	cmd.AddCommand(newCmdRestart(t, store, auth))
+	cmd.AddCommand(newCmdLogs())
+	cmd.AddCommand(newCmdTrigger(t))
+	cmd.AddCommand(newCmdEvents(t))
+	cmd.AddCommand(newCmdInstall(t))
+	cmd.AddCommand(newCmdUninstall(t))
 
 	return cmd
 }
@@ -35,16 +49,33 @@ func NewCmdRunTasks(t *terminal.Terminal, store RunTasksStore) *cobra.Command {
 type RunTasksStore interface {
 	ssh.ConfigUpdaterStore
 	ssh.SSHConfigurerV2Store
+	ssh.JetBrainsGatewayConfigurerStore
+	forwards.ManagerStore
+	filesync.ManagerStore
 }
 
-func RunTasks(_ *terminal.Terminal, store RunTasksStore, detached bool) error {
-	ts := getDefaultTasks(store)
+func RunTasks(t *terminal.Terminal, store RunTasksStore, auth huproxyclient.HubProxyAuth, detached bool) error {
+	// the service itself must not bail out on finding the service active
+	if os.Getenv(tasks.SystemdServiceEnv) == "" {
+		_, unit, err := getSystemdStatus()
+		if err != nil {
+			return errors.WrapAndTrace(err)
+		}
+		if unit.IsActive() {
+			t.Vprintf("the daemon runs as the systemd service %s, see brev run-tasks status\n", tasks.SystemdUnitName)
+			return nil
+		}
+	}
+	ts, err := getDefaultTasks(store, auth)
+	if err != nil {
+		return errors.WrapAndTrace(err)
+	}
 	home, err := files.GetBrevHome()
 	if err != nil {
 		return errors.WrapAndTrace(err)
 	}
 	if detached {
-		err := tasks.RunTaskAsDaemon(ts, home)
+		err = tasks.RunTaskAsDaemon(ts, home)
 		if err != nil {
 			return errors.WrapAndTrace(err)
 		}
@@ -57,14 +88,30 @@ func RunTasks(_ *terminal.Terminal, store RunTasksStore, detached bool) error {
 	return nil
 }
 
-func getDefaultTasks(store RunTasksStore) []tasks.Task {
+func getDefaultTasks(store RunTasksStore, auth huproxyclient.HubProxyAuth) ([]tasks.Task, error) {
+	dockerContexts, err := dockercontext.NewDefaultConfigurer()
+	if err != nil {
+		return nil, errors.WrapAndTrace(err)
+	}
 	cu := ssh.ConfigUpdater{
 		Store: store,
 		Configs: []ssh.Config{
 			ssh.NewSSHConfigurerV2(
 				store,
 			),
+			dockerContexts,
+			ssh.NewJetBrainsGatewayConfigurer(store),
 		},
 	}
-	return []tasks.Task{cu}
+	forwardsConfig, err := forwards.NewDefaultStore()
+	if err != nil {
+		return nil, errors.WrapAndTrace(err)
+	}
+	fm := forwards.NewManager(forwardsConfig, store, forwards.NewDefaultForwarder(store, auth))
+	syncsConfig, err := filesync.NewDefaultStore()
+	if err != nil {
+		return nil, errors.WrapAndTrace(err)
+	}
+	sm := filesync.NewManager(syncsConfig, store, filesync.NewSSHConnector(store, auth))
+	return []tasks.Task{cu, fm, sm}, nil
 }
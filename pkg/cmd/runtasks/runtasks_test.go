@@ -1 +1,62 @@
 package runtasks
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLastLines(t *testing.T) {
+	log := []byte("a\nb\nc\n")
+	assert.Equal(t, "b\nc\n", string(lastLines(log, 2)))
+	assert.Equal(t, "a\nb\nc\n", string(lastLines(log, 5)))
+	assert.Equal(t, "", string(lastLines(log, 0)))
+	assert.Equal(t, "b\nc", string(lastLines([]byte("a\nb\nc"), 2)))
+}
+
+func TestCopyFromFollowsRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "task_daemon.log")
+	var out bytes.Buffer
+	offset, err := printLastLines(&out, path, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), offset)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("one\ntwo\n"), 0o644))
+	offset, err = printLastLines(&out, path, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "two\n", out.String())
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("one\ntwo\nthree\n"), 0o644))
+	out.Reset()
+	offset, err = copyFrom(&out, path, offset)
+	assert.Nil(t, err)
+	assert.Equal(t, "three\n", out.String())
+
+	// rotated
+	assert.Nil(t, ioutil.WriteFile(path, []byte("four\n"), 0o644))
+	out.Reset()
+	offset, err = copyFrom(&out, path, offset)
+	assert.Nil(t, err)
+	assert.Equal(t, "four\n", out.String())
+	assert.Equal(t, int64(5), offset)
+}
+
+func TestFormatTasks(t *testing.T) {
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	out := formatTasks([]tasks.TaskStatus{
+		{Name: "ssh-config", Cron: "@every 3s", Runs: 4, LastRun: now.Add(-2 * time.Second), LastDuration: 120 * time.Millisecond},
+		{Name: "forwards", Cron: "@every 10s", Running: true, Runs: 1, Failures: 1, LastError: "[error] manager.go:10\n\t: refused"},
+		{Name: "syncs", Cron: "@every 10s", Runs: 3, Failures: 2, LastRun: now.Add(-time.Minute), LastError: "refused", ConsecutiveFailures: 2, RetryAt: now.Add(20 * time.Second)},
+		{Name: "once"},
+	}, now)
+	assert.Equal(t, `TASK         SCHEDULE     RUNS   FAILURES   LAST RUN   DURATION   LAST ERROR
+ssh-config   @every 3s    4      0          2s ago     120ms      -
+forwards     @every 10s   1      1          running    -          [error] manager.go:10
+syncs        @every 10s   3      2          1m0s ago   0s         refused (2 in a row, retrying in 20s)
+once         -            0      0          -          -          -`, out)
+}
@@ -0,0 +1,148 @@
+package runtasks
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
+	"github.com/brevdev/brev-cli/pkg/tasks"
+	"github.com/brevdev/brev-cli/pkg/terminal"
+	"github.com/spf13/cobra"
+)
+
+func newCmdInstall(t *terminal.Terminal) *cobra.Command {
+	var systemd bool
+
+	cmd := &cobra.Command{
+		Use:                   "install",
+		DisableFlagsInUseLine: true,
+		Short:                 "Run the daemon as a service that starts when you log in",
+		Long:                  "Install the daemon as the systemd user service " + tasks.SystemdUnitName + ", which runs brev run-tasks in the foreground and restarts it if it fails. It replaces a daemon started with brev run-tasks -d. User services stop when you log out unless lingering is enabled with loginctl enable-linger.",
+		Example:               "brev run-tasks install --systemd",
+		Args:                  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !systemd {
+				return fmt.Errorf("pass --systemd, systemd user services are the only supported service manager")
+			}
+			if runtime.GOOS != "linux" {
+				return fmt.Errorf("systemd services are only supported on linux, run the daemon with brev run-tasks -d instead")
+			}
+			svc, err := tasks.NewDefaultSystemdService()
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			exe, err := getExecutable()
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			home, err := files.GetBrevHome()
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			pid, err := tasks.StopDaemon(home, tasks.DaemonStopTimeout)
+			if err == nil {
+				t.Vprintf("stopped the daemon started with brev run-tasks -d [pid=%d]\n", pid)
+			} else if !errors.Is(err, tasks.ErrDaemonNotRunning) {
+				return breverrors.WrapAndTrace(err)
+			}
+			err = svc.Install(exe)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			t.Vprint(t.Green("installed and started %s", tasks.SystemdUnitName))
+			t.Vprintf("unit file: %s\nlogs: journalctl --user -u %s\n", svc.UnitPath(), tasks.SystemdUnitName)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&systemd, "systemd", false, "install a systemd user service")
+	return cmd
+}
+
+func newCmdUninstall(t *terminal.Terminal) *cobra.Command {
+	return &cobra.Command{
+		Use:                   "uninstall",
+		DisableFlagsInUseLine: true,
+		Short:                 "Stop and remove the service brev run-tasks install created",
+		Args:                  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			svc, err := tasks.NewDefaultSystemdService()
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			err = svc.Uninstall()
+			if errors.Is(err, tasks.ErrSystemdServiceNotInstalled) {
+				t.Vprint("the systemd service is not installed")
+				return nil
+			}
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			t.Vprintf("removed %s\n", tasks.SystemdUnitName)
+			return nil
+		},
+	}
+}
+
+// getExecutable is the brev the service runs. It prefers the brev on the
+// PATH if it is this binary, since that is usually a symlink that keeps
+// pointing at brev across upgrades while the binary's own path changes.
+func getExecutable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	onPath, err := exec.LookPath("brev")
+	if err != nil {
+		return exe, nil
+	}
+	onPath, err = filepath.Abs(onPath)
+	if err != nil {
+		return exe, nil
+	}
+	if isSameFile(onPath, exe) {
+		return onPath, nil
+	}
+	return exe, nil
+}
+
+func isSameFile(a, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
+
+func getSystemdStatus() (*tasks.SystemdService, tasks.SystemdStatus, error) {
+	svc, err := tasks.NewDefaultSystemdService()
+	if err != nil {
+		return nil, tasks.SystemdStatus{}, breverrors.WrapAndTrace(err)
+	}
+	status, err := svc.Status()
+	if err != nil {
+		return nil, tasks.SystemdStatus{}, breverrors.WrapAndTrace(err)
+	}
+	return svc, status, nil
+}
+
+func formatUnitStatus(t *terminal.Terminal, status tasks.SystemdStatus) string {
+	var state string
+	switch status.Active {
+	case "active":
+		state = t.Green(status.Active)
+	case "activating", "reloading":
+		state = t.Yellow(status.Active)
+	default:
+		state = t.Red(status.Active)
+	}
+	return fmt.Sprintf("%s as the systemd service %s [%s]\nunit file: %s\nlogs: journalctl --user -u %s", state, tasks.SystemdUnitName, status.Enabled, status.UnitPath, tasks.SystemdUnitName)
+}
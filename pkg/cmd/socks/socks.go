@@ -0,0 +1,137 @@
+// Package socks runs a local proxy that reaches the network of a workspace
+package socks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/brevdev/brev-cli/pkg/cmd/completions"
+	"github.com/brevdev/brev-cli/pkg/cmd/proxy"
+	"github.com/brevdev/brev-cli/pkg/compat"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/huproxyclient"
+	"github.com/brevdev/brev-cli/pkg/portforward"
+	"github.com/brevdev/brev-cli/pkg/socks"
+	"github.com/brevdev/brev-cli/pkg/terminal"
+	"github.com/hashicorp/go-multierror"
+	"github.com/spf13/cobra"
+)
+
+type SocksStore interface {
+	proxy.ProxyStore
+	completions.CompletionStore
+}
+
+type socksOptions struct {
+	listen     string
+	httpListen string
+	quiet      bool
+}
+
+func NewCmdSocks(t *terminal.Terminal, store SocksStore, auth huproxyclient.HubProxyAuth) *cobra.Command {
+	var opts socksOptions
+
+	cmd := &cobra.Command{
+		Annotations:           map[string]string{"ssh": ""},
+		Use:                   "socks <workspace>",
+		DisableFlagsInUseLine: true,
+		Short:                 "Proxy connections through a workspace",
+		Long:                  "Run a local SOCKS5 proxy, and optionally an HTTP CONNECT proxy, that opens every connection from the workspace over ssh. Use it to reach services that are only reachable from the workspace's cluster network.",
+		Example:               "brev socks my-ws --listen 127.0.0.1:1080\ncurl --socks5-hostname 127.0.0.1:1080 http://internal-service\nbrev socks my-ws --http 127.0.0.1:3128",
+		Args:                  cobra.ExactArgs(1),
+		ValidArgsFunction:     completions.GetAllWorkspaceNameCompletionHandler(store, t),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := RunSocks(t, store, auth, args[0], opts)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&opts.listen, "listen", "127.0.0.1:1080", "address the SOCKS5 proxy listens on")
+	cmd.Flags().StringVar(&opts.httpListen, "http", "", "also serve an HTTP CONNECT proxy on this address")
+	cmd.Flags().BoolVarP(&opts.quiet, "quiet", "q", false, "do not log every connection")
+	return cmd
+}
+
+func RunSocks(t *terminal.Terminal, store SocksStore, auth huproxyclient.HubProxyAuth, workspaceNameOrID string, opts socksOptions) error {
+	workspace, err := proxy.NewWorkspaceProxy(store, compat.DefaultMatrix, 0).ResolveWorkspace(workspaceNameOrID)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if workspace.Status != "RUNNING" {
+		return fmt.Errorf("workspace %s is %s, start it with `brev start %s`", workspace.Name, workspace.Status, workspace.Name)
+	}
+	keys, err := store.GetCurrentUserKeys()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	socksListener, err := net.Listen("tcp", opts.listen)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer socksListener.Close() //nolint:errcheck // closing an already closed listener is fine
+	var httpListener net.Listener
+	if opts.httpListen != "" {
+		httpListener, err = net.Listen("tcp", opts.httpListen)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		defer httpListener.Close() //nolint:errcheck // closing an already closed listener is fine
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	tunnel, err := portforward.NewSSHPortForwarder(auth, keys.PrivateKey).Connect(ctx, workspace.GetProxyURL())
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer tunnel.Close() //nolint:errcheck // the proxy is done
+	go func() {
+		// stop serving if the workspace goes away
+		_ = tunnel.Wait()
+		cancel()
+	}()
+
+	server := socks.NewServer(tunnel, func(s socks.ConnStats) {
+		if s.Err != nil {
+			t.Vprint(t.Yellow("%s", s.String()))
+		} else if !opts.quiet {
+			t.Vprint(s.String())
+		}
+	})
+
+	errs := make(chan error, 2)
+	t.Vprintf("SOCKS5 proxy to %s listening on %s\n", t.Green(workspace.Name), socksListener.Addr())
+	go func() {
+		errs <- server.ServeSOCKS(ctx, socksListener)
+	}()
+	servers := 1
+	if httpListener != nil {
+		servers++
+		t.Vprintf("HTTP CONNECT proxy to %s listening on %s\n", t.Green(workspace.Name), httpListener.Addr())
+		go func() {
+			errs <- server.ServeConnect(ctx, httpListener)
+		}()
+	}
+
+	var result error
+	for i := 0; i < servers; i++ {
+		err := <-errs
+		if err != nil {
+			result = multierror.Append(result, err)
+			cancel()
+		}
+	}
+	if result != nil {
+		return breverrors.WrapAndTrace(result)
+	}
+	t.Vprint("proxy stopped")
+	return nil
+}
@@ -1,48 +1,170 @@
 package ssh
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/brevdev/brev-cli/pkg/cmd/completions"
+	"github.com/brevdev/brev-cli/pkg/cmd/proxy"
 	"github.com/brevdev/brev-cli/pkg/cmdcontext"
+	"github.com/brevdev/brev-cli/pkg/compat"
+	"github.com/brevdev/brev-cli/pkg/entity"
 	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/huproxyclient"
+	"github.com/brevdev/brev-cli/pkg/k8s"
+	"github.com/brevdev/brev-cli/pkg/portforward"
 	"github.com/brevdev/brev-cli/pkg/terminal"
 	"github.com/spf13/cobra"
+	gossh "golang.org/x/crypto/ssh"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+	"k8s.io/kubectl/pkg/util/term"
 )
 
-func NewCmdSSH(t *terminal.Terminal) *cobra.Command {
-	// opts := SshOptions{}
+type SSHStore interface {
+	proxy.ProxyStore
+	completions.CompletionStore
+}
+
+type sshOptions struct {
+	via       string
+	container string
+}
+
+func NewCmdSSH(t *terminal.Terminal, store SSHStore, auth huproxyclient.HubProxyAuth) *cobra.Command {
+	var opts sshOptions
 
 	cmd := &cobra.Command{
-		Use:         "ssh",
-		Annotations: map[string]string{"ssh": ""},
-		Short:       "SSH into your workspace",
-		Long:        "SSH into your workspace",
-		Example:     `brev ssh [workspace_name]`,
-		Args:        cobra.ExactArgs(1),
-		// ValidArgs:   brevapi.GetWorkspaceNames(),
+		Use:                   "ssh <workspace>",
+		DisableFlagsInUseLine: true,
+		Annotations:           map[string]string{"ssh": ""},
+		Short:                 "SSH into your workspace",
+		Long:                  fmt.Sprintf("Open a shell on your workspace. By default it connects to the workspace's ssh server through its proxy. With --via %s it runs the shell in the workspace's pod through the Kubernetes api instead, which works with old workspace images and networks that block websockets.", portforward.ViaK8s),
+		Example:               "brev ssh my-ws\nbrev ssh my-ws --via k8s",
+		Args:                  cobra.ExactArgs(1),
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 			err := cmdcontext.InvokeParentPersistentPreRun(cmd, args)
 			if err != nil {
 				return breverrors.WrapAndTrace(err)
 			}
-
-			// _, err = brevapi.CheckOutsideBrevErrorMessage(t)
-			return breverrors.WrapAndTrace(err)
-		},
-		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
-			return []string{}, cobra.ShellCompDirectiveNoSpace | cobra.ShellCompDirectiveDefault
+			return nil
 		},
-		RunE: func(cmd *cobra.Command, args []string) error {
-			err := ssh(t, args[0])
+		ValidArgsFunction: completions.GetAllWorkspaceNameCompletionHandler(store, t),
+		Run: func(cmd *cobra.Command, args []string) {
+			code, err := RunSSH(store, auth, args[0], opts)
 			if err != nil {
-				return breverrors.WrapAndTrace(err)
+				t.Errprint(err, "")
+				os.Exit(1)
+			}
+			if code != 0 {
+				os.Exit(code)
 			}
-			return nil
 		},
 	}
-
+	cmd.Flags().StringVar(&opts.via, "via", portforward.ViaSSH, fmt.Sprintf("connect over ssh (%s) or exec through the k8s api (%s)", portforward.ViaSSH, portforward.ViaK8s))
+	cmd.Flags().StringVarP(&opts.container, "container", "c", "", fmt.Sprintf("container to open the shell in with --via %s, the workspace's main container by default", portforward.ViaK8s))
 	return cmd
 }
 
-func ssh(_ *terminal.Terminal, _ string) error {
-	// exec.Command("ssh " + workspace.DNS)
+// RunSSH opens an interactive shell and returns its exit code
+func RunSSH(store SSHStore, auth huproxyclient.HubProxyAuth, workspaceNameOrID string, opts sshOptions) (int, error) {
+	err := portforward.ValidateVia(opts.via)
+	if err != nil {
+		return 0, breverrors.WrapAndTrace(err)
+	}
+	if opts.container != "" && opts.via != portforward.ViaK8s {
+		return 0, fmt.Errorf("--container is only supported with --via %s", portforward.ViaK8s)
+	}
+	workspace, err := proxy.NewWorkspaceProxy(store, compat.DefaultMatrix, 0).ResolveWorkspace(workspaceNameOrID)
+	if err != nil {
+		return 0, breverrors.WrapAndTrace(err)
+	}
+	if workspace.Status != "RUNNING" {
+		return 0, fmt.Errorf("workspace %s is %s, start it with `brev start %s`", workspace.Name, workspace.Status, workspace.Name)
+	}
+
+	tty := term.TTY{In: os.Stdin, Out: os.Stdout, Raw: true}
+	var sizes remotecommand.TerminalSizeQueue
+	if tty.IsTerminalIn() && tty.IsTerminalOut() {
+		sizes = tty.MonitorSize(tty.GetSize())
+	} else {
+		tty.Raw = false
+	}
+
+	if opts.via == portforward.ViaK8s {
+		err = tty.Safe(func() error {
+			return viaK8s(store, *workspace, opts.container, sizes)
+		})
+	} else {
+		err = tty.Safe(func() error {
+			return viaSSH(store, auth, *workspace, sizes)
+		})
+	}
+	return exitCode(err)
+}
+
+func viaSSH(store SSHStore, auth huproxyclient.HubProxyAuth, workspace entity.Workspace, sizes remotecommand.TerminalSizeQueue) error {
+	keys, err := store.GetCurrentUserKeys()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer cancel()
+	tunnel, err := portforward.NewSSHPortForwarder(auth, keys.PrivateKey).Connect(ctx, workspace.GetProxyURL())
+	if err != nil {
+		return fmt.Errorf("%w\nif the workspace's ssh proxy is unreachable try `brev ssh %s --via %s`", err, workspace.Name, portforward.ViaK8s)
+	}
+	defer tunnel.Close() //nolint:errcheck // the shell is done
+	err = tunnel.Shell(os.Stdin, os.Stdout, os.Stderr, sizes)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
 	return nil
 }
+
+func viaK8s(store SSHStore, workspace entity.Workspace, container string, sizes remotecommand.TerminalSizeQueue) error {
+	meta, err := store.GetWorkspaceMetaData(workspace.ID)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	mapper, err := k8s.NewDefaultWorkspaceGroupClientMapper(store)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	client, err := mapper.GetK8sClient(workspace.WorkspaceGroupID)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = k8s.Exec(context.Background(), client, *meta, k8s.ExecOptions{
+		Container: container,
+		Stdin:     os.Stdin,
+		Stdout:    os.Stdout,
+		Stderr:    os.Stderr,
+		TTY:       sizes != nil,
+		SizeQueue: sizes,
+	})
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// exitCode passes the shell's exit code through, whichever way it ran
+func exitCode(err error) (int, error) {
+	var sshExit *gossh.ExitError
+	var k8sExit utilexec.ExitError
+	switch {
+	case err == nil:
+		return 0, nil
+	case errors.As(err, &sshExit):
+		return sshExit.ExitStatus(), nil
+	case errors.As(err, &k8sExit):
+		return k8sExit.ExitStatus(), nil
+	default:
+		return 0, breverrors.WrapAndTrace(err)
+	}
+}
@@ -1 +1,23 @@
 package ssh
+
+import (
+	"fmt"
+	"testing"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+func TestExitCode(t *testing.T) {
+	code, err := exitCode(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, code)
+
+	code, err = exitCode(breverrors.WrapAndTrace(utilexec.CodeExitError{Err: fmt.Errorf("exit"), Code: 3}))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, code)
+
+	_, err = exitCode(fmt.Errorf("connection refused"))
+	assert.NotNil(t, err)
+}
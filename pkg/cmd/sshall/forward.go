@@ -0,0 +1,219 @@
+package sshall
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/k8s"
+	"github.com/brevdev/brev-cli/pkg/portforward"
+)
+
+type ForwardState string
+
+const (
+	ForwardStateStarting  ForwardState = "starting"
+	ForwardStateHealthy   ForwardState = "healthy"
+	ForwardStateUnhealthy ForwardState = "unhealthy"
+	ForwardStateBackoff   ForwardState = "backoff"
+	ForwardStateStopped   ForwardState = "stopped"
+)
+
+type ForwardStatus struct {
+	WorkspaceID string       `json:"workspaceId"`
+	Name        string       `json:"name"`
+	LocalID     string       `json:"localId"`
+	LocalPort   string       `json:"localPort,omitempty"`
+	State       ForwardState `json:"state"`
+	Since       time.Time    `json:"since"`
+	Restarts    int          `json:"restarts"`
+	LastError   string       `json:"lastError,omitempty"`
+	NextRetry   *time.Time   `json:"nextRetry,omitempty"`
+}
+
+type Forwarder interface {
+	// Forward blocks until the forward fails or ctx is done
+	Forward(ctx context.Context, workspace entity.WorkspaceWithMeta, portMapping string) error
+}
+
+// HealthChecker checks the workspace is reachable through the local port
+type HealthChecker func(ctx context.Context, localPort string) error
+
+type K8sForwarder struct {
+	workspaceGroupClientMapper k8s.WorkspaceGroupClientMapper
+}
+
+func NewK8sForwarder(workspaceGroupClientMapper k8s.WorkspaceGroupClientMapper) *K8sForwarder {
+	return &K8sForwarder{workspaceGroupClientMapper: workspaceGroupClientMapper}
+}
+
+func (f K8sForwarder) Forward(ctx context.Context, workspace entity.WorkspaceWithMeta, portMapping string) error {
+	pf := portforward.NewPortForwardOptions(
+		f.workspaceGroupClientMapper,
+		portforward.NewDefaultPortForwarder(),
+	)
+	_, err := pf.WithWorkspace(workspace)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	pf.WithPort(portMapping)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(pf.StopChannel)
+		case <-done:
+		}
+	}()
+
+	err = pf.Forward()
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return fmt.Errorf("port forward ended")
+}
+
+// SSHBannerHealthCheck passes if an ssh server answers on the local port,
+// which means the forward reaches the workspace's sshd
+func SSHBannerHealthCheck(ctx context.Context, localPort string) error {
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort("localhost", localPort))
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer conn.Close() //nolint:errcheck // only the banner matters
+
+	err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if !strings.HasPrefix(banner, "SSH-") {
+		return fmt.Errorf("unexpected banner %q", strings.TrimSpace(banner))
+	}
+	return nil
+}
+
+type forward struct {
+	workspace entity.WorkspaceWithMeta
+	localID   entity.WorkspaceLocalID
+	cancel    context.CancelFunc
+	done      chan struct{}
+	checkNow  chan struct{}
+}
+
+// supervise keeps the forward for one workspace up until ctx is done,
+// restarting it with exponential backoff whenever it fails or stops passing
+// health checks
+func (s *SSHAll) supervise(ctx context.Context, f *forward) {
+	defer close(f.done)
+	defer s.setState(f.workspace.ID, func(st *ForwardStatus) {
+		st.State = ForwardStateStopped
+		st.NextRetry = nil
+	})
+
+	backoff := s.opts.MinBackoff
+	for {
+		startedAt := time.Now()
+		err := s.runForward(ctx, f)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(startedAt) > s.opts.MaxBackoff {
+			backoff = s.opts.MinBackoff // it was up for a while so this is a fresh failure
+		}
+
+		nextRetry := time.Now().Add(backoff)
+		s.setState(f.workspace.ID, func(st *ForwardStatus) {
+			st.State = ForwardStateBackoff
+			st.LastError = err.Error()
+			st.NextRetry = &nextRetry
+		})
+		s.logf("%v, retrying in %s [workspace=%s]", err, backoff, f.localID)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > s.opts.MaxBackoff {
+			backoff = s.opts.MaxBackoff
+		}
+		s.setState(f.workspace.ID, func(st *ForwardStatus) {
+			st.Restarts++
+		})
+	}
+}
+
+// runForward runs a single attempt and returns why it ended
+func (s *SSHAll) runForward(ctx context.Context, f *forward) error {
+	port, err := s.getPort(f.localID)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	s.setState(f.workspace.ID, func(st *ForwardStatus) {
+		st.State = ForwardStateStarting
+		st.LocalPort = port
+		st.NextRetry = nil
+	})
+
+	attemptCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	forwardErrs := make(chan error, 1)
+	go func() {
+		forwardErrs <- s.forwarder.Forward(attemptCtx, f.workspace, makeSSHPortMapping(port))
+	}()
+
+	ticker := time.NewTicker(s.opts.HealthCheckInterval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case err := <-forwardErrs:
+			if err == nil {
+				err = fmt.Errorf("port forward ended")
+			}
+			return err
+		case <-ctx.Done():
+			cancel()
+			<-forwardErrs
+			return ctx.Err() //nolint:wrapcheck // only used to stop
+		case <-ticker.C:
+		case <-f.checkNow:
+		}
+
+		err := s.healthCheck(attemptCtx, port)
+		if err == nil {
+			failures = 0
+			s.setState(f.workspace.ID, func(st *ForwardStatus) {
+				st.State = ForwardStateHealthy
+				st.LastError = ""
+			})
+			continue
+		}
+		failures++
+		s.setState(f.workspace.ID, func(st *ForwardStatus) {
+			st.State = ForwardStateUnhealthy
+			st.LastError = err.Error()
+		})
+		if failures >= s.opts.UnhealthyThreshold {
+			cancel()
+			<-forwardErrs
+			return fmt.Errorf("health check failed %d times: %w", failures, err)
+		}
+	}
+}
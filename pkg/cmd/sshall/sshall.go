@@ -1,172 +1,332 @@
 package sshall
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/brevdev/brev-cli/pkg/entity"
 	breverrors "github.com/brevdev/brev-cli/pkg/errors"
-	"github.com/brevdev/brev-cli/pkg/files"
 	"github.com/brevdev/brev-cli/pkg/k8s"
-	"github.com/brevdev/brev-cli/pkg/portforward"
-	"github.com/pkg/errors"
-	"golang.org/x/crypto/ssh"
 	"k8s.io/apimachinery/pkg/util/runtime"
 )
 
-type (
-	connectionMap map[entity.WorkspaceWithMeta]chan struct{}
-	retrymap      map[entity.WorkspaceWithMeta]int
-)
+type SSHResolver interface {
+	GetConfiguredWorkspacePort(entity.WorkspaceLocalID) (string, error)
+}
 
-type SSHAll struct {
-	workspaces                 []entity.WorkspaceWithMeta
-	workspaceGroupClientMapper k8s.WorkspaceGroupClientMapper
-	sshResolver                SSHResolver
-	workspaceConnections       connectionMap
-	workspaceConnectionsMutex  *sync.RWMutex
-	retries                    retrymap
+// WorkspaceSource lists the workspaces that should be forwarded
+type WorkspaceSource interface {
+	GetWorkspaces() ([]entity.WorkspaceWithMeta, error)
 }
 
-type SSHResolver interface {
-	GetConfiguredWorkspacePort(entity.WorkspaceLocalID) (string, error)
+// ConfigSyncer writes ssh config entries, and so assigns local ports, for
+// the current set of workspaces
+type ConfigSyncer interface {
+	SyncWorkspaces(workspaces []entity.WorkspaceWithMeta) error
+}
+
+type Options struct {
+	ReconcileInterval   time.Duration
+	HealthCheckInterval time.Duration
+	UnhealthyThreshold  int
+	MinBackoff          time.Duration
+	MaxBackoff          time.Duration
+	StatusAddr          string // disabled if empty
+}
+
+func DefaultOptions() Options {
+	return Options{
+		ReconcileInterval:   30 * time.Second,
+		HealthCheckInterval: 15 * time.Second,
+		UnhealthyThreshold:  2,
+		MinBackoff:          time.Second,
+		MaxBackoff:          time.Minute,
+		StatusAddr:          "localhost:0",
+	}
+}
+
+// SSHAll supervises a port-forward per running workspace and keeps the set of
+// forwards in line with the workspaces in the org
+type SSHAll struct {
+	workspaceSource WorkspaceSource
+	sshResolver     SSHResolver
+	configSyncer    ConfigSyncer
+	forwarder       Forwarder
+	healthCheck     HealthChecker
+	opts            Options
+	logf            func(format string, a ...interface{})
+
+	configMu sync.Mutex // serializes config writes with port lookups
+
+	mu       sync.Mutex
+	forwards map[string]*forward
+	statuses map[string]*ForwardStatus
 }
 
 func NewSSHAll(
-	workspaces []entity.WorkspaceWithMeta,
+	workspaceSource WorkspaceSource,
 	workspaceGroupClientMapper k8s.WorkspaceGroupClientMapper,
 	sshResolver SSHResolver,
-
+	opts Options,
 ) *SSHAll {
 	return &SSHAll{
-		workspaces:                 workspaces,
-		workspaceGroupClientMapper: workspaceGroupClientMapper,
-		sshResolver:                sshResolver,
-		workspaceConnections:       make(connectionMap),
-		workspaceConnectionsMutex:  &sync.RWMutex{},
-		retries:                    make(retrymap),
+		workspaceSource: workspaceSource,
+		sshResolver:     sshResolver,
+		forwarder:       NewK8sForwarder(workspaceGroupClientMapper),
+		healthCheck:     SSHBannerHealthCheck,
+		opts:            opts,
+		logf:            log.Printf,
+		forwards:        make(map[string]*forward),
+		statuses:        make(map[string]*ForwardStatus),
 	}
 }
 
-func workspaceSSHConnectionHealthCheck(w entity.WorkspaceWithMeta) (bool, error) {
-	var hostKey ssh.PublicKey
-	// A public key may be used to authenticate against the remote
-	// 	var hostKey ssh.PublicKey
-	// A public key may be used to authenticate against the remote
-	// server by using an unencrypted PEM-encoded private key file.
-	//
-	// If you have an encrypted private key, the crypto/x509 package
-	// can be used to decrypt it.
-	key, err := ioutil.ReadFile(files.GetSSHPrivateKeyPath())
-	if err != nil {
-		return false, breverrors.WrapAndTrace(err, "unable to read private key: %v")
-	}
+func (s *SSHAll) WithConfigSyncer(configSyncer ConfigSyncer) *SSHAll {
+	s.configSyncer = configSyncer
+	return s
+}
+
+func (s *SSHAll) WithForwarder(forwarder Forwarder, healthCheck HealthChecker) *SSHAll {
+	s.forwarder = forwarder
+	s.healthCheck = healthCheck
+	return s
+}
+
+func (s *SSHAll) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Println(`Please add the following to your ssh config to
+avoid false positives for user host key checking.
+
+Host *
+  NoHostAuthenticationForLocalhost yes
+
+	`)
 
-	// Create the Signer for this private key.
-	signer, err := ssh.ParsePrivateKey(key)
+	err := s.RunContext(ctx)
 	if err != nil {
-		return false, breverrors.WrapAndTrace(err, "unable to parse private key: %v")
+		return breverrors.WrapAndTrace(err)
 	}
+	return nil
+}
+
+// RunContext supervises forwards until ctx is done
+func (s *SSHAll) RunContext(ctx context.Context) error {
+	// kubectl reports broken forwards through its global error handlers
+	// rather than returning, so use them as a hint to health check early,
+	// for as long as this run lasts
+	handlers := runtime.ErrorHandlers
+	runtime.ErrorHandlers = append(handlers[:len(handlers):len(handlers)], func(_ error) {
+		s.checkAllNow()
+	})
+	defer func() {
+		runtime.ErrorHandlers = handlers
+	}()
 
-	config := &ssh.ClientConfig{
-		User: "brev",
-		Auth: []ssh.AuthMethod{
-			// Use the PublicKeys method for remote authentication.
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: ssh.FixedHostKey(hostKey),
+	if s.opts.StatusAddr != "" {
+		addr, err := s.serveStatus(ctx, s.opts.StatusAddr)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		fmt.Printf("forward status at http://%s/status\n", addr)
 	}
 
-	// Connect to the remote server and perform the SSH handshake.
-	client, err := ssh.Dial("tcp", w.DNS, config)
+	err := s.reconcile(ctx)
 	if err != nil {
-		return false, breverrors.WrapAndTrace(err, "unable to connect: %v")
+		return breverrors.WrapAndTrace(err)
 	}
-	err = client.Close()
-	if err != nil {
-		return true, breverrors.WrapAndTrace(err)
+
+	ticker := time.NewTicker(s.opts.ReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.stopAll()
+			return nil
+		case <-ticker.C:
+			err := s.reconcile(ctx)
+			if err != nil {
+				s.logf("could not reconcile workspaces: %v", err)
+			}
+		}
 	}
-	return true, nil
 }
 
-// NOTE: not sure if passing in all the workspaces to check for name is useful here, like in entity.go: GetLocalIdentifier
-func (s SSHAll) runPortForwardWorkspace(workspace entity.WorkspaceWithMeta, _ []entity.WorkspaceWithMeta) {
-	err := s.portforwardWorkspace(workspace)
+// reconcile starts forwards for new running workspaces and stops forwards
+// for workspaces that stopped, were deleted or moved to another pod
+func (s *SSHAll) reconcile(ctx context.Context) error {
+	workspaces, err := s.workspaceSource.GetWorkspaces()
 	if err != nil {
-		// todo have verbose version with trace
-		fmt.Printf("%v [workspace=%s]\n", errors.Cause(err), workspace.DNS)
+		return breverrors.WrapAndTrace(err)
+	}
+	var running []entity.WorkspaceWithMeta
+	for _, w := range workspaces {
+		if w.Status == "RUNNING" {
+			running = append(running, w)
+		}
 	}
-}
 
-func (s SSHAll) Run() error {
-	errorQueue := make(chan error, 1)
+	if s.configSyncer != nil {
+		s.configMu.Lock()
+		err = s.configSyncer.SyncWorkspaces(running)
+		s.configMu.Unlock()
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+	}
 
-	// set up error handling for the ssh connections, very much brute force
-	// since kubectl was not intended to be used a library like this
-	runtime.ErrorHandlers = append(runtime.ErrorHandlers, func(err error) {
-		errorQueue <- err
-	})
+	wanted := make(map[string]entity.WorkspaceWithMeta)
+	for _, w := range running {
+		wanted[w.ID] = w
+	}
 
-	go func() {
-		for {
-			<-errorQueue
-			fmt.Println("resetting unhealthy connections")
-			for _, w := range s.workspaces {
-				isHealthy, _ := workspaceSSHConnectionHealthCheck(w)
-				if !isHealthy {
-					fmt.Printf("resetting [w=%s]\n", w.DNS)
-					TryClose(s.workspaceConnections[w])
-					if s.retries[w] > 0 {
-						s.retries[w]--
-						s.runPortForwardWorkspace(w, s.workspaces)
-					}
-				}
-			}
+	s.mu.Lock()
+	var toStop []*forward
+	for id, f := range s.forwards {
+		w, ok := wanted[id]
+		if !ok || w.WorkspaceMetaData != f.workspace.WorkspaceMetaData {
+			toStop = append(toStop, f)
+			delete(s.forwards, id)
 		}
-	}()
-
-	if len(s.workspaces) == 0 {
-		fmt.Println("No workspaces in org")
-		return nil
+	}
+	s.mu.Unlock()
+	for _, f := range toStop {
+		s.logf("stopping forward [workspace=%s]", f.localID)
+		f.cancel()
+		<-f.done
+		s.mu.Lock()
+		if _, restarted := s.forwards[f.workspace.ID]; !restarted {
+			delete(s.statuses, f.workspace.ID)
+		}
+		s.mu.Unlock()
 	}
 
-	fmt.Println(`Please add the following to your ssh config to
-avoid false positives for user host key checking.
+	allWorkspaces := WorkspacesFromWorkspaceWithMeta(running)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range running {
+		if _, ok := s.forwards[w.ID]; ok {
+			continue
+		}
+		localID := w.GetLocalIdentifier(allWorkspaces)
+		fctx, cancel := context.WithCancel(ctx)
+		f := &forward{
+			workspace: w,
+			localID:   localID,
+			cancel:    cancel,
+			done:      make(chan struct{}),
+			checkNow:  make(chan struct{}, 1),
+		}
+		s.forwards[w.ID] = f
+		s.statuses[w.ID] = &ForwardStatus{
+			WorkspaceID: w.ID,
+			Name:        w.Name,
+			LocalID:     string(localID),
+			State:       ForwardStateStarting,
+			Since:       time.Now(),
+		}
+		fmt.Printf("ssh %s\n", localID)
+		go s.supervise(fctx, f)
+	}
+	return nil
+}
 
-Host *
-  NoHostAuthenticationForLocalhost yes
+func (s *SSHAll) stopAll() {
+	s.mu.Lock()
+	forwards := make([]*forward, 0, len(s.forwards))
+	for _, f := range s.forwards {
+		forwards = append(forwards, f)
+	}
+	s.mu.Unlock()
+	for _, f := range forwards {
+		f.cancel()
+		<-f.done
+	}
+}
 
-	`)
+func (s *SSHAll) checkAllNow() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.forwards {
+		select {
+		case f.checkNow <- struct{}{}:
+		default:
+		}
+	}
+}
 
-	fmt.Println()
-	for _, w := range s.workspaces {
-		fmt.Printf("ssh %s\n", w.GetLocalIdentifier(WorkspacesFromWorkspaceWithMeta(s.workspaces)))
-		s.retries[w] = 3 // TODO magic number
-		s.runPortForwardWorkspace(w, s.workspaces)
+func (s *SSHAll) getPort(localID entity.WorkspaceLocalID) (string, error) {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	port, err := s.sshResolver.GetConfiguredWorkspacePort(localID)
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	if port == "" {
+		return "", fmt.Errorf("port not found")
 	}
-	fmt.Println()
+	return port, nil
+}
 
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt)
-	defer signal.Stop(signals)
-	<-signals
+func (s *SSHAll) setState(workspaceID string, update func(*ForwardStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.statuses[workspaceID]
+	if !ok {
+		return
+	}
+	prev := st.State
+	update(st)
+	if st.State != prev {
+		st.Since = time.Now()
+	}
+}
 
-	return nil
+// Status returns a snapshot of every forward sorted by local id
+func (s *SSHAll) Status() []ForwardStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]ForwardStatus, 0, len(s.statuses))
+	for _, st := range s.statuses {
+		statuses = append(statuses, *st)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].LocalID < statuses[j].LocalID
+	})
+	return statuses
 }
 
-func TryClose(toClose chan struct{}) {
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Println("recovered panic:", r)
-		}
+func (s *SSHAll) serveStatus(ctx context.Context, addr string) (string, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.Status())
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		_ = server.Serve(l)
 	}()
-	close(toClose)
+	return l.Addr().String(), nil
 }
 
 // NADER IS SO FUCKING SORRY FOR DOING THIS TWICE BUT I HAVE NO CLUE WHERE THIS HELPER FUNCTION SHOULD GO SO ITS COPY/PASTED ELSEWHERE
@@ -194,49 +354,6 @@ func WorkspacesFromWorkspaceWithMeta(wwm []entity.WorkspaceWithMeta) []entity.Wo
 	return workspaces
 }
 
-func (s SSHAll) portforwardWorkspace(workspace entity.WorkspaceWithMeta) error {
-	port, err := s.sshResolver.GetConfiguredWorkspacePort(workspace.Workspace.GetLocalIdentifier(nil))
-	if err != nil {
-		return breverrors.WrapAndTrace(err)
-	}
-	if port == "" {
-		return fmt.Errorf("port not found")
-	}
-	portMapping := makeSSHPortMapping(port)
-	err = s.portforwardWorkspaceAtPort(workspace, portMapping)
-	if err != nil {
-		return breverrors.WrapAndTrace(err)
-	}
-	return nil
-}
-
-func (s *SSHAll) portforwardWorkspaceAtPort(workspace entity.WorkspaceWithMeta, portMapping string) error {
-	dpf := portforward.NewDefaultPortForwarder()
-	pf := portforward.NewPortForwardOptions(
-		s.workspaceGroupClientMapper,
-		dpf,
-	)
-
-	s.workspaceConnectionsMutex.Lock()
-	s.workspaceConnections[workspace] = pf.StopChannel
-	s.workspaceConnectionsMutex.Unlock()
-
-	_, err := pf.WithWorkspace(workspace)
-	if err != nil {
-		return breverrors.WrapAndTrace(err)
-	}
-	pf.WithPort(portMapping)
-
-	go func() {
-		err = pf.RunPortforward()
-		if err != nil {
-			log.Println(err)
-		}
-	}()
-
-	return nil
-}
-
 type (
 	RandomSSHResolver struct {
 		WorkspaceResolver WorkspaceResolver
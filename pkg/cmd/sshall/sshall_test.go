@@ -1,5 +1,19 @@
 package sshall
 
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/runtime"
+)
+
 // func Test_getActiveWorkspaces(t *testing.T) {
 // 	_, err := getUserActiveWorkspaces()
 // 	ae := breverrors.ActiveOrgFileNotFound{}
@@ -23,3 +37,194 @@ package sshall
 // 	err = Run(workspaces, getRandomLocalPortForWorkspace)
 // 	assert.Nil(t, err)
 // }
+
+type fakeSource struct {
+	mu         sync.Mutex
+	workspaces []entity.WorkspaceWithMeta
+}
+
+func (f *fakeSource) GetWorkspaces() ([]entity.WorkspaceWithMeta, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.workspaces, nil
+}
+
+func (f *fakeSource) set(workspaces ...entity.WorkspaceWithMeta) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.workspaces = workspaces
+}
+
+type fakeResolver struct{}
+
+func (fakeResolver) GetConfiguredWorkspacePort(_ entity.WorkspaceLocalID) (string, error) {
+	return "2222", nil
+}
+
+type fakeForwarder struct {
+	mu     sync.Mutex
+	starts map[string]int
+	fail   bool
+}
+
+func (f *fakeForwarder) Forward(ctx context.Context, workspace entity.WorkspaceWithMeta, _ string) error {
+	f.mu.Lock()
+	f.starts[workspace.ID]++
+	fail := f.fail
+	f.mu.Unlock()
+	if fail {
+		return fmt.Errorf("forward failed")
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func (f *fakeForwarder) startCount(id string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.starts[id]
+}
+
+func testOptions() Options {
+	return Options{
+		ReconcileInterval:   time.Hour,
+		HealthCheckInterval: 5 * time.Millisecond,
+		UnhealthyThreshold:  2,
+		MinBackoff:          time.Millisecond,
+		MaxBackoff:          10 * time.Millisecond,
+	}
+}
+
+func runningWorkspace(id string) entity.WorkspaceWithMeta {
+	return entity.WorkspaceWithMeta{Workspace: entity.Workspace{ID: id, Name: id, DNS: id + "-org.brev.sh", Status: "RUNNING"}}
+}
+
+func newTestSSHAll(source WorkspaceSource, forwarder Forwarder, healthCheck HealthChecker) *SSHAll {
+	s := NewSSHAll(source, nil, fakeResolver{}, testOptions()).WithForwarder(forwarder, healthCheck)
+	s.logf = func(string, ...interface{}) {}
+	return s
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for condition")
+}
+
+func TestSuperviseRestartsFailedForward(t *testing.T) {
+	source := &fakeSource{}
+	source.set(runningWorkspace("a"))
+	forwarder := &fakeForwarder{starts: map[string]int{}, fail: true}
+	s := newTestSSHAll(source, forwarder, func(context.Context, string) error { return nil })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.Nil(t, s.reconcile(ctx))
+
+	waitFor(t, func() bool { return forwarder.startCount("a") >= 3 })
+	statuses := s.Status()
+	if assert.Len(t, statuses, 1) {
+		assert.Equal(t, "forward failed", statuses[0].LastError)
+		assert.True(t, statuses[0].Restarts >= 2)
+	}
+}
+
+func TestSuperviseRestartsUnhealthyForward(t *testing.T) {
+	source := &fakeSource{}
+	source.set(runningWorkspace("a"))
+	forwarder := &fakeForwarder{starts: map[string]int{}}
+	s := newTestSSHAll(source, forwarder, func(context.Context, string) error { return fmt.Errorf("no banner") })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.Nil(t, s.reconcile(ctx))
+
+	waitFor(t, func() bool { return forwarder.startCount("a") >= 2 })
+}
+
+func TestHealthyForwardIsNotRestarted(t *testing.T) {
+	source := &fakeSource{}
+	source.set(runningWorkspace("a"))
+	forwarder := &fakeForwarder{starts: map[string]int{}}
+	s := newTestSSHAll(source, forwarder, func(context.Context, string) error { return nil })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.Nil(t, s.reconcile(ctx))
+
+	waitFor(t, func() bool {
+		statuses := s.Status()
+		return len(statuses) == 1 && statuses[0].State == ForwardStateHealthy
+	})
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, 1, forwarder.startCount("a"))
+	assert.Equal(t, "2222", s.Status()[0].LocalPort)
+}
+
+func TestReconcileAddsAndRemovesWorkspaces(t *testing.T) {
+	source := &fakeSource{}
+	stopped := runningWorkspace("c")
+	stopped.Status = "STOPPED"
+	source.set(runningWorkspace("a"), stopped)
+	forwarder := &fakeForwarder{starts: map[string]int{}}
+	s := newTestSSHAll(source, forwarder, func(context.Context, string) error { return nil })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.Nil(t, s.reconcile(ctx))
+	waitFor(t, func() bool { return forwarder.startCount("a") == 1 })
+	assert.Len(t, s.Status(), 1)
+
+	source.set(runningWorkspace("b"), stopped)
+	assert.Nil(t, s.reconcile(ctx))
+	waitFor(t, func() bool { return forwarder.startCount("b") == 1 })
+
+	statuses := s.Status()
+	if assert.Len(t, statuses, 1) {
+		assert.Equal(t, "b", statuses[0].WorkspaceID)
+	}
+	assert.Equal(t, 0, forwarder.startCount("c"))
+}
+
+func TestStatusEndpoint(t *testing.T) {
+	source := &fakeSource{}
+	source.set(runningWorkspace("a"))
+	forwarder := &fakeForwarder{starts: map[string]int{}}
+	s := newTestSSHAll(source, forwarder, func(context.Context, string) error { return nil })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.Nil(t, s.reconcile(ctx))
+	addr, err := s.serveStatus(ctx, "localhost:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	res, err := http.Get(fmt.Sprintf("http://%s/status", addr))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer res.Body.Close() //nolint:errcheck // test
+	var statuses []ForwardStatus
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&statuses))
+	if assert.Len(t, statuses, 1) {
+		assert.Equal(t, "a", statuses[0].WorkspaceID)
+	}
+}
+
+func TestRunContextRestoresErrorHandlers(t *testing.T) {
+	s := newTestSSHAll(&fakeSource{}, &fakeForwarder{starts: map[string]int{}}, func(context.Context, string) error { return nil })
+	before := len(runtime.ErrorHandlers)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, s.RunContext(ctx))
+	}
+	assert.Len(t, runtime.ErrorHandlers, before)
+}
@@ -9,7 +9,9 @@ import (
 	"github.com/brevdev/brev-cli/pkg/cmd/completions"
 	"github.com/brevdev/brev-cli/pkg/config"
 	"github.com/brevdev/brev-cli/pkg/entity"
+	"github.com/brevdev/brev-cli/pkg/ssh"
 	"github.com/brevdev/brev-cli/pkg/store"
+	"github.com/brevdev/brev-cli/pkg/tasks"
 	"github.com/brevdev/brev-cli/pkg/terminal"
 	"github.com/spf13/cobra"
 
@@ -384,6 +386,9 @@ func pollUntil(t *terminal.Terminal, wsid string, state string, startStore Start
 			isReady = true
 		}
 	}
+	// have the daemon add the workspace to the ssh config now rather than on
+	// its next run
+	tasks.Nudge(ssh.ConfigUpdaterTaskName)
 	return nil
 }
 
@@ -7,7 +7,9 @@ import (
 	"github.com/brevdev/brev-cli/pkg/cmd/completions"
 	"github.com/brevdev/brev-cli/pkg/entity"
 	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/ssh"
 	"github.com/brevdev/brev-cli/pkg/store"
+	"github.com/brevdev/brev-cli/pkg/tasks"
 	"github.com/brevdev/brev-cli/pkg/terminal"
 	"github.com/spf13/cobra"
 )
@@ -57,6 +59,7 @@ func stopWorkspace(workspaceName string, t *terminal.Terminal, stopStore StopSto
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
 	}
+	tasks.Nudge(ssh.ConfigUpdaterTaskName)
 
 	t.Vprintf(t.Green("Workspace "+workspace.Name+" is stopping.") +
 		"\nNote: this can take a few seconds. Run 'brev ls' to check status\n")
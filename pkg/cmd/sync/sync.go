@@ -0,0 +1,255 @@
+// Package sync keeps a local directory and a workspace directory in sync
+package sync
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/cmd/completions"
+	"github.com/brevdev/brev-cli/pkg/cmd/proxy"
+	"github.com/brevdev/brev-cli/pkg/cmd/runtasks"
+	"github.com/brevdev/brev-cli/pkg/compat"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/filesync"
+	"github.com/brevdev/brev-cli/pkg/huproxyclient"
+	"github.com/brevdev/brev-cli/pkg/terminal"
+	"github.com/brevdev/brev-cli/pkg/transfer"
+	"github.com/spf13/cobra"
+)
+
+type SyncStore interface {
+	proxy.ProxyStore
+	completions.CompletionStore
+}
+
+type syncOptions struct {
+	policy   string
+	excludes []string
+	interval time.Duration
+	daemon   bool
+	name     string
+}
+
+func NewCmdSync(t *terminal.Terminal, store SyncStore, auth huproxyclient.HubProxyAuth) *cobra.Command {
+	var opts syncOptions
+
+	cmd := &cobra.Command{
+		Annotations:           map[string]string{"ssh": ""},
+		Use:                   "sync <local-dir> <workspace>:<remote-dir>",
+		DisableFlagsInUseLine: true,
+		Short:                 "Sync a local directory with a workspace",
+		Long:                  "Keep a local directory and a directory on a workspace in sync in both directions, so you can edit locally and run on the workspace. Paths in the directory's .gitignore, and .git itself, are not synced. When a file changed on both sides since the last sync the --policy decides which side wins.\n\nWith --daemon the sync is saved and kept running by the run-tasks daemon, see `brev sync ls` and `brev sync rm`.",
+		Example:               "brev sync . my-ws:workspace/app\nbrev sync ./app my-ws:workspace/app --exclude node_modules --policy local\nbrev sync ./app my-ws:workspace/app --daemon --name app",
+		Args:                  cobra.ExactArgs(2),
+		ValidArgsFunction:     completions.GetAllWorkspaceNameCompletionHandler(store, t),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := RunSync(t, store, auth, args[0], args[1], opts)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&opts.policy, "policy", string(filesync.PolicyNewer), fmt.Sprintf("who wins when a file changed on both sides: %s, %s or %s", filesync.PolicyNewer, filesync.PolicyLocal, filesync.PolicyRemote))
+	cmd.Flags().StringSliceVar(&opts.excludes, "exclude", nil, "gitignore style patterns to not sync, in addition to .gitignore")
+	cmd.Flags().DurationVar(&opts.interval, "interval", filesync.DefaultPollInterval, "how often to check the workspace for changes, local changes are synced as they happen")
+	cmd.Flags().BoolVar(&opts.daemon, "daemon", false, "save the sync for the run-tasks daemon instead of running it in the foreground")
+	cmd.Flags().StringVar(&opts.name, "name", "", "name of the sync, <workspace>-<local dir name> by default")
+	cmd.AddCommand(newCmdLs(t))
+	cmd.AddCommand(newCmdRm(t))
+	return cmd
+}
+
+func newCmdLs(t *terminal.Terminal) *cobra.Command {
+	return &cobra.Command{
+		Use:                   "ls",
+		DisableFlagsInUseLine: true,
+		Short:                 "List syncs run by the daemon",
+		Args:                  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := RunLs(t)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+}
+
+func newCmdRm(t *terminal.Terminal) *cobra.Command {
+	return &cobra.Command{
+		Use:                   "rm <name>...",
+		DisableFlagsInUseLine: true,
+		Short:                 "Remove syncs run by the daemon",
+		Long:                  "Stop syncing. Files already synced are left on both sides.",
+		Args:                  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := RunRm(t, args)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			return nil
+		},
+	}
+}
+
+// splitRemote splits <workspace>:<dir>, where dir defaults to the home
+// directory
+func splitRemote(arg string) (string, string, error) {
+	i := strings.Index(arg, ":")
+	if i < 1 {
+		return "", "", fmt.Errorf("expected <workspace>:<remote-dir>, got %q", arg)
+	}
+	dir := arg[i+1:]
+	if dir == "" {
+		dir = "."
+	}
+	return arg[:i], dir, nil
+}
+
+func RunSync(t *terminal.Terminal, store SyncStore, auth huproxyclient.HubProxyAuth, localArg, remoteArg string, opts syncOptions) error {
+	workspaceNameOrID, remoteDir, err := splitRemote(remoteArg)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	policy, err := filesync.ParsePolicy(opts.policy)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if opts.interval <= 0 {
+		return fmt.Errorf("--interval must be positive")
+	}
+	localDir, err := filepath.Abs(localArg)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	workspace, err := proxy.NewWorkspaceProxy(store, compat.DefaultMatrix, 0).ResolveWorkspace(workspaceNameOrID)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	spec := filesync.Spec{
+		Name:          opts.name,
+		LocalDir:      localDir,
+		WorkspaceID:   workspace.ID,
+		WorkspaceName: workspace.Name,
+		RemoteDir:     remoteDir,
+		Policy:        policy,
+		Excludes:      opts.excludes,
+	}
+	if spec.Name == "" {
+		spec.Name = filesync.DefaultName(workspace.Name, localDir)
+	}
+	if opts.daemon {
+		return saveSync(t, spec)
+	}
+
+	if workspace.Status != "RUNNING" {
+		return fmt.Errorf("workspace %s is %s, start it with `brev start %s`", workspace.Name, workspace.Status, workspace.Name)
+	}
+	ignorer, err := filesync.LoadIgnorer(localDir, opts.excludes)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	remote, err := filesync.NewSSHConnector(store, auth).Connect(ctx, workspace)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	t.Vprintf("syncing %s with %s:%s, press ctrl-c to stop\n", localDir, t.Green(workspace.Name), remoteDir)
+	stateFile, err := filesync.NewDefaultStateFile(spec)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	syncer, err := filesync.NewSyncer(transfer.NewCopier(remote), localDir, remoteDir, ignorer, policy, stateFile)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = syncer.Run(ctx, opts.interval, func(c filesync.Change) {
+		switch {
+		case c.Err != nil:
+			t.Vprint(t.Red("%s", c.String()))
+		case c.Conflict:
+			t.Vprint(t.Yellow("%s", c.String()))
+		default:
+			t.Vprint(c.String())
+		}
+	})
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func saveSync(t *terminal.Terminal, spec filesync.Spec) error {
+	syncsConfig, err := filesync.NewDefaultStore()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = syncsConfig.Update(func(c *filesync.Config) error {
+		return c.Add(spec)
+	})
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	t.Vprintf("added sync %s of %s with %s:%s\n", t.Green(spec.Name), spec.LocalDir, spec.WorkspaceName, spec.RemoteDir)
+	runtasks.WarnIfDaemonNotRunning(t, "syncs are run")
+	return nil
+}
+
+func RunLs(t *terminal.Terminal) error {
+	syncsConfig, err := filesync.NewDefaultStore()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	c, err := syncsConfig.Load()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if len(c.Syncs) == 0 {
+		t.Vprint("no syncs, add one with `brev sync <local-dir> <workspace>:<remote-dir> --daemon`")
+		return nil
+	}
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "NAME\tLOCAL\tWORKSPACE\tREMOTE\tPOLICY")
+	for _, s := range c.Syncs {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.Name, s.LocalDir, s.WorkspaceName, s.RemoteDir, s.Policy)
+	}
+	_ = w.Flush()
+	t.Vprint(strings.TrimSuffix(b.String(), "\n"))
+	runtasks.WarnIfDaemonNotRunning(t, "syncs are run")
+	return nil
+}
+
+func RunRm(t *terminal.Terminal, names []string) error {
+	syncsConfig, err := filesync.NewDefaultStore()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = syncsConfig.Update(func(c *filesync.Config) error {
+		return c.Remove(names...)
+	})
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	for _, name := range names {
+		err = filesync.RemoveDefaultStateFile(name)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+	}
+	t.Vprintf("removed %s\n", strings.Join(names, ", "))
+	return nil
+}
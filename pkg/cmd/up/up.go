@@ -3,10 +3,12 @@ package up
 import (
 	"fmt"
 
+	"github.com/brevdev/brev-cli/pkg/cmd/runtasks"
 	"github.com/brevdev/brev-cli/pkg/cmd/sshall"
 	"github.com/brevdev/brev-cli/pkg/entity"
 	breverrors "github.com/brevdev/brev-cli/pkg/errors"
 	"github.com/brevdev/brev-cli/pkg/k8s"
+	"github.com/brevdev/brev-cli/pkg/localports"
 	ssh "github.com/brevdev/brev-cli/pkg/ssh"
 	"github.com/brevdev/brev-cli/pkg/store"
 	"github.com/brevdev/brev-cli/pkg/terminal"
@@ -18,6 +20,8 @@ type upOptions struct {
 	on            *Up
 	upStore       UpStore
 	jetbrainsOnly bool
+	statusAddr    string
+	useSSHConfig  bool
 }
 
 func NewCmdJetbrains(upStore UpStore, t *terminal.Terminal, jetbrainsOnly bool) *cobra.Command {
@@ -28,8 +32,8 @@ func NewCmdJetbrains(upStore UpStore, t *terminal.Terminal, jetbrainsOnly bool)
 		Use:                   "jetbrains",
 		DisableFlagsInUseLine: true,
 		Short:                 "Run a helper proxy for required by jetbrains products",
-		Long:                  "This command runs a helper proxy for jetbrains products that allows your jetbrains IDEs ssh access. It does not update if new workspaces are created or deleted so stop the process and re-run it.",
-		Example:               "brev jetbrains",
+		Long:                  "This command runs a helper proxy for jetbrains products that allows your jetbrains IDEs ssh access. It picks up workspaces as they are started or stopped and restarts forwards that become unhealthy.\n\nEntries are written to every installed JetBrains Gateway, set " + store.JetBrainsGatewayConfigEnv + " to use a different config directory. With --use-ssh-config the entries connect through the workspaces' hosts in the brev ssh config instead, so no helper proxy is needed and the command exits once they are written. The brev run-tasks daemon and brev refresh then keep them up to date, until brev jetbrains is run without the flag.",
+		Example:               "brev jetbrains\nbrev jetbrains --use-ssh-config",
 		Args:                  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
 			cmdutil.CheckErr(opts.Complete(t, cmd, args))
@@ -37,10 +41,15 @@ func NewCmdJetbrains(upStore UpStore, t *terminal.Terminal, jetbrainsOnly bool)
 			cmdutil.CheckErr(opts.RunOn(t))
 		},
 	}
+	cmd.Flags().StringVar(&opts.statusAddr, "status-addr", "localhost:0", "address to serve forward status on, empty to disable")
+	cmd.Flags().BoolVar(&opts.useSSHConfig, "use-ssh-config", false, "write gateway entries that use the brev ssh config and exit")
 	return cmd
 }
 
 func (s *upOptions) Complete(t *terminal.Terminal, _ *cobra.Command, _ []string) error {
+	if s.useSSHConfig {
+		return nil
+	}
 	// spinner := t.NewSpinner()
 	// spinner.Suffix = "  Setting up client"
 	t.Print("Setting up client...")
@@ -58,6 +67,11 @@ func (s *upOptions) Complete(t *terminal.Terminal, _ *cobra.Command, _ []string)
 		return breverrors.WrapAndTrace(err)
 	}
 
+	ports, err := reclaimPorts(t, s.upStore, workspaces)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
 	var runningWorkspaces []entity.WorkspaceWithMeta
 	for _, w := range workspaces {
 		if w.Status == "RUNNING" {
@@ -83,14 +97,24 @@ func (s *upOptions) Complete(t *terminal.Terminal, _ *cobra.Command, _ []string)
 			t.Print("")
 			return fmt.Errorf("jetbrains dne")
 		}
-		jbConfig, err := ssh.NewJetBrainsGatewayConfig(s.upStore)
+		// the entries are this command's port forwards again, the daemon
+		// leaves them alone
+		err = s.upStore.SetJetBrainsGatewayUsesSSHConfig(false)
 		if err != nil {
 			return breverrors.WrapAndTrace(err)
 		}
-		// copy values so we aren't modifying eachother
-		reader := jbConfig
-		sshConfigWriter := jbConfig
-		sshConfigurer = ssh.NewSSHConfigurer(runningWorkspaces, reader, []ssh.Writer{sshConfigWriter}, s.upStore, workspaceGroupClientMapper.GetPrivateKey())
+		jbConfigs, err := ssh.NewJetBrainsGatewayConfigs(s.upStore, false)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		// every installed gateway gets the entries, ports are read from the
+		// newest one
+		var writers []ssh.Writer
+		for _, jbConfig := range jbConfigs {
+			writers = append(writers, jbConfig)
+		}
+		sshConfigurer = ssh.NewSSHConfigurer(runningWorkspaces, jbConfigs[0], writers, s.upStore, workspaceGroupClientMapper.GetPrivateKey()).
+			WithPortAssigner(ports)
 		if err != nil {
 			return breverrors.WrapAndTrace(err)
 		}
@@ -103,13 +127,16 @@ func (s *upOptions) Complete(t *terminal.Terminal, _ *cobra.Command, _ []string)
 		// copy values so we aren't modifying eachother
 		reader := sshConfig
 		sshConfigWriter := sshConfig
-		sshConfigurer = ssh.NewSSHConfigurer(runningWorkspaces, reader, []ssh.Writer{sshConfigWriter}, s.upStore, workspaceGroupClientMapper.GetPrivateKey())
+		sshConfigurer = ssh.NewSSHConfigurer(runningWorkspaces, reader, []ssh.Writer{sshConfigWriter}, s.upStore, workspaceGroupClientMapper.GetPrivateKey()).
+			WithPortAssigner(ports)
 		if err != nil {
 			return breverrors.WrapAndTrace(err)
 		}
 	}
 
-	s.on = NewUp(runningWorkspaces, sshConfigurer, workspaceGroupClientMapper)
+	s.on = NewUp(runningWorkspaces, sshConfigurer, workspaceGroupClientMapper).
+		WithWorkspaceSource(upWorkspaceSource{upStore: s.upStore}).
+		WithStatusAddr(s.statusAddr)
 	// spinner.Stop()
 	return nil
 }
@@ -117,7 +144,9 @@ func (s *upOptions) Complete(t *terminal.Terminal, _ *cobra.Command, _ []string)
 type UpStore interface {
 	ssh.SSHStore
 	ssh.SSHConfigurerStore
-	ssh.JetBrainsGatewayConfigStore
+	ssh.JetBrainsGatewayConfigurerStore
+	ssh.ConfigUpdaterStore
+	ssh.SSHConfigurerV2Store
 	k8s.K8sStore
 	GetActiveOrganizationOrDefault() (*entity.Organization, error)
 	GetWorkspaces(organizationID string, options *store.GetWorkspacesOptions) ([]entity.Workspace, error)
@@ -127,23 +156,91 @@ type UpStore interface {
 }
 
 func (s upOptions) Validate(_ *terminal.Terminal) error {
+	if s.useSSHConfig && !s.jetbrainsOnly {
+		return fmt.Errorf("--use-ssh-config is only supported by brev jetbrains")
+	}
 	return nil
 }
 
-func (s upOptions) RunOn(_ *terminal.Terminal) error {
+func (s upOptions) RunOn(t *terminal.Terminal) error {
+	if s.useSSHConfig {
+		return s.writeSSHConfigEntries(t)
+	}
 	fmt.Println("Running up...")
 	return s.on.Run()
 }
 
+// reclaimPorts frees the ports.json ports of the org's deleted workspaces,
+// workspaces are all of the user's workspaces in the active org
+func reclaimPorts(t *terminal.Terminal, upStore UpStore, workspaces []entity.WorkspaceWithMeta) (*localports.Assigner, error) {
+	ports, err := localports.NewDefaultAssigner()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	org, err := upStore.GetActiveOrganizationOrDefault()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	var ids []string
+	for _, w := range workspaces {
+		ids = append(ids, w.ID)
+	}
+	reclaimed, err := ports.Reclaim(org.ID, ids)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	if len(reclaimed) > 0 {
+		t.Vprintf("freed the local ports of %d deleted workspaces\n", len(reclaimed))
+	}
+	return ports, nil
+}
+
+// writeSSHConfigEntries points gateway at the hosts of the brev ssh config,
+// which connect through brev proxy, so no port forwards are needed
+func (s upOptions) writeSSHConfigEntries(t *terminal.Terminal) error {
+	exists, err := s.upStore.DoesJetbrainsFilePathExist()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if !exists {
+		return fmt.Errorf("jetbrains gateway is not installed, get it from https://www.jetbrains.com/remote-development/gateway")
+	}
+	// from now on the run-tasks daemon and brev refresh keep the entries up
+	// to date
+	err = s.upStore.SetJetBrainsGatewayUsesSSHConfig(true)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = ssh.ConfigUpdater{
+		Store:   s.upStore,
+		Configs: []ssh.Config{ssh.NewSSHConfigurerV2(s.upStore), ssh.NewJetBrainsGatewayConfigurer(s.upStore)},
+	}.Run()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	paths, err := s.upStore.GetJetBrainsConfigPaths()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	for _, path := range paths {
+		t.Vprintf("updated %s\n", path)
+	}
+	runtasks.WarnIfDaemonNotRunning(t, "the entries are updated as workspaces are started or stopped")
+	return nil
+}
+
 type SSHConfigurer interface {
 	Sync() error
 	sshall.SSHResolver
+	sshall.ConfigSyncer
 }
 
 type Up struct {
 	sshConfigurer              SSHConfigurer
 	workspaceGroupClientMapper k8s.WorkspaceGroupClientMapper
 	workspaces                 []entity.WorkspaceWithMeta
+	workspaceSource            sshall.WorkspaceSource
+	statusAddr                 string
 }
 
 func NewUp(workspaces []entity.WorkspaceWithMeta, sshConfigurer SSHConfigurer, workspaceGroupClientMapper k8s.WorkspaceGroupClientMapper) *Up {
@@ -151,16 +248,33 @@ func NewUp(workspaces []entity.WorkspaceWithMeta, sshConfigurer SSHConfigurer, w
 		workspaces:                 workspaces,
 		sshConfigurer:              sshConfigurer,
 		workspaceGroupClientMapper: workspaceGroupClientMapper,
+		workspaceSource:            staticWorkspaceSource(workspaces),
+		statusAddr:                 sshall.DefaultOptions().StatusAddr,
 	}
 }
 
+// WithWorkspaceSource makes up follow workspaces as they start and stop
+// instead of only forwarding the ones it was created with
+func (o *Up) WithWorkspaceSource(source sshall.WorkspaceSource) *Up {
+	o.workspaceSource = source
+	return o
+}
+
+func (o *Up) WithStatusAddr(addr string) *Up {
+	o.statusAddr = addr
+	return o
+}
+
 func (o Up) Run() error {
 	err := o.sshConfigurer.Sync()
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
 	}
 
-	sshall := sshall.NewSSHAll(o.workspaces, o.workspaceGroupClientMapper, o.sshConfigurer)
+	opts := sshall.DefaultOptions()
+	opts.StatusAddr = o.statusAddr
+	sshall := sshall.NewSSHAll(o.workspaceSource, o.workspaceGroupClientMapper, o.sshConfigurer, opts).
+		WithConfigSyncer(o.sshConfigurer)
 	err = sshall.Run()
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
@@ -169,6 +283,24 @@ func (o Up) Run() error {
 	return nil
 }
 
+type staticWorkspaceSource []entity.WorkspaceWithMeta
+
+func (s staticWorkspaceSource) GetWorkspaces() ([]entity.WorkspaceWithMeta, error) {
+	return s, nil
+}
+
+type upWorkspaceSource struct {
+	upStore UpStore
+}
+
+func (s upWorkspaceSource) GetWorkspaces() ([]entity.WorkspaceWithMeta, error) {
+	workspaces, err := GetActiveWorkspaces(s.upStore)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return workspaces, nil
+}
+
 func GetActiveWorkspaces(upStore UpStore) ([]entity.WorkspaceWithMeta, error) {
 	// fmt.Println("Resolving workspaces...")
 
@@ -0,0 +1,260 @@
+// Package compat decides how the cli connects to a workspace. Instead of
+// hardcoding the infra and image versions a cli release understands, each
+// release ships a matrix of semver ranges that can be overridden by config or
+// by the matrix published with a newer release.
+package compat
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
+	"github.com/spf13/afero"
+)
+
+// Strategy is how the cli connects to a workspace's ssh server
+type Strategy string
+
+const (
+	StrategyHuproxy     Strategy = "huproxy"      // websocket through the workspace's proxy sidecar
+	StrategyPortForward Strategy = "port-forward" // k8s port-forward to the pod, for workspaces that predate the proxy
+)
+
+// Rule maps a range of workspaces to the strategy used to connect to them.
+// Ranges are space separated constraints such as ">=1.7.0 <1.8.0" or "1.7.x".
+type Rule struct {
+	Strategy     Strategy `json:"strategy"`
+	InfraVersion string   `json:"infraVersion,omitempty"` // any if empty
+	Image        string   `json:"image,omitempty"`        // image repository, any if empty
+	ImageVersion string   `json:"imageVersion,omitempty"` // any if empty
+}
+
+// Matrix rules are checked in order, the first match wins
+type Matrix struct {
+	Rules []Rule `json:"rules"`
+}
+
+// DefaultMatrix is what this release of the cli supports
+var DefaultMatrix = Matrix{
+	Rules: []Rule{
+		{
+			Strategy:     StrategyHuproxy,
+			InfraVersion: "1.7.x",
+			Image:        "brevdev/ubuntu-proxy",
+			ImageVersion: "0.3.x",
+		},
+		{
+			Strategy:     StrategyPortForward,
+			InfraVersion: "<1.7.0",
+		},
+	},
+}
+
+// LoadMatrix returns the matrix at path if it exists, otherwise the default
+func LoadMatrix(fs afero.Fs, path string) (*Matrix, error) {
+	exists, err := afero.Exists(fs, path)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	if !exists {
+		m := DefaultMatrix
+		return &m, nil
+	}
+	var m Matrix
+	err = files.ReadJSON(fs, path, &m)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	err = m.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid compatibility matrix %s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// LoadDefaultMatrix loads the override from the brev home
+func LoadDefaultMatrix() (*Matrix, error) {
+	path, err := files.GetCompatibilityMatrixPath()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	m, err := LoadMatrix(files.AppFs, path)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return m, nil
+}
+
+var releaseMatrixRE = regexp.MustCompile("(?s)```brev-compatibility\\s*\n(.*?)```")
+
+// MatrixFromReleaseNotes extracts the matrix a release publishes in its notes
+// in a ```brev-compatibility fenced block
+func MatrixFromReleaseNotes(body string) (*Matrix, bool) {
+	match := releaseMatrixRE.FindStringSubmatch(body)
+	if match == nil {
+		return nil, false
+	}
+	var m Matrix
+	if err := json.Unmarshal([]byte(match[1]), &m); err != nil {
+		return nil, false
+	}
+	if err := m.Validate(); err != nil {
+		return nil, false
+	}
+	return &m, true
+}
+
+func (m Matrix) Validate() error {
+	if len(m.Rules) == 0 {
+		return fmt.Errorf("no rules")
+	}
+	for i, r := range m.Rules {
+		switch r.Strategy {
+		case StrategyHuproxy, StrategyPortForward:
+		default:
+			return fmt.Errorf("rule %d: unknown strategy %q", i, r.Strategy)
+		}
+		if _, err := ParseRange(r.InfraVersion); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+		if _, err := ParseRange(r.ImageVersion); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Check returns the strategy to connect to the workspace, or an error that
+// says whether the workspace or the cli needs upgrading
+func (m Matrix) Check(workspace *entity.Workspace) (Strategy, error) {
+	image, imageVersion := splitImage(workspace.WorkspaceTemplate.Image)
+
+	anyOlder := false
+	var otherImages []string
+	for _, r := range m.Rules {
+		v, err := r.verdict(workspace.Version, image, imageVersion)
+		if err != nil {
+			return "", breverrors.WrapAndTrace(err)
+		}
+		if v == inRange {
+			return r.Strategy, nil
+		}
+		if v == below {
+			anyOlder = true
+		}
+		if v == otherImage {
+			otherImages = append(otherImages, r.Image)
+		}
+	}
+
+	if anyOlder {
+		return "", &WorkspaceTooOldError{
+			Workspace:    workspace.Name,
+			InfraVersion: workspace.Version,
+			Image:        workspace.WorkspaceTemplate.Image,
+		}
+	}
+	if len(otherImages) > 0 {
+		return "", &IncompatibleImageError{
+			Workspace:       workspace.Name,
+			Image:           workspace.WorkspaceTemplate.Image,
+			SupportedImages: otherImages,
+		}
+	}
+	return "", &CLITooOldError{
+		InfraVersion: workspace.Version,
+		Image:        workspace.WorkspaceTemplate.Image,
+	}
+}
+
+// otherImage is the verdict of a rule that supports the workspace's version
+// but only with another image, which `brev reset` does not change
+const otherImage position = above + 1
+
+// verdict is below if the workspace is older than the rule allows and above
+// if it is newer
+func (r Rule) verdict(infraVersion, image, imageVersion string) (position, error) {
+	infraRange, err := ParseRange(r.InfraVersion)
+	if err != nil {
+		return 0, breverrors.WrapAndTrace(err)
+	}
+	if r.Image != "" && r.Image != image {
+		if infraRange.position(infraVersion) == above {
+			return above, nil
+		}
+		return otherImage, nil
+	}
+	imageRange, err := ParseRange(r.ImageVersion)
+	if err != nil {
+		return 0, breverrors.WrapAndTrace(err)
+	}
+	infraPos := infraRange.position(infraVersion)
+	imagePos := imageRange.position(imageVersion)
+	if infraPos == above || imagePos == above {
+		return above, nil
+	}
+	if infraPos == below || imagePos == below {
+		return below, nil
+	}
+	return inRange, nil
+}
+
+// splitImage splits "brevdev/ubuntu-proxy:0.3.2" into repository and tag,
+// leaving registry ports alone
+func splitImage(image string) (string, string) {
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return image, ""
+	}
+	return image[:i], image[i+1:]
+}
+
+type WorkspaceTooOldError struct {
+	Workspace    string
+	InfraVersion string
+	Image        string
+}
+
+func (e *WorkspaceTooOldError) Error() string {
+	return fmt.Sprintf("workspace %s is older than this cli supports [version=%s] [image=%s]", e.Workspace, e.InfraVersion, e.Image)
+}
+
+func (e *WorkspaceTooOldError) Directive() string {
+	return fmt.Sprintf("run `brev reset %s` to upgrade the workspace", e.Workspace)
+}
+
+type IncompatibleImageError struct {
+	Workspace       string
+	Image           string
+	SupportedImages []string
+}
+
+func (e *IncompatibleImageError) Error() string {
+	return fmt.Sprintf("workspace %s runs an image this cli does not support [image=%s]", e.Workspace, e.Image)
+}
+
+func (e *IncompatibleImageError) Directive() string {
+	return fmt.Sprintf("create a new workspace from a supported image (%s) and move your work to it", strings.Join(e.SupportedImages, ", "))
+}
+
+type CLITooOldError struct {
+	InfraVersion string
+	Image        string
+	// UpgradeTo is the release known to support the workspace, if any
+	UpgradeTo string
+}
+
+func (e *CLITooOldError) Error() string {
+	return fmt.Sprintf("workspace is newer than this cli supports [version=%s] [image=%s]", e.InfraVersion, e.Image)
+}
+
+func (e *CLITooOldError) Directive() string {
+	if e.UpgradeTo != "" {
+		return fmt.Sprintf("upgrade the cli to %s with `brew upgrade brevdev/tap/brev`", e.UpgradeTo)
+	}
+	return "upgrade the cli with `brew upgrade brevdev/tap/brev`"
+}
@@ -0,0 +1,115 @@
+package compat
+
+import (
+	"testing"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeWorkspace(version, image string) *entity.Workspace {
+	return &entity.Workspace{
+		Name:              "my-ws",
+		Version:           version,
+		WorkspaceTemplate: entity.WorkspaceTemplate{Image: image},
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	r, err := ParseRange("1.7.x")
+	assert.Nil(t, err)
+	assert.True(t, r.Contains("v1.7.0"))
+	assert.True(t, r.Contains("v1.7.12"))
+	assert.False(t, r.Contains("v1.8.0"))
+	assert.False(t, r.Contains("v1.6.9"))
+
+	r, err = ParseRange(">=0.3.1 <=0.4")
+	assert.Nil(t, err)
+	assert.True(t, r.Contains("0.3.1"))
+	assert.True(t, r.Contains("0.4.0"))
+	assert.False(t, r.Contains("0.4.1"))
+	assert.False(t, r.Contains("0.3.0"))
+
+	r, err = ParseRange("2.*")
+	assert.Nil(t, err)
+	assert.True(t, r.Contains("v2.9.1"))
+	assert.False(t, r.Contains("v3"))
+
+	r, err = ParseRange("")
+	assert.Nil(t, err)
+	assert.True(t, r.Contains("anything"))
+
+	_, err = ParseRange(">=1.x")
+	assert.NotNil(t, err)
+	_, err = ParseRange("latest")
+	assert.NotNil(t, err)
+}
+
+func TestDefaultMatrixCheck(t *testing.T) {
+	strategy, err := DefaultMatrix.Check(makeWorkspace("v1.7.3", "brevdev/ubuntu-proxy:0.3.2"))
+	assert.Nil(t, err)
+	assert.Equal(t, StrategyHuproxy, strategy)
+
+	strategy, err = DefaultMatrix.Check(makeWorkspace("v1.6.0", "brevdev/ubuntu:0.1"))
+	assert.Nil(t, err)
+	assert.Equal(t, StrategyPortForward, strategy)
+
+	_, err = DefaultMatrix.Check(makeWorkspace("v1.7.3", "brevdev/ubuntu-proxy:0.2.9"))
+	assert.IsType(t, &WorkspaceTooOldError{}, err)
+	assert.Contains(t, err.(*WorkspaceTooOldError).Directive(), "brev reset my-ws")
+
+	_, err = DefaultMatrix.Check(makeWorkspace("v1.7.3", "someone/custom:1.0"))
+	assert.IsType(t, &IncompatibleImageError{}, err)
+	assert.Contains(t, err.(*IncompatibleImageError).Directive(), "brevdev/ubuntu-proxy")
+	assert.NotContains(t, err.(*IncompatibleImageError).Directive(), "brev reset")
+
+	_, err = DefaultMatrix.Check(makeWorkspace("v1.8.0", "someone/custom:1.0"))
+	assert.IsType(t, &CLITooOldError{}, err)
+
+	_, err = DefaultMatrix.Check(makeWorkspace("v1.8.0", "brevdev/ubuntu-proxy:0.3.2"))
+	assert.IsType(t, &CLITooOldError{}, err)
+
+	_, err = DefaultMatrix.Check(makeWorkspace("v1.7.3", "brevdev/ubuntu-proxy:0.4.0"))
+	assert.IsType(t, &CLITooOldError{}, err)
+}
+
+func TestSplitImage(t *testing.T) {
+	image, tag := splitImage("brevdev/ubuntu-proxy:0.3.2")
+	assert.Equal(t, "brevdev/ubuntu-proxy", image)
+	assert.Equal(t, "0.3.2", tag)
+
+	image, tag = splitImage("localhost:5000/ubuntu-proxy")
+	assert.Equal(t, "localhost:5000/ubuntu-proxy", image)
+	assert.Equal(t, "", tag)
+}
+
+func TestLoadMatrix(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	m, err := LoadMatrix(fs, "/home/.brev/compatibility.json")
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultMatrix, *m)
+
+	err = afero.WriteFile(fs, "/home/.brev/compatibility.json", []byte(`{"rules":[{"strategy":"huproxy","infraVersion":"1.8.x"}]}`), 0o644)
+	assert.Nil(t, err)
+	m, err = LoadMatrix(fs, "/home/.brev/compatibility.json")
+	assert.Nil(t, err)
+	strategy, err := m.Check(makeWorkspace("v1.8.1", "anything:1.0"))
+	assert.Nil(t, err)
+	assert.Equal(t, StrategyHuproxy, strategy)
+
+	err = afero.WriteFile(fs, "/home/.brev/compatibility.json", []byte(`{"rules":[{"strategy":"carrier-pigeon"}]}`), 0o644)
+	assert.Nil(t, err)
+	_, err = LoadMatrix(fs, "/home/.brev/compatibility.json")
+	assert.NotNil(t, err)
+}
+
+func TestMatrixFromReleaseNotes(t *testing.T) {
+	body := "## Changes\n\n* things\n\n```brev-compatibility\n{\"rules\":[{\"strategy\":\"huproxy\",\"infraVersion\":\"1.8.x\"}]}\n```\n"
+	m, ok := MatrixFromReleaseNotes(body)
+	assert.True(t, ok)
+	assert.Len(t, m.Rules, 1)
+
+	_, ok = MatrixFromReleaseNotes("## Changes\n")
+	assert.False(t, ok)
+}
@@ -0,0 +1,131 @@
+package compat
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+type position int
+
+const (
+	below position = iota - 1
+	inRange
+	above
+)
+
+type constraint struct {
+	op string
+	v  *version.Version
+}
+
+// Range is a set of constraints that must all hold
+type Range []constraint
+
+// ParseRange parses space separated constraints made of an operator (>=, >,
+// <=, <, =) and a version. A bare "1.7.x" or "1.7.*" means ">=1.7.0 <1.8.0".
+// An empty string matches everything.
+func ParseRange(s string) (Range, error) {
+	var r Range
+	for _, field := range strings.Fields(s) {
+		op, v := splitOperator(field)
+		if wildcard := strings.TrimSuffix(strings.TrimSuffix(v, ".x"), ".*"); wildcard != v {
+			if op != "=" {
+				return nil, fmt.Errorf("invalid constraint %q: wildcards can not have an operator", field)
+			}
+			lower, err := parseVersion(wildcard)
+			if err != nil {
+				return nil, fmt.Errorf("invalid constraint %q: %w", field, err)
+			}
+			r = append(r, constraint{op: ">=", v: lower}, constraint{op: "<", v: bumpLast(lower, len(strings.Split(wildcard, ".")))})
+			continue
+		}
+		parsed, err := parseVersion(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid constraint %q: %w", field, err)
+		}
+		r = append(r, constraint{op: op, v: parsed})
+	}
+	return r, nil
+}
+
+// parseVersion accepts versions with a single component like "v2", which
+// ParseGeneric rejects
+func parseVersion(s string) (*version.Version, error) {
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	v, err := version.ParseGeneric(s)
+	if err != nil {
+		return nil, err //nolint:wrapcheck // callers add the constraint to the message
+	}
+	return v, nil
+}
+
+func splitOperator(field string) (string, string) {
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(field, op) {
+			return op, strings.TrimPrefix(field, op)
+		}
+	}
+	return "=", field
+}
+
+// bumpLast returns the smallest version above every version that starts with
+// the first n components of v
+func bumpLast(v *version.Version, n int) *version.Version {
+	switch n {
+	case 1:
+		return v.WithMajor(v.Major() + 1).WithMinor(0).WithPatch(0)
+	case 2:
+		return v.WithMinor(v.Minor() + 1).WithPatch(0)
+	default:
+		return v.WithPatch(v.Patch() + 1)
+	}
+}
+
+// Contains reports whether s satisfies every constraint
+func (r Range) Contains(s string) bool {
+	return r.position(s) == inRange
+}
+
+// position is below if s fails a lower bound and above if it fails an upper
+// bound. Versions that can not be parsed are treated as too old.
+func (r Range) position(s string) position {
+	if len(r) == 0 {
+		return inRange
+	}
+	v, err := parseVersion(s)
+	if err != nil {
+		return below
+	}
+	for _, c := range r {
+		switch c.op {
+		case ">=":
+			if v.LessThan(c.v) {
+				return below
+			}
+		case ">":
+			if !c.v.LessThan(v) {
+				return below
+			}
+		case "<=":
+			if c.v.LessThan(v) {
+				return above
+			}
+		case "<":
+			if !v.LessThan(c.v) {
+				return above
+			}
+		case "=":
+			if v.LessThan(c.v) {
+				return below
+			}
+			if c.v.LessThan(v) {
+				return above
+			}
+		}
+	}
+	return inRange
+}
@@ -14,6 +14,7 @@ const (
 	clusterID                EnvVarName = "DEFAULT_CLUSTER_ID"
 	defaultWorkspaceClass    EnvVarName = "DEFAULT_WORKSPACE_CLASS"
 	defaultWorkspaceTemplate EnvVarName = "DEFAULT_WORKSPACE_TEMPLATE"
+	portForwardVia           EnvVarName = "BREV_PORT_FORWARD_VIA"
 )
 
 type ConstantsConfig struct{}
@@ -44,6 +45,11 @@ func (c ConstantsConfig) GetDefaultWorkspaceTemplate() string {
 	return getEnvOrDefault(defaultWorkspaceTemplate, "4nbb4lg2s")
 }
 
+// GetPortForwardVia is the default transport for port forwards, "k8s" or "ssh"
+func (c ConstantsConfig) GetPortForwardVia() string {
+	return getEnvOrDefault(portForwardVia, "k8s")
+}
+
 func getEnvOrDefault(envVarName EnvVarName, defaultVal string) string {
 	version := os.Getenv(string(envVarName))
 	if version == "" {
@@ -0,0 +1,304 @@
+// Package dockercontext registers docker contexts that run docker commands
+// on a workspace over its entry in the brev ssh config, so that
+// `docker --context brev-<alias> build .` builds on the workspace.
+package dockercontext
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
+	"github.com/brevdev/brev-cli/pkg/ssh"
+	"github.com/spf13/afero"
+)
+
+const (
+	namePrefix = "brev-"
+	// workspaceIDField marks the contexts brev manages, the docker cli keeps
+	// unknown metadata fields
+	workspaceIDField = "BrevWorkspaceID"
+)
+
+// ContextName is the docker context of the workspace with ssh alias alias
+func ContextName(alias string) string {
+	return namePrefix + alias
+}
+
+// Context is a docker context brev manages
+type Context struct {
+	Name        string
+	Host        string // ssh://<alias>
+	Description string
+	WorkspaceID string
+}
+
+func NewContext(workspace entity.Workspace, alias string) Context {
+	return Context{
+		Name:        ContextName(alias),
+		Host:        "ssh://" + alias,
+		Description: "brev workspace " + workspace.Name,
+		WorkspaceID: workspace.ID,
+	}
+}
+
+// Store reads and writes contexts in the docker cli's config directory in
+// the layout of its context store, contexts/meta/<sha256 of name>/meta.json
+type Store struct {
+	fs  afero.Fs
+	dir string
+}
+
+func NewStore(fs afero.Fs, dockerConfigDir string) *Store {
+	return &Store{fs: fs, dir: dockerConfigDir}
+}
+
+// NewDefaultStore uses $DOCKER_CONFIG, or ~/.docker, like the docker cli
+func NewDefaultStore() (*Store, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, breverrors.WrapAndTrace(err)
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	return NewStore(files.AppFs, dir), nil
+}
+
+type contextMeta struct {
+	Name      string                      `json:"Name"`
+	Metadata  map[string]interface{}      `json:"Metadata"`
+	Endpoints map[string]contextEndpoints `json:"Endpoints"`
+}
+
+type contextEndpoints struct {
+	Host          string `json:"Host"`
+	SkipTLSVerify bool   `json:"SkipTLSVerify"`
+}
+
+func (s Store) metaDir() string {
+	return filepath.Join(s.dir, "contexts", "meta")
+}
+
+func (s Store) contextDir(name string) string {
+	digest := sha256.Sum256([]byte(name))
+	return filepath.Join(s.metaDir(), hex.EncodeToString(digest[:]))
+}
+
+func (s Store) Save(c Context) error {
+	meta := contextMeta{
+		Name: c.Name,
+		Metadata: map[string]interface{}{
+			"Description":    c.Description,
+			workspaceIDField: c.WorkspaceID,
+		},
+		Endpoints: map[string]contextEndpoints{"docker": {Host: c.Host}},
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	dir := s.contextDir(c.Name)
+	err = s.fs.MkdirAll(dir, 0o755)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = afero.WriteFile(s.fs, filepath.Join(dir, "meta.json"), b, 0o644)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func (s Store) Remove(name string) error {
+	err := s.fs.RemoveAll(s.contextDir(name))
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// List returns the contexts brev manages, ignoring the user's own
+func (s Store) List() ([]Context, error) {
+	exists, err := afero.DirExists(s.fs, s.metaDir())
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	dirs, err := afero.ReadDir(s.fs, s.metaDir())
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	var contexts []Context
+	for _, d := range dirs {
+		var meta contextMeta
+		err := files.ReadJSON(s.fs, filepath.Join(s.metaDir(), d.Name(), "meta.json"), &meta)
+		if err != nil {
+			continue // not a context, or not one of ours
+		}
+		workspaceID, _ := meta.Metadata[workspaceIDField].(string)
+		if workspaceID == "" || !strings.HasPrefix(meta.Name, namePrefix) {
+			continue
+		}
+		description, _ := meta.Metadata["Description"].(string)
+		contexts = append(contexts, Context{
+			Name:        meta.Name,
+			Host:        meta.Endpoints["docker"].Host,
+			Description: description,
+			WorkspaceID: workspaceID,
+		})
+	}
+	sort.Slice(contexts, func(i, j int) bool { return contexts[i].Name < contexts[j].Name })
+	return contexts, nil
+}
+
+// Selection is the workspaces the user created docker contexts for. Their
+// contexts exist while they are running.
+type Selection struct {
+	WorkspaceIDs []string `json:"workspaceIds"`
+}
+
+func (s Selection) Has(workspaceID string) bool {
+	for _, id := range s.WorkspaceIDs {
+		if id == workspaceID {
+			return true
+		}
+	}
+	return false
+}
+
+// Add returns false if the workspace was already selected
+func (s *Selection) Add(workspaceID string) bool {
+	if s.Has(workspaceID) {
+		return false
+	}
+	s.WorkspaceIDs = append(s.WorkspaceIDs, workspaceID)
+	return true
+}
+
+// Remove returns false if the workspace was not selected
+func (s *Selection) Remove(workspaceID string) bool {
+	for i, id := range s.WorkspaceIDs {
+		if id == workspaceID {
+			s.WorkspaceIDs = append(s.WorkspaceIDs[:i], s.WorkspaceIDs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// SelectionStore reads and writes the selection shared by the cli and the
+// daemon
+type SelectionStore struct {
+	fs   afero.Fs
+	path string
+}
+
+func NewSelectionStore(fs afero.Fs, path string) *SelectionStore {
+	return &SelectionStore{fs: fs, path: path}
+}
+
+func NewDefaultSelectionStore() (*SelectionStore, error) {
+	path, err := files.GetDockerContextsPath()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return NewSelectionStore(files.AppFs, path), nil
+}
+
+// Load returns an empty selection if none has been saved
+func (s SelectionStore) Load() (*Selection, error) {
+	exists, err := afero.Exists(s.fs, s.path)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	if !exists {
+		return &Selection{}, nil
+	}
+	var sel Selection
+	err = files.ReadJSON(s.fs, s.path, &sel)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return &sel, nil
+}
+
+func (s SelectionStore) Save(sel *Selection) error {
+	err := files.WriteJSONAtomic(s.fs, s.path, sel, 0o644)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// Configurer keeps a docker context for each selected running workspace,
+// pointing at its ssh config alias, and removes the others
+type Configurer struct {
+	contexts  *Store
+	selection *SelectionStore
+}
+
+var _ ssh.Config = Configurer{}
+
+func NewConfigurer(contexts *Store, selection *SelectionStore) *Configurer {
+	return &Configurer{contexts: contexts, selection: selection}
+}
+
+func NewDefaultConfigurer() (*Configurer, error) {
+	contexts, err := NewDefaultStore()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	selection, err := NewDefaultSelectionStore()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return NewConfigurer(contexts, selection), nil
+}
+
+// Update is given the running workspaces, as is the ssh config, so aliases
+// match the ssh config's hosts
+func (c Configurer) Update(workspaces []entity.Workspace) error {
+	sel, err := c.selection.Load()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	want := make(map[string]Context)
+	for _, w := range workspaces {
+		if sel.Has(w.ID) {
+			ctx := NewContext(w, string(w.GetLocalIdentifier(workspaces)))
+			want[ctx.Name] = ctx
+		}
+	}
+
+	existing, err := c.contexts.List()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	for _, e := range existing {
+		if w, ok := want[e.Name]; ok && w == e {
+			delete(want, e.Name)
+			continue
+		}
+		err = c.contexts.Remove(e.Name)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+	}
+	for _, ctx := range want {
+		err = c.contexts.Save(ctx)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+	}
+	return nil
+}
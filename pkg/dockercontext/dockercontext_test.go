@@ -0,0 +1,94 @@
+package dockercontext
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreUsesDockerLayout(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	store := NewStore(fs, "/home/.docker")
+	err := store.Save(Context{Name: "brev-foo", Host: "ssh://foo", Description: "brev workspace foo", WorkspaceID: "ws1"})
+	assert.Nil(t, err)
+
+	// sha256("brev-foo"), as the docker cli names context directories
+	b, err := afero.ReadFile(fs, "/home/.docker/contexts/meta/ba8db3a153de3758e172f36c90634a74d5f2c7a4a47527579710d9397086f28b/meta.json")
+	assert.Nil(t, err)
+	var meta map[string]interface{}
+	assert.Nil(t, json.Unmarshal(b, &meta))
+	assert.Equal(t, "brev-foo", meta["Name"])
+	assert.Equal(t, map[string]interface{}{"Host": "ssh://foo", "SkipTLSVerify": false}, meta["Endpoints"].(map[string]interface{})["docker"])
+}
+
+func TestStoreListsOnlyBrevContexts(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	store := NewStore(fs, "/home/.docker")
+	contexts, err := store.List()
+	assert.Nil(t, err)
+	assert.Empty(t, contexts)
+
+	assert.Nil(t, store.Save(Context{Name: "brev-foo", Host: "ssh://foo", WorkspaceID: "ws1"}))
+	// a context the user made themselves
+	dir := store.contextDir("colima")
+	assert.Nil(t, fs.MkdirAll(dir, 0o755))
+	assert.Nil(t, afero.WriteFile(fs, dir+"/meta.json", []byte(`{"Name":"colima","Metadata":{},"Endpoints":{"docker":{"Host":"unix:///colima.sock"}}}`), 0o644))
+
+	contexts, err = store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []Context{{Name: "brev-foo", Host: "ssh://foo", WorkspaceID: "ws1"}}, contexts)
+
+	assert.Nil(t, store.Remove("brev-foo"))
+	contexts, err = store.List()
+	assert.Nil(t, err)
+	assert.Empty(t, contexts)
+	exists, _ := afero.Exists(fs, dir+"/meta.json")
+	assert.True(t, exists)
+}
+
+func TestConfigurerFollowsRunningWorkspaces(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	contexts := NewStore(fs, "/home/.docker")
+	selection := NewSelectionStore(fs, "/home/.brev/docker_contexts.json")
+	configurer := NewConfigurer(contexts, selection)
+
+	sel := &Selection{}
+	assert.True(t, sel.Add("ws1"))
+	assert.False(t, sel.Add("ws1"))
+	assert.True(t, sel.Add("ws2"))
+	assert.Nil(t, selection.Save(sel))
+
+	foo := entity.Workspace{ID: "ws1", Name: "foo", DNS: "foo-abcd-org.brev.sh"}
+	bar := entity.Workspace{ID: "ws2", Name: "bar", DNS: "bar-efgh-org.brev.sh"}
+	other := entity.Workspace{ID: "ws3", Name: "other", DNS: "other-ijkl-org.brev.sh"}
+
+	assert.Nil(t, configurer.Update([]entity.Workspace{foo, other}))
+	listed, err := contexts.List()
+	assert.Nil(t, err)
+	if assert.Len(t, listed, 1) {
+		alias := string(foo.GetLocalIdentifier([]entity.Workspace{foo, other}))
+		assert.Equal(t, ContextName(alias), listed[0].Name)
+		assert.Equal(t, "ssh://"+alias, listed[0].Host)
+	}
+
+	// foo stops and bar starts
+	assert.Nil(t, configurer.Update([]entity.Workspace{bar}))
+	listed, err = contexts.List()
+	assert.Nil(t, err)
+	if assert.Len(t, listed, 1) {
+		assert.Equal(t, "ws2", listed[0].WorkspaceID)
+	}
+
+	sel, err = selection.Load()
+	assert.Nil(t, err)
+	assert.True(t, sel.Remove("ws2"))
+	assert.False(t, sel.Remove("ws2"))
+	assert.Nil(t, selection.Save(sel))
+	assert.Nil(t, configurer.Update([]entity.Workspace{bar}))
+	listed, err = contexts.List()
+	assert.Nil(t, err)
+	assert.Empty(t, listed)
+}
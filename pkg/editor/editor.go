@@ -0,0 +1,228 @@
+// Package editor is the registry of editors brev open can launch on a
+// workspace. Editors connect through the workspace's host in the brev ssh
+// config.
+package editor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/alessio/shellescape"
+	"github.com/brevdev/brev-cli/pkg/entity"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
+	"github.com/spf13/afero"
+)
+
+// WorkspaceDir is where workspaces clone their repo
+const WorkspaceDir = "/home/brev/workspace"
+
+// DefaultEditor is used until the user sets their own
+const DefaultEditor = "code"
+
+// Target is what to open
+type Target struct {
+	Alias string // the workspace's host in the brev ssh config
+	Path  string // absolute path on the workspace
+}
+
+type Editor struct {
+	Name        string
+	Description string
+	// Command opens the target. It is run attached to the terminal if
+	// Interactive, otherwise it is expected to hand off to a gui and return.
+	Command     func(t Target) []string
+	Interactive bool
+	// URL is opened with the system's url handler instead of running a
+	// command
+	URL func(t Target) string
+}
+
+func vscodeLike(name, binary, description string) Editor {
+	return Editor{
+		Name:        name,
+		Description: description,
+		Command: func(t Target) []string {
+			uri := url.URL{Scheme: "vscode-remote", Host: "ssh-remote+" + t.Alias, Path: t.Path}
+			return []string{binary, "--folder-uri", uri.String()}
+		},
+	}
+}
+
+// ssh runs command in the target's directory on the workspace
+func ssh(t Target, command string) []string {
+	return []string{"ssh", "-t", t.Alias, fmt.Sprintf("cd %s && %s", shellescape.Quote(t.Path), command)}
+}
+
+var editors = []Editor{
+	vscodeLike("code", "code", "VS Code with the Remote - SSH extension"),
+	vscodeLike("code-insiders", "code-insiders", "VS Code Insiders with the Remote - SSH extension"),
+	vscodeLike("cursor", "cursor", "Cursor"),
+	{
+		Name:        "gateway",
+		Description: "JetBrains Gateway",
+		URL: func(t Target) string {
+			q := url.Values{}
+			q.Set("type", "ssh")
+			q.Set("deploy", "false")
+			q.Set("host", t.Alias)
+			q.Set("port", "22")
+			q.Set("user", "brev")
+			q.Set("projectPath", t.Path)
+			return "jetbrains-gateway://connect#" + q.Encode()
+		},
+	},
+	{
+		Name:        "emacs",
+		Description: "Emacs, editing on the workspace with TRAMP",
+		Command: func(t Target) []string {
+			return []string{"emacs", fmt.Sprintf("/ssh:%s:%s/", t.Alias, t.Path)}
+		},
+		Interactive: true,
+	},
+	{
+		Name:        "nvim",
+		Description: "neovim running on the workspace, over ssh",
+		Command: func(t Target) []string {
+			return ssh(t, "exec nvim .")
+		},
+		Interactive: true,
+	},
+	{
+		Name:        "terminal",
+		Description: "a login shell on the workspace, over ssh",
+		Command: func(t Target) []string {
+			return ssh(t, `exec "$SHELL" -l`)
+		},
+		Interactive: true,
+	},
+}
+
+// Get returns the editor named name
+func Get(name string) (*Editor, error) {
+	for i, e := range editors {
+		if e.Name == name {
+			return &editors[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown editor %q, choose one of %s", name, strings.Join(Names(), ", "))
+}
+
+// Names of the known editors, sorted
+func Names() []string {
+	var names []string
+	for _, e := range editors {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Help lists the editors, one per line
+func Help() string {
+	var lines []string
+	for _, e := range editors {
+		lines = append(lines, fmt.Sprintf("  %-14s %s", e.Name, e.Description))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// RepoDir is the directory the workspace's repo is cloned into, or the
+// workspace directory if it has no repo
+func RepoDir(workspace entity.Workspace) string {
+	name := RepoName(workspace.GitRepo)
+	if name == "" {
+		return WorkspaceDir
+	}
+	return path.Join(WorkspaceDir, name)
+}
+
+// RepoName is the last element of a git url without .git, as git clone
+// names the directory. It handles scp-like urls such as
+// github.com:org/repo.git.
+func RepoName(gitRepo string) string {
+	repo := strings.TrimRight(strings.TrimSpace(gitRepo), "/")
+	if i := strings.LastIndexAny(repo, "/:"); i >= 0 {
+		repo = repo[i+1:]
+	}
+	return strings.TrimSuffix(repo, ".git")
+}
+
+// ResolvePath is the path to open: the repo directory, or p, relative to
+// the workspace directory unless it is absolute
+func ResolvePath(workspace entity.Workspace, p string) string {
+	switch {
+	case p == "":
+		return RepoDir(workspace)
+	case path.IsAbs(p):
+		return path.Clean(p)
+	case p == "~" || strings.HasPrefix(p, "~/"):
+		return path.Join("/home/brev", p[1:])
+	default:
+		return path.Join(WorkspaceDir, p)
+	}
+}
+
+// Settings are the user's preferences, kept in the personal settings file
+type Settings struct {
+	DefaultEditor string `json:"defaultEditor,omitempty"`
+}
+
+// GetDefaultEditor is the editor the user chose, or DefaultEditor
+func (s Settings) GetDefaultEditor() string {
+	if s.DefaultEditor == "" {
+		return DefaultEditor
+	}
+	return s.DefaultEditor
+}
+
+// SettingsStore reads and writes the personal settings file
+type SettingsStore struct {
+	fs   afero.Fs
+	path string
+}
+
+func NewSettingsStore(fs afero.Fs, path string) *SettingsStore {
+	return &SettingsStore{fs: fs, path: path}
+}
+
+func NewDefaultSettingsStore() *SettingsStore {
+	return NewSettingsStore(files.AppFs, files.GetPersonalSettingsCachePath())
+}
+
+// Load returns empty settings if none have been saved
+func (s SettingsStore) Load() (*Settings, error) {
+	exists, err := afero.Exists(s.fs, s.path)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	if !exists {
+		return &Settings{}, nil
+	}
+	var settings Settings
+	err = files.ReadJSON(s.fs, s.path, &settings)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return &settings, nil
+}
+
+func (s SettingsStore) Save(settings *Settings) error {
+	b, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = s.fs.MkdirAll(path.Dir(s.path), 0o755)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = afero.WriteFile(s.fs, s.path, b, 0o644)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
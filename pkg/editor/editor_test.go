@@ -0,0 +1,75 @@
+package editor
+
+import (
+	"testing"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepoName(t *testing.T) {
+	assert.Equal(t, "brev-cli", RepoName("github.com:brevdev/brev-cli.git"))
+	assert.Equal(t, "brev-cli", RepoName("https://github.com/brevdev/brev-cli/"))
+	assert.Equal(t, "repo", RepoName("git@gitlab.com:group/sub/repo.git"))
+	assert.Equal(t, "", RepoName(""))
+}
+
+func TestResolvePath(t *testing.T) {
+	ws := entity.Workspace{GitRepo: "github.com:brevdev/brev-cli.git"}
+	assert.Equal(t, "/home/brev/workspace/brev-cli", ResolvePath(ws, ""))
+	assert.Equal(t, "/home/brev/workspace", ResolvePath(entity.Workspace{}, ""), "no repo")
+	assert.Equal(t, "/home/brev/workspace/brev-cli/src", ResolvePath(ws, "brev-cli/src/"))
+	assert.Equal(t, "/etc", ResolvePath(ws, "/etc/"))
+	assert.Equal(t, "/home/brev/notes", ResolvePath(ws, "~/notes"))
+	assert.Equal(t, "/home/brev", ResolvePath(ws, "~"))
+}
+
+func TestEditors(t *testing.T) {
+	target := Target{Alias: "my-ws", Path: "/home/brev/workspace/my repo"}
+
+	code, err := Get("code")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"code", "--folder-uri", "vscode-remote://ssh-remote+my-ws/home/brev/workspace/my%20repo"}, code.Command(target))
+	assert.False(t, code.Interactive)
+
+	cursor, err := Get("cursor")
+	assert.Nil(t, err)
+	assert.Equal(t, "cursor", cursor.Command(target)[0])
+
+	gateway, err := Get("gateway")
+	assert.Nil(t, err)
+	assert.Nil(t, gateway.Command)
+	assert.Equal(t, "jetbrains-gateway://connect#deploy=false&host=my-ws&port=22&projectPath=%2Fhome%2Fbrev%2Fworkspace%2Fmy+repo&type=ssh&user=brev", gateway.URL(target))
+
+	emacs, err := Get("emacs")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"emacs", "/ssh:my-ws:/home/brev/workspace/my repo/"}, emacs.Command(target))
+
+	nvim, err := Get("nvim")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ssh", "-t", "my-ws", "cd '/home/brev/workspace/my repo' && exec nvim ."}, nvim.Command(target))
+	assert.True(t, nvim.Interactive)
+
+	_, err = Get("notepad")
+	assert.NotNil(t, err)
+
+	for _, name := range Names() {
+		e, err := Get(name)
+		assert.Nil(t, err)
+		assert.True(t, (e.Command == nil) != (e.URL == nil), "%s launches with a command or a url", name)
+	}
+}
+
+func TestSettingsStore(t *testing.T) {
+	store := NewSettingsStore(afero.NewMemMapFs(), "/home/.brev/personal_settings.json")
+	settings, err := store.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultEditor, settings.GetDefaultEditor())
+
+	settings.DefaultEditor = "nvim"
+	assert.Nil(t, store.Save(settings))
+	settings, err = store.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, "nvim", settings.GetDefaultEditor())
+}
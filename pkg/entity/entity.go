@@ -115,6 +115,7 @@ type Workspace struct {
 	GitRepo           string            `json:"gitRepo"`
 	Version           string            `json:"version"`
 	WorkspaceTemplate WorkspaceTemplate `json:"workspaceTemplate"`
+	Applications      []Application     `json:"applications,omitempty"`
 	// The below are other fields that might not be needed yet so commented out
 	// PrimaryApplicationId         string `json:"primaryApplicationId,omitempty"`
 	// LastOnlineAt         string `json:"lastOnlineAt,omitempty"`
@@ -180,6 +181,11 @@ func (w Workspace) GetSSHURL() string {
 	return "ssh-" + w.DNS
 }
 
+// GetProxyURL is the huproxy websocket that tunnels to the workspace's sshd
+func (w Workspace) GetProxyURL() string {
+	return fmt.Sprintf("wss://%s/proxy", w.GetSSHURL())
+}
+
 func makeNameSafeForEmacs(name string) string {
 	splitBySlash := strings.Split(name, "/")
 
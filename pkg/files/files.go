@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 
 	breverrors "github.com/brevdev/brev-cli/pkg/errors"
 	"github.com/google/uuid"
@@ -19,11 +20,21 @@ const (
 	activeOrgFile      = "active_org.json"
 	orgCacheFile       = "org_cache.json"
 	workspaceCacheFile = "workspace_cache.json"
-	// WIP: This will be used to let people "brev open" with editors other than VS Code
+	// preferences such as the editor brev open uses
 	personalSettingsCache         = "personal_settings.json"
 	kubeCertFileName              = "brev.crt"
 	sshPrivateKeyFileName         = "brev.pem"
 	backupSSHConfigFileNamePrefix = "config.bak"
+	proxyAgentSocketFileName      = "proxy_agent.sock"
+	compatibilityMatrixFileName   = "compatibility.json"
+	forwardsFileName              = "forwards.json"
+	syncsFileName                 = "syncs.json"
+	syncStatesDirName             = "syncs"
+	userKeysCacheFileName         = "user_keys_cache.json"
+	dockerContextsFileName        = "docker_contexts.json"
+	jetBrainsGatewayFileName      = "jetbrains_gateway.json"
+	portsFileName                 = "ports.json"
+	daemonSocketFileName          = "daemon.sock"
 	sshPrivateKeyFilePermissions  = 0o600
 	defaultFilePermission         = 0o770
 )
@@ -111,6 +122,88 @@ func GetSSHPrivateKeyPath() string {
 	return makeBrevFilePathOrPanic(GetSSHPrivateKeyFileName())
 }
 
+func GetProxyAgentSocketPath() (string, error) {
+	fpath, err := makeBrevFilePath(proxyAgentSocketFileName)
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	return *fpath, nil
+}
+
+func GetCompatibilityMatrixPath() (string, error) {
+	fpath, err := makeBrevFilePath(compatibilityMatrixFileName)
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	return *fpath, nil
+}
+
+func GetForwardsPath() (string, error) {
+	fpath, err := makeBrevFilePath(forwardsFileName)
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	return *fpath, nil
+}
+
+func GetSyncsPath() (string, error) {
+	fpath, err := makeBrevFilePath(syncsFileName)
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	return *fpath, nil
+}
+
+// GetSyncStatePath is where the state of a sync after its last sync is kept
+func GetSyncStatePath(fileName string) (string, error) {
+	fpath, err := makeBrevFilePath(filepath.Join(syncStatesDirName, fileName))
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	return *fpath, nil
+}
+
+func GetUserKeysCachePath() (string, error) {
+	fpath, err := makeBrevFilePath(userKeysCacheFileName)
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	return *fpath, nil
+}
+
+func GetDockerContextsPath() (string, error) {
+	fpath, err := makeBrevFilePath(dockerContextsFileName)
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	return *fpath, nil
+}
+
+func GetJetBrainsGatewaySettingsPath() (string, error) {
+	fpath, err := makeBrevFilePath(jetBrainsGatewayFileName)
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	return *fpath, nil
+}
+
+func GetPortsPath() (string, error) {
+	fpath, err := makeBrevFilePath(portsFileName)
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	return *fpath, nil
+}
+
+// GetDaemonSocketPath is where brev run-tasks serves its api
+func GetDaemonSocketPath() (string, error) {
+	fpath, err := makeBrevFilePath(daemonSocketFileName)
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	return *fpath, nil
+}
+
 func GetUserSSHConfigPath() (string, error) {
 	home, err := os.UserHomeDir()
 	if err != nil {
@@ -306,3 +399,92 @@ func touchFile(path string) (*os.File, error) {
 	}
 	return f, nil
 }
+
+const (
+	lockRetryInterval = 10 * time.Millisecond
+	// lockStaleAfter is when a lock left behind by a process that died
+	// holding it is broken
+	lockStaleAfter = 10 * time.Second
+)
+
+// WriteFileAtomic writes data to a temporary file next to path and renames it
+// over path, so a concurrent reader or a crash never sees a partially written
+// file. The directory is created if it does not exist.
+func WriteFileAtomic(fs afero.Fs, path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	err := fs.MkdirAll(dir, 0o755)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	tmp, err := afero.TempFile(fs, dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = fs.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = fs.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = fs.Remove(tmp.Name())
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// WriteJSONAtomic writes v as indented json with WriteFileAtomic
+func WriteJSONAtomic(fs afero.Fs, path string, v interface{}, perm os.FileMode) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = WriteFileAtomic(fs, path, b, perm)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// WithFileLock runs fn holding a lock on path, so the read-modify-write
+// updates of brev commands and the run-tasks daemon do not overwrite each
+// other. The lock is a path.lock file, which works on every platform and
+// filesystem.
+func WithFileLock(fs afero.Fs, path string, fn func() error) error {
+	unlock, err := lockFile(fs, path+".lock")
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer unlock()
+	err = fn()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func lockFile(fs afero.Fs, lockPath string) (func(), error) {
+	err := fs.MkdirAll(filepath.Dir(lockPath), 0o755)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	for {
+		f, err := fs.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			_ = f.Close()
+			return func() { _ = fs.Remove(lockPath) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, breverrors.WrapAndTrace(err)
+		}
+		if info, err := fs.Stat(lockPath); err == nil && time.Since(info.ModTime()) > lockStaleAfter {
+			_ = fs.Remove(lockPath)
+			continue
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
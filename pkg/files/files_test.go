@@ -2,8 +2,11 @@ package files
 
 // Basic imports
 import (
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -26,6 +29,71 @@ func (s *filesTestSuite) TestGetNewBackupSSHConfigFilePath() {
 	s.Nil(err)
 }
 
+func (s *filesTestSuite) TestWriteFileAtomic() {
+	fs := afero.NewMemMapFs()
+	s.Nil(afero.WriteFile(fs, "/a/b.json", []byte("old"), 0o644))
+	s.Nil(WriteFileAtomic(fs, "/a/b.json", []byte("new"), 0o600))
+	b, err := afero.ReadFile(fs, "/a/b.json")
+	s.Nil(err)
+	s.Equal("new", string(b))
+	info, err := fs.Stat("/a/b.json")
+	s.Nil(err)
+	s.Equal("-rw-------", info.Mode().Perm().String())
+	// the temporary file is renamed away
+	entries, err := afero.ReadDir(fs, "/a")
+	s.Nil(err)
+	s.Len(entries, 1)
+
+	s.Nil(WriteJSONAtomic(fs, "/c/d.json", map[string]int{"a": 1}, 0o644))
+	b, err = afero.ReadFile(fs, "/c/d.json")
+	s.Nil(err)
+	s.Equal("{\n  \"a\": 1\n}", string(b))
+}
+
+func (s *filesTestSuite) TestWithFileLock() {
+	fs := afero.NewMemMapFs()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	holders, maxHolders := 0, 0
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Nil(WithFileLock(fs, "/a/b.json", func() error {
+				mu.Lock()
+				holders++
+				if holders > maxHolders {
+					maxHolders = holders
+				}
+				mu.Unlock()
+				time.Sleep(5 * time.Millisecond)
+				mu.Lock()
+				holders--
+				mu.Unlock()
+				return nil
+			}))
+		}()
+	}
+	wg.Wait()
+	s.Equal(1, maxHolders)
+	exists, err := afero.Exists(fs, "/a/b.json.lock")
+	s.Nil(err)
+	s.False(exists)
+}
+
+func (s *filesTestSuite) TestWithFileLockBreaksStaleLock() {
+	fs := afero.NewMemMapFs()
+	s.Nil(afero.WriteFile(fs, "/a/b.json.lock", nil, 0o600))
+	stale := time.Now().Add(-2 * lockStaleAfter)
+	s.Nil(fs.Chtimes("/a/b.json.lock", stale, stale))
+	ran := false
+	s.Nil(WithFileLock(fs, "/a/b.json", func() error {
+		ran = true
+		return nil
+	}))
+	s.True(ran)
+}
+
 // In order for 'go test' to run this suite, we need to create
 // a normal test function and pass our suite to suite.Run
 func TestFiles(t *testing.T) {
@@ -0,0 +1,137 @@
+package filesync
+
+import (
+	"fmt"
+	"path/filepath"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
+	"github.com/spf13/afero"
+)
+
+// Spec is a sync that the run-tasks daemon keeps running
+type Spec struct {
+	Name          string   `json:"name"`
+	LocalDir      string   `json:"localDir"`
+	WorkspaceID   string   `json:"workspaceId"`
+	WorkspaceName string   `json:"workspaceName"`
+	RemoteDir     string   `json:"remoteDir"`
+	Policy        Policy   `json:"policy"`
+	Excludes      []string `json:"excludes,omitempty"`
+}
+
+// DefaultName names a sync that was not given a name
+func DefaultName(workspaceName, localDir string) string {
+	return fmt.Sprintf("%s-%s", workspaceName, filepath.Base(localDir))
+}
+
+type Config struct {
+	Syncs []Spec `json:"syncs"`
+}
+
+func (c Config) Get(name string) (Spec, bool) {
+	for _, s := range c.Syncs {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Spec{}, false
+}
+
+// Add refuses a second sync of the same local directory, which would copy
+// every change twice
+func (c *Config) Add(s Spec) error {
+	if _, exists := c.Get(s.Name); exists {
+		return fmt.Errorf("a sync named %s already exists, remove it with `brev sync rm %s` or pick another --name", s.Name, s.Name)
+	}
+	for _, existing := range c.Syncs {
+		if existing.LocalDir == s.LocalDir {
+			return fmt.Errorf("%s is already synced by %s", s.LocalDir, existing.Name)
+		}
+	}
+	c.Syncs = append(c.Syncs, s)
+	return nil
+}
+
+func (c *Config) Remove(names ...string) error {
+	remove := map[string]bool{}
+	for _, name := range names {
+		if _, ok := c.Get(name); !ok {
+			return fmt.Errorf("no sync named %s, see `brev sync ls`", name)
+		}
+		remove[name] = true
+	}
+	var kept []Spec
+	for _, s := range c.Syncs {
+		if !remove[s.Name] {
+			kept = append(kept, s)
+		}
+	}
+	c.Syncs = kept
+	return nil
+}
+
+// Store reads and writes the config shared by the cli and the daemon
+type Store struct {
+	fs   afero.Fs
+	path string
+}
+
+func NewStore(fs afero.Fs, path string) *Store {
+	return &Store{fs: fs, path: path}
+}
+
+func NewDefaultStore() (*Store, error) {
+	path, err := files.GetSyncsPath()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return NewStore(files.AppFs, path), nil
+}
+
+// Load returns an empty config if none has been saved
+func (s Store) Load() (*Config, error) {
+	exists, err := afero.Exists(s.fs, s.path)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	if !exists {
+		return &Config{}, nil
+	}
+	var c Config
+	err = files.ReadJSON(s.fs, s.path, &c)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return &c, nil
+}
+
+// Save replaces the config atomically so the daemon never reads a partially
+// written one
+func (s Store) Save(c *Config) error {
+	err := files.WriteJSONAtomic(s.fs, s.path, c, 0o644)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// Update loads the config, applies fn and saves the result if fn succeeds. It
+// holds a lock on the file, so a concurrent update is not lost.
+func (s Store) Update(fn func(c *Config) error) error {
+	err := files.WithFileLock(s.fs, s.path, func() error {
+		c, err := s.Load()
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		err = fn(c)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		return s.Save(c)
+	})
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
@@ -0,0 +1,423 @@
+// Package filesync keeps a local directory and a directory on a workspace in
+// sync in both directions. Local changes are watched and the workspace is
+// polled, and what changed is compared with the state both sides had after
+// the last sync, so a change on one side is copied to the other and a change
+// on both sides is a conflict settled by a Policy.
+package filesync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/transfer"
+)
+
+// Policy settles conflicts, where a path changed on both sides since the
+// last sync
+type Policy string
+
+const (
+	PolicyNewer  Policy = "newer"  // the most recently modified side wins, changes win over deletes
+	PolicyLocal  Policy = "local"  // this machine wins
+	PolicyRemote Policy = "remote" // the workspace wins
+)
+
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case PolicyNewer, PolicyLocal, PolicyRemote:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown conflict policy %q, use %s, %s or %s", s, PolicyNewer, PolicyLocal, PolicyRemote)
+	}
+}
+
+type Action string
+
+const (
+	ActionPush         Action = "push"
+	ActionPull         Action = "pull"
+	ActionDeleteRemote Action = "delete-remote"
+	ActionDeleteLocal  Action = "delete-local"
+)
+
+// Change is a path that was synced, or failed to sync
+type Change struct {
+	Path     string
+	Action   Action
+	Conflict bool
+	Err      error
+}
+
+func (c Change) String() string {
+	var s string
+	switch c.Action {
+	case ActionPush:
+		s = "pushed " + c.Path
+	case ActionPull:
+		s = "pulled " + c.Path
+	case ActionDeleteRemote:
+		s = "deleted " + c.Path + " on the workspace"
+	case ActionDeleteLocal:
+		s = "deleted " + c.Path + " locally"
+	}
+	if c.Conflict {
+		s += ", it changed on both sides"
+	}
+	if c.Err != nil {
+		s = fmt.Sprintf("could not sync %s: %v", c.Path, c.Err)
+	}
+	return s
+}
+
+// state is what is compared between syncs. Directory times change with
+// their contents so only their existence counts.
+type state struct {
+	Dir     bool        `json:"dir,omitempty"`
+	Mode    os.FileMode `json:"mode,omitempty"`
+	Size    int64       `json:"size,omitempty"`
+	ModTime int64       `json:"modTime,omitempty"` // seconds, all that sftp carries
+}
+
+func stateOf(e transfer.Entry) state {
+	if e.Dir {
+		return state{Dir: true}
+	}
+	return state{Mode: e.Mode, Size: e.Size, ModTime: e.ModTime.Unix()}
+}
+
+// sameContent guesses that both sides hold the same file, as rsync does,
+// from the size and modification time
+func sameContent(a, b state) bool {
+	return a.Dir == b.Dir && a.Size == b.Size && a.ModTime == b.ModTime
+}
+
+type Syncer struct {
+	copier  *transfer.Copier
+	local   string
+	remote  string
+	ignorer *Ignorer
+	policy  Policy
+
+	// the state of each side after the last sync, saved to stateFile if it
+	// is set
+	baseLocal  map[string]state
+	baseRemote map[string]state
+	stateFile  *StateFile
+	dirty      bool
+}
+
+// NewSyncer starts from the state saved in stateFile, if it is not nil, and
+// saves the state there after each sync
+func NewSyncer(copier *transfer.Copier, local, remote string, ignorer *Ignorer, policy Policy, stateFile *StateFile) (*Syncer, error) {
+	s := &Syncer{
+		copier:     copier,
+		local:      local,
+		remote:     remote,
+		ignorer:    ignorer,
+		policy:     policy,
+		baseLocal:  map[string]state{},
+		baseRemote: map[string]state{},
+		stateFile:  stateFile,
+	}
+	if stateFile != nil {
+		var err error
+		s.baseLocal, s.baseRemote, err = stateFile.load()
+		if err != nil {
+			return nil, breverrors.WrapAndTrace(err)
+		}
+	}
+	return s, nil
+}
+
+// snapshotLocal lists sub, a path relative to the local directory, and
+// everything under it. A missing sub is empty.
+func (s *Syncer) snapshotLocal(sub string) (map[string]transfer.Entry, error) {
+	entries := map[string]transfer.Entry{}
+	root := s.localPath(sub)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && (p != root || sub != "") {
+				return nil // removed while walking, or before
+			}
+			return breverrors.WrapAndTrace(err)
+		}
+		rel, err := filepath.Rel(s.local, p)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if s.ignorer.Ignored(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && (!info.Mode().IsRegular() || transfer.IsPartial(rel)) {
+			return nil
+		}
+		entries[rel] = transfer.Entry{Path: rel, Dir: info.IsDir(), Mode: info.Mode().Perm(), Size: info.Size(), ModTime: info.ModTime()}
+		return nil
+	})
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return entries, nil
+}
+
+// snapshotRemote lists sub on the workspace like snapshotLocal
+func (s *Syncer) snapshotRemote(sub string) (map[string]transfer.Entry, error) {
+	list, err := s.copier.ListRemote(s.remotePath(sub), func(rel string, dir bool) bool {
+		return s.ignorer.Ignored(joinRel(sub, rel), dir)
+	})
+	if err != nil {
+		if sub != "" && errors.Is(err, os.ErrNotExist) {
+			return map[string]transfer.Entry{}, nil
+		}
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	entries := map[string]transfer.Entry{}
+	for _, e := range list {
+		e.Path = joinRel(sub, e.Path)
+		if e.Path == "" {
+			continue
+		}
+		entries[e.Path] = e
+	}
+	return entries, nil
+}
+
+// Sync compares both sides with the last sync once and copies or deletes
+// what changed. Paths that fail are returned as changes with Err set and
+// retried on the next sync; the error is for failing to list either side.
+func (s *Syncer) Sync() ([]Change, error) {
+	return s.SyncPaths([]string{""})
+}
+
+// SyncPaths is Sync limited to the given paths, relative to the local
+// directory, and everything under them
+func (s *Syncer) SyncPaths(paths []string) ([]Change, error) {
+	roots := topmost(paths)
+	local := map[string]transfer.Entry{}
+	remote := map[string]transfer.Entry{}
+	for _, root := range roots {
+		l, err := s.snapshotLocal(root)
+		if err != nil {
+			return nil, err
+		}
+		r, err := s.snapshotRemote(root)
+		if err != nil {
+			return nil, err
+		}
+		for p, e := range l {
+			local[p] = e
+		}
+		for p, e := range r {
+			remote[p] = e
+		}
+	}
+
+	paths = nil
+	seen := map[string]bool{}
+	add := func(p string) {
+		if !seen[p] && inAny(p, roots) {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	for _, m := range []map[string]transfer.Entry{local, remote} {
+		for p := range m {
+			add(p)
+		}
+	}
+	for _, m := range []map[string]state{s.baseLocal, s.baseRemote} {
+		for p := range m {
+			add(p)
+		}
+	}
+	sort.Strings(paths)
+
+	var changes []Change
+	var deleted []string
+	for _, p := range paths {
+		if underAny(p, deleted) {
+			s.forget(p)
+			continue
+		}
+		change, ok := s.syncPath(p, local, remote)
+		if !ok {
+			continue
+		}
+		if change.Err == nil && (change.Action == ActionDeleteLocal || change.Action == ActionDeleteRemote) {
+			deleted = append(deleted, p)
+		}
+		changes = append(changes, change)
+	}
+	if s.dirty && s.stateFile != nil {
+		err := s.stateFile.save(s.baseLocal, s.baseRemote)
+		if err != nil {
+			return changes, breverrors.WrapAndTrace(err)
+		}
+		s.dirty = false
+	}
+	return changes, nil
+}
+
+func (s *Syncer) syncPath(p string, local, remote map[string]transfer.Entry) (Change, bool) {
+	l, lok := local[p]
+	r, rok := remote[p]
+	lChanged := changed(l, lok, s.baseLocal, p)
+	rChanged := changed(r, rok, s.baseRemote, p)
+
+	if !lChanged && !rChanged {
+		return Change{}, false
+	}
+	if lChanged && rChanged {
+		if !lok && !rok || lok && rok && sameContent(stateOf(l), stateOf(r)) {
+			s.record(p, l, lok, r, rok)
+			return Change{}, false
+		}
+	}
+
+	conflict := lChanged && rChanged
+	localWins := lChanged
+	if conflict {
+		localWins = s.localWins(l, lok, r, rok)
+	}
+
+	var change Change
+	var err error
+	switch {
+	case localWins && lok:
+		change = Change{Path: p, Action: ActionPush, Conflict: conflict}
+		if rok && r.Dir != l.Dir {
+			err = s.copier.RemoveRemote(s.remotePath(p))
+		}
+		if err == nil {
+			err = s.copier.Put(s.localPath(p), l, s.remotePath(p))
+		}
+		r, rok = l, true
+	case localWins:
+		change = Change{Path: p, Action: ActionDeleteRemote, Conflict: conflict}
+		err = s.copier.RemoveRemote(s.remotePath(p))
+		rok = false
+	case rok:
+		change = Change{Path: p, Action: ActionPull, Conflict: conflict}
+		if lok && r.Dir != l.Dir {
+			err = os.RemoveAll(s.localPath(p))
+		}
+		if err == nil {
+			err = s.copier.Get(s.remotePath(p), r, s.localPath(p))
+		}
+		l, lok = r, true
+	default:
+		change = Change{Path: p, Action: ActionDeleteLocal, Conflict: conflict}
+		err = os.RemoveAll(s.localPath(p))
+		lok = false
+	}
+	if err != nil {
+		change.Err = err
+		return change, true
+	}
+	s.record(p, l, lok, r, rok)
+	return change, true
+}
+
+// localWins settles a conflict by the policy
+func (s *Syncer) localWins(l transfer.Entry, lok bool, r transfer.Entry, rok bool) bool {
+	switch s.policy {
+	case PolicyLocal:
+		return true
+	case PolicyRemote:
+		return false
+	}
+	if lok != rok {
+		return lok
+	}
+	return !l.ModTime.Before(r.ModTime)
+}
+
+func (s *Syncer) record(p string, l transfer.Entry, lok bool, r transfer.Entry, rok bool) {
+	s.dirty = true
+	if lok {
+		s.baseLocal[p] = stateOf(l)
+	} else {
+		delete(s.baseLocal, p)
+	}
+	if rok {
+		s.baseRemote[p] = stateOf(r)
+	} else {
+		delete(s.baseRemote, p)
+	}
+}
+
+func (s *Syncer) forget(p string) {
+	s.dirty = true
+	delete(s.baseLocal, p)
+	delete(s.baseRemote, p)
+}
+
+func (s *Syncer) localPath(p string) string {
+	return filepath.Join(s.local, filepath.FromSlash(p))
+}
+
+func (s *Syncer) remotePath(p string) string {
+	if p == "" {
+		return s.remote
+	}
+	return strings.TrimSuffix(s.remote, "/") + "/" + p
+}
+
+func changed(e transfer.Entry, ok bool, base map[string]state, p string) bool {
+	b, had := base[p]
+	if ok != had {
+		return true
+	}
+	return ok && stateOf(e) != b
+}
+
+// topmost drops the paths under another one, "" is the whole directory
+func topmost(paths []string) []string {
+	sorted := append([]string{}, paths...)
+	sort.Strings(sorted)
+	var roots []string
+	for _, p := range sorted {
+		if !inAny(p, roots) {
+			roots = append(roots, p)
+		}
+	}
+	return roots
+}
+
+// inAny is whether p is one of roots or under one
+func inAny(p string, roots []string) bool {
+	for _, r := range roots {
+		if r == "" || p == r || strings.HasPrefix(p, r+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func joinRel(dir, name string) string {
+	if dir == "" || name == "" {
+		return dir + name
+	}
+	return dir + "/" + name
+}
+
+func underAny(p string, dirs []string) bool {
+	for _, d := range dirs {
+		if strings.HasPrefix(p, d+"/") {
+			return true
+		}
+	}
+	return false
+}
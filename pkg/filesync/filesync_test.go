@@ -0,0 +1,320 @@
+package filesync
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/transfer"
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIgnorer(t *testing.T) {
+	ig := NewIgnorer([]string{
+		"# comment",
+		"node_modules/",
+		"*.log",
+		"!keep.log",
+		"/build",
+		"docs/**/*.tmp",
+	})
+	for p, isDir := range map[string]bool{
+		".git":                true,
+		".git/config":         false,
+		"node_modules":        true,
+		"web/node_modules/x":  false,
+		"a.log":               false,
+		"dir/b.log":           false,
+		"build":               true,
+		"build/out":           false,
+		"docs/a/b/c.tmp":      false,
+		"docs/c.tmp":          false,
+		"file.brevpart":       false,
+		"dir/sub/file.tmp.go": false,
+	} {
+		expected := p != "dir/sub/file.tmp.go"
+		assert.Equal(t, expected, ig.Ignored(p, isDir), p)
+	}
+	assert.False(t, ig.Ignored("keep.log", false))
+	assert.False(t, ig.Ignored("node_modules", false), "dir only patterns skip files")
+	assert.False(t, ig.Ignored("src/build", true), "patterns with a slash are anchored")
+	assert.False(t, ig.Ignored("main.go", false))
+}
+
+func TestLoadIgnorer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "brev-sync-ignore")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir) //nolint:errcheck // test
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte("dist\n"), 0o644))
+
+	ig, err := LoadIgnorer(dir, []string{"*.bin"})
+	assert.Nil(t, err)
+	assert.True(t, ig.Ignored("dist", true))
+	assert.True(t, ig.Ignored("x.bin", false))
+	assert.False(t, ig.Ignored("x.go", false))
+}
+
+// serveSFTP serves this machine's files over sftp in process, standing in
+// for a workspace
+func serveSFTP(t *testing.T) *sftp.Client {
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverReader, serverWriter})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	go server.Serve() //nolint:errcheck // ends when the client closes
+	client, err := sftp.NewClientPipe(clientReader, clientWriter)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		// closing the server's end first ends the client's read loop
+		_ = server.Close()
+		_ = client.Close()
+	})
+	return client
+}
+
+func write(t *testing.T, p, content string, modTime time.Time) {
+	assert.Nil(t, os.MkdirAll(filepath.Dir(p), 0o755))
+	assert.Nil(t, ioutil.WriteFile(p, []byte(content), 0o644))
+	assert.Nil(t, os.Chtimes(p, modTime, modTime))
+}
+
+func read(t *testing.T, p string) string {
+	b, err := ioutil.ReadFile(p) //nolint:gosec // test
+	if err != nil {
+		return "<missing>"
+	}
+	return string(b)
+}
+
+func actions(changes []Change) map[string]Action {
+	m := map[string]Action{}
+	for _, c := range changes {
+		m[c.Path] = c.Action
+	}
+	return m
+}
+
+func TestSyncer(t *testing.T) {
+	root, err := ioutil.TempDir("", "brev-sync")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(root) //nolint:errcheck // test
+	local := filepath.Join(root, "local")
+	remote := filepath.Join(root, "remote")
+	assert.Nil(t, os.MkdirAll(local, 0o755))
+	assert.Nil(t, os.MkdirAll(remote, 0o755))
+
+	then := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write(t, filepath.Join(local, "main.go"), "package main", then)
+	write(t, filepath.Join(local, "node_modules", "dep.js"), "dep", then)
+	write(t, filepath.Join(remote, "out", "result.txt"), "42", then)
+	write(t, filepath.Join(local, "both.txt"), "old local", then)
+	write(t, filepath.Join(remote, "both.txt"), "new remote", then.Add(time.Minute))
+
+	s, err := NewSyncer(transfer.NewCopier(serveSFTP(t)), local, remote, NewIgnorer([]string{"node_modules/"}), PolicyNewer, nil)
+	assert.Nil(t, err)
+
+	changes, err := s.Sync()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]Action{
+		"main.go":        ActionPush,
+		"out":            ActionPull,
+		"out/result.txt": ActionPull,
+		"both.txt":       ActionPull,
+	}, actions(changes))
+	assert.Equal(t, "package main", read(t, filepath.Join(remote, "main.go")))
+	assert.Equal(t, "42", read(t, filepath.Join(local, "out", "result.txt")))
+	assert.Equal(t, "new remote", read(t, filepath.Join(local, "both.txt")))
+	assert.Equal(t, "<missing>", read(t, filepath.Join(remote, "node_modules", "dep.js")))
+
+	changes, err = s.Sync()
+	assert.Nil(t, err)
+	assert.Empty(t, changes, "nothing changed since the last sync")
+
+	// one sided changes and deletes
+	write(t, filepath.Join(local, "main.go"), "package main // edited", then.Add(2*time.Minute))
+	assert.Nil(t, os.RemoveAll(filepath.Join(remote, "out")))
+	changes, err = s.Sync()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]Action{"main.go": ActionPush, "out": ActionDeleteLocal}, actions(changes))
+	assert.Equal(t, "package main // edited", read(t, filepath.Join(remote, "main.go")))
+	_, err = os.Stat(filepath.Join(local, "out"))
+	assert.True(t, os.IsNotExist(err))
+
+	// both changed, the newer side wins
+	write(t, filepath.Join(local, "both.txt"), "newest local", then.Add(4*time.Minute))
+	write(t, filepath.Join(remote, "both.txt"), "newer remote", then.Add(3*time.Minute))
+	changes, err = s.Sync()
+	assert.Nil(t, err)
+	if assert.Len(t, changes, 1) {
+		assert.Equal(t, Change{Path: "both.txt", Action: ActionPush, Conflict: true}, changes[0])
+	}
+	assert.Equal(t, "newest local", read(t, filepath.Join(remote, "both.txt")))
+}
+
+func TestSyncerRemotePolicy(t *testing.T) {
+	root, err := ioutil.TempDir("", "brev-sync")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(root) //nolint:errcheck // test
+	local := filepath.Join(root, "local")
+	remote := filepath.Join(root, "remote")
+
+	then := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write(t, filepath.Join(local, "a.txt"), "local", then.Add(time.Minute))
+	write(t, filepath.Join(remote, "a.txt"), "remote", then)
+
+	s, err := NewSyncer(transfer.NewCopier(serveSFTP(t)), local, remote, NewIgnorer(nil), PolicyRemote, nil)
+	assert.Nil(t, err)
+	changes, err := s.Sync()
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{{Path: "a.txt", Action: ActionPull, Conflict: true}}, changes)
+	assert.Equal(t, "remote", read(t, filepath.Join(local, "a.txt")))
+}
+
+func TestSyncerRestartKeepsDeletes(t *testing.T) {
+	root, err := ioutil.TempDir("", "brev-sync")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(root) //nolint:errcheck // test
+	local := filepath.Join(root, "local")
+	remote := filepath.Join(root, "remote")
+	assert.Nil(t, os.MkdirAll(remote, 0o755))
+	then := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write(t, filepath.Join(local, "a.txt"), "a", then)
+	write(t, filepath.Join(local, "b.txt"), "b", then)
+
+	stateFile := NewStateFile(afero.NewMemMapFs(), "/syncs/app.state", Spec{Name: "app", LocalDir: local, RemoteDir: remote})
+	s, err := NewSyncer(transfer.NewCopier(serveSFTP(t)), local, remote, NewIgnorer(nil), PolicyNewer, stateFile)
+	assert.Nil(t, err)
+	_, err = s.Sync()
+	assert.Nil(t, err)
+	assert.Equal(t, "a", read(t, filepath.Join(remote, "a.txt")))
+
+	// deleted while no sync was running
+	assert.Nil(t, os.Remove(filepath.Join(local, "a.txt")))
+
+	s, err = NewSyncer(transfer.NewCopier(serveSFTP(t)), local, remote, NewIgnorer(nil), PolicyNewer, stateFile)
+	assert.Nil(t, err)
+	changes, err := s.Sync()
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{{Path: "a.txt", Action: ActionDeleteRemote}}, changes)
+	assert.Equal(t, "<missing>", read(t, filepath.Join(remote, "a.txt")))
+	assert.Equal(t, "b", read(t, filepath.Join(remote, "b.txt")))
+
+	// state saved for other directories is not used
+	other := NewStateFile(stateFile.fs, stateFile.path, Spec{Name: "app", LocalDir: local, RemoteDir: filepath.Join(root, "other")})
+	l, r, err := other.load()
+	assert.Nil(t, err)
+	assert.Empty(t, l)
+	assert.Empty(t, r)
+}
+
+func TestConfigAdd(t *testing.T) {
+	var c Config
+	assert.Nil(t, c.Add(Spec{Name: "a", LocalDir: "/src"}))
+	assert.NotNil(t, c.Add(Spec{Name: "a", LocalDir: "/other"}))
+	assert.NotNil(t, c.Add(Spec{Name: "b", LocalDir: "/src"}))
+	assert.Nil(t, c.Remove("a"))
+	assert.NotNil(t, c.Remove("a"))
+}
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy("local")
+	assert.Nil(t, err)
+	assert.Equal(t, PolicyLocal, p)
+	_, err = ParsePolicy("both")
+	assert.NotNil(t, err)
+}
+
+func TestSyncPaths(t *testing.T) {
+	root, err := ioutil.TempDir("", "brev-sync")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(root) //nolint:errcheck // test
+	local := filepath.Join(root, "local")
+	remote := filepath.Join(root, "remote")
+
+	then := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write(t, filepath.Join(local, "a", "x.txt"), "x", then)
+	write(t, filepath.Join(local, "b.txt"), "b", then)
+	assert.Nil(t, os.MkdirAll(remote, 0o755))
+	s, err := NewSyncer(transfer.NewCopier(serveSFTP(t)), local, remote, NewIgnorer(nil), PolicyNewer, nil)
+	assert.Nil(t, err)
+	_, err = s.Sync()
+	assert.Nil(t, err)
+
+	write(t, filepath.Join(local, "b.txt"), "b edited", then.Add(time.Minute))
+	write(t, filepath.Join(remote, "remote.txt"), "r", then)
+	assert.Nil(t, os.RemoveAll(filepath.Join(local, "a")))
+	changes, err := s.SyncPaths([]string{"a/x.txt", "a"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]Action{"a": ActionDeleteRemote}, actions(changes), "only the given paths are synced")
+	assert.Equal(t, "<missing>", read(t, filepath.Join(remote, "a", "x.txt")))
+	assert.Equal(t, "b", read(t, filepath.Join(remote, "b.txt")))
+
+	changes, err = s.Sync()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]Action{"b.txt": ActionPush, "remote.txt": ActionPull}, actions(changes))
+}
+
+func TestRunWatchesLocalChanges(t *testing.T) {
+	root, err := ioutil.TempDir("", "brev-sync")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(root) //nolint:errcheck // test
+	local := filepath.Join(root, "local")
+	remote := filepath.Join(root, "remote")
+	s, err := NewSyncer(transfer.NewCopier(serveSFTP(t)), local, remote, NewIgnorer([]string{"*.log"}), PolicyNewer, nil)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan Change, 10)
+	done := make(chan error, 1)
+	go func() {
+		// the workspace is not polled again during the test
+		done <- s.Run(ctx, time.Hour, func(c Change) { changes <- c })
+	}()
+	defer func() {
+		cancel()
+		assert.Nil(t, <-done)
+	}()
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(remote)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	now := time.Now()
+	write(t, filepath.Join(local, "new", "dir", "main.go"), "package main", now)
+	write(t, filepath.Join(local, "debug.log"), "ignored", now)
+	assert.Eventually(t, func() bool {
+		return read(t, filepath.Join(remote, "new", "dir", "main.go")) == "package main"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a directory created after the watch started is watched too
+	write(t, filepath.Join(local, "new", "dir", "util.go"), "package util", now)
+	assert.Eventually(t, func() bool {
+		return read(t, filepath.Join(remote, "new", "dir", "util.go")) == "package util"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "<missing>", read(t, filepath.Join(remote, "debug.log")))
+}
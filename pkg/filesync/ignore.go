@@ -0,0 +1,159 @@
+package filesync
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+)
+
+// alwaysIgnored are never synced, whatever .gitignore says
+var alwaysIgnored = []string{".git/", "*.brevpart"}
+
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Ignorer decides which paths are not synced, with .gitignore semantics:
+// rules are matched in order and the last match wins, "!" re-includes, a
+// trailing "/" only matches directories, and patterns containing a "/" are
+// relative to the synced root. Excluding a directory excludes everything in
+// it.
+type Ignorer struct {
+	rules []ignoreRule
+}
+
+// NewIgnorer builds an Ignorer from gitignore lines
+func NewIgnorer(lines []string) *Ignorer {
+	ig := &Ignorer{}
+	for _, line := range append(append([]string{}, alwaysIgnored...), lines...) {
+		rule, ok := parseIgnoreLine(line)
+		if ok {
+			ig.rules = append(ig.rules, rule)
+		}
+	}
+	return ig
+}
+
+// LoadIgnorer reads the .gitignore at the root of dir, if there is one, and
+// adds the extra patterns after it
+func LoadIgnorer(dir string, extra []string) (*Ignorer, error) {
+	var lines []string
+	f, err := os.Open(filepath.Join(dir, ".gitignore")) //nolint:gosec // the user picked the directory
+	switch {
+	case err == nil:
+		defer f.Close() //nolint:errcheck // only read
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, breverrors.WrapAndTrace(err)
+		}
+	case !os.IsNotExist(err):
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return NewIgnorer(append(lines, extra...)), nil
+}
+
+func parseIgnoreLine(line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	line = strings.TrimPrefix(line, `\`)
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	prefix := "^"
+	if !anchored {
+		prefix = "^(?:.*/)?"
+	}
+	re, err := regexp.Compile(prefix + globToRegexp(line) + "$")
+	if err != nil {
+		return ignoreRule{}, false
+	}
+	rule.re = re
+	return rule, true
+}
+
+// globToRegexp translates a gitignore glob, where * and ? do not match "/"
+// and ** matches any number of directories
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		ch := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case ch == '*':
+			b.WriteString("[^/]*")
+		case ch == '?':
+			b.WriteString("[^/]")
+		case ch == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case ch == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	return b.String()
+}
+
+// Ignored reports whether the slash separated path, relative to the synced
+// root, is excluded
+func (ig *Ignorer) Ignored(p string, isDir bool) bool {
+	parts := strings.Split(p, "/")
+	for i := 1; i < len(parts); i++ {
+		if ig.match(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return ig.match(p, isDir)
+}
+
+func (ig *Ignorer) match(p string, isDir bool) bool {
+	ignored := false
+	for _, rule := range ig.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(p) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,215 @@
+package filesync
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/huproxyclient"
+	"github.com/brevdev/brev-cli/pkg/portforward"
+	"github.com/brevdev/brev-cli/pkg/tasks"
+	"github.com/brevdev/brev-cli/pkg/transfer"
+	"github.com/pkg/sftp"
+)
+
+// DefaultPollInterval is how often the workspace is checked for changes,
+// local changes are watched
+const DefaultPollInterval = 30 * time.Second
+
+type ManagerStore interface {
+	GetWorkspace(workspaceID string) (*entity.Workspace, error)
+	GetCurrentUserKeys() (*entity.UserKeys, error)
+}
+
+// Connector opens an sftp session to a workspace to sync over
+type Connector interface {
+	Connect(ctx context.Context, workspace *entity.Workspace) (*sftp.Client, error)
+}
+
+// SSHConnector connects over the workspace's huproxy websocket
+type SSHConnector struct {
+	store ManagerStore
+	auth  huproxyclient.HubProxyAuth
+}
+
+func NewSSHConnector(store ManagerStore, auth huproxyclient.HubProxyAuth) *SSHConnector {
+	return &SSHConnector{store: store, auth: auth}
+}
+
+// Connect returns an sftp session that is closed with its tunnel when ctx is
+// done
+func (c SSHConnector) Connect(ctx context.Context, workspace *entity.Workspace) (*sftp.Client, error) {
+	keys, err := c.store.GetCurrentUserKeys()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	tunnel, err := portforward.NewSSHPortForwarder(c.auth, keys.PrivateKey).Connect(ctx, workspace.GetProxyURL())
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	client, err := tunnel.SFTP()
+	if err != nil {
+		_ = tunnel.Close()
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = client.Close()
+		_ = tunnel.Close()
+	}()
+	return client, nil
+}
+
+type running struct {
+	spec   Spec
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Manager is a run-tasks task that runs the configured syncs, restarts the
+// ones that failed and stops the ones that were removed. Syncs of
+// workspaces that are not running are retried on the next run.
+type Manager struct {
+	config    *Store
+	store     ManagerStore
+	connector Connector
+
+	mu      sync.Mutex
+	running map[string]*running
+}
+
+var _ tasks.StoppableTask = &Manager{}
+
+func NewManager(config *Store, store ManagerStore, connector Connector) *Manager {
+	return &Manager{
+		config:    config,
+		store:     store,
+		connector: connector,
+		running:   make(map[string]*running),
+	}
+}
+
+func (m *Manager) GetTaskSpec() tasks.TaskSpec {
+	return tasks.TaskSpec{
+		RunCronImmediately: true,
+		Cron:               "@every 10s",
+		Name:               "syncs",
+		Timeout:            time.Minute,
+		SkipIfRunning:      true,
+		Backoff:            10 * time.Second,
+		MaxBackoff:         5 * time.Minute,
+	}
+}
+
+func (m *Manager) Run() error {
+	c, err := m.config.Load()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	wanted := map[string]Spec{}
+	for _, s := range c.Syncs {
+		wanted[s.Name] = s
+	}
+
+	m.mu.Lock()
+	var toStop []*running
+	for name, r := range m.running {
+		spec, ok := wanted[name]
+		if ok && reflect.DeepEqual(spec, r.spec) && !isDone(r) {
+			delete(wanted, name)
+			continue
+		}
+		toStop = append(toStop, r)
+		delete(m.running, name)
+	}
+	m.mu.Unlock()
+	for _, r := range toStop {
+		r.cancel()
+		<-r.done
+	}
+
+	for _, s := range c.Syncs {
+		if _, ok := wanted[s.Name]; !ok {
+			continue
+		}
+		err := m.start(s)
+		if err != nil {
+			log.Printf("sync %s: %v", s.Name, err)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) start(s Spec) error {
+	workspace, err := m.store.GetWorkspace(s.WorkspaceID)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if workspace.Status != "RUNNING" {
+		return fmt.Errorf("workspace %s is %s, waiting for it to run", s.WorkspaceName, workspace.Status)
+	}
+	ignorer, err := LoadIgnorer(s.LocalDir, s.Excludes)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &running{spec: s, cancel: cancel, done: make(chan struct{})}
+	m.mu.Lock()
+	m.running[s.Name] = r
+	m.mu.Unlock()
+
+	log.Printf("sync %s: syncing %s with %s:%s", s.Name, s.LocalDir, s.WorkspaceName, s.RemoteDir)
+	go func() {
+		defer close(r.done)
+		remote, err := m.connector.Connect(ctx, workspace)
+		if err != nil {
+			log.Printf("sync %s: %v", s.Name, err)
+			return
+		}
+		stateFile, err := NewDefaultStateFile(s)
+		if err != nil {
+			log.Printf("sync %s: %v", s.Name, err)
+			return
+		}
+		syncer, err := NewSyncer(transfer.NewCopier(remote), s.LocalDir, s.RemoteDir, ignorer, s.Policy, stateFile)
+		if err != nil {
+			log.Printf("sync %s: %v", s.Name, err)
+			return
+		}
+		err = syncer.Run(ctx, DefaultPollInterval, func(c Change) {
+			log.Printf("sync %s: %s", s.Name, c)
+		})
+		if err != nil {
+			log.Printf("sync %s: %v", s.Name, err)
+		}
+	}()
+	return nil
+}
+
+// Stop stops every sync
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	all := m.running
+	m.running = make(map[string]*running)
+	m.mu.Unlock()
+	for _, r := range all {
+		r.cancel()
+		<-r.done
+	}
+}
+
+func isDone(r *running) bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
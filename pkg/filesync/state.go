@@ -0,0 +1,103 @@
+package filesync
+
+import (
+	"os"
+	"strings"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
+	"github.com/spf13/afero"
+)
+
+// savedState is the state both sides had after the last sync of the
+// directories it names
+type savedState struct {
+	LocalDir    string           `json:"localDir"`
+	WorkspaceID string           `json:"workspaceId"`
+	RemoteDir   string           `json:"remoteDir"`
+	Local       map[string]state `json:"local"`
+	Remote      map[string]state `json:"remote"`
+}
+
+// StateFile keeps the state of a sync after its last sync, so a sync
+// restarted by the daemon, reconnected after its connection dropped or run
+// again with brev sync still tells a file deleted on one side in the meantime
+// from a file new on the other
+type StateFile struct {
+	fs   afero.Fs
+	path string
+	spec Spec
+}
+
+func NewStateFile(fs afero.Fs, path string, spec Spec) *StateFile {
+	return &StateFile{fs: fs, path: path, spec: spec}
+}
+
+// NewDefaultStateFile keeps the state of spec under ~/.brev/syncs
+func NewDefaultStateFile(spec Spec) (*StateFile, error) {
+	path, err := files.GetSyncStatePath(stateFileName(spec.Name))
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return NewStateFile(files.AppFs, path, spec), nil
+}
+
+// RemoveDefaultStateFile removes the state of the sync named name, doing
+// nothing if there is none
+func RemoveDefaultStateFile(name string) error {
+	path, err := files.GetSyncStatePath(stateFileName(name))
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = files.AppFs.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func stateFileName(name string) string {
+	return strings.NewReplacer("/", "_", `\`, "_").Replace(name) + ".state"
+}
+
+// load returns empty states if none have been saved, or the saved ones are
+// of other directories
+func (f StateFile) load() (local, remote map[string]state, err error) {
+	local, remote = map[string]state{}, map[string]state{}
+	exists, err := afero.Exists(f.fs, f.path)
+	if err != nil {
+		return nil, nil, breverrors.WrapAndTrace(err)
+	}
+	if !exists {
+		return local, remote, nil
+	}
+	var saved savedState
+	err = files.ReadJSON(f.fs, f.path, &saved)
+	if err != nil {
+		return nil, nil, breverrors.WrapAndTrace(err)
+	}
+	if saved.LocalDir != f.spec.LocalDir || saved.WorkspaceID != f.spec.WorkspaceID || saved.RemoteDir != f.spec.RemoteDir {
+		return local, remote, nil
+	}
+	if saved.Local != nil {
+		local = saved.Local
+	}
+	if saved.Remote != nil {
+		remote = saved.Remote
+	}
+	return local, remote, nil
+}
+
+func (f StateFile) save(local, remote map[string]state) error {
+	err := files.WriteJSONAtomic(f.fs, f.path, savedState{
+		LocalDir:    f.spec.LocalDir,
+		WorkspaceID: f.spec.WorkspaceID,
+		RemoteDir:   f.spec.RemoteDir,
+		Local:       local,
+		Remote:      remote,
+	}, 0o644)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package filesync
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/fsnotify/fsnotify"
+)
+
+// settleDelay is how long local changes have to stop before they are synced,
+// so that a save or a checkout is synced at once rather than file by file
+var settleDelay = 200 * time.Millisecond
+
+// Run creates both directories and syncs everything once. Then it syncs
+// local changes as they happen and polls the workspace, where there is
+// nothing to watch, every pollInterval, until ctx is done or a side can not
+// be listed, which usually means the connection to the workspace is gone.
+func (s *Syncer) Run(ctx context.Context, pollInterval time.Duration, onChange func(Change)) error {
+	err := os.MkdirAll(s.local, 0o755)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = s.copier.MkdirRemote(s.remote)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer watcher.Close() //nolint:errcheck // nothing to do once the sync is over
+	// watching before the first sync so that no change is missed in between
+	s.watch(watcher, "")
+
+	report := func(changes []Change, err error) error {
+		for _, c := range changes {
+			onChange(c)
+		}
+		return err
+	}
+	err = report(s.Sync())
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	pending := map[string]bool{}
+	var settled <-chan time.Time
+	for err == nil {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			err = report(s.Sync())
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return fmt.Errorf("stopped watching %s", s.local)
+			}
+			rel, ok := s.watchedPath(event.Name)
+			if !ok {
+				continue
+			}
+			if event.Op&fsnotify.Create != 0 {
+				s.watch(watcher, rel)
+			}
+			pending[rel] = true
+			settled = time.After(settleDelay)
+		case _, ok := <-watcher.Errors:
+			if !ok {
+				return fmt.Errorf("stopped watching %s", s.local)
+			}
+			// events may have been dropped, compare everything
+			err = report(s.Sync())
+		case <-settled:
+			paths := make([]string, 0, len(pending))
+			for p := range pending {
+				paths = append(paths, p)
+			}
+			pending = map[string]bool{}
+			settled = nil
+			err = report(s.SyncPaths(paths))
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return breverrors.WrapAndTrace(err)
+}
+
+// watch adds the directories at and under sub that are synced to watcher.
+// Directories removed in the meantime are skipped, their removal is synced
+// on its own.
+func (s *Syncer) watch(watcher *fsnotify.Watcher, sub string) {
+	_ = filepath.Walk(s.localPath(sub), func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.local, p)
+		if err != nil {
+			return nil
+		}
+		if rel != "." && s.ignorer.Ignored(filepath.ToSlash(rel), true) {
+			return filepath.SkipDir
+		}
+		_ = watcher.Add(p)
+		return nil
+	})
+}
+
+// watchedPath is the synced path an event is about, and false for the
+// directory itself and ignored paths
+func (s *Syncer) watchedPath(name string) (string, bool) {
+	rel, err := filepath.Rel(s.local, name)
+	if err != nil || rel == "." {
+		return "", false
+	}
+	rel = filepath.ToSlash(rel)
+	info, err := os.Lstat(name)
+	isDir := err == nil && info.IsDir() || s.baseLocal[rel].Dir
+	return rel, !s.ignorer.Ignored(rel, isDir)
+}
@@ -0,0 +1,260 @@
+package forwards
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/localports"
+)
+
+// listeningPortsCommand prints the kernel's tcp socket tables, which every
+// workspace image has, unlike ss or netstat
+const listeningPortsCommand = "cat /proc/net/tcp /proc/net/tcp6 2>/dev/null"
+
+// tcpListen is the socket state of a listening socket in /proc/net/tcp
+const tcpListen = "0A"
+
+// DefaultIgnoredPorts are listeners every workspace has that are not worth
+// forwarding
+var DefaultIgnoredPorts = []int{22}
+
+// ParseProcNetTCP returns the sorted, deduplicated ports in the listen state
+// from the contents of /proc/net/tcp and /proc/net/tcp6
+func ParseProcNetTCP(table string) []int {
+	seen := map[int]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(table))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// sl local_address rem_address st ...
+		if len(fields) < 4 || fields[3] != tcpListen {
+			continue
+		}
+		i := strings.LastIndex(fields[1], ":")
+		if i < 0 {
+			continue
+		}
+		port, err := strconv.ParseInt(fields[1][i+1:], 16, 32)
+		if err != nil || port == 0 {
+			continue
+		}
+		seen[int(port)] = true
+	}
+	ports := make([]int, 0, len(seen))
+	for p := range seen {
+		ports = append(ports, p)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// PortNames names ports after the workspace's applications and template, so
+// 8080 shows up as "vscode" rather than just a number
+func PortNames(workspace entity.Workspace) map[int]string {
+	names := map[int]string{}
+	if workspace.WorkspaceTemplate.Port != 0 && workspace.WorkspaceTemplate.Name != "" {
+		names[workspace.WorkspaceTemplate.Port] = workspace.WorkspaceTemplate.Name
+	}
+	for _, a := range workspace.Applications {
+		if a.Port != 0 && a.Name != "" {
+			names[a.Port] = a.Name
+		}
+	}
+	return names
+}
+
+// AutoTunnel runs commands on and forwards ports from a workspace, as
+// portforward.SSHTunnel does
+type AutoTunnel interface {
+	Output(cmd string) ([]byte, error)
+	Forward(address, local, remote string) (net.Listener, error)
+}
+
+// AutoEvent is a change AutoForwarder made, or could not make, to the
+// forwarded ports
+type AutoEvent struct {
+	Port    int
+	Name    string // friendly name of the port, if known
+	Added   bool
+	Removed bool
+	Err     error // why the port is not forwarded
+}
+
+func (e AutoEvent) String() string {
+	port := strconv.Itoa(e.Port)
+	if e.Name != "" {
+		port = fmt.Sprintf("%d (%s)", e.Port, e.Name)
+	}
+	switch {
+	case e.Err != nil:
+		return fmt.Sprintf("not forwarding %s: %v", port, e.Err)
+	case e.Removed:
+		return fmt.Sprintf("stopped forwarding %s, nothing listens on it anymore", port)
+	default:
+		return fmt.Sprintf("forwarding %s to localhost:%d", port, e.Port)
+	}
+}
+
+// AutoForwarder forwards every port that a workspace listens on to the same
+// local port, and stops forwarding ports that are no longer listened on.
+// Ports that are taken locally, or fail to forward, are retried on every sync
+// but reported only once.
+type AutoForwarder struct {
+	tunnel  AutoTunnel
+	address string
+	names   map[int]string
+	ignored map[int]bool
+	isFree  localports.PortChecker
+
+	mu        sync.Mutex
+	listeners map[int]net.Listener
+	// ports not forwarded whose error was already reported
+	reported map[int]bool
+}
+
+func NewAutoForwarder(tunnel AutoTunnel, address string, names map[int]string, isFree localports.PortChecker) *AutoForwarder {
+	ignored := map[int]bool{}
+	for _, p := range DefaultIgnoredPorts {
+		ignored[p] = true
+	}
+	return &AutoForwarder{
+		tunnel:    tunnel,
+		address:   address,
+		names:     names,
+		ignored:   ignored,
+		isFree:    isFree,
+		listeners: map[int]net.Listener{},
+		reported:  map[int]bool{},
+	}
+}
+
+// Ignore stops ports from being forwarded
+func (a *AutoForwarder) Ignore(ports ...int) *AutoForwarder {
+	for _, p := range ports {
+		a.ignored[p] = true
+	}
+	return a
+}
+
+// Ports returns the ports currently forwarded
+func (a *AutoForwarder) Ports() []int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ports := make([]int, 0, len(a.listeners))
+	for p := range a.listeners {
+		ports = append(ports, p)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// Sync lists the workspace's listening ports once and adds and removes
+// forwards to match
+func (a *AutoForwarder) Sync() ([]AutoEvent, error) {
+	out, err := a.tunnel.Output(listeningPortsCommand)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	remote := map[int]bool{}
+	for _, p := range ParseProcNetTCP(string(out)) {
+		if !a.ignored[p] {
+			remote[p] = true
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var events []AutoEvent
+
+	for p, l := range a.listeners {
+		if remote[p] {
+			continue
+		}
+		_ = l.Close()
+		delete(a.listeners, p)
+		events = append(events, AutoEvent{Port: p, Name: a.names[p], Removed: true})
+	}
+	for p := range a.reported {
+		if !remote[p] {
+			delete(a.reported, p)
+		}
+	}
+
+	for _, p := range sortedKeys(remote) {
+		if _, ok := a.listeners[p]; ok {
+			continue
+		}
+		err := a.forward(p)
+		if err != nil {
+			if !a.reported[p] {
+				a.reported[p] = true
+				events = append(events, AutoEvent{Port: p, Name: a.names[p], Err: err})
+			}
+			continue
+		}
+		delete(a.reported, p)
+		events = append(events, AutoEvent{Port: p, Name: a.names[p], Added: true})
+	}
+	return events, nil
+}
+
+func (a *AutoForwarder) forward(p int) error {
+	if !a.isFree(a.address, p) {
+		return fmt.Errorf("local port %d is in use", p)
+	}
+	l, err := a.tunnel.Forward(a.address, strconv.Itoa(p), strconv.Itoa(p))
+	if err != nil {
+		return err //nolint:wrapcheck // shown to the user as is
+	}
+	a.listeners[p] = l
+	return nil
+}
+
+// Run syncs every interval until ctx is done or listing ports fails, calling
+// onEvent with every change
+func (a *AutoForwarder) Run(ctx context.Context, interval time.Duration, onEvent func(AutoEvent)) error {
+	defer a.Close()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		events, err := a.Sync()
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		for _, e := range events {
+			onEvent(e)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops every forward
+func (a *AutoForwarder) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for p, l := range a.listeners {
+		_ = l.Close()
+		delete(a.listeners, p)
+	}
+}
+
+func sortedKeys(m map[int]bool) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
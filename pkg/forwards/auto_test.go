@@ -0,0 +1,101 @@
+package forwards
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	"github.com/stretchr/testify/assert"
+)
+
+const procNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 2 1 0000000000000000 100 0 0 10 0
+   2: 0100007F:1F90 0100007F:A2B4 01 00000000:00000000 00:00000000 00000000  1000        0 3 1 0000000000000000 20 4 30 10 -1
+   3: 0100007F:A2B4 0100007F:1F90 01 00000000:00000000 00:00000000 00000000  1000        0 4 1 0000000000000000 20 4 30 10 -1
+  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000000000000:0BB8 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 5 1 0000000000000000 100 0 0 10 0
+   1: 00000000000000000000000000000000:1F90 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 6 1 0000000000000000 100 0 0 10 0
+`
+
+func TestParseProcNetTCP(t *testing.T) {
+	assert.Equal(t, []int{22, 3000, 8080}, ParseProcNetTCP(procNetTCP))
+	assert.Empty(t, ParseProcNetTCP(""))
+}
+
+func TestPortNames(t *testing.T) {
+	names := PortNames(entity.Workspace{
+		WorkspaceTemplate: entity.WorkspaceTemplate{Name: "ubuntu", Port: 22778},
+		Applications:      []entity.Application{{Name: "vscode", Port: 22778}, {Name: "jupyter", Port: 8888}, {Name: "none"}},
+	})
+	assert.Equal(t, map[int]string{22778: "vscode", 8888: "jupyter"}, names)
+}
+
+type fakeTunnel struct {
+	ports    []int
+	forwards map[string]*fakeListener
+}
+
+func (f *fakeTunnel) Output(string) ([]byte, error) {
+	var out string
+	for _, p := range f.ports {
+		out += "0: 00000000:" + strconv.FormatInt(int64(p), 16) + " 00000000:0000 0A\n"
+	}
+	return []byte(out), nil
+}
+
+func (f *fakeTunnel) Forward(address, local, remote string) (net.Listener, error) {
+	l := &fakeListener{}
+	f.forwards[local+":"+remote] = l
+	return l, nil
+}
+
+type fakeListener struct {
+	net.Listener
+	closed bool
+}
+
+func (l *fakeListener) Close() error {
+	l.closed = true
+	return nil
+}
+
+func TestAutoForwarderSync(t *testing.T) {
+	tunnel := &fakeTunnel{ports: []int{22, 3000, 8080}, forwards: map[string]*fakeListener{}}
+	inUse := map[int]bool{8080: true}
+	a := NewAutoForwarder(tunnel, DefaultAddress, map[int]string{3000: "web"}, func(_ string, port int) bool {
+		return !inUse[port]
+	})
+
+	events, err := a.Sync()
+	assert.Nil(t, err)
+	assert.Equal(t, []int{3000}, a.Ports())
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, AutoEvent{Port: 3000, Name: "web", Added: true}, events[0])
+		assert.Equal(t, 8080, events[1].Port)
+		assert.NotNil(t, events[1].Err)
+	}
+	assert.Contains(t, tunnel.forwards, "3000:3000")
+
+	// ports not forwarded are only reported once, but retried until they are
+	events, err = a.Sync()
+	assert.Nil(t, err)
+	assert.Empty(t, events)
+	delete(inUse, 8080)
+	events, err = a.Sync()
+	assert.Nil(t, err)
+	assert.Equal(t, []AutoEvent{{Port: 8080, Added: true}}, events)
+	assert.Equal(t, []int{3000, 8080}, a.Ports())
+
+	tunnel.ports = []int{22, 5432}
+	events, err = a.Sync()
+	assert.Nil(t, err)
+	assert.Equal(t, []int{5432}, a.Ports())
+	assert.ElementsMatch(t, []AutoEvent{{Port: 3000, Name: "web", Removed: true}, {Port: 8080, Removed: true}, {Port: 5432, Added: true}}, events)
+	assert.True(t, tunnel.forwards["3000:3000"].closed)
+
+	a.Close()
+	assert.Empty(t, a.Ports())
+	assert.True(t, tunnel.forwards["5432:5432"].closed)
+}
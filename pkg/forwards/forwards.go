@@ -0,0 +1,291 @@
+// Package forwards keeps the named port forwards that `brev forward` adds and
+// the run-tasks daemon keeps running in the background.
+package forwards
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
+	"github.com/brevdev/brev-cli/pkg/localports"
+	"github.com/spf13/afero"
+)
+
+const (
+	DefaultAddress = "localhost"
+	// maxFallbackAttempts is how many ports above a taken one are tried
+	maxFallbackAttempts = 100
+)
+
+type PortMapping struct {
+	Local  int `json:"local"`
+	Remote int `json:"remote"`
+}
+
+// ParsePortMapping parses "local:remote", or "port" to use the same port on
+// both ends
+func ParsePortMapping(s string) (PortMapping, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 2 {
+		return PortMapping{}, fmt.Errorf("invalid port mapping %q, expected local:remote or port", s)
+	}
+	remote, err := parsePort(parts[len(parts)-1])
+	if err != nil {
+		return PortMapping{}, fmt.Errorf("invalid port mapping %q: %w", s, err)
+	}
+	local := remote
+	if len(parts) == 2 {
+		local, err = parsePort(parts[0])
+		if err != nil {
+			return PortMapping{}, fmt.Errorf("invalid port mapping %q: %w", s, err)
+		}
+	}
+	return PortMapping{Local: local, Remote: remote}, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("%q is not a port", s)
+	}
+	return port, nil
+}
+
+func (p PortMapping) String() string {
+	return fmt.Sprintf("%d:%d", p.Local, p.Remote)
+}
+
+type Forward struct {
+	Name          string        `json:"name"`
+	WorkspaceID   string        `json:"workspaceId"`
+	WorkspaceName string        `json:"workspaceName"`
+	Address       string        `json:"address"`
+	Ports         []PortMapping `json:"ports"`
+	Reverse       []PortMapping `json:"reverse,omitempty"` // workspace ports forwarded to this machine
+	Via           string        `json:"via,omitempty"`     // portforward.ViaK8s if empty
+}
+
+// ParseReversePortMapping parses "remote:local", the order ssh -R uses
+func ParseReversePortMapping(s string) (PortMapping, error) {
+	p, err := ParsePortMapping(s)
+	if err != nil {
+		return PortMapping{}, err
+	}
+	return PortMapping{Local: p.Remote, Remote: p.Local}, nil
+}
+
+// ReverseString formats a reverse mapping as "remote:local"
+func (p PortMapping) ReverseString() string {
+	return fmt.Sprintf("%d:%d", p.Remote, p.Local)
+}
+
+// DefaultName is used when a forward is added without --name
+func DefaultName(workspaceName string, ports []PortMapping, reverse []PortMapping) string {
+	if len(ports) == 0 {
+		return fmt.Sprintf("%s-r%d", workspaceName, reverse[0].Remote)
+	}
+	return fmt.Sprintf("%s-%d", workspaceName, ports[0].Remote)
+}
+
+func (f Forward) PortStrings() []string {
+	ports := make([]string, len(f.Ports))
+	for i, p := range f.Ports {
+		ports[i] = p.String()
+	}
+	return ports
+}
+
+func (f Forward) ReverseStrings() []string {
+	ports := make([]string, len(f.Reverse))
+	for i, p := range f.Reverse {
+		ports[i] = p.ReverseString()
+	}
+	return ports
+}
+
+type Config struct {
+	Forwards []Forward `json:"forwards"`
+}
+
+func (c Config) Get(name string) (*Forward, bool) {
+	for i := range c.Forwards {
+		if c.Forwards[i].Name == name {
+			return &c.Forwards[i], true
+		}
+	}
+	return nil, false
+}
+
+// Reassignment records a local port that was taken and the port used instead
+type Reassignment struct {
+	From   int
+	To     int
+	Reason string
+}
+
+// Add adds the forward, moving any local port that another forward or
+// process already holds to the next free port above it
+func (c *Config) Add(f Forward, isFree localports.PortChecker) ([]Reassignment, error) {
+	if _, exists := c.Get(f.Name); exists {
+		return nil, fmt.Errorf("a forward named %s already exists, remove it with `brev forward rm %s` or pick another --name", f.Name, f.Name)
+	}
+	if len(f.Ports) == 0 && len(f.Reverse) == 0 {
+		return nil, fmt.Errorf("no ports to forward")
+	}
+	if f.Address == "" {
+		f.Address = DefaultAddress
+	}
+
+	var reassignments []Reassignment
+	taken := map[int]bool{}
+	for i, p := range f.Ports {
+		reason := c.conflict(f.Address, p.Local, taken, isFree)
+		if reason != "" {
+			port, err := c.fallbackPort(f.Address, p.Local, taken, isFree)
+			if err != nil {
+				return nil, breverrors.WrapAndTrace(err)
+			}
+			reassignments = append(reassignments, Reassignment{From: p.Local, To: port, Reason: reason})
+			f.Ports[i].Local = port
+		}
+		taken[f.Ports[i].Local] = true
+	}
+	c.Forwards = append(c.Forwards, f)
+	return reassignments, nil
+}
+
+// conflict says why the local port can not be used, or "" if it can
+func (c Config) conflict(address string, port int, taken map[int]bool, isFree localports.PortChecker) string {
+	if taken[port] {
+		return "listed twice"
+	}
+	for _, other := range c.Forwards {
+		if !addressesOverlap(address, other.Address) {
+			continue
+		}
+		for _, p := range other.Ports {
+			if p.Local == port {
+				return fmt.Sprintf("used by forward %s", other.Name)
+			}
+		}
+	}
+	if !isFree(address, port) {
+		return "in use by another process"
+	}
+	return ""
+}
+
+func (c Config) fallbackPort(address string, port int, taken map[int]bool, isFree localports.PortChecker) (int, error) {
+	for candidate := port + 1; candidate <= port+maxFallbackAttempts && candidate <= 65535; candidate++ {
+		if c.conflict(address, candidate, taken, isFree) == "" {
+			return candidate, nil
+		}
+	}
+	return 0, fmt.Errorf("no free local port found between %d and %d", port+1, port+maxFallbackAttempts)
+}
+
+// addressesOverlap is true if listening on both addresses would collide
+func addressesOverlap(a, b string) bool {
+	if isWildcard(a) || isWildcard(b) {
+		return true
+	}
+	return normalizeAddress(a) == normalizeAddress(b)
+}
+
+func isWildcard(address string) bool {
+	return address == "0.0.0.0" || address == "::" || address == "*"
+}
+
+func normalizeAddress(address string) string {
+	if address == "" || address == "127.0.0.1" || address == "::1" {
+		return DefaultAddress
+	}
+	return address
+}
+
+// Remove removes the named forwards, failing without changes if any of them
+// do not exist
+func (c *Config) Remove(names ...string) error {
+	remove := map[string]bool{}
+	for _, name := range names {
+		if _, ok := c.Get(name); !ok {
+			return fmt.Errorf("no forward named %s, see `brev forward ls`", name)
+		}
+		remove[name] = true
+	}
+	var kept []Forward
+	for _, f := range c.Forwards {
+		if !remove[f.Name] {
+			kept = append(kept, f)
+		}
+	}
+	c.Forwards = kept
+	return nil
+}
+
+// Store reads and writes the config shared by the cli and the daemon
+type Store struct {
+	fs   afero.Fs
+	path string
+}
+
+func NewStore(fs afero.Fs, path string) *Store {
+	return &Store{fs: fs, path: path}
+}
+
+func NewDefaultStore() (*Store, error) {
+	path, err := files.GetForwardsPath()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return NewStore(files.AppFs, path), nil
+}
+
+// Load returns an empty config if none has been saved
+func (s Store) Load() (*Config, error) {
+	exists, err := afero.Exists(s.fs, s.path)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	if !exists {
+		return &Config{}, nil
+	}
+	var c Config
+	err = files.ReadJSON(s.fs, s.path, &c)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return &c, nil
+}
+
+// Save replaces the config atomically so the daemon never reads a partially
+// written one
+func (s Store) Save(c *Config) error {
+	err := files.WriteJSONAtomic(s.fs, s.path, c, 0o644)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// Update loads the config, applies fn and saves the result if fn succeeds. It
+// holds a lock on the file, so a concurrent update is not lost.
+func (s Store) Update(fn func(c *Config) error) error {
+	err := files.WithFileLock(s.fs, s.path, func() error {
+		c, err := s.Load()
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		err = fn(c)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		return s.Save(c)
+	})
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package forwards
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func allFree(string, int) bool { return true }
+
+func TestParsePortMapping(t *testing.T) {
+	p, err := ParsePortMapping("8080:80")
+	assert.Nil(t, err)
+	assert.Equal(t, PortMapping{Local: 8080, Remote: 80}, p)
+
+	p, err = ParsePortMapping("5432")
+	assert.Nil(t, err)
+	assert.Equal(t, PortMapping{Local: 5432, Remote: 5432}, p)
+
+	for _, invalid := range []string{"", "a:80", "80:b", "1:2:3", "0", "70000"} {
+		_, err = ParsePortMapping(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestParseReversePortMapping(t *testing.T) {
+	p, err := ParseReversePortMapping("9000:3000")
+	assert.Nil(t, err)
+	assert.Equal(t, PortMapping{Local: 3000, Remote: 9000}, p)
+	assert.Equal(t, "9000:3000", p.ReverseString())
+	assert.Equal(t, "ws-r9000", DefaultName("ws", nil, []PortMapping{p}))
+}
+
+func TestAddFallsBackFromPortUsedByForward(t *testing.T) {
+	c := &Config{}
+	_, err := c.Add(Forward{Name: "web", Ports: []PortMapping{{Local: 8080, Remote: 80}}}, allFree)
+	assert.Nil(t, err)
+
+	reassignments, err := c.Add(Forward{Name: "api", Ports: []PortMapping{{Local: 8080, Remote: 8080}}}, allFree)
+	assert.Nil(t, err)
+	assert.Equal(t, []Reassignment{{From: 8080, To: 8081, Reason: "used by forward web"}}, reassignments)
+	f, ok := c.Get("api")
+	assert.True(t, ok)
+	assert.Equal(t, 8081, f.Ports[0].Local)
+	assert.Equal(t, DefaultAddress, f.Address)
+}
+
+func TestAddFallsBackFromPortInUse(t *testing.T) {
+	c := &Config{}
+	inUse := func(_ string, port int) bool { return port != 5432 && port != 5433 }
+	reassignments, err := c.Add(Forward{Name: "db", Ports: []PortMapping{{Local: 5432, Remote: 5432}, {Local: 5434, Remote: 6379}}}, inUse)
+	assert.Nil(t, err)
+	// the first port skips 5433, which is also in use, and takes 5434 from
+	// the second port
+	assert.Equal(t, []Reassignment{{From: 5432, To: 5434, Reason: "in use by another process"}, {From: 5434, To: 5435, Reason: "listed twice"}}, reassignments)
+}
+
+func TestAddOnDifferentAddresses(t *testing.T) {
+	c := &Config{}
+	_, err := c.Add(Forward{Name: "a", Address: "192.168.1.2", Ports: []PortMapping{{Local: 80, Remote: 80}}}, allFree)
+	assert.Nil(t, err)
+
+	reassignments, err := c.Add(Forward{Name: "b", Address: "localhost", Ports: []PortMapping{{Local: 80, Remote: 80}}}, allFree)
+	assert.Nil(t, err)
+	assert.Empty(t, reassignments)
+
+	reassignments, err = c.Add(Forward{Name: "c", Address: "0.0.0.0", Ports: []PortMapping{{Local: 80, Remote: 80}}}, allFree)
+	assert.Nil(t, err)
+	assert.Len(t, reassignments, 1)
+}
+
+func TestAddDuplicateName(t *testing.T) {
+	c := &Config{}
+	_, err := c.Add(Forward{Name: "a", Ports: []PortMapping{{Local: 80, Remote: 80}}}, allFree)
+	assert.Nil(t, err)
+	_, err = c.Add(Forward{Name: "a", Ports: []PortMapping{{Local: 90, Remote: 90}}}, allFree)
+	assert.NotNil(t, err)
+}
+
+func TestRemove(t *testing.T) {
+	c := &Config{Forwards: []Forward{{Name: "a"}, {Name: "b"}, {Name: "c"}}}
+	assert.NotNil(t, c.Remove("a", "missing"))
+	assert.Len(t, c.Forwards, 3)
+
+	assert.Nil(t, c.Remove("a", "c"))
+	assert.Equal(t, []Forward{{Name: "b"}}, c.Forwards)
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	s := NewStore(afero.NewMemMapFs(), "/home/.brev/forwards.json")
+	c, err := s.Load()
+	assert.Nil(t, err)
+	assert.Empty(t, c.Forwards)
+
+	err = s.Update(func(c *Config) error {
+		_, err := c.Add(Forward{Name: "a", WorkspaceID: "ws", Ports: []PortMapping{{Local: 80, Remote: 80}}}, allFree)
+		return err
+	})
+	assert.Nil(t, err)
+
+	c, err = s.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, []Forward{{Name: "a", WorkspaceID: "ws", Address: DefaultAddress, Ports: []PortMapping{{Local: 80, Remote: 80}}}}, c.Forwards)
+}
+
+type fakeManagerStore struct {
+	mu     sync.Mutex
+	status string
+}
+
+func (s *fakeManagerStore) GetCurrentUserKeys() (*entity.UserKeys, error) {
+	return &entity.UserKeys{}, nil
+}
+
+func (s *fakeManagerStore) GetWorkspace(workspaceID string) (*entity.Workspace, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &entity.Workspace{ID: workspaceID, Status: s.status}, nil
+}
+
+func (s *fakeManagerStore) GetWorkspaceMetaData(_ string) (*entity.WorkspaceMetaData, error) {
+	return &entity.WorkspaceMetaData{}, nil
+}
+
+type fakeForwarder struct {
+	mu     sync.Mutex
+	active map[string][]string
+	starts int
+}
+
+func (f *fakeForwarder) Forward(ctx context.Context, workspace entity.WorkspaceWithMeta, fwd Forward) error {
+	f.mu.Lock()
+	f.active[workspace.ID] = fwd.PortStrings()
+	f.starts++
+	f.mu.Unlock()
+	<-ctx.Done()
+	f.mu.Lock()
+	delete(f.active, workspace.ID)
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *fakeForwarder) snapshot() (map[string][]string, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	active := map[string][]string{}
+	for k, v := range f.active {
+		active[k] = v
+	}
+	return active, f.starts
+}
+
+func TestManagerReconciles(t *testing.T) {
+	config := NewStore(afero.NewMemMapFs(), "/forwards.json")
+	store := &fakeManagerStore{status: "STOPPED"}
+	forwarder := &fakeForwarder{active: map[string][]string{}}
+	m := NewManager(config, store, forwarder)
+	defer m.Stop()
+
+	assert.Nil(t, config.Save(&Config{Forwards: []Forward{{Name: "a", WorkspaceID: "ws1", Ports: []PortMapping{{Local: 80, Remote: 80}}}}}))
+	assert.Nil(t, m.Run())
+	active, _ := waitForActive(forwarder, 0)
+	assert.Empty(t, active)
+
+	store.mu.Lock()
+	store.status = "RUNNING"
+	store.mu.Unlock()
+	assert.Nil(t, m.Run())
+	active, _ = waitForActive(forwarder, 1)
+	assert.Equal(t, map[string][]string{"ws1": {"80:80"}}, active)
+
+	// unchanged forwards are left alone
+	assert.Nil(t, m.Run())
+	_, starts := forwarder.snapshot()
+	assert.Equal(t, 1, starts)
+
+	assert.Nil(t, config.Save(&Config{Forwards: []Forward{{Name: "b", WorkspaceID: "ws2", Ports: []PortMapping{{Local: 90, Remote: 90}}}}}))
+	assert.Nil(t, m.Run())
+	active, _ = waitForActive(forwarder, 1)
+	assert.Equal(t, map[string][]string{"ws2": {"90:90"}}, active)
+}
+
+func waitForActive(f *fakeForwarder, n int) (map[string][]string, int) {
+	for i := 0; i < 100; i++ {
+		active, starts := f.snapshot()
+		if len(active) == n {
+			return active, starts
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return f.snapshot()
+}
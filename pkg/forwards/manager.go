@@ -0,0 +1,234 @@
+package forwards
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/huproxyclient"
+	"github.com/brevdev/brev-cli/pkg/k8s"
+	"github.com/brevdev/brev-cli/pkg/portforward"
+	"github.com/brevdev/brev-cli/pkg/tasks"
+)
+
+type ManagerStore interface {
+	k8s.K8sStore
+	GetWorkspace(workspaceID string) (*entity.Workspace, error)
+	GetWorkspaceMetaData(workspaceID string) (*entity.WorkspaceMetaData, error)
+}
+
+type Forwarder interface {
+	// Forward blocks until the forward fails or ctx is done
+	Forward(ctx context.Context, workspace entity.WorkspaceWithMeta, f Forward) error
+}
+
+// DefaultForwarder forwards through the k8s api of the workspace's group or
+// over ssh, as the forward asks. Clients and keys are fetched on use so the
+// daemon starts without network, the k8s clients only for forwards that need
+// them.
+type DefaultForwarder struct {
+	store  k8s.K8sStore
+	auth   huproxyclient.HubProxyAuth
+	mu     sync.Mutex
+	mapper *k8s.DefaultWorkspaceGroupClientMapper
+}
+
+func NewDefaultForwarder(store k8s.K8sStore, auth huproxyclient.HubProxyAuth) *DefaultForwarder {
+	return &DefaultForwarder{store: store, auth: auth}
+}
+
+func (d *DefaultForwarder) getMapper() (*k8s.DefaultWorkspaceGroupClientMapper, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.mapper == nil {
+		mapper, err := k8s.NewDefaultWorkspaceGroupClientMapper(d.store)
+		if err != nil {
+			return nil, breverrors.WrapAndTrace(err)
+		}
+		d.mapper = mapper
+	}
+	return d.mapper, nil
+}
+
+func (d *DefaultForwarder) makeOptions(f Forward) (*portforward.PortForwardOptions, error) {
+	if f.Via == portforward.ViaSSH {
+		keys, err := d.store.GetCurrentUserKeys()
+		if err != nil {
+			return nil, breverrors.WrapAndTrace(err)
+		}
+		return portforward.NewPortForwardOptions(nil, portforward.NewSSHPortForwarder(d.auth, keys.PrivateKey)), nil
+	}
+	mapper, err := d.getMapper()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return portforward.NewPortForwardOptions(mapper, portforward.NewDefaultPortForwarder()), nil
+}
+
+func (d *DefaultForwarder) Forward(ctx context.Context, workspace entity.WorkspaceWithMeta, f Forward) error {
+	pf, err := d.makeOptions(f)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	_, err = pf.WithWorkspace(workspace)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	pf.WithAddress(f.Address).WithPorts(f.PortStrings()).WithReversePorts(f.ReverseStrings())
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(pf.StopChannel)
+		case <-done:
+		}
+	}()
+
+	err = pf.Forward()
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return fmt.Errorf("port forward ended")
+}
+
+type running struct {
+	spec   Forward
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Manager is a run-tasks task that starts the configured forwards, restarts
+// the ones that failed and stops the ones that were removed. Forwards to
+// workspaces that are not running are retried on the next run.
+type Manager struct {
+	config    *Store
+	store     ManagerStore
+	forwarder Forwarder
+
+	mu      sync.Mutex
+	running map[string]*running
+}
+
+var _ tasks.StoppableTask = &Manager{}
+
+func NewManager(config *Store, store ManagerStore, forwarder Forwarder) *Manager {
+	return &Manager{
+		config:    config,
+		store:     store,
+		forwarder: forwarder,
+		running:   make(map[string]*running),
+	}
+}
+
+func (m *Manager) GetTaskSpec() tasks.TaskSpec {
+	return tasks.TaskSpec{
+		RunCronImmediately: true,
+		Cron:               "@every 10s",
+		Name:               "forwards",
+		Timeout:            time.Minute,
+		SkipIfRunning:      true,
+		Backoff:            10 * time.Second,
+		MaxBackoff:         5 * time.Minute,
+	}
+}
+
+func (m *Manager) Run() error {
+	c, err := m.config.Load()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	wanted := map[string]Forward{}
+	for _, f := range c.Forwards {
+		wanted[f.Name] = f
+	}
+
+	m.mu.Lock()
+	var toStop []*running
+	for name, r := range m.running {
+		spec, ok := wanted[name]
+		if ok && reflect.DeepEqual(spec, r.spec) && !isDone(r) {
+			delete(wanted, name)
+			continue
+		}
+		toStop = append(toStop, r)
+		delete(m.running, name)
+	}
+	m.mu.Unlock()
+	for _, r := range toStop {
+		r.cancel()
+		<-r.done
+	}
+
+	for _, f := range c.Forwards {
+		if _, ok := wanted[f.Name]; !ok {
+			continue
+		}
+		err := m.start(f)
+		if err != nil {
+			log.Printf("forward %s: %v", f.Name, err)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) start(f Forward) error {
+	workspace, err := m.store.GetWorkspace(f.WorkspaceID)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if workspace.Status != "RUNNING" {
+		return fmt.Errorf("workspace %s is %s, waiting for it to run", f.WorkspaceName, workspace.Status)
+	}
+	meta, err := m.store.GetWorkspaceMetaData(f.WorkspaceID)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &running{spec: f, cancel: cancel, done: make(chan struct{})}
+	m.mu.Lock()
+	m.running[f.Name] = r
+	m.mu.Unlock()
+
+	log.Printf("forward %s: forwarding %v on %s to %s, reverse %v", f.Name, f.PortStrings(), f.Address, f.WorkspaceName, f.ReverseStrings())
+	go func() {
+		defer close(r.done)
+		err := m.forwarder.Forward(ctx, entity.WorkspaceWithMeta{Workspace: *workspace, WorkspaceMetaData: *meta}, f)
+		if err != nil {
+			log.Printf("forward %s: %v", f.Name, err)
+		}
+	}()
+	return nil
+}
+
+// Stop stops every forward
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	all := m.running
+	m.running = make(map[string]*running)
+	m.mu.Unlock()
+	for _, r := range all {
+		r.cancel()
+		<-r.done
+	}
+}
+
+func isDone(r *running) bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,153 @@
+package huproxyclient
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/gorilla/websocket"
+)
+
+// CloseReason explains why a proxy session ended
+type CloseReason string
+
+const (
+	CloseReasonNormal           CloseReason = "normal"
+	CloseReasonWorkspaceStopped CloseReason = "workspace_stopped"
+	CloseReasonNetwork          CloseReason = "network"
+	CloseReasonAuth             CloseReason = "auth"
+	CloseReasonCanceled         CloseReason = "canceled"
+	CloseReasonProtocol         CloseReason = "protocol"
+	CloseReasonUnknown          CloseReason = "unknown"
+)
+
+// exit codes stay clear of 255, which ssh uses for its own failures
+const (
+	exitCodeUnknown              = 1
+	exitCodeNetwork              = 11
+	exitCodeWorkspaceUnavailable = 12
+	exitCodeAuth                 = 13
+	exitCodeProtocol             = 14
+	exitCodeCanceled             = 130 // same as a shell interrupted by SIGINT
+)
+
+// SessionEndedError is returned when the websocket session could not be
+// established or ended for any reason other than a normal close
+type SessionEndedError struct {
+	Reason     CloseReason
+	StatusCode int // http status of a failed dial, 0 otherwise
+	Err        error
+}
+
+var _ error = &SessionEndedError{}
+
+func (e *SessionEndedError) Error() string {
+	msg := fmt.Sprintf("proxy session ended [reason=%s]", e.Reason)
+	if e.StatusCode != 0 {
+		msg = fmt.Sprintf("%s [status=%d]", msg, e.StatusCode)
+	}
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s: %v", msg, e.Err)
+	}
+	return msg
+}
+
+func (e *SessionEndedError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SessionEndedError) Directive() string {
+	var brevErr breverrors.BrevError
+	if errors.As(e.Err, &brevErr) && brevErr.Directive() != "" {
+		return brevErr.Directive()
+	}
+	switch e.Reason {
+	case CloseReasonWorkspaceStopped:
+		return "the workspace is not reachable, it may have been stopped or deleted. check `brev ls` and run `brev start <name>`"
+	case CloseReasonNetwork:
+		return "lost connection to the workspace, check your internet connection and reconnect"
+	case CloseReasonAuth:
+		return "your credentials were rejected, run `brev login`"
+	case CloseReasonProtocol:
+		return "the workspace proxy sent an unexpected message, try upgrading the cli"
+	default:
+		return ""
+	}
+}
+
+// ExitCode maps the close reason to a process exit code so that callers
+// like ssh can surface why the session ended
+func (e *SessionEndedError) ExitCode() int {
+	switch e.Reason {
+	case CloseReasonNormal:
+		return 0
+	case CloseReasonNetwork:
+		return exitCodeNetwork
+	case CloseReasonWorkspaceStopped:
+		return exitCodeWorkspaceUnavailable
+	case CloseReasonAuth:
+		return exitCodeAuth
+	case CloseReasonProtocol:
+		return exitCodeProtocol
+	case CloseReasonCanceled:
+		return exitCodeCanceled
+	default:
+		return exitCodeUnknown
+	}
+}
+
+// ExitCode returns the exit code for any error returned from this package
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var sessionErr *SessionEndedError
+	if errors.As(err, &sessionErr) {
+		return sessionErr.ExitCode()
+	}
+	return exitCodeUnknown
+}
+
+func isRetryable(err error) bool {
+	var sessionErr *SessionEndedError
+	if !errors.As(err, &sessionErr) {
+		return false
+	}
+	return sessionErr.Reason == CloseReasonNetwork || sessionErr.Reason == CloseReasonWorkspaceStopped
+}
+
+func classifyDialError(resp *http.Response, err error) *SessionEndedError {
+	if resp == nil {
+		return &SessionEndedError{Reason: CloseReasonNetwork, Err: err}
+	}
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &SessionEndedError{Reason: CloseReasonAuth, StatusCode: resp.StatusCode, Err: err}
+	case http.StatusNotFound, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return &SessionEndedError{Reason: CloseReasonWorkspaceStopped, StatusCode: resp.StatusCode, Err: err}
+	default:
+		return &SessionEndedError{Reason: CloseReasonUnknown, StatusCode: resp.StatusCode, Err: err}
+	}
+}
+
+func classifyReadError(err error) *SessionEndedError {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		switch closeErr.Code {
+		case websocket.CloseNormalClosure:
+			return &SessionEndedError{Reason: CloseReasonNormal, Err: err}
+		case websocket.CloseGoingAway, websocket.CloseServiceRestart, websocket.CloseTryAgainLater:
+			return &SessionEndedError{Reason: CloseReasonWorkspaceStopped, Err: err}
+		case websocket.ClosePolicyViolation:
+			return &SessionEndedError{Reason: CloseReasonAuth, Err: err}
+		case websocket.CloseUnsupportedData, websocket.CloseProtocolError:
+			return &SessionEndedError{Reason: CloseReasonProtocol, Err: err}
+		default:
+			return &SessionEndedError{Reason: CloseReasonNetwork, Err: err}
+		}
+	}
+	// anything else, including a missed pong deadline, means the
+	// connection itself went away
+	return &SessionEndedError{Reason: CloseReasonNetwork, Err: err}
+}
@@ -5,106 +5,272 @@ package huproxyclient
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"time"
 
-	"github.com/brevdev/brev-cli/pkg/entity"
-	"github.com/brevdev/brev-cli/pkg/errors"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 
 	huproxy "github.com/google/huproxy/lib"
 )
 
-var writeTimeout = 10 * time.Second
+type HubProxyAuth interface {
+	GetAccessToken() (string, error)
+}
 
-type HubProxyStore interface {
-	GetAuthTokens() (*entity.AuthTokens, error)
+type Options struct {
+	DialTimeout  time.Duration // per attempt, includes the websocket handshake
+	DialRetries  int           // extra attempts made if the workspace or network is unreachable
+	RetryBackoff time.Duration // doubled after every failed attempt
+	PingInterval time.Duration
+	PongWait     time.Duration // must be larger than PingInterval
+	WriteTimeout time.Duration
 }
 
-func dialError(url string, resp *http.Response, err error) {
-	if resp != nil {
-		extra := ""
-		b, err1 := ioutil.ReadAll(resp.Body)
-		if err1 != nil {
-			log.Warningf("Failed to read HTTP body: %v", err1)
-		}
-		extra = "Body:\n" + string(b)
-		log.Fatalf("%s: HTTP error: %d %s\n%s", err, resp.StatusCode, resp.Status, extra)
+func DefaultOptions() Options {
+	return Options{
+		DialTimeout:  15 * time.Second,
+		DialRetries:  3,
+		RetryBackoff: time.Second,
+		PingInterval: 20 * time.Second,
+		PongWait:     60 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+}
+
+type Client struct {
+	url  string
+	auth HubProxyAuth
+	opts Options
+}
 
+func NewClient(url string, auth HubProxyAuth) *Client {
+	return &Client{
+		url:  url,
+		auth: auth,
+		opts: DefaultOptions(),
 	}
-	log.Fatalf("Dial to %q fail: %v", url, err)
 }
 
-func Run(url string, store HubProxyStore) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+func (c *Client) WithOptions(opts Options) *Client {
+	c.opts = opts
+	return c
+}
 
-	dialer := websocket.Dialer{}
-	dialer.TLSClientConfig = new(tls.Config)
+// Run bridges stdin/stdout with the workspace proxy until either side closes
+func Run(ctx context.Context, url string, auth HubProxyAuth, opts Options) error {
+	err := NewClient(url, auth).WithOptions(opts).Run(ctx, os.Stdin, os.Stdout)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
 
-	head := map[string][]string{}
+func (c Client) Run(ctx context.Context, in io.Reader, out io.Writer) error {
+	conn, err := c.Dial(ctx)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer conn.Close() //nolint:errcheck // closing is best effort once the session is over
 
-	token, err := store.GetAuthTokens()
+	err = c.RunProxy(ctx, conn, in, out)
 	if err != nil {
-		return errors.WrapAndTrace(err)
+		return breverrors.WrapAndTrace(err)
 	}
+	return nil
+}
 
-	head["Authorization"] = []string{
-		"Bearer " + token.AccessToken,
+// DialConn connects to the proxy and returns the session as a net.Conn for
+// protocols that run on top of it, such as an ssh client. The session ends
+// when the conn is closed or ctx is done.
+func (c Client) DialConn(ctx context.Context) (net.Conn, error) {
+	conn, err := c.Dial(ctx)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
 	}
+	local, remote := net.Pipe()
+	go func() {
+		defer conn.Close() //nolint:errcheck // closing is best effort once the session is over
+		err := c.RunProxy(ctx, conn, remote, remote)
+		if err != nil {
+			log.Debugf("proxy session ended: %v", err)
+		}
+		_ = remote.Close()
+	}()
+	return local, nil
+}
 
-	conn, resp, err := dialer.Dial(url, head)
+// Dial connects to the proxy, refreshing the access token and retrying
+// with backoff when the failure looks transient
+func (c Client) Dial(ctx context.Context) (*websocket.Conn, error) {
+	backoff := c.opts.RetryBackoff
+	var lastErr error
+	for attempt := 0; attempt <= c.opts.DialRetries; attempt++ {
+		if attempt > 0 {
+			log.Warnf("could not reach workspace, retrying in %s (%d/%d): %v", backoff, attempt, c.opts.DialRetries, lastErr)
+			select {
+			case <-ctx.Done():
+				return nil, &SessionEndedError{Reason: CloseReasonCanceled, Err: ctx.Err()}
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		conn, err := c.dialOnce(ctx)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if !isRetryable(err) {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+func (c Client) dialOnce(ctx context.Context) (*websocket.Conn, error) {
+	token, err := c.auth.GetAccessToken()
 	if err != nil {
-		dialError(url, resp, err)
+		return nil, &SessionEndedError{Reason: CloseReasonAuth, Err: err}
+	}
+	if token == "" {
+		return nil, &SessionEndedError{Reason: CloseReasonAuth, Err: fmt.Errorf("not logged in")}
+	}
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: c.opts.DialTimeout,
+		TLSClientConfig:  new(tls.Config),
 	}
-	defer conn.Close() //nolint:errcheck // lazy to refactor
+	head := http.Header{}
+	head.Set("Authorization", "Bearer "+token)
 
-	RunProxy(ctx, conn, cancel)
+	dialCtx, cancel := context.WithTimeout(ctx, c.opts.DialTimeout)
+	defer cancel()
+	conn, resp, err := dialer.DialContext(dialCtx, c.url, head)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, &SessionEndedError{Reason: CloseReasonCanceled, Err: ctx.Err()}
+		}
+		return nil, dialError(c.url, resp, err)
+	}
+	return conn, nil
+}
 
-	if ctx.Err() != nil {
-		return errors.WrapAndTrace(ctx.Err())
+func dialError(url string, resp *http.Response, err error) error {
+	sessionErr := classifyDialError(resp, err)
+	if resp != nil {
+		b, err1 := ioutil.ReadAll(resp.Body)
+		if err1 != nil {
+			log.Warningf("Failed to read HTTP body: %v", err1)
+		}
+		sessionErr.Err = fmt.Errorf("%v: HTTP error: %s\nBody:\n%s", err, resp.Status, string(b))
+		return sessionErr
 	}
-	return nil
+	sessionErr.Err = fmt.Errorf("dial to %q failed: %w", url, err)
+	return sessionErr
 }
 
-func RunProxy(ctx context.Context, conn *websocket.Conn, cancel context.CancelFunc) {
-	// websocket -> stdout
+// RunProxy copies websocket messages to out and in to the websocket while
+// keeping the connection alive with pings. A nil return means the session
+// was closed normally by either side.
+func (c Client) RunProxy(ctx context.Context, conn *websocket.Conn, in io.Reader, out io.Writer) error {
+	readErrs := make(chan error, 1)
+	writeErrs := make(chan error, 1)
+
+	err := conn.SetReadDeadline(time.Now().Add(c.opts.PongWait))
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(c.opts.PongWait))
+	})
+
+	// websocket -> out
 	go func() {
-		for {
-			mt, r, err := conn.NextReader()
-			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
-				return
-			}
+		readErrs <- copyFromWebsocket(conn, out)
+	}()
+
+	// in -> websocket
+	writeCtx, writeCancel := context.WithCancel(ctx)
+	defer writeCancel()
+	go func() {
+		// TODO: NextWriter() seems to be broken.
+		writeErrs <- huproxy.File2WS(writeCtx, writeCancel, in, conn)
+	}()
+
+	ticker := time.NewTicker(c.opts.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.sendClose(conn, websocket.CloseGoingAway)
+			return &SessionEndedError{Reason: CloseReasonCanceled, Err: ctx.Err()}
+		case <-ticker.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.opts.WriteTimeout))
 			if err != nil {
-				log.Warn("Workspace disconnect: may be from network failure or workspace was stopped/deleted")
-				log.Fatal(err)
+				return &SessionEndedError{Reason: CloseReasonNetwork, Err: err}
+			}
+		case err := <-readErrs:
+			sessionErr := classifyReadError(err)
+			if sessionErr.Reason == CloseReasonNormal {
+				return nil
 			}
-			if mt != websocket.BinaryMessage {
-				log.Fatal("non-binary websocket message received")
+			return sessionErr
+		case err := <-writeErrs:
+			if ctx.Err() != nil {
+				c.sendClose(conn, websocket.CloseGoingAway)
+				return &SessionEndedError{Reason: CloseReasonCanceled, Err: ctx.Err()}
 			}
-			if _, err := io.Copy(os.Stdout, r); err != nil {
-				log.Errorf("Reading from websocket: %v", err)
-				cancel()
+			if err == nil || err == io.EOF {
+				// local side is done, let the remote finish flushing
+				c.sendClose(conn, websocket.CloseNormalClosure)
+				return c.waitForRemoteClose(readErrs)
 			}
+			return &SessionEndedError{Reason: CloseReasonNetwork, Err: err}
 		}
-	}()
+	}
+}
+
+func copyFromWebsocket(conn *websocket.Conn, out io.Writer) error {
+	for {
+		mt, r, err := conn.NextReader()
+		if err != nil {
+			return err //nolint:wrapcheck // classified by the caller
+		}
+		if mt != websocket.BinaryMessage {
+			return &websocket.CloseError{Code: websocket.CloseUnsupportedData, Text: "non-binary websocket message received"}
+		}
+		if _, err := io.Copy(out, r); err != nil {
+			return fmt.Errorf("reading from websocket: %w", err)
+		}
+	}
+}
+
+func (c Client) sendClose(conn *websocket.Conn, code int) {
+	err := conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, ""),
+		time.Now().Add(c.opts.WriteTimeout))
+	if err != nil && err != websocket.ErrCloseSent {
+		log.Errorf("Error sending 'close' message: %v", err)
+	}
+}
 
-	// stdin -> websocket
-	// TODO: NextWriter() seems to be broken.
-	if err := huproxy.File2WS(ctx, cancel, os.Stdin, conn); err == io.EOF {
-		if err1 := conn.WriteControl(websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
-			time.Now().Add(writeTimeout)); err1 == websocket.ErrCloseSent {
-			_ = ""
-		} else if err1 != nil {
-			log.Errorf("Error sending 'close' message: %v", err1)
+func (c Client) waitForRemoteClose(readErrs chan error) error {
+	select {
+	case err := <-readErrs:
+		sessionErr := classifyReadError(err)
+		if sessionErr.Reason == CloseReasonNormal {
+			return nil
 		}
-	} else if err != nil {
-		log.Errorf("reading from stdin: %v", err)
-		cancel()
+		return sessionErr
+	case <-time.After(c.opts.WriteTimeout):
+		return nil
 	}
 }
@@ -1 +1,105 @@
 package huproxyclient
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+type dummyAuth struct {
+	token string
+}
+
+func (d dummyAuth) GetAccessToken() (string, error) {
+	return d.token, nil
+}
+
+func testOptions() Options {
+	return Options{
+		DialTimeout:  time.Second,
+		DialRetries:  1,
+		RetryBackoff: time.Millisecond,
+		PingInterval: 50 * time.Millisecond,
+		PongWait:     time.Second,
+		WriteTimeout: time.Second,
+	}
+}
+
+func wsURL(s *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+func newEchoServer(t *testing.T) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer conn.Close() //nolint:errcheck // test
+		for {
+			mt, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			err = conn.WriteMessage(mt, b)
+			if err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func TestRunEchoesUntilStdinCloses(t *testing.T) {
+	s := newEchoServer(t)
+	defer s.Close()
+
+	out := &bytes.Buffer{}
+	c := NewClient(wsURL(s), dummyAuth{"good"}).WithOptions(testOptions())
+	err := c.Run(context.Background(), strings.NewReader("hello"), out)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", out.String())
+}
+
+func TestDialUnauthorizedIsNotRetried(t *testing.T) {
+	s := newEchoServer(t)
+	defer s.Close()
+
+	c := NewClient(wsURL(s), dummyAuth{"bad"}).WithOptions(testOptions())
+	_, err := c.Dial(context.Background())
+	assert.NotNil(t, err)
+	assert.Equal(t, exitCodeAuth, ExitCode(err))
+}
+
+func TestDialNotLoggedIn(t *testing.T) {
+	c := NewClient("ws://localhost:1", dummyAuth{""}).WithOptions(testOptions())
+	_, err := c.Dial(context.Background())
+	assert.Equal(t, exitCodeAuth, ExitCode(err))
+}
+
+func TestDialUnreachableIsNetwork(t *testing.T) {
+	s := newEchoServer(t)
+	url := wsURL(s)
+	s.Close()
+
+	c := NewClient(url, dummyAuth{"good"}).WithOptions(testOptions())
+	_, err := c.Dial(context.Background())
+	assert.Equal(t, exitCodeNetwork, ExitCode(err))
+}
+
+func TestClassifyReadError(t *testing.T) {
+	assert.Equal(t, CloseReasonNormal, classifyReadError(&websocket.CloseError{Code: websocket.CloseNormalClosure}).Reason)
+	assert.Equal(t, CloseReasonWorkspaceStopped, classifyReadError(&websocket.CloseError{Code: websocket.CloseGoingAway}).Reason)
+	assert.Equal(t, CloseReasonNetwork, classifyReadError(&websocket.CloseError{Code: websocket.CloseAbnormalClosure}).Reason)
+}
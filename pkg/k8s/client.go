@@ -2,11 +2,17 @@ package k8s
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/brevdev/brev-cli/pkg/entity"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport"
 
 	breverrors "github.com/brevdev/brev-cli/pkg/errors"
 )
@@ -33,26 +39,33 @@ type K8sClientConfig interface {
 	GetCA() []byte
 }
 
-func NewDefaultClient(config K8sClientConfig) K8sClient {
-	restConfig := dynamic.ConfigFor(&rest.Config{
-		Host:    config.GetHost(),
-		APIPath: "/api",
-		TLSClientConfig: rest.TLSClientConfig{
-			CertData: config.GetCert(),
-			KeyData:  config.GetKey(),
-			CAData:   config.GetCA(),
-		},
-	})
+// NewDefaultClient returns a client authenticated with config's
+// certificate. wrap, if not nil, wraps its transport.
+func NewDefaultClient(config K8sClientConfig, wrap transport.WrapperFunc) (K8sClient, error) {
+	restConfig := newRestConfig(config)
+	restConfig.WrapTransport = wrap
 
 	k8sClient, err := kubernetes.NewForConfig(restConfig)
 	if err != nil {
-		panic(err)
+		return nil, breverrors.WrapAndTrace(err)
 	}
 
 	return &DefaultClient{
 		k8sClientset:  k8sClient,
 		k8sRestConfig: restConfig,
-	}
+	}, nil
+}
+
+func newRestConfig(config K8sClientConfig) *rest.Config {
+	return dynamic.ConfigFor(&rest.Config{
+		Host:    config.GetHost(),
+		APIPath: "/api",
+		TLSClientConfig: rest.TLSClientConfig{
+			CertData: config.GetCert(),
+			KeyData:  config.GetKey(),
+			CAData:   config.GetCA(),
+		},
+	})
 }
 
 func (c DefaultClient) GetK8sClient() *kubernetes.Clientset {
@@ -63,10 +76,16 @@ func (c DefaultClient) GetK8sRestConfig() *rest.Config {
 	return c.k8sRestConfig
 }
 
+// DefaultWorkspaceGroupClientMapper builds the client of a workspace group
+// the first time it is asked for, from cached keys. Clients are rebuilt with
+// renewed keys before their certificate expires, and requests the cluster
+// rejects with a 401 are retried once with renewed keys.
 type DefaultWorkspaceGroupClientMapper struct {
-	workspaceK8sClientMap map[string]K8sClient
-	workspaceK8sAPIURLMap map[string]string
-	privateKey            string
+	cache *KeyCache
+
+	mu      sync.Mutex
+	keys    *entity.UserKeys
+	clients map[string]K8sClient
 }
 
 type K8sStore interface {
@@ -74,45 +93,195 @@ type K8sStore interface {
 }
 
 func NewDefaultWorkspaceGroupClientMapper(k8sStore K8sStore) (*DefaultWorkspaceGroupClientMapper, error) {
-	keys, err := k8sStore.GetCurrentUserKeys()
+	cache, err := NewDefaultKeyCache(k8sStore)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	mapper, err := NewWorkspaceGroupClientMapper(cache)
 	if err != nil {
 		return nil, breverrors.WrapAndTrace(err)
 	}
+	return mapper, nil
+}
 
-	wkc := make(map[string]K8sClient)
-	wka := make(map[string]string)
-	for _, wk := range keys.WorkspaceGroups {
-		rcc := RemoteK8sClientConfig{
-			host: wk.APIURL,
-			cert: []byte(wk.Cert),
-			key:  []byte(keys.PrivateKey),
-			ca:   []byte(wk.CA),
-		}
-		wkc[wk.GroupID] = NewDefaultClient(rcc)
-		wka[wk.GroupID] = wk.APIURL
+func NewWorkspaceGroupClientMapper(cache *KeyCache) (*DefaultWorkspaceGroupClientMapper, error) {
+	keys, err := cache.GetCurrentUserKeys()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
 	}
+	return &DefaultWorkspaceGroupClientMapper{cache: cache, keys: keys, clients: make(map[string]K8sClient)}, nil
+}
+
+func (d *DefaultWorkspaceGroupClientMapper) GetK8sClient(workspaceGroupID string) (K8sClient, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	return &DefaultWorkspaceGroupClientMapper{workspaceK8sClientMap: wkc, workspaceK8sAPIURLMap: wka, privateKey: keys.PrivateKey}, nil
+	wk, err := d.groupKeys(workspaceGroupID)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	if client, ok := d.clients[workspaceGroupID]; ok {
+		return client, nil
+	}
+	client, err := d.newClient(*wk)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	d.clients[workspaceGroupID] = client
+	return client, nil
 }
 
-func (d DefaultWorkspaceGroupClientMapper) GetK8sClient(workspaceGroupID string) (K8sClient, error) {
-	client, doesExists := d.workspaceK8sClientMap[workspaceGroupID]
-	if !doesExists {
+func (d *DefaultWorkspaceGroupClientMapper) GetK8sAPIURL(workspaceGroupID string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	wk, err := d.groupKeys(workspaceGroupID)
+	if err != nil {
+		return "", fmt.Errorf("k8s api url for workspace group does not exist [workspace group id=%s]", workspaceGroupID)
+	}
+	return wk.APIURL, nil
+}
+
+func (d *DefaultWorkspaceGroupClientMapper) GetPrivateKey() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.keys.PrivateKey
+}
+
+// groupKeys renews the keys if the group is new to them or its certificate
+// is about to expire. Callers hold mu.
+func (d *DefaultWorkspaceGroupClientMapper) groupKeys(workspaceGroupID string) (*entity.WorkspaceGroupKeys, error) {
+	wk, err := d.keys.GetWorkspaceGroupKeysByGroupID(workspaceGroupID)
+	if err == nil && !d.cache.expiring(*wk) {
+		return wk, nil
+	}
+	err = d.renewLocked()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	wk, err = d.keys.GetWorkspaceGroupKeysByGroupID(workspaceGroupID)
+	if err != nil {
 		return nil, fmt.Errorf("client for workspace group does not exist [workspace group id=%s]", workspaceGroupID)
 	}
+	return wk, nil
+}
+
+// renewLocked fetches the keys and drops the clients built from the old
+// ones. Callers hold mu.
+func (d *DefaultWorkspaceGroupClientMapper) renewLocked() error {
+	keys, err := d.cache.Refresh()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	d.keys = keys
+	d.clients = make(map[string]K8sClient)
+	return nil
+}
+
+// renewTransport is called when the cluster rejects the group's certificate.
+// It returns a transport with the renewed certificate for the rejected
+// request to be retried on.
+func (d *DefaultWorkspaceGroupClientMapper) renewTransport(workspaceGroupID string) (http.RoundTripper, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	err := d.renewLocked()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	wk, err := d.keys.GetWorkspaceGroupKeysByGroupID(workspaceGroupID)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	rt, err := rest.TransportFor(newRestConfig(d.clientConfig(*wk)))
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return rt, nil
+}
+
+func (d *DefaultWorkspaceGroupClientMapper) newClient(wk entity.WorkspaceGroupKeys) (K8sClient, error) {
+	client, err := NewDefaultClient(d.clientConfig(wk), func(rt http.RoundTripper) http.RoundTripper {
+		return &renewingRoundTripper{rt: rt, renew: func() (http.RoundTripper, error) {
+			return d.renewTransport(wk.GroupID)
+		}}
+	})
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
 	return client, nil
 }
 
-func (d DefaultWorkspaceGroupClientMapper) GetK8sAPIURL(workspaceGroupID string) (string, error) {
-	url, doesExists := d.workspaceK8sAPIURLMap[workspaceGroupID]
-	if !doesExists {
-		return "", fmt.Errorf("k8s api url for workspace group does not exist [workspace group id=%s]", workspaceGroupID)
+func (d *DefaultWorkspaceGroupClientMapper) clientConfig(wk entity.WorkspaceGroupKeys) RemoteK8sClientConfig {
+	return RemoteK8sClientConfig{
+		host: wk.APIURL,
+		cert: []byte(wk.Cert),
+		key:  []byte(d.keys.PrivateKey),
+		ca:   []byte(wk.CA),
 	}
-	return url, nil
 }
 
-func (d DefaultWorkspaceGroupClientMapper) GetPrivateKey() string {
-	return d.privateKey
+// renewingRoundTripper retries a request the cluster rejects with a 401
+// once, with a renewed certificate, and sends every later request with it.
+// Upgrades, as for exec and port-forward, can not be retried and fail, but
+// the next one succeeds.
+type renewingRoundTripper struct {
+	mu    sync.Mutex
+	rt    http.RoundTripper
+	renew func() (http.RoundTripper, error)
+}
+
+func (r *renewingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	rt := r.rt
+	r.mu.Unlock()
+
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		return res, nil
+	}
+	renewed, err := r.renew()
+	if err != nil {
+		return res, nil
+	}
+	r.mu.Lock()
+	r.rt = renewed
+	r.mu.Unlock()
+
+	retry, ok := replay(req)
+	if !ok {
+		return res, nil
+	}
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	_ = res.Body.Close()
+	res, err = renewed.RoundTrip(retry)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return res, nil
+}
+
+// replay copies a request to send it again, if its body can be read again
+// and it is not an upgrade
+func replay(req *http.Request) (*http.Request, bool) {
+	if strings.EqualFold(req.Header.Get("Connection"), "upgrade") {
+		return nil, false
+	}
+	retry := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, false
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, false
+		}
+		retry.Body = body
+	}
+	return retry, true
 }
 
 type RemoteK8sClientConfig struct {
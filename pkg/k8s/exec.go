@@ -0,0 +1,112 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// LoginShell runs bash as a login shell where the image has it, otherwise sh
+var LoginShell = []string{"/bin/sh", "-c", "if command -v bash >/dev/null 2>&1; then exec bash -l; else exec sh -l; fi"}
+
+type ExecOptions struct {
+	Container string   // the pod's default container if empty
+	Command   []string // LoginShell if empty
+	Stdin     io.Reader
+	Stdout    io.Writer
+	Stderr    io.Writer // unused with TTY, the terminal carries both
+	TTY       bool
+	SizeQueue remotecommand.TerminalSizeQueue
+}
+
+// Exec runs a command in the workspace's pod through the k8s api, like
+// kubectl exec. It does not need the workspace's ssh server or its proxy. A
+// command that exits non-zero returns a k8s.io/client-go/util/exec.ExitError.
+func Exec(ctx context.Context, client K8sClient, meta entity.WorkspaceMetaData, opts ExecOptions) error {
+	container, err := execContainer(ctx, client.GetK8sClient(), meta, opts.Container)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	opts.Container = container
+
+	restConfig := client.GetK8sRestConfig()
+	execURL, err := ExecURL(restConfig.Host, meta, opts)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	executor, err := remotecommand.NewSPDYExecutor(restConfig, "POST", execURL)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	streamOpts := remotecommand.StreamOptions{
+		Stdin:             opts.Stdin,
+		Stdout:            opts.Stdout,
+		Stderr:            opts.Stderr,
+		Tty:               opts.TTY,
+		TerminalSizeQueue: opts.SizeQueue,
+	}
+	if opts.TTY {
+		streamOpts.Stderr = nil
+	}
+	err = executor.Stream(streamOpts)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func execContainer(ctx context.Context, client kubernetes.Interface, meta entity.WorkspaceMetaData, name string) (string, error) {
+	pod, err := client.CoreV1().Pods(meta.GetNamespaceName()).Get(ctx, meta.GetPodName(), metav1.GetOptions{})
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	if pod.Status.Phase != corev1.PodRunning {
+		return "", fmt.Errorf("pod %s is %s, not running", pod.Name, strings.ToLower(string(pod.Status.Phase)))
+	}
+	container, err := PickContainer(pod, name)
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	return container, nil
+}
+
+// ExecURL is the exec subresource of the workspace's pod on the k8s api at
+// host
+func ExecURL(host string, meta entity.WorkspaceMetaData, opts ExecOptions) (*url.URL, error) {
+	u, err := url.Parse(fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s/exec", strings.TrimSuffix(host, "/"), meta.GetNamespaceName(), meta.GetPodName()))
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	command := opts.Command
+	if len(command) == 0 {
+		command = LoginShell
+	}
+	q := url.Values{}
+	q.Set("container", opts.Container)
+	for _, c := range command {
+		q.Add("command", c)
+	}
+	if opts.Stdin != nil {
+		q.Set("stdin", "true")
+	}
+	if opts.Stdout != nil {
+		q.Set("stdout", "true")
+	}
+	if opts.Stderr != nil && !opts.TTY {
+		q.Set("stderr", "true")
+	}
+	if opts.TTY {
+		q.Set("tty", "true")
+	}
+	u.RawQuery = q.Encode()
+	return u, nil
+}
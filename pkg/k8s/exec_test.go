@@ -0,0 +1,47 @@
+package k8s
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestExecURL(t *testing.T) {
+	u, err := ExecURL("https://k8s.example.com/", meta, ExecOptions{Container: "workspace", Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr, TTY: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "/api/v1/namespaces/ws-ns/pods/ws-pod/exec", u.Path)
+	q := u.Query()
+	assert.Equal(t, LoginShell, q["command"])
+	assert.Equal(t, "workspace", q.Get("container"))
+	assert.Equal(t, "true", q.Get("tty"))
+	assert.Equal(t, "true", q.Get("stdin"))
+	assert.Empty(t, q.Get("stderr"), "a tty carries stderr")
+
+	u, err = ExecURL("https://k8s.example.com", meta, ExecOptions{Container: "workspace", Command: []string{"ls", "-a"}, Stdout: os.Stdout, Stderr: os.Stderr})
+	assert.Nil(t, err)
+	q = u.Query()
+	assert.Equal(t, []string{"ls", "-a"}, q["command"])
+	assert.Equal(t, "true", q.Get("stderr"))
+	assert.Empty(t, q.Get("stdin"))
+	assert.Empty(t, q.Get("tty"))
+}
+
+func TestExecContainer(t *testing.T) {
+	pod := newPod("workspace", "sidecar")
+	client := fake.NewSimpleClientset(pod)
+	_, err := execContainer(context.Background(), client, meta, "")
+	assert.NotNil(t, err, "a pending pod can not exec")
+
+	pod.Status.Phase = corev1.PodRunning
+	client = fake.NewSimpleClientset(pod)
+	name, err := execContainer(context.Background(), client, meta, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "workspace", name)
+	name, err = execContainer(context.Background(), client, meta, "sidecar")
+	assert.Nil(t, err)
+	assert.Equal(t, "sidecar", name)
+}
@@ -0,0 +1,159 @@
+package k8s
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
+	"github.com/spf13/afero"
+)
+
+// RenewBefore is how long before a workspace group certificate expires that
+// keys are fetched again
+const RenewBefore = 10 * time.Minute
+
+// KeyCache keeps the current user's keys on disk so that each command does
+// not have to fetch them. Keys are fetched again when a certificate is about
+// to expire, or on Refresh, as when the cluster rejects a certificate.
+type KeyCache struct {
+	store K8sStore
+	fs    afero.Fs
+	path  string
+	now   func() time.Time
+}
+
+var _ K8sStore = &KeyCache{}
+
+func NewKeyCache(store K8sStore, fs afero.Fs, path string) *KeyCache {
+	return &KeyCache{store: store, fs: fs, path: path, now: time.Now}
+}
+
+func NewDefaultKeyCache(store K8sStore) (*KeyCache, error) {
+	path, err := files.GetUserKeysCachePath()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return NewKeyCache(store, files.AppFs, path), nil
+}
+
+// ClearDefaultKeyCache forgets the cached keys, as when the user changes
+func ClearDefaultKeyCache() error {
+	cache, err := NewDefaultKeyCache(nil)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = cache.Clear()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// GetCurrentUserKeys returns the cached keys while their certificates are
+// good for at least RenewBefore, otherwise fetches them
+func (c *KeyCache) GetCurrentUserKeys() (*entity.UserKeys, error) {
+	keys, err := c.load()
+	// an unreadable cache is as good as an empty one
+	if err == nil && keys != nil && c.fresh(*keys) {
+		return keys, nil
+	}
+	keys, err = c.Refresh()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return keys, nil
+}
+
+// Refresh fetches the keys and caches them
+func (c *KeyCache) Refresh() (*entity.UserKeys, error) {
+	keys, err := c.store.GetCurrentUserKeys()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	// failing to cache only costs a fetch next time
+	_ = c.save(keys)
+	return keys, nil
+}
+
+// Clear removes the cached keys, if any
+func (c *KeyCache) Clear() error {
+	exists, err := afero.Exists(c.fs, c.path)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if !exists {
+		return nil
+	}
+	err = c.fs.Remove(c.path)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func (c *KeyCache) fresh(keys entity.UserKeys) bool {
+	for _, wk := range keys.WorkspaceGroups {
+		if c.expiring(wk) {
+			return false
+		}
+	}
+	return true
+}
+
+// expiring is true if the group's certificate expires within RenewBefore or
+// can not be read
+func (c *KeyCache) expiring(wk entity.WorkspaceGroupKeys) bool {
+	notAfter, err := CertNotAfter(wk.Cert)
+	if err != nil {
+		return true
+	}
+	return !c.now().Add(RenewBefore).Before(notAfter)
+}
+
+func (c *KeyCache) load() (*entity.UserKeys, error) {
+	exists, err := afero.Exists(c.fs, c.path)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	var keys entity.UserKeys
+	err = files.ReadJSON(c.fs, c.path, &keys)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return &keys, nil
+}
+
+// save keeps the keys readable by the user only, they include the private
+// key
+func (c *KeyCache) save(keys *entity.UserKeys) error {
+	err := c.fs.MkdirAll(filepath.Dir(c.path), 0o700)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = files.WriteJSONAtomic(c.fs, c.path, keys, 0o600)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// CertNotAfter is when the first certificate in a PEM bundle expires
+func CertNotAfter(certPEM string) (time.Time, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return time.Time{}, fmt.Errorf("no PEM certificate found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, breverrors.WrapAndTrace(err)
+	}
+	return cert.NotAfter, nil
+}
@@ -0,0 +1,184 @@
+package k8s
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// certPEM returns a self signed certificate and its private key
+func certPEM(t *testing.T, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "brev"},
+		NotBefore:    notAfter.Add(-24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+type fakeKeyStore struct {
+	keys  []entity.UserKeys // returned in turn, the last one repeatedly
+	calls int
+}
+
+func (f *fakeKeyStore) GetCurrentUserKeys() (*entity.UserKeys, error) {
+	i := f.calls
+	if i >= len(f.keys) {
+		i = len(f.keys) - 1
+	}
+	f.calls++
+	keys := f.keys[i]
+	return &keys, nil
+}
+
+func userKeys(cert, key string, groups ...string) entity.UserKeys {
+	keys := entity.UserKeys{PrivateKey: key}
+	for _, g := range groups {
+		keys.WorkspaceGroups = append(keys.WorkspaceGroups, entity.WorkspaceGroupKeys{GroupID: g, Cert: cert, APIURL: "https://" + g + ".example.com"})
+	}
+	return keys
+}
+
+func TestKeyCacheHonorsNotAfter(t *testing.T) {
+	now := time.Now()
+	cert, key := certPEM(t, now.Add(time.Hour))
+	store := &fakeKeyStore{keys: []entity.UserKeys{userKeys(cert, key, "g1")}}
+	fs := afero.NewMemMapFs()
+	cache := NewKeyCache(store, fs, "/home/.brev/user_keys_cache.json")
+	cache.now = func() time.Time { return now }
+
+	keys, err := cache.GetCurrentUserKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, key, keys.PrivateKey)
+	_, err = NewKeyCache(store, fs, "/home/.brev/user_keys_cache.json").GetCurrentUserKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, store.calls, "a second command reads the cache")
+
+	info, err := fs.Stat("/home/.brev/user_keys_cache.json")
+	assert.Nil(t, err)
+	assert.Equal(t, "-rw-------", info.Mode().String())
+
+	cache.now = func() time.Time { return now.Add(time.Hour - RenewBefore) }
+	_, err = cache.GetCurrentUserKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, store.calls, "keys are renewed before the certificate expires")
+
+	assert.Nil(t, cache.Clear())
+	assert.Nil(t, cache.Clear())
+	_, err = cache.GetCurrentUserKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, store.calls)
+}
+
+func TestMapperIsLazyAndRenewsForNewGroups(t *testing.T) {
+	cert, key := certPEM(t, time.Now().Add(time.Hour))
+	store := &fakeKeyStore{keys: []entity.UserKeys{userKeys(cert, key, "g1"), userKeys(cert, key, "g1", "g2")}}
+	mapper, err := NewWorkspaceGroupClientMapper(NewKeyCache(store, afero.NewMemMapFs(), "/keys.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, key, mapper.GetPrivateKey())
+	assert.Empty(t, mapper.clients)
+
+	c1, err := mapper.GetK8sClient("g1")
+	assert.Nil(t, err)
+	again, err := mapper.GetK8sClient("g1")
+	assert.Nil(t, err)
+	assert.True(t, c1 == again)
+	assert.Equal(t, 1, store.calls)
+
+	url, err := mapper.GetK8sAPIURL("g2")
+	assert.Nil(t, err, "a group missing from the cached keys is fetched")
+	assert.Equal(t, "https://g2.example.com", url)
+	assert.Equal(t, 2, store.calls)
+
+	_, err = mapper.GetK8sClient("g3")
+	assert.NotNil(t, err)
+
+	store.keys = []entity.UserKeys{{PrivateKey: "not a key", WorkspaceGroups: []entity.WorkspaceGroupKeys{{GroupID: "g4", Cert: cert}}}}
+	_, err = mapper.GetK8sClient("g4")
+	assert.NotNil(t, err, "bad keys are an error, not a panic")
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func respond(status int, hits *int) roundTripFunc {
+	return func(req *http.Request) (*http.Response, error) {
+		*hits++
+		if req.Body != nil {
+			b, _ := ioutil.ReadAll(req.Body)
+			if string(b) != "payload" {
+				return nil, fmt.Errorf("body %q was not replayed", b)
+			}
+		}
+		return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}
+}
+
+func TestRenewingRoundTripperRetriesOn401(t *testing.T) {
+	var oldHits, newHits, renewals int
+	rt := &renewingRoundTripper{
+		rt: respond(http.StatusUnauthorized, &oldHits),
+		renew: func() (http.RoundTripper, error) {
+			renewals++
+			return respond(http.StatusOK, &newHits), nil
+		},
+	}
+
+	req, _ := http.NewRequest("POST", "https://k8s.example.com/api", strings.NewReader("payload"))
+	res, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, []int{1, 1, 1}, []int{oldHits, newHits, renewals})
+
+	req, _ = http.NewRequest("GET", "https://k8s.example.com/api", nil)
+	res, err = rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, []int{1, 2, 1}, []int{oldHits, newHits, renewals}, "later requests use the renewed certificate")
+}
+
+func TestRenewingRoundTripperDoesNotReplayUpgrades(t *testing.T) {
+	var oldHits, newHits int
+	rt := &renewingRoundTripper{
+		rt: respond(http.StatusUnauthorized, &oldHits),
+		renew: func() (http.RoundTripper, error) {
+			return respond(http.StatusOK, &newHits), nil
+		},
+	}
+	req, _ := http.NewRequest("POST", "https://k8s.example.com/exec", nil)
+	req.Header.Set("Connection", "Upgrade")
+	res, err := rt.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	assert.Equal(t, 0, newHits)
+}
@@ -0,0 +1,181 @@
+package k8s
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
+	"github.com/spf13/afero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientauthv1beta1 "k8s.io/client-go/pkg/apis/clientauthentication/v1beta1"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+const execCredentialAPIVersion = "client.authentication.k8s.io/v1beta1"
+
+// KubeconfigName names the cluster, user and context of a workspace group
+func KubeconfigName(workspaceGroupID string) string {
+	return "brev-" + workspaceGroupID
+}
+
+// KubeconfigGroup is a workspace group to add a context for. The context
+// defaults to Namespace if it is not empty.
+type KubeconfigGroup struct {
+	Keys      entity.WorkspaceGroupKeys
+	Namespace string
+}
+
+type KubeconfigOptions struct {
+	// PrivateKey is embedded with each group's certificate unless Exec is set
+	PrivateKey string
+	// Exec is a command that prints an ExecCredential for the workspace group
+	// id appended to it, so kubectl always has a fresh certificate
+	Exec []string
+}
+
+// Kubeconfig returns a config with a cluster, user and context per
+// workspace group. The current context is the first group's.
+func Kubeconfig(groups []KubeconfigGroup, opts KubeconfigOptions) *clientcmdapi.Config {
+	config := clientcmdapi.NewConfig()
+	for _, g := range groups {
+		name := KubeconfigName(g.Keys.GroupID)
+		cluster := clientcmdapi.NewCluster()
+		cluster.Server = g.Keys.APIURL
+		cluster.CertificateAuthorityData = []byte(g.Keys.CA)
+		config.Clusters[name] = cluster
+
+		user := clientcmdapi.NewAuthInfo()
+		if len(opts.Exec) > 0 {
+			user.Exec = &clientcmdapi.ExecConfig{
+				APIVersion:      execCredentialAPIVersion,
+				Command:         opts.Exec[0],
+				Args:            append(append([]string{}, opts.Exec[1:]...), g.Keys.GroupID),
+				InteractiveMode: clientcmdapi.NeverExecInteractiveMode,
+			}
+		} else {
+			user.ClientCertificateData = []byte(g.Keys.Cert)
+			user.ClientKeyData = []byte(opts.PrivateKey)
+		}
+		config.AuthInfos[name] = user
+
+		context := clientcmdapi.NewContext()
+		context.Cluster = name
+		context.AuthInfo = name
+		context.Namespace = g.Namespace
+		config.Contexts[name] = context
+
+		if config.CurrentContext == "" {
+			config.CurrentContext = name
+		}
+	}
+	return config
+}
+
+// MergeKubeconfig adds src's clusters, users and contexts to dst, replacing
+// those with the same name. dst's current context is kept if it has one.
+func MergeKubeconfig(dst, src *clientcmdapi.Config) {
+	for name, c := range src.Clusters {
+		dst.Clusters[name] = c
+	}
+	for name, u := range src.AuthInfos {
+		dst.AuthInfos[name] = u
+	}
+	for name, c := range src.Contexts {
+		dst.Contexts[name] = c
+	}
+	if dst.CurrentContext == "" {
+		dst.CurrentContext = src.CurrentContext
+	}
+}
+
+// DefaultKubeconfigPath is where kubectl reads its config from: the first
+// file in $KUBECONFIG, otherwise ~/.kube/config
+func DefaultKubeconfigPath() string {
+	for _, path := range filepath.SplitList(os.Getenv(clientcmd.RecommendedConfigPathEnvVar)) {
+		if path != "" {
+			return path
+		}
+	}
+	return clientcmd.RecommendedHomeFile
+}
+
+// LoadKubeconfig returns an empty config if there is none at path
+func LoadKubeconfig(fs afero.Fs, path string) (*clientcmdapi.Config, error) {
+	exists, err := afero.Exists(fs, path)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	if !exists {
+		return clientcmdapi.NewConfig(), nil
+	}
+	b, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	config, err := clientcmd.Load(b)
+	if err != nil {
+		return nil, fmt.Errorf("could not read kubeconfig %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// WriteKubeconfig writes config to path, readable only by the user as it
+// holds credentials. It replaces the file atomically, a crash while merging
+// into the user's kubeconfig must not truncate it. A symlinked kubeconfig is
+// replaced at its target so the link is kept.
+func WriteKubeconfig(fs afero.Fs, path string, config *clientcmdapi.Config) error {
+	b, err := clientcmd.Write(*config)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if r, ok := fs.(afero.LinkReader); ok {
+		if target, err := r.ReadlinkIfPossible(path); err == nil {
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(path), target)
+			}
+			path = target
+		}
+	}
+	err = fs.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = files.WriteFileAtomic(fs, path, b, 0o600)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// ExecCredential is what a kubeconfig exec plugin prints for a workspace
+// group. It expires RenewBefore the certificate does, so kubectl asks again
+// while the certificate is still good.
+func ExecCredential(keys entity.UserKeys, workspaceGroupID string) ([]byte, error) {
+	wk, err := keys.GetWorkspaceGroupKeysByGroupID(workspaceGroupID)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	notAfter, err := CertNotAfter(wk.Cert)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	expiration := metav1.NewTime(notAfter.Add(-RenewBefore))
+	cred := clientauthv1beta1.ExecCredential{
+		TypeMeta: metav1.TypeMeta{APIVersion: execCredentialAPIVersion, Kind: "ExecCredential"},
+		Status: &clientauthv1beta1.ExecCredentialStatus{
+			ClientCertificateData: wk.Cert,
+			ClientKeyData:         keys.PrivateKey,
+			ExpirationTimestamp:   &expiration,
+		},
+	}
+	b, err := json.Marshal(cred)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return b, nil
+}
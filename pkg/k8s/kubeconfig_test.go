@@ -0,0 +1,112 @@
+package k8s
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	clientauthv1beta1 "k8s.io/client-go/pkg/apis/clientauthentication/v1beta1"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+var kubeconfigGroups = []KubeconfigGroup{
+	{Keys: entity.WorkspaceGroupKeys{GroupID: "g1", Cert: "cert1", CA: "ca1", APIURL: "https://g1.example.com"}, Namespace: "me"},
+	{Keys: entity.WorkspaceGroupKeys{GroupID: "g2", Cert: "cert2", CA: "ca2", APIURL: "https://g2.example.com"}},
+}
+
+func TestKubeconfigEmbedsCredentials(t *testing.T) {
+	config := Kubeconfig(kubeconfigGroups, KubeconfigOptions{PrivateKey: "key"})
+	assert.Equal(t, "brev-g1", config.CurrentContext)
+	assert.Len(t, config.Contexts, 2)
+	assert.Equal(t, "me", config.Contexts["brev-g1"].Namespace)
+	assert.Equal(t, "https://g2.example.com", config.Clusters["brev-g2"].Server)
+	assert.Equal(t, []byte("ca2"), config.Clusters["brev-g2"].CertificateAuthorityData)
+	assert.Equal(t, []byte("cert2"), config.AuthInfos["brev-g2"].ClientCertificateData)
+	assert.Equal(t, []byte("key"), config.AuthInfos["brev-g2"].ClientKeyData)
+	assert.Nil(t, config.AuthInfos["brev-g2"].Exec)
+}
+
+func TestKubeconfigExec(t *testing.T) {
+	config := Kubeconfig(kubeconfigGroups, KubeconfigOptions{PrivateKey: "key", Exec: []string{"/bin/brev", "kubeconfig", "credential"}})
+	user := config.AuthInfos["brev-g1"]
+	assert.Empty(t, user.ClientKeyData)
+	if assert.NotNil(t, user.Exec) {
+		assert.Equal(t, "/bin/brev", user.Exec.Command)
+		assert.Equal(t, []string{"kubeconfig", "credential", "g1"}, user.Exec.Args)
+	}
+	assert.Equal(t, []string{"kubeconfig", "credential", "g2"}, config.AuthInfos["brev-g2"].Exec.Args)
+}
+
+func TestMergeAndWriteKubeconfig(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := "/home/.kube/config"
+
+	existing, err := LoadKubeconfig(fs, path)
+	assert.Nil(t, err)
+	existing.Clusters["work"] = &clientcmdapi.Cluster{Server: "https://work.example.com"}
+	existing.Contexts["work"] = &clientcmdapi.Context{Cluster: "work"}
+	existing.CurrentContext = "work"
+	assert.Nil(t, WriteKubeconfig(fs, path, existing))
+
+	existing, err = LoadKubeconfig(fs, path)
+	assert.Nil(t, err)
+	MergeKubeconfig(existing, Kubeconfig(kubeconfigGroups, KubeconfigOptions{PrivateKey: "key"}))
+	assert.Nil(t, WriteKubeconfig(fs, path, existing))
+
+	merged, err := LoadKubeconfig(fs, path)
+	assert.Nil(t, err)
+	assert.Equal(t, "work", merged.CurrentContext)
+	assert.Len(t, merged.Contexts, 3)
+	assert.Equal(t, "https://work.example.com", merged.Clusters["work"].Server)
+	assert.Equal(t, []byte("key"), merged.AuthInfos["brev-g1"].ClientKeyData)
+
+	info, err := fs.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "-rw-------", info.Mode().String())
+	// the merge replaced the file, no temporary file is left next to it
+	entries, err := afero.ReadDir(fs, "/home/.kube")
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestWriteKubeconfigKeepsSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "dotfiles", "kubeconfig")
+	link := filepath.Join(dir, "config")
+	fs := afero.NewOsFs()
+	assert.Nil(t, WriteKubeconfig(fs, target, clientcmdapi.NewConfig()))
+	if err := os.Symlink(filepath.Join("dotfiles", "kubeconfig"), link); err != nil {
+		t.Skipf("can not create symlinks: %v", err)
+	}
+
+	assert.Nil(t, WriteKubeconfig(fs, link, Kubeconfig(kubeconfigGroups, KubeconfigOptions{PrivateKey: "key"})))
+	info, err := os.Lstat(link)
+	assert.Nil(t, err)
+	assert.True(t, info.Mode()&os.ModeSymlink != 0)
+	written, err := LoadKubeconfig(fs, target)
+	assert.Nil(t, err)
+	assert.Len(t, written.Contexts, 2)
+}
+
+func TestExecCredential(t *testing.T) {
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	cert, key := certPEM(t, notAfter)
+	b, err := ExecCredential(userKeys(cert, key, "g1"), "g1")
+	if !assert.Nil(t, err) {
+		return
+	}
+	var cred clientauthv1beta1.ExecCredential
+	assert.Nil(t, json.Unmarshal(b, &cred))
+	assert.Equal(t, "ExecCredential", cred.Kind)
+	assert.Equal(t, cert, cred.Status.ClientCertificateData)
+	assert.Equal(t, key, cred.Status.ClientKeyData)
+	assert.True(t, cred.Status.ExpirationTimestamp.Time.Equal(notAfter.Add(-RenewBefore)))
+
+	_, err = ExecCredential(userKeys(cert, key, "g1"), "g2")
+	assert.NotNil(t, err)
+}
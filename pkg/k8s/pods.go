@@ -0,0 +1,173 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+)
+
+// defaultContainerAnnotation names the container kubectl picks when none is
+// given
+const defaultContainerAnnotation = "kubectl.kubernetes.io/default-container"
+
+type LogOptions struct {
+	Container  string
+	Follow     bool
+	Since      time.Duration // zero for all logs
+	Tail       int64         // negative for all lines
+	Timestamps bool
+	Previous   bool // logs of the last terminated container, after a crash
+}
+
+// StreamLogs copies a container's logs from the workspace's pod to out until
+// the logs end, or with Follow until ctx is done
+func StreamLogs(ctx context.Context, client kubernetes.Interface, meta entity.WorkspaceMetaData, opts LogOptions, out io.Writer) error {
+	pods := client.CoreV1().Pods(meta.GetNamespaceName())
+	pod, err := pods.Get(ctx, meta.GetPodName(), metav1.GetOptions{})
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	container, err := PickContainer(pod, opts.Container)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	logOpts := &corev1.PodLogOptions{
+		Container:  container,
+		Follow:     opts.Follow,
+		Timestamps: opts.Timestamps,
+		Previous:   opts.Previous,
+	}
+	if opts.Since > 0 {
+		seconds := int64(opts.Since.Round(time.Second) / time.Second)
+		if seconds < 1 {
+			seconds = 1
+		}
+		logOpts.SinceSeconds = &seconds
+	}
+	if opts.Tail >= 0 {
+		tail := opts.Tail
+		logOpts.TailLines = &tail
+	}
+
+	stream, err := pods.GetLogs(meta.GetPodName(), logOpts).Stream(ctx)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer stream.Close() //nolint:errcheck // read only
+	_, err = io.Copy(out, stream)
+	if err != nil && ctx.Err() == nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// PickContainer returns the named container, or the pod's default one:
+// the one annotated as default, otherwise the first
+func PickContainer(pod *corev1.Pod, name string) (string, error) {
+	var names []string
+	for _, c := range pod.Spec.Containers {
+		names = append(names, c.Name)
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("pod %s has no containers", pod.Name)
+	}
+	if name == "" {
+		name = pod.Annotations[defaultContainerAnnotation]
+	}
+	if name == "" {
+		return names[0], nil
+	}
+	for _, n := range names {
+		if n == name {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("pod %s has no container %s, choose one of %v", pod.Name, name, names)
+}
+
+// PodReport is what the cluster says about a workspace's pod
+type PodReport struct {
+	Deleted    bool // the pod no longer exists, only its events are left
+	Phase      corev1.PodPhase
+	Reason     string
+	Message    string
+	Conditions []corev1.PodCondition
+	Containers []corev1.ContainerStatus
+	Events     []corev1.Event // oldest first
+}
+
+// DescribePod collects the status and events of the workspace's pod. The
+// events of a pod that no longer exists are still returned.
+func DescribePod(ctx context.Context, client kubernetes.Interface, meta entity.WorkspaceMetaData) (*PodReport, error) {
+	report := &PodReport{}
+	pod, err := client.CoreV1().Pods(meta.GetNamespaceName()).Get(ctx, meta.GetPodName(), metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		report.Deleted = true
+	case err != nil:
+		return nil, breverrors.WrapAndTrace(err)
+	default:
+		report.Phase = pod.Status.Phase
+		report.Reason = pod.Status.Reason
+		report.Message = pod.Status.Message
+		report.Conditions = pod.Status.Conditions
+		report.Containers = append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	}
+
+	events, err := client.CoreV1().Events(meta.GetNamespaceName()).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("involvedObject.name", meta.GetPodName()).String(),
+	})
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	for _, e := range events.Items {
+		// the fake clientset ignores field selectors, and so might a proxy
+		if e.InvolvedObject.Name == meta.GetPodName() {
+			report.Events = append(report.Events, e)
+		}
+	}
+	sort.SliceStable(report.Events, func(i, j int) bool {
+		return EventTime(report.Events[i]).Before(EventTime(report.Events[j]))
+	})
+	return report, nil
+}
+
+// EventTime is when the event last happened, whichever of its times is set
+func EventTime(e corev1.Event) time.Time {
+	switch {
+	case !e.LastTimestamp.IsZero():
+		return e.LastTimestamp.Time
+	case !e.EventTime.IsZero():
+		return e.EventTime.Time
+	case !e.FirstTimestamp.IsZero():
+		return e.FirstTimestamp.Time
+	default:
+		return e.CreationTimestamp.Time
+	}
+}
+
+// ContainerState describes a container status in a few words, like
+// kubectl get pods
+func ContainerState(s corev1.ContainerStatus) string {
+	switch {
+	case s.State.Waiting != nil:
+		return "waiting: " + s.State.Waiting.Reason
+	case s.State.Terminated != nil:
+		return fmt.Sprintf("terminated: %s (exit %d)", s.State.Terminated.Reason, s.State.Terminated.ExitCode)
+	case s.State.Running != nil:
+		return "running"
+	default:
+		return "unknown"
+	}
+}
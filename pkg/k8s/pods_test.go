@@ -0,0 +1,143 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var meta = entity.WorkspaceMetaData{PodName: "ws-pod", NamespaceName: "ws-ns"}
+
+func newPod(containers ...string) *corev1.Pod {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: meta.PodName, Namespace: meta.NamespaceName}}
+	for _, c := range containers {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: c})
+	}
+	return pod
+}
+
+func logOptions(t *testing.T, client *fake.Clientset) *corev1.PodLogOptions {
+	for _, a := range client.Actions() {
+		if a.GetSubresource() == "log" {
+			opts, ok := a.(k8stesting.GenericAction).GetValue().(*corev1.PodLogOptions)
+			if assert.True(t, ok) {
+				return opts
+			}
+		}
+	}
+	t.Fatal("logs were not requested")
+	return nil
+}
+
+func TestStreamLogs(t *testing.T) {
+	client := fake.NewSimpleClientset(newPod("workspace", "sidecar"))
+	var out bytes.Buffer
+	err := StreamLogs(context.Background(), client, meta, LogOptions{Follow: true, Since: 90 * time.Second, Tail: 10}, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, "fake logs", out.String())
+
+	opts := logOptions(t, client)
+	assert.Equal(t, "workspace", opts.Container)
+	assert.True(t, opts.Follow)
+	assert.Equal(t, int64(90), *opts.SinceSeconds)
+	assert.Equal(t, int64(10), *opts.TailLines)
+}
+
+func TestStreamLogsAllLines(t *testing.T) {
+	client := fake.NewSimpleClientset(newPod("workspace", "sidecar"))
+	err := StreamLogs(context.Background(), client, meta, LogOptions{Container: "sidecar", Tail: -1}, &bytes.Buffer{})
+	assert.Nil(t, err)
+	opts := logOptions(t, client)
+	assert.Equal(t, "sidecar", opts.Container)
+	assert.Nil(t, opts.TailLines)
+	assert.Nil(t, opts.SinceSeconds)
+
+	err = StreamLogs(context.Background(), client, meta, LogOptions{Container: "missing"}, &bytes.Buffer{})
+	assert.NotNil(t, err)
+}
+
+func TestPickContainer(t *testing.T) {
+	pod := newPod("a", "b")
+	name, err := PickContainer(pod, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "a", name)
+
+	pod.Annotations = map[string]string{defaultContainerAnnotation: "b"}
+	name, err = PickContainer(pod, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "b", name)
+
+	_, err = PickContainer(newPod(), "")
+	assert.NotNil(t, err)
+}
+
+func podEvent(name, pod, reason string, at time.Time) *corev1.Event {
+	return &corev1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: name, Namespace: meta.NamespaceName},
+		InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: pod},
+		Reason:         reason,
+		LastTimestamp:  metav1.NewTime(at),
+	}
+}
+
+func TestDescribePod(t *testing.T) {
+	pod := newPod("workspace")
+	pod.Status = corev1.PodStatus{
+		Phase: corev1.PodPending,
+		Conditions: []corev1.PodCondition{
+			{Type: corev1.PodScheduled, Status: corev1.ConditionFalse, Reason: "Unschedulable"},
+		},
+		ContainerStatuses: []corev1.ContainerStatus{
+			{Name: "workspace", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}}},
+		},
+	}
+	now := time.Now()
+	client := fake.NewSimpleClientset(
+		pod,
+		podEvent("e1", meta.PodName, "BackOff", now),
+		podEvent("e2", meta.PodName, "FailedScheduling", now.Add(-time.Minute)),
+		podEvent("e3", "other-pod", "Pulled", now),
+	)
+
+	report, err := DescribePod(context.Background(), client, meta)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.False(t, report.Deleted)
+	assert.Equal(t, corev1.PodPending, report.Phase)
+	assert.Len(t, report.Conditions, 1)
+	if assert.Len(t, report.Containers, 1) {
+		assert.Equal(t, "waiting: ImagePullBackOff", ContainerState(report.Containers[0]))
+	}
+	if assert.Len(t, report.Events, 2) {
+		assert.Equal(t, "FailedScheduling", report.Events[0].Reason)
+		assert.Equal(t, "BackOff", report.Events[1].Reason)
+	}
+}
+
+func TestDescribeDeletedPod(t *testing.T) {
+	now := time.Now()
+	client := fake.NewSimpleClientset(
+		podEvent("e1", meta.PodName, "Killing", now),
+		podEvent("e2", "other-pod", "Pulled", now),
+	)
+
+	report, err := DescribePod(context.Background(), client, meta)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.True(t, report.Deleted)
+	assert.Equal(t, corev1.PodPhase(""), report.Phase)
+	assert.Empty(t, report.Containers)
+	if assert.Len(t, report.Events, 1) {
+		assert.Equal(t, "Killing", report.Events[0].Reason)
+	}
+}
@@ -0,0 +1,262 @@
+// Package localports keeps the local port each workspace's localhost entries
+// in the ssh config and JetBrains Gateway forward to, so a workspace keeps
+// its port across syncs and restarts of brev jetbrains.
+package localports
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
+	"github.com/spf13/afero"
+)
+
+// entryAddress is the address the localhost entries connect to
+const entryAddress = "localhost"
+
+// PortChecker reports whether a local port can be listened on
+type PortChecker func(address string, port int) bool
+
+// IsPortFree tries to listen on the port
+func IsPortFree(address string, port int) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort(address, strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	_ = l.Close()
+	return true
+}
+
+// DefaultRange is where ports are allocated from unless ports.json sets
+// another range
+var DefaultRange = Range{First: 2222, Last: 2999}
+
+type Range struct {
+	First int `json:"first"`
+	Last  int `json:"last"`
+}
+
+func (r Range) Contains(port int) bool {
+	return r.First <= port && port <= r.Last
+}
+
+func (r Range) String() string {
+	if r.First == r.Last {
+		return fmt.Sprint(r.First)
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+type Assignment struct {
+	Port           int    `json:"port"`
+	OrganizationID string `json:"organizationId,omitempty"`
+}
+
+// Registry maps workspace ids to their local port
+type Registry struct {
+	// Range overrides DefaultRange
+	Range *Range `json:"range,omitempty"`
+	// Reserved ports are never allocated, for ports other programs use
+	Reserved []Range               `json:"reserved,omitempty"`
+	Ports    map[string]Assignment `json:"ports"`
+}
+
+func (r Registry) allocationRange() Range {
+	if r.Range != nil {
+		return *r.Range
+	}
+	return DefaultRange
+}
+
+func (r Registry) isReserved(port int) bool {
+	for _, reserved := range r.Reserved {
+		if reserved.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// owner is the workspace the port is assigned to, or ""
+func (r Registry) owner(port int) string {
+	for id, a := range r.Ports {
+		if a.Port == port {
+			return id
+		}
+	}
+	return ""
+}
+
+// Workspace is what Assign needs to know about a workspace
+type Workspace struct {
+	ID             string
+	OrganizationID string
+	// ConfiguredPort is the port an existing config entry uses, 0 if none.
+	// It is adopted when the workspace has no port yet, so entries written
+	// before the registry keep their port.
+	ConfiguredPort int
+}
+
+// Assign returns the workspace's port, allocating one the first time.
+// Allocated ports skip reserved ports, ports in taken, ports of other
+// workspaces and ports isFree can not bind. A port already assigned is kept
+// without checking it is free, brev jetbrains itself listens on it.
+func (r *Registry) Assign(w Workspace, taken map[int]bool, isFree PortChecker) (int, error) {
+	if r.Ports == nil {
+		r.Ports = make(map[string]Assignment)
+	}
+	if a, ok := r.Ports[w.ID]; ok {
+		return a.Port, nil
+	}
+	if p := w.ConfiguredPort; p != 0 && !r.isReserved(p) && r.owner(p) == "" {
+		r.Ports[w.ID] = Assignment{Port: p, OrganizationID: w.OrganizationID}
+		return p, nil
+	}
+	allocationRange := r.allocationRange()
+	for p := allocationRange.First; p <= allocationRange.Last; p++ {
+		if taken[p] || r.isReserved(p) || r.owner(p) != "" || !isFree(entryAddress, p) {
+			continue
+		}
+		r.Ports[w.ID] = Assignment{Port: p, OrganizationID: w.OrganizationID}
+		return p, nil
+	}
+	return 0, fmt.Errorf("no free local port in %s, widen the range in ports.json", allocationRange)
+}
+
+// Reclaim frees the ports of the organization's workspaces that are not in
+// workspaceIDs, which should be all of the organization's workspaces, and
+// returns the ids of the workspaces whose ports were freed
+func (r *Registry) Reclaim(organizationID string, workspaceIDs []string) []string {
+	exists := make(map[string]bool)
+	for _, id := range workspaceIDs {
+		exists[id] = true
+	}
+	var reclaimed []string
+	for id, a := range r.Ports {
+		if a.OrganizationID == organizationID && !exists[id] {
+			delete(r.Ports, id)
+			reclaimed = append(reclaimed, id)
+		}
+	}
+	sort.Strings(reclaimed)
+	return reclaimed
+}
+
+// Store reads and writes ports.json
+type Store struct {
+	fs   afero.Fs
+	path string
+}
+
+func NewStore(fs afero.Fs, path string) *Store {
+	return &Store{fs: fs, path: path}
+}
+
+func NewDefaultStore() (*Store, error) {
+	path, err := files.GetPortsPath()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return NewStore(files.AppFs, path), nil
+}
+
+// Load returns an empty registry if none has been saved
+func (s Store) Load() (*Registry, error) {
+	exists, err := afero.Exists(s.fs, s.path)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	if !exists {
+		return &Registry{Ports: make(map[string]Assignment)}, nil
+	}
+	var r Registry
+	err = files.ReadJSON(s.fs, s.path, &r)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	if r.Ports == nil {
+		r.Ports = make(map[string]Assignment)
+	}
+	return &r, nil
+}
+
+func (s Store) Save(r *Registry) error {
+	err := files.WriteJSONAtomic(s.fs, s.path, r, 0o644)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// Update loads the registry, applies fn and saves the result if fn succeeds. It
+// holds a lock on the file, so a concurrent update is not lost.
+func (s Store) Update(fn func(r *Registry) error) error {
+	err := files.WithFileLock(s.fs, s.path, func() error {
+		r, err := s.Load()
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		err = fn(r)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		return s.Save(r)
+	})
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// Assigner assigns the ports of the workspaces ssh.SSHConfigurer syncs,
+// persisting them in the store
+type Assigner struct {
+	store  *Store
+	isFree PortChecker
+}
+
+func NewAssigner(store *Store, isFree PortChecker) *Assigner {
+	return &Assigner{store: store, isFree: isFree}
+}
+
+func NewDefaultAssigner() (*Assigner, error) {
+	store, err := NewDefaultStore()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return NewAssigner(store, IsPortFree), nil
+}
+
+func (a Assigner) AssignPorts(workspaces []Workspace, taken map[int]bool) (map[string]int, error) {
+	ports := make(map[string]int)
+	err := a.store.Update(func(r *Registry) error {
+		for _, w := range workspaces {
+			port, err := r.Assign(w, taken, a.isFree)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			ports[w.ID] = port
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return ports, nil
+}
+
+// Reclaim frees the ports of deleted workspaces, see Registry.Reclaim
+func (a Assigner) Reclaim(organizationID string, workspaceIDs []string) ([]string, error) {
+	var reclaimed []string
+	err := a.store.Update(func(r *Registry) error {
+		reclaimed = r.Reclaim(organizationID, workspaceIDs)
+		return nil
+	})
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return reclaimed, nil
+}
@@ -0,0 +1,96 @@
+package localports
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func allFree(string, int) bool { return true }
+
+func TestAssignIsStable(t *testing.T) {
+	r := &Registry{}
+	port, err := r.Assign(Workspace{ID: "ws1", OrganizationID: "org"}, nil, allFree)
+	assert.Nil(t, err)
+	assert.Equal(t, 2222, port)
+
+	port, err = r.Assign(Workspace{ID: "ws2", OrganizationID: "org"}, nil, allFree)
+	assert.Nil(t, err)
+	assert.Equal(t, 2223, port)
+
+	// assigned ports are kept even if something now listens on them
+	port, err = r.Assign(Workspace{ID: "ws1", OrganizationID: "org", ConfiguredPort: 2300}, nil, func(string, int) bool { return false })
+	assert.Nil(t, err)
+	assert.Equal(t, 2222, port)
+}
+
+func TestAssignSkipsTakenReservedAndBoundPorts(t *testing.T) {
+	r := &Registry{Reserved: []Range{{First: 2223, Last: 2224}}}
+	bound := func(_ string, port int) bool { return port != 2226 }
+	port, err := r.Assign(Workspace{ID: "ws1"}, map[int]bool{2222: true, 2225: true}, bound)
+	assert.Nil(t, err)
+	assert.Equal(t, 2227, port)
+
+	r = &Registry{Range: &Range{First: 3000, Last: 3001}}
+	_, err = r.Assign(Workspace{ID: "ws1"}, nil, allFree)
+	assert.Nil(t, err)
+	_, err = r.Assign(Workspace{ID: "ws2"}, nil, allFree)
+	assert.Nil(t, err)
+	_, err = r.Assign(Workspace{ID: "ws3"}, nil, allFree)
+	assert.NotNil(t, err)
+}
+
+func TestAssignAdoptsConfiguredPort(t *testing.T) {
+	r := &Registry{Reserved: []Range{{First: 8080, Last: 8080}}}
+	port, err := r.Assign(Workspace{ID: "ws1", ConfiguredPort: 2230}, map[int]bool{2230: true}, allFree)
+	assert.Nil(t, err)
+	assert.Equal(t, 2230, port)
+
+	// another workspace's port is not adopted
+	port, err = r.Assign(Workspace{ID: "ws2", ConfiguredPort: 2230}, map[int]bool{2230: true}, allFree)
+	assert.Nil(t, err)
+	assert.Equal(t, 2222, port)
+
+	port, err = r.Assign(Workspace{ID: "ws3", ConfiguredPort: 8080}, nil, allFree)
+	assert.Nil(t, err)
+	assert.Equal(t, 2223, port)
+}
+
+func TestReclaim(t *testing.T) {
+	r := &Registry{Ports: map[string]Assignment{
+		"ws1": {Port: 2222, OrganizationID: "org1"},
+		"ws2": {Port: 2223, OrganizationID: "org1"},
+		"ws3": {Port: 2224, OrganizationID: "org2"},
+	}}
+	assert.Equal(t, []string{"ws2"}, r.Reclaim("org1", []string{"ws1"}))
+	assert.Equal(t, map[string]Assignment{
+		"ws1": {Port: 2222, OrganizationID: "org1"},
+		"ws3": {Port: 2224, OrganizationID: "org2"},
+	}, r.Ports)
+
+	port, err := r.Assign(Workspace{ID: "ws4"}, nil, allFree)
+	assert.Nil(t, err)
+	assert.Equal(t, 2223, port)
+}
+
+func TestAssignerPersists(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assigner := NewAssigner(NewStore(fs, "/home/.brev/ports.json"), allFree)
+	ports, err := assigner.AssignPorts([]Workspace{{ID: "ws1", OrganizationID: "org"}, {ID: "ws2", OrganizationID: "org"}}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"ws1": 2222, "ws2": 2223}, ports)
+
+	// a new process picks up the same ports
+	assigner = NewAssigner(NewStore(fs, "/home/.brev/ports.json"), allFree)
+	ports, err = assigner.AssignPorts([]Workspace{{ID: "ws2", OrganizationID: "org"}}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"ws2": 2223}, ports)
+
+	reclaimed, err := assigner.Reclaim("org", []string{"ws2"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ws1"}, reclaimed)
+	r, err := NewStore(fs, "/home/.brev/ports.json").Load()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]Assignment{"ws2": {Port: 2223, OrganizationID: "org"}}, r.Ports)
+}
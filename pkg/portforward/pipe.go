@@ -0,0 +1,36 @@
+package portforward
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// CloseWriter is a connection that can be half closed
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+// Pipe copies both ways until both sides are done, passing on half closes so
+// that request/response protocols finish cleanly. It returns the bytes copied
+// from a to b and from b to a.
+func Pipe(a, b net.Conn) (int64, int64) {
+	var aToB, bToA int64
+	var wg sync.WaitGroup
+	copyHalf := func(dst, src net.Conn, n *int64) {
+		defer wg.Done()
+		written, err := io.Copy(dst, src)
+		atomic.AddInt64(n, written)
+		if cw, ok := dst.(CloseWriter); ok && err == nil {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+	wg.Add(2)
+	go copyHalf(b, a, &aToB)
+	go copyHalf(a, b, &bToA)
+	wg.Wait()
+	return aToB, bToA
+}
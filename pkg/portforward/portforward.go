@@ -2,10 +2,13 @@ package portforward
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"sync"
 
 	breverrors "github.com/brevdev/brev-cli/pkg/errors"
 
@@ -27,8 +30,11 @@ type PortForwardOptions struct {
 	Namespace string
 	PodName   string
 
+	ProxyURL string // huproxy websocket of the workspace, used by SSHPortForwarder
+
 	Address      []string
 	Ports        []string
+	ReversePorts []string // remote:local, only supported by SSHPortForwarder
 	StopChannel  chan struct{}
 	ReadyChannel chan struct{}
 }
@@ -50,9 +56,16 @@ func NewPortForwardOptions(workspaceGroupClientMapper k8s.WorkspaceGroupClientMa
 	return p
 }
 
+// WithWorkspace looks up the k8s client of the workspace's group unless the
+// mapper is nil, which is the case when forwarding over ssh
 func (o *PortForwardOptions) WithWorkspace(workspace entity.WorkspaceWithMeta) (*PortForwardOptions, error) {
 	o.Namespace = workspace.GetNamespaceName()
 	o.PodName = workspace.GetPodName()
+	o.ProxyURL = workspace.GetProxyURL()
+
+	if o.WorkspaceGroupClientMapper == nil {
+		return o, nil
+	}
 
 	k8sAPIURL, err := o.WorkspaceGroupClientMapper.GetK8sAPIURL(workspace.WorkspaceGroupID)
 	if err != nil {
@@ -80,6 +93,28 @@ func (o *PortForwardOptions) WithPort(port string) *PortForwardOptions {
 	return o
 }
 
+// WithPorts forwards several local:remote pairs over one connection
+func (o *PortForwardOptions) WithPorts(ports []string) *PortForwardOptions {
+	o.Ports = ports
+
+	return o
+}
+
+// WithReversePorts forwards remote:local pairs from the workspace back to
+// this machine
+func (o *PortForwardOptions) WithReversePorts(ports []string) *PortForwardOptions {
+	o.ReversePorts = ports
+
+	return o
+}
+
+// WithAddress sets the local addresses to listen on, localhost by default
+func (o *PortForwardOptions) WithAddress(address ...string) *PortForwardOptions {
+	o.Address = address
+
+	return o
+}
+
 func (o PortForwardOptions) RunPortforward() error {
 	// cmd := portforward.NewCmdPortForward(tf, streams) // This command is useful to have around to go to def of kubectl cmd
 
@@ -94,9 +129,17 @@ func (o PortForwardOptions) RunPortforward() error {
 		}
 	}()
 
-	urlStr := fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s/portforward", o.K8sAPIURL, o.Namespace, o.PodName)
+	err := o.Forward()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
 
-	url, err := url.Parse(urlStr)
+// Forward blocks until StopChannel is closed or the forward fails. Unlike
+// RunPortforward it leaves signal handling to the caller.
+func (o PortForwardOptions) Forward() error {
+	url, err := o.portForwardURL()
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
 	}
@@ -107,6 +150,87 @@ func (o PortForwardOptions) RunPortforward() error {
 	return nil
 }
 
+func (o PortForwardOptions) portForwardURL() (*url.URL, error) {
+	urlStr := fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s/portforward", o.K8sAPIURL, o.Namespace, o.PodName)
+	url, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return url, nil
+}
+
+// DialPort forwards an ephemeral local port to remotePort on the pod and
+// connects to it. Closing the returned connection stops the forward.
+func (o PortForwardOptions) DialPort(remotePort string) (*ForwardedConn, error) {
+	url, err := o.portForwardURL()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	transport, upgrader, err := spdy.RoundTripperFor(o.K8sClient.GetK8sRestConfig())
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, "POST", url)
+
+	stopChannel := make(chan struct{})
+	readyChannel := make(chan struct{})
+	// stdout may be the stream itself, as in a ProxyCommand, so only errors are written
+	fw, err := toolsportforward.NewOnAddresses(dialer, []string{"localhost"}, []string{"0:" + remotePort}, stopChannel, readyChannel, ioutil.Discard, os.Stderr)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- fw.ForwardPorts()
+	}()
+	select {
+	case <-readyChannel:
+	case err := <-errs:
+		return nil, breverrors.WrapAndTrace(err)
+	}
+
+	stop := func() { close(stopChannel) }
+	ports, err := fw.GetPorts()
+	if err != nil {
+		stop()
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", ports[0].Local))
+	if err != nil {
+		stop()
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return &ForwardedConn{Conn: conn, stop: stop}, nil
+}
+
+type ForwardedConn struct {
+	net.Conn
+	stop     func()
+	stopOnce sync.Once
+}
+
+// CloseWrite half closes the connection if it supports it
+func (c *ForwardedConn) CloseWrite() error {
+	cw, ok := c.Conn.(CloseWriter)
+	if !ok {
+		return nil
+	}
+	err := cw.CloseWrite()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func (c *ForwardedConn) Close() error {
+	err := c.Conn.Close()
+	c.stopOnce.Do(c.stop)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
 type DefaultPortForwarder struct {
 	genericclioptions.IOStreams
 }
@@ -118,6 +242,9 @@ func NewDefaultPortForwarder() *DefaultPortForwarder {
 }
 
 func (f *DefaultPortForwarder) ForwardPorts(method string, url *url.URL, opts PortForwardOptions) error {
+	if len(opts.ReversePorts) > 0 {
+		return fmt.Errorf("reverse forwards are only supported over ssh, use --via %s", ViaSSH)
+	}
 	transport, upgrader, err := spdy.RoundTripperFor(opts.K8sClient.GetK8sRestConfig())
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
@@ -1 +1,20 @@
 package portforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardedConnWithoutHalfClose(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close() //nolint:errcheck // test
+
+	stopped := 0
+	conn := &ForwardedConn{Conn: a, stop: func() { stopped++ }}
+	assert.Nil(t, conn.CloseWrite())
+	assert.Nil(t, conn.Close())
+	_ = conn.Close()
+	assert.Equal(t, 1, stopped)
+}
@@ -0,0 +1,321 @@
+package portforward
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/huproxyclient"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Transports a port forward can use
+const (
+	ViaK8s = "k8s" // spdy through the k8s api of the workspace group
+	ViaSSH = "ssh" // ssh channels through the workspace's huproxy websocket
+)
+
+func ValidateVia(via string) error {
+	switch via {
+	case ViaK8s, ViaSSH:
+		return nil
+	default:
+		return fmt.Errorf("unknown port forward transport %q, use %s or %s", via, ViaK8s, ViaSSH)
+	}
+}
+
+// SSHPortForwarder forwards ports with ssh direct-tcpip channels, and reverse
+// ports with tcpip-forward requests, over the workspace's huproxy websocket.
+// Unlike DefaultPortForwarder it works behind proxies that block SPDY and
+// does not need a k8s client for the workspace group.
+type SSHPortForwarder struct {
+	Auth       huproxyclient.HubProxyAuth
+	PrivateKey string
+	Options    huproxyclient.Options
+	Out        io.Writer
+	ErrOut     io.Writer
+}
+
+var _ PortForwarder = &SSHPortForwarder{}
+
+func NewSSHPortForwarder(auth huproxyclient.HubProxyAuth, privateKey string) *SSHPortForwarder {
+	return &SSHPortForwarder{
+		Auth:       auth,
+		PrivateKey: privateKey,
+		Options:    huproxyclient.DefaultOptions(),
+		Out:        os.Stdout,
+		ErrOut:     os.Stderr,
+	}
+}
+
+// Connect opens an ssh connection to the workspace behind proxyURL. The
+// connection is closed when ctx is done.
+func (f *SSHPortForwarder) Connect(ctx context.Context, proxyURL string) (*SSHTunnel, error) {
+	signer, err := ssh.ParsePrivateKey([]byte(f.PrivateKey))
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	conn, err := huproxyclient.NewClient(proxyURL, f.Auth).WithOptions(f.Options).DialConn(ctx)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, proxyURL, &ssh.ClientConfig{
+		User: "brev",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		// the websocket is authenticated and TLS protected, which is also why
+		// the generated ssh config does not check workspace host keys
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(), //nolint:gosec // see above
+		Timeout:         f.Options.DialTimeout,
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return &SSHTunnel{Client: ssh.NewClient(sshConn, chans, reqs), errOut: f.ErrOut}, nil
+}
+
+// ForwardPorts ignores method and url, which address the k8s api, and
+// connects to opts.ProxyURL instead
+func (f *SSHPortForwarder) ForwardPorts(_ string, _ *url.URL, opts PortForwardOptions) error {
+	if opts.ProxyURL == "" {
+		return fmt.Errorf("no proxy url to forward over")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-opts.StopChannel:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	tunnel, err := f.Connect(ctx, opts.ProxyURL)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer tunnel.Close() //nolint:errcheck // the forward is over
+
+	for _, p := range opts.Ports {
+		local, remote := splitPortPair(p)
+		for _, address := range opts.Address {
+			l, err := tunnel.Forward(address, local, remote)
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			_, _ = fmt.Fprintf(f.Out, "Forwarding from %s -> %s\n", l.Addr(), remote)
+		}
+	}
+
+	for _, p := range opts.ReversePorts {
+		remote, local := splitPortPair(p)
+		_, err := tunnel.Reverse(remote, local)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		_, _ = fmt.Fprintf(f.Out, "Forwarding from workspace port %s -> localhost:%s\n", remote, local)
+	}
+
+	if opts.ReadyChannel != nil {
+		close(opts.ReadyChannel)
+	}
+
+	waitErrs := make(chan error, 1)
+	go func() {
+		waitErrs <- tunnel.Wait()
+	}()
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-waitErrs:
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("ssh connection to workspace closed: %w", err)
+	}
+}
+
+// SSHTunnel is an ssh connection to a workspace that ports are forwarded and
+// commands are run over. Closing it stops every forward.
+type SSHTunnel struct {
+	*ssh.Client
+	errOut io.Writer
+
+	mu        sync.Mutex
+	listeners []net.Listener
+}
+
+// Forward listens on address:local and forwards connections to the
+// workspace's remote port until the listener or the tunnel is closed
+func (t *SSHTunnel) Forward(address, local, remote string) (net.Listener, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(address, local))
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	t.track(l)
+	remoteAddr := net.JoinHostPort("localhost", remote)
+	go t.serve(l, func() (net.Conn, error) {
+		return t.Dial("tcp", remoteAddr)
+	})
+	return l, nil
+}
+
+// Reverse listens on the workspace's remote port and forwards connections
+// to local on this machine
+func (t *SSHTunnel) Reverse(remote, local string) (net.Listener, error) {
+	l, err := t.Listen("tcp", net.JoinHostPort("localhost", remote))
+	if err != nil {
+		return nil, fmt.Errorf("workspace refused to listen on port %s, sshd may not allow tcp forwarding: %w", remote, err)
+	}
+	t.track(l)
+	localAddr := net.JoinHostPort("localhost", local)
+	go t.serve(l, func() (net.Conn, error) {
+		return net.DialTimeout("tcp", localAddr, 10*time.Second)
+	})
+	return l, nil
+}
+
+// Output runs cmd on the workspace and returns its stdout
+func (t *SSHTunnel) Output(cmd string) ([]byte, error) {
+	session, err := t.NewSession()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	defer session.Close() //nolint:errcheck // the command is done
+	out, err := session.Output(cmd)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return out, nil
+}
+
+// SFTP opens an sftp session to the workspace's files. Relative paths are
+// relative to the workspace's home directory.
+func (t *SSHTunnel) SFTP() (*sftp.Client, error) {
+	client, err := sftp.NewClient(t.Client)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return client, nil
+}
+
+// Exec runs cmd on the workspace with the given stdio, any of which may be
+// nil. A command that exits non-zero returns an *ssh.ExitError.
+func (t *SSHTunnel) Exec(cmd string, stdin io.Reader, stdout, stderr io.Writer) error {
+	session, err := t.NewSession()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer session.Close() //nolint:errcheck // the command is done
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+	err = session.Run(cmd)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// Shell runs the user's login shell on the workspace. With a size queue the
+// shell gets a pty of the first size, resized with each one after. A shell
+// that exits non-zero returns an *ssh.ExitError.
+func (t *SSHTunnel) Shell(stdin io.Reader, stdout, stderr io.Writer, sizes remotecommand.TerminalSizeQueue) error {
+	session, err := t.NewSession()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer session.Close() //nolint:errcheck // the shell is done
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if sizes != nil {
+		size := sizes.Next()
+		if size == nil {
+			size = &remotecommand.TerminalSize{Width: 80, Height: 24}
+		}
+		term := os.Getenv("TERM")
+		if term == "" {
+			term = "xterm-256color"
+		}
+		err = session.RequestPty(term, int(size.Height), int(size.Width), ssh.TerminalModes{})
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		go func() {
+			for size := sizes.Next(); size != nil; size = sizes.Next() {
+				if session.WindowChange(int(size.Height), int(size.Width)) != nil {
+					return
+				}
+			}
+		}()
+	}
+	err = session.Shell()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = session.Wait()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func (t *SSHTunnel) Close() error {
+	t.mu.Lock()
+	for _, l := range t.listeners {
+		_ = l.Close()
+	}
+	t.listeners = nil
+	t.mu.Unlock()
+	err := t.Client.Close()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func (t *SSHTunnel) track(l net.Listener) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.listeners = append(t.listeners, l)
+}
+
+// serve pipes every connection accepted on l to a connection from dial
+func (t *SSHTunnel) serve(l net.Listener, dial func() (net.Conn, error)) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close() //nolint:errcheck // best effort
+			target, err := dial()
+			if err != nil {
+				_, _ = fmt.Fprintf(t.errOut, "could not forward connection from %s: %v\n", conn.RemoteAddr(), err)
+				return
+			}
+			defer target.Close() //nolint:errcheck // best effort
+			Pipe(conn, target)
+		}()
+	}
+}
+
+// splitPortPair splits "a:b", where a lone port is used for both sides
+func splitPortPair(p string) (string, string) {
+	parts := strings.SplitN(p, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], parts[0]
+	}
+	return parts[0], parts[1]
+}
@@ -0,0 +1,287 @@
+package portforward
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+type dummyAuth struct{}
+
+func (dummyAuth) GetAccessToken() (string, error) {
+	return "token", nil
+}
+
+func newKey(t *testing.T) (*rsa.PrivateKey, ssh.Signer) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return key, signer
+}
+
+// newSSHProxyServer serves an ssh server that supports direct-tcpip and
+// tcpip-forward behind a websocket, like a workspace behind huproxy
+func newSSHProxyServer(t *testing.T, clientKey ssh.PublicKey) *httptest.Server {
+	_, hostSigner := newKey(t)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, fmt.Errorf("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close() //nolint:errcheck // test
+		local, remote := net.Pipe()
+		go func() {
+			for {
+				_, b, err := ws.ReadMessage()
+				if err != nil {
+					_ = remote.Close()
+					return
+				}
+				if _, err := remote.Write(b); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := remote.Read(buf)
+				if n > 0 {
+					if werr := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
+						return
+					}
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+		serveSSH(local, config)
+	}))
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer sshConn.Close() //nolint:errcheck // test
+
+	go func() {
+		for req := range reqs {
+			if req.Type != "tcpip-forward" {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			var fwd struct {
+				Addr string
+				Port uint32
+			}
+			if err := ssh.Unmarshal(req.Payload, &fwd); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			l, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(int(fwd.Port))))
+			if err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			go func() {
+				_ = sshConn.Wait()
+				_ = l.Close()
+			}()
+			go func() {
+				for {
+					c, err := l.Accept()
+					if err != nil {
+						return
+					}
+					payload := ssh.Marshal(struct {
+						Addr     string
+						Port     uint32
+						OrigAddr string
+						OrigPort uint32
+					}{fwd.Addr, fwd.Port, "127.0.0.1", 1234})
+					ch, chReqs, err := sshConn.OpenChannel("forwarded-tcpip", payload)
+					if err != nil {
+						_ = c.Close()
+						continue
+					}
+					go ssh.DiscardRequests(chReqs)
+					go pipeChannel(c, ch)
+				}
+			}()
+		}
+	}()
+
+	for newCh := range chans {
+		if newCh.ChannelType() != "direct-tcpip" {
+			_ = newCh.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		var target struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err := ssh.Unmarshal(newCh.ExtraData(), &target); err != nil {
+			_ = newCh.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		c, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		if err != nil {
+			_ = newCh.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			_ = c.Close()
+			continue
+		}
+		go ssh.DiscardRequests(chReqs)
+		go pipeChannel(c, ch)
+	}
+}
+
+func pipeChannel(c net.Conn, ch ssh.Channel) {
+	defer c.Close()  //nolint:errcheck // test
+	defer ch.Close() //nolint:errcheck // test
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(ch, c)
+		_ = ch.CloseWrite()
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(c, ch)
+		_ = c.(*net.TCPConn).CloseWrite()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+func newEchoListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close() //nolint:errcheck // test
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer l.Close() //nolint:errcheck // test
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+func assertEchoes(t *testing.T, port string) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("localhost", port), time.Second)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close() //nolint:errcheck // test
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, conn.(*net.TCPConn).CloseWrite())
+	b, err := ioutil.ReadAll(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(b))
+}
+
+func TestSSHPortForwarder(t *testing.T) {
+	clientKey, clientSigner := newKey(t)
+	s := newSSHProxyServer(t, clientSigner.PublicKey())
+	defer s.Close()
+	echo := newEchoListener(t)
+	defer echo.Close() //nolint:errcheck // test
+	echoPort := strconv.Itoa(echo.Addr().(*net.TCPAddr).Port)
+
+	privateKey := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(clientKey)}))
+	forwarder := NewSSHPortForwarder(dummyAuth{}, privateKey)
+	forwarder.Options.DialRetries = 0
+	forwarder.Out = ioutil.Discard
+
+	localPort := freePort(t)
+	reversePort := freePort(t)
+	opts := NewPortForwardOptions(nil, forwarder)
+	opts.ProxyURL = "ws" + strings.TrimPrefix(s.URL, "http")
+	opts.WithPorts([]string{localPort + ":" + echoPort}).WithReversePorts([]string{reversePort + ":" + echoPort})
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- opts.Forward()
+	}()
+	select {
+	case <-opts.ReadyChannel:
+	case err := <-errs:
+		t.Fatalf("forward failed: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the forward")
+	}
+
+	assertEchoes(t, localPort)
+	assertEchoes(t, reversePort)
+
+	close(opts.StopChannel)
+	select {
+	case err := <-errs:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("forward did not stop")
+	}
+}
+
+func TestDefaultPortForwarderRejectsReverse(t *testing.T) {
+	err := NewDefaultPortForwarder().ForwardPorts("POST", nil, PortForwardOptions{ReversePorts: []string{"1:1"}})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,369 @@
+// Package proxyagent runs a long lived local process that ssh ProxyCommands
+// connect to over a unix socket. It caches workspace and key lookups and keeps
+// a warm websocket per recently used workspace so that `brev proxy` does not
+// have to hit the api and dial a fresh connection on every ssh invocation.
+package proxyagent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/huproxyclient"
+	"github.com/gorilla/websocket"
+)
+
+type AgentStore interface {
+	GetCurrentUserKeys() (*entity.UserKeys, error)
+	WritePrivateKey(pem string) error
+}
+
+type WorkspaceProxy interface {
+	ResolveWorkspace(nameOrID string) (*entity.Workspace, error)
+	EnsureWorkspaceRunning(ctx context.Context, workspace *entity.Workspace, progress func(string)) (*entity.Workspace, error)
+	// CheckWorkspaceCanSSH returns a DirectRequiredError if the workspace can
+	// only be reached by something other than huproxy
+	CheckWorkspaceCanSSH(workspace *entity.Workspace) error
+	MakeProxyURL(workspace *entity.Workspace) string
+}
+
+type cachedWorkspace struct {
+	workspace *entity.Workspace
+	fetchedAt time.Time
+}
+
+type warmConn struct {
+	conn     *websocket.Conn
+	dialedAt time.Time
+}
+
+type Agent struct {
+	store        AgentStore
+	auth         huproxyclient.HubProxyAuth
+	proxy        WorkspaceProxy
+	proxyOptions huproxyclient.Options
+
+	WorkspaceTTL time.Duration
+	KeysTTL      time.Duration
+	// sshd drops connections that do not authenticate within its
+	// LoginGraceTime (2m by default) so warm connections must be recycled
+	// well before that
+	WarmTTL time.Duration
+
+	mu            sync.Mutex
+	workspaces    map[string]cachedWorkspace
+	privateKey    string
+	keysFetchedAt time.Time
+	warm          map[string]warmConn
+}
+
+func NewAgent(store AgentStore, auth huproxyclient.HubProxyAuth, proxy WorkspaceProxy, proxyOptions huproxyclient.Options) *Agent {
+	return &Agent{
+		store:        store,
+		auth:         auth,
+		proxy:        proxy,
+		proxyOptions: proxyOptions,
+		WorkspaceTTL: 30 * time.Second,
+		KeysTTL:      10 * time.Minute,
+		WarmTTL:      45 * time.Second,
+		workspaces:   make(map[string]cachedWorkspace),
+		warm:         make(map[string]warmConn),
+	}
+}
+
+// ListenAndServe serves on a unix socket at socketPath until ctx is done
+func (a *Agent) ListenAndServe(ctx context.Context, socketPath string) error {
+	err := removeStaleSocket(socketPath)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = os.Chmod(socketPath, 0o600)
+	if err != nil {
+		_ = l.Close()
+		return breverrors.WrapAndTrace(err)
+	}
+	log.Printf("proxy agent listening on %s", socketPath)
+
+	err = a.Serve(ctx, l)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func removeStaleSocket(socketPath string) error {
+	if _, err := os.Stat(socketPath); os.IsNotExist(err) {
+		return nil
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("proxy agent already running [socket=%s]", socketPath)
+	}
+	err = os.Remove(socketPath)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func (a *Agent) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+	defer a.closeWarm()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return breverrors.WrapAndTrace(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.handle(ctx, conn)
+		}()
+	}
+}
+
+func (a *Agent) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close() //nolint:errcheck // nothing to do once the stream is over
+
+	err := conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	reader := bufio.NewReader(conn)
+	var req ConnectRequest
+	err = readLine(reader, &req)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	err = conn.SetDeadline(time.Now().Add(getHandshakeTimeout(req)))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	workspace, ws, err := a.open(ctx, req, func(progress string) {
+		_ = writeLine(conn, ConnectResponse{Progress: progress})
+	})
+	if err != nil {
+		log.Printf("%v [workspace=%s]", err, req.WorkspaceID)
+		res := ConnectResponse{Error: err.Error()}
+		var sessionErr *huproxyclient.SessionEndedError
+		if errors.As(err, &sessionErr) {
+			res.Reason = sessionErr.Reason
+		}
+		var brevErr breverrors.BrevError
+		if errors.As(err, &brevErr) {
+			res.Directive = brevErr.Directive()
+		}
+		var directErr *DirectRequiredError
+		if errors.As(err, &directErr) {
+			res = ConnectResponse{Error: directErr.Reason, Direct: true}
+		}
+		_ = writeLine(conn, res)
+		return
+	}
+	defer ws.Close() //nolint:errcheck // nothing to do once the stream is over
+
+	err = writeLine(conn, ConnectResponse{})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	go a.warmUp(ctx, workspace)
+
+	client := huproxyclient.NewClient(a.proxy.MakeProxyURL(workspace), a.auth).WithOptions(a.proxyOptions)
+	err = client.RunProxy(ctx, ws, reader, conn)
+	if err != nil {
+		log.Printf("%v [workspace=%s]", err, workspace.ID)
+		a.invalidateWorkspace(req.WorkspaceID)
+	}
+}
+
+func (a *Agent) open(ctx context.Context, req ConnectRequest, progress func(string)) (*entity.Workspace, *websocket.Conn, error) {
+	nameOrID := req.WorkspaceID
+	workspace, err := a.getWorkspace(nameOrID)
+	if err != nil {
+		return nil, nil, breverrors.WrapAndTrace(err)
+	}
+	if req.AutoStart && workspace.Status != "RUNNING" {
+		a.invalidateWorkspace(nameOrID)
+		workspace, err = a.proxy.EnsureWorkspaceRunning(ctx, workspace, progress)
+		if err != nil {
+			return nil, nil, breverrors.WrapAndTrace(err)
+		}
+	}
+	err = a.proxy.CheckWorkspaceCanSSH(workspace)
+	if err != nil {
+		a.invalidateWorkspace(nameOrID)
+		return nil, nil, breverrors.WrapAndTrace(err)
+	}
+	err = a.ensurePrivateKey()
+	if err != nil {
+		return nil, nil, breverrors.WrapAndTrace(err)
+	}
+
+	if ws := a.takeWarm(workspace.ID); ws != nil {
+		return workspace, ws, nil
+	}
+	ws, err := a.dial(ctx, workspace)
+	if err != nil {
+		a.invalidateWorkspace(nameOrID)
+		return nil, nil, breverrors.WrapAndTrace(err)
+	}
+	return workspace, ws, nil
+}
+
+func (a *Agent) dial(ctx context.Context, workspace *entity.Workspace) (*websocket.Conn, error) {
+	client := huproxyclient.NewClient(a.proxy.MakeProxyURL(workspace), a.auth).WithOptions(a.proxyOptions)
+	conn, err := client.Dial(ctx)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return conn, nil
+}
+
+// getWorkspace caches by the identifier ssh was given, which may be a name
+// or alias rather than the id
+func (a *Agent) getWorkspace(nameOrID string) (*entity.Workspace, error) {
+	a.mu.Lock()
+	cached, ok := a.workspaces[nameOrID]
+	a.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < a.WorkspaceTTL {
+		return cached.workspace, nil
+	}
+
+	workspace, err := a.proxy.ResolveWorkspace(nameOrID)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	a.mu.Lock()
+	a.workspaces[nameOrID] = cachedWorkspace{workspace: workspace, fetchedAt: time.Now()}
+	a.mu.Unlock()
+	return workspace, nil
+}
+
+func (a *Agent) invalidateWorkspace(nameOrID string) {
+	a.mu.Lock()
+	delete(a.workspaces, nameOrID)
+	a.mu.Unlock()
+}
+
+// ensurePrivateKey only hits the api once per KeysTTL and only touches the
+// key file when the key changed
+func (a *Agent) ensurePrivateKey() error {
+	a.mu.Lock()
+	fresh := time.Since(a.keysFetchedAt) < a.KeysTTL
+	a.mu.Unlock()
+	if fresh {
+		return nil
+	}
+
+	keys, err := a.store.GetCurrentUserKeys()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if keys.PrivateKey != a.privateKey {
+		err = a.store.WritePrivateKey(keys.PrivateKey)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		a.privateKey = keys.PrivateKey
+	}
+	a.keysFetchedAt = time.Now()
+	return nil
+}
+
+func (a *Agent) takeWarm(workspaceID string) *websocket.Conn {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	w, ok := a.warm[workspaceID]
+	if !ok {
+		return nil
+	}
+	delete(a.warm, workspaceID)
+	if time.Since(w.dialedAt) >= a.WarmTTL {
+		_ = w.conn.Close()
+		return nil
+	}
+	return w.conn
+}
+
+// warmUp dials a spare connection so the next ssh to this workspace does not
+// wait on the websocket handshake
+func (a *Agent) warmUp(ctx context.Context, workspace *entity.Workspace) {
+	a.mu.Lock()
+	_, exists := a.warm[workspace.ID]
+	a.mu.Unlock()
+	if exists || a.WarmTTL <= 0 {
+		return
+	}
+
+	ws, err := a.dial(ctx, workspace)
+	if err != nil {
+		log.Printf("could not warm connection: %v [workspace=%s]", err, workspace.ID)
+		return
+	}
+
+	a.mu.Lock()
+	if _, exists := a.warm[workspace.ID]; exists {
+		a.mu.Unlock()
+		_ = ws.Close()
+		return
+	}
+	a.warm[workspace.ID] = warmConn{conn: ws, dialedAt: time.Now()}
+	a.mu.Unlock()
+
+	time.AfterFunc(a.WarmTTL, func() {
+		a.mu.Lock()
+		w, ok := a.warm[workspace.ID]
+		if ok && w.conn == ws {
+			delete(a.warm, workspace.ID)
+		}
+		a.mu.Unlock()
+		if ok && w.conn == ws {
+			_ = ws.Close()
+		}
+	})
+}
+
+func (a *Agent) closeWarm() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id, w := range a.warm {
+		_ = w.conn.Close()
+		delete(a.warm, id)
+	}
+}
@@ -0,0 +1,200 @@
+package proxyagent
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brevdev/brev-cli/pkg/entity"
+	"github.com/brevdev/brev-cli/pkg/huproxyclient"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+type dummyStore struct {
+	mu                sync.Mutex
+	getWorkspaceCalls int
+	getKeysCalls      int
+	status            string
+}
+
+func (d *dummyStore) GetWorkspace(workspaceID string) (*entity.Workspace, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.getWorkspaceCalls++
+	return &entity.Workspace{ID: workspaceID, Status: d.status}, nil
+}
+
+func (d *dummyStore) GetCurrentUserKeys() (*entity.UserKeys, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.getKeysCalls++
+	return &entity.UserKeys{PrivateKey: "key"}, nil
+}
+
+func (d *dummyStore) WritePrivateKey(_ string) error {
+	return nil
+}
+
+type dummyAuth struct{}
+
+func (dummyAuth) GetAccessToken() (string, error) {
+	return "token", nil
+}
+
+type dummyProxy struct {
+	store *dummyStore
+	url   string
+}
+
+func (d dummyProxy) ResolveWorkspace(nameOrID string) (*entity.Workspace, error) {
+	return d.store.GetWorkspace(nameOrID)
+}
+
+func (d dummyProxy) EnsureWorkspaceRunning(_ context.Context, workspace *entity.Workspace, progress func(string)) (*entity.Workspace, error) {
+	progress("starting")
+	d.store.mu.Lock()
+	d.store.status = "RUNNING"
+	d.store.mu.Unlock()
+	return d.store.GetWorkspace(workspace.ID)
+}
+
+func (d dummyProxy) CheckWorkspaceCanSSH(workspace *entity.Workspace) error {
+	if workspace.Status == "LEGACY" {
+		return &DirectRequiredError{Reason: "workspace is reached by port-forward"}
+	}
+	if workspace.Status != "RUNNING" {
+		return fmt.Errorf("workspace is not in RUNNING state, status: %s", workspace.Status)
+	}
+	return nil
+}
+
+func (d dummyProxy) MakeProxyURL(_ *entity.Workspace) string {
+	return d.url
+}
+
+func newEchoServer() *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close() //nolint:errcheck // test
+		for {
+			mt, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(mt, b); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func startAgent(t *testing.T, store *dummyStore) (string, func()) {
+	s := newEchoServer()
+	dir, err := ioutil.TempDir("", "proxyagent")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	socketPath := filepath.Join(dir, "agent.sock")
+
+	opts := huproxyclient.DefaultOptions()
+	opts.DialRetries = 0
+	agent := NewAgent(store, dummyAuth{}, dummyProxy{store: store, url: "ws" + strings.TrimPrefix(s.URL, "http")}, opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = agent.ListenAndServe(ctx, socketPath)
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(socketPath); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return socketPath, func() {
+		cancel()
+		<-done
+		s.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestConnectThroughAgent(t *testing.T) {
+	store := &dummyStore{status: "RUNNING"}
+	socketPath, stop := startAgent(t, store)
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		conn, err := Connect(socketPath, ConnectRequest{WorkspaceID: "ws-id"}, func(string) {})
+		if !assert.Nil(t, err) {
+			return
+		}
+		_, err = conn.Write([]byte("hello"))
+		assert.Nil(t, err)
+		assert.Nil(t, conn.CloseWrite())
+		b, err := ioutil.ReadAll(conn)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(b))
+		_ = conn.Close()
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	assert.Equal(t, 1, store.getWorkspaceCalls)
+	assert.Equal(t, 1, store.getKeysCalls)
+}
+
+func TestConnectToStoppedWorkspace(t *testing.T) {
+	store := &dummyStore{status: "STOPPED"}
+	socketPath, stop := startAgent(t, store)
+	defer stop()
+
+	_, err := Connect(socketPath, ConnectRequest{WorkspaceID: "ws-id"}, func(string) {})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "RUNNING")
+}
+
+func TestConnectAutoStartsStoppedWorkspace(t *testing.T) {
+	store := &dummyStore{status: "STOPPED"}
+	socketPath, stop := startAgent(t, store)
+	defer stop()
+
+	var progress []string
+	conn, err := Connect(socketPath, ConnectRequest{WorkspaceID: "ws-id", AutoStart: true}, func(p string) {
+		progress = append(progress, p)
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	_ = conn.Close()
+	assert.Equal(t, []string{"starting"}, progress)
+}
+
+func TestConnectToWorkspaceAgentCanNotServe(t *testing.T) {
+	store := &dummyStore{status: "LEGACY"}
+	socketPath, stop := startAgent(t, store)
+	defer stop()
+
+	_, err := Connect(socketPath, ConnectRequest{WorkspaceID: "ws-id"}, func(string) {})
+	_, ok := err.(*DirectRequiredError)
+	assert.True(t, ok)
+}
+
+func TestConnectWithoutAgent(t *testing.T) {
+	_, err := Connect(filepath.Join(os.TempDir(), "does-not-exist.sock"), ConnectRequest{WorkspaceID: "ws-id"}, func(string) {})
+	_, ok := err.(*AgentNotRunningError)
+	assert.True(t, ok)
+}
@@ -0,0 +1,70 @@
+package proxyagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/signal"
+	"syscall"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
+	"github.com/sevlyar/go-daemon"
+)
+
+// Run serves until the process receives a stop signal
+func (a *Agent) Run(socketPath string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT)
+	defer stop()
+
+	err := a.ListenAndServe(ctx, socketPath)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	log.Print("stopped")
+	return nil
+}
+
+func (a *Agent) RunAsDaemon(socketPath string, brevHome string) error {
+	err := files.MakeBrevHome()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	pidFile := fmt.Sprintf("%s/proxy_agent.pid", brevHome)
+	logFile := fmt.Sprintf("%s/proxy_agent.log", brevHome)
+	cntxt := &daemon.Context{
+		PidFileName: pidFile,
+		PidFilePerm: 0o644,
+		LogFileName: logFile,
+		LogFilePerm: 0o640,
+		WorkDir:     brevHome,
+		Umask:       0o27,
+		Args:        []string{},
+	}
+
+	fmt.Printf("PID File: %s\n", pidFile)
+	fmt.Printf("Log File: %s\n", logFile)
+
+	d, err := cntxt.Reborn()
+	if err != nil {
+		if errors.Is(err, daemon.ErrWouldBlock) {
+			log.Print("proxy agent already running")
+			return nil
+		}
+		return breverrors.WrapAndTrace(err)
+	}
+	if d != nil {
+		return nil
+	}
+	defer cntxt.Release() //nolint:errcheck // pid file is removed on a best effort basis
+
+	log.Print("- - - - - - - - - - - - - - -")
+	log.Print("proxy agent started")
+
+	err = a.Run(socketPath)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
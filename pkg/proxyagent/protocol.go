@@ -0,0 +1,187 @@
+package proxyagent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/huproxyclient"
+)
+
+// A connection to the agent starts with a single json line request, then
+// json line responses until one without progress. After a successful response
+// the connection is a raw byte stream to the workspace's ssh server.
+
+type ConnectRequest struct {
+	WorkspaceID string `json:"workspaceId"` // id, name or local alias
+	AutoStart   bool   `json:"autoStart,omitempty"`
+}
+
+// The agent may send any number of progress responses before the final one
+type ConnectResponse struct {
+	Progress  string                    `json:"progress,omitempty"`
+	Error     string                    `json:"error,omitempty"`
+	Directive string                    `json:"directive,omitempty"`
+	Reason    huproxyclient.CloseReason `json:"reason,omitempty"`
+	// Direct means the agent can not serve this workspace and the client
+	// should connect on its own
+	Direct bool `json:"direct,omitempty"`
+}
+
+var (
+	handshakeTimeout          = 2 * time.Minute
+	autoStartHandshakeTimeout = 30 * time.Minute
+)
+
+func getHandshakeTimeout(req ConnectRequest) time.Duration {
+	if req.AutoStart {
+		return autoStartHandshakeTimeout
+	}
+	return handshakeTimeout
+}
+
+func writeLine(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	_, err = w.Write(append(b, '\n'))
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func readLine(r *bufio.Reader, v interface{}) error {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = json.Unmarshal(line, v)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// Conn is a stream to a workspace that goes through the agent
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c Conn) Read(b []byte) (int, error) {
+	n, err := c.reader.Read(b)
+	if err != nil {
+		return n, err //nolint:wrapcheck // io errors must stay unwrapped for io.Copy
+	}
+	return n, nil
+}
+
+// CloseWrite signals the workspace that there is no more input
+func (c Conn) CloseWrite() error {
+	if uc, ok := c.Conn.(*net.UnixConn); ok {
+		err := uc.CloseWrite()
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+	}
+	return nil
+}
+
+// Connect asks the agent listening on socketPath to open a stream to the
+// workspace. It returns an error without side effects if the agent is not
+// running so that callers can fall back to connecting directly.
+func Connect(socketPath string, req ConnectRequest, progress func(string)) (*Conn, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, &AgentNotRunningError{Err: err}
+	}
+
+	err = conn.SetDeadline(time.Now().Add(getHandshakeTimeout(req)))
+	if err != nil {
+		_ = conn.Close()
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	err = writeLine(conn, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	reader := bufio.NewReader(conn)
+	var res ConnectResponse
+	for {
+		res = ConnectResponse{}
+		err = readLine(reader, &res)
+		if err != nil {
+			_ = conn.Close()
+			return nil, breverrors.WrapAndTrace(err)
+		}
+		if res.Progress == "" {
+			break
+		}
+		progress(res.Progress)
+	}
+	if res.Direct {
+		_ = conn.Close()
+		return nil, &DirectRequiredError{Reason: res.Error}
+	}
+	if res.Error != "" {
+		_ = conn.Close()
+		reason := res.Reason
+		if reason == "" {
+			reason = huproxyclient.CloseReasonUnknown
+		}
+		return nil, &huproxyclient.SessionEndedError{Reason: reason, Err: &agentError{message: res.Error, directive: res.Directive}}
+	}
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		_ = conn.Close()
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return &Conn{Conn: conn, reader: reader}, nil
+}
+
+type AgentNotRunningError struct {
+	Err error
+}
+
+func (e *AgentNotRunningError) Error() string {
+	return fmt.Sprintf("proxy agent is not running: %v", e.Err)
+}
+
+func (e *AgentNotRunningError) Directive() string {
+	return "run `brev proxy-agent -d` to start it"
+}
+
+func (e *AgentNotRunningError) Unwrap() error {
+	return e.Err
+}
+
+// DirectRequiredError is returned by the agent for workspaces that need a
+// connection strategy it does not implement
+type DirectRequiredError struct {
+	Reason string
+}
+
+func (e *DirectRequiredError) Error() string {
+	return fmt.Sprintf("proxy agent can not connect to this workspace: %s", e.Reason)
+}
+
+// agentError carries an error and its directive across the socket
+type agentError struct {
+	message   string
+	directive string
+}
+
+func (e *agentError) Error() string {
+	return fmt.Sprintf("proxy agent: %s", e.message)
+}
+
+func (e *agentError) Directive() string {
+	return e.directive
+}
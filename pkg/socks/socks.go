@@ -0,0 +1,311 @@
+// Package socks serves SOCKS5 and HTTP CONNECT proxies that dial their
+// targets through a workspace, so services only reachable from the
+// workspace's network can be used from this machine
+package socks
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/portforward"
+)
+
+const socksVersion = 5
+
+// socks5 method, command, address type and reply codes from RFC 1928
+const (
+	methodNoAuth       = 0x00
+	methodNoAcceptable = 0xff
+
+	cmdConnect = 0x01
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+
+	repSuccess             = 0x00
+	repHostUnreachable     = 0x04
+	repCommandNotSupported = 0x07
+	repAddressNotSupported = 0x08
+)
+
+// Dialer opens connections from the workspace, which ssh.Client does with
+// direct-tcpip channels
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// ConnStats describes a proxied connection once it has closed
+type ConnStats struct {
+	Protocol string // "socks5" or "http"
+	Client   string
+	Target   string
+	Sent     int64 // bytes from the client to the target
+	Received int64 // bytes from the target to the client
+	Duration time.Duration
+	Err      error // why the connection could not be proxied
+}
+
+func (s ConnStats) String() string {
+	if s.Err != nil {
+		return fmt.Sprintf("%s %s -> %s failed: %v", s.Protocol, s.Client, s.Target, s.Err)
+	}
+	return fmt.Sprintf("%s %s -> %s sent %d bytes, received %d bytes in %s", s.Protocol, s.Client, s.Target, s.Sent, s.Received, s.Duration.Round(time.Millisecond))
+}
+
+type Server struct {
+	Dialer Dialer
+	// OnClose is called with the stats of every connection when it closes
+	OnClose func(ConnStats)
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+func NewServer(dialer Dialer, onClose func(ConnStats)) *Server {
+	return &Server{Dialer: dialer, OnClose: onClose, conns: map[net.Conn]bool{}}
+}
+
+// ServeSOCKS accepts SOCKS5 connections on l until ctx is done, then closes
+// the open connections and waits for them
+func (s *Server) ServeSOCKS(ctx context.Context, l net.Listener) error {
+	return s.serve(ctx, l, s.handleSOCKS)
+}
+
+// ServeConnect accepts HTTP CONNECT requests on l until ctx is done, then
+// closes the open connections and waits for them
+func (s *Server) ServeConnect(ctx context.Context, l net.Listener) error {
+	return s.serve(ctx, l, s.handleHTTP)
+}
+
+func (s *Server) serve(ctx context.Context, l net.Listener, handle func(net.Conn) ConnStats) error {
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = l.Close()
+			s.closeAll()
+		case <-stopped:
+		}
+	}()
+	defer close(stopped)
+
+	var wg sync.WaitGroup
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			wg.Wait()
+			if ctx.Err() != nil {
+				return nil
+			}
+			return breverrors.WrapAndTrace(err)
+		}
+		s.track(conn, true)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.track(conn, false)
+			defer conn.Close() //nolint:errcheck // the connection is done
+			start := time.Now()
+			stats := handle(conn)
+			stats.Client = conn.RemoteAddr().String()
+			stats.Duration = time.Since(start)
+			if s.OnClose != nil {
+				s.OnClose(stats)
+			}
+		}()
+	}
+}
+
+func (s *Server) track(conn net.Conn, open bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if open {
+		s.conns[conn] = true
+	} else {
+		delete(s.conns, conn)
+	}
+}
+
+func (s *Server) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+}
+
+func (s *Server) handleSOCKS(conn net.Conn) ConnStats {
+	stats := ConnStats{Protocol: "socks5"}
+	r := bufio.NewReader(conn)
+
+	target, err := socksHandshake(r, conn)
+	stats.Target = target
+	if err != nil {
+		stats.Err = err
+		return stats
+	}
+
+	remote, err := s.Dialer.Dial("tcp", target)
+	if err != nil {
+		_, _ = conn.Write(socksReply(repHostUnreachable))
+		stats.Err = err
+		return stats
+	}
+	defer remote.Close() //nolint:errcheck // the connection is done
+	_, err = conn.Write(socksReply(repSuccess))
+	if err != nil {
+		stats.Err = err
+		return stats
+	}
+
+	stats.Sent, stats.Received = portforward.Pipe(&bufferedConn{Conn: conn, r: r}, remote)
+	return stats
+}
+
+// socksHandshake negotiates no authentication and reads a CONNECT request,
+// replying with an error for anything else
+func socksHandshake(r *bufio.Reader, w io.Writer) (string, error) {
+	var header [2]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	_, err = io.ReadFull(r, methods)
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	if !containsByte(methods, methodNoAuth) {
+		_, _ = w.Write([]byte{socksVersion, methodNoAcceptable})
+		return "", fmt.Errorf("client does not support connecting without authentication")
+	}
+	_, err = w.Write([]byte{socksVersion, methodNoAuth})
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+
+	var req [4]byte
+	_, err = io.ReadFull(r, req[:])
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	if req[1] != cmdConnect {
+		_, _ = w.Write(socksReply(repCommandNotSupported))
+		return "", fmt.Errorf("unsupported socks command %d, only connect is supported", req[1])
+	}
+
+	var host string
+	switch req[3] {
+	case atypIPv4, atypIPv6:
+		size := net.IPv4len
+		if req[3] == atypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		_, err = io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case atypDomain:
+		var size byte
+		size, err = r.ReadByte()
+		if err == nil {
+			name := make([]byte, size)
+			_, err = io.ReadFull(r, name)
+			host = string(name)
+		}
+	default:
+		_, _ = w.Write(socksReply(repAddressNotSupported))
+		return "", fmt.Errorf("unsupported socks address type %d", req[3])
+	}
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	var port [2]byte
+	_, err = io.ReadFull(r, port[:])
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksReply does not report the bound address, which clients ignore for
+// connect
+func socksReply(rep byte) []byte {
+	return []byte{socksVersion, rep, 0, atypIPv4, 0, 0, 0, 0, 0, 0}
+}
+
+func (s *Server) handleHTTP(conn net.Conn) ConnStats {
+	stats := ConnStats{Protocol: "http"}
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		stats.Err = err
+		return stats
+	}
+	stats.Target = req.Host
+	if req.Method != http.MethodConnect {
+		_, _ = io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\nAllow: CONNECT\r\nContent-Length: 0\r\n\r\n")
+		stats.Err = fmt.Errorf("only CONNECT is supported, got %s", req.Method)
+		return stats
+	}
+	if _, _, err = net.SplitHostPort(req.Host); err != nil {
+		_, _ = io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+		stats.Err = err
+		return stats
+	}
+
+	remote, err := s.Dialer.Dial("tcp", req.Host)
+	if err != nil {
+		_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		stats.Err = err
+		return stats
+	}
+	defer remote.Close() //nolint:errcheck // the connection is done
+	_, err = io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	if err != nil {
+		stats.Err = err
+		return stats
+	}
+
+	stats.Sent, stats.Received = portforward.Pipe(&bufferedConn{Conn: conn, r: r}, remote)
+	return stats
+}
+
+// bufferedConn reads what the handshake's reader buffered before reading
+// from the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b) //nolint:wrapcheck // io passthrough
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(portforward.CloseWriter); ok {
+		return cw.CloseWrite() //nolint:wrapcheck // io passthrough
+	}
+	return nil
+}
+
+func containsByte(bs []byte, b byte) bool {
+	for _, x := range bs {
+		if x == b {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package socks
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// netDialer dials directly and records the targets, standing in for a
+// workspace
+type netDialer struct {
+	mu      sync.Mutex
+	targets []string
+}
+
+func (d *netDialer) Dial(network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.targets = append(d.targets, addr)
+	d.mu.Unlock()
+	return net.Dial(network, addr)
+}
+
+func newEchoListener(t *testing.T) (net.Listener, int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close() //nolint:errcheck // test
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return l, l.Addr().(*net.TCPAddr).Port
+}
+
+type stats struct {
+	mu  sync.Mutex
+	all []ConnStats
+}
+
+func (s *stats) add(c ConnStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.all = append(s.all, c)
+}
+
+func (s *stats) get() []ConnStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ConnStats(nil), s.all...)
+}
+
+func startServer(t *testing.T, serve func(*Server, context.Context, net.Listener) error) (string, *netDialer, *stats, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	dialer := &netDialer{}
+	st := &stats{}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- serve(NewServer(dialer, st.add), ctx, l)
+	}()
+	stop := func() {
+		cancel()
+		select {
+		case err := <-errs:
+			assert.Nil(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("server did not stop")
+		}
+	}
+	return l.Addr().String(), dialer, st, stop
+}
+
+func assertEchoes(t *testing.T, conn net.Conn, r io.Reader) {
+	_, err := conn.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, conn.(*net.TCPConn).CloseWrite())
+	b, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(b))
+}
+
+func TestSOCKSConnectByDomain(t *testing.T) {
+	echo, port := newEchoListener(t)
+	defer echo.Close() //nolint:errcheck // test
+	addr, dialer, st, stop := startServer(t, (*Server).ServeSOCKS)
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close() //nolint:errcheck // test
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte{5, 1, 0})
+	assert.Nil(t, err)
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{5, 0}, reply)
+
+	req := []byte{5, 1, 0, 3, byte(len("localhost"))}
+	req = append(req, "localhost"...)
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	_, err = conn.Write(req)
+	assert.Nil(t, err)
+	reply = make([]byte, 10)
+	_, err = io.ReadFull(conn, reply)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(0), reply[1])
+
+	assertEchoes(t, conn, conn)
+	stop()
+
+	assert.Equal(t, []string{net.JoinHostPort("localhost", strconv.Itoa(port))}, dialer.targets)
+	if assert.Len(t, st.get(), 1) {
+		s := st.get()[0]
+		assert.Nil(t, s.Err)
+		assert.Equal(t, "socks5", s.Protocol)
+		assert.Equal(t, int64(5), s.Sent)
+		assert.Equal(t, int64(5), s.Received)
+	}
+}
+
+func TestSOCKSRejectsBind(t *testing.T) {
+	addr, dialer, st, stop := startServer(t, (*Server).ServeSOCKS)
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close() //nolint:errcheck // test
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte{5, 1, 0, 5, 2, 0, 1, 127, 0, 0, 1, 0, 80})
+	assert.Nil(t, err)
+	reply := make([]byte, 12)
+	_, err = io.ReadFull(conn, reply)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(7), reply[3])
+	stop()
+
+	assert.Empty(t, dialer.targets)
+	if assert.Len(t, st.get(), 1) {
+		assert.NotNil(t, st.get()[0].Err)
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	echo, port := newEchoListener(t)
+	defer echo.Close() //nolint:errcheck // test
+	addr, _, st, stop := startServer(t, (*Server).ServeConnect)
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close() //nolint:errcheck // test
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	target := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	assert.Nil(t, err)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assertEchoes(t, conn, r)
+	stop()
+
+	if assert.Len(t, st.get(), 1) {
+		assert.Equal(t, target, st.get()[0].Target)
+		assert.Nil(t, st.get()[0].Err)
+	}
+}
+
+func TestHTTPRejectsPlainRequests(t *testing.T) {
+	addr, _, _, stop := startServer(t, (*Server).ServeConnect)
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close() //nolint:errcheck // test
+	_, err = fmt.Fprint(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Nil(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
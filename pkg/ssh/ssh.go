@@ -16,14 +16,15 @@ package ssh
 import (
 	"bytes"
 	"encoding/xml"
-	"fmt"
 	"strconv"
 	"strings"
 	"text/template"
 
 	"github.com/brevdev/brev-cli/pkg/entity"
 	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/localports"
 	"github.com/kevinburke/ssh_config"
+	"github.com/spf13/afero"
 )
 
 const workspaceSSHConfigTemplate = `Host {{ .Host }}
@@ -73,6 +74,12 @@ type (
 		Writers    []Writer
 		workspaces []entity.WorkspaceWithMeta
 		privateKey string
+		ports      PortAssigner
+	}
+	// PortAssigner gives each workspace a stable local port, see
+	// localports.Assigner
+	PortAssigner interface {
+		AssignPorts(workspaces []localports.Workspace, taken map[int]bool) (map[string]int, error)
 	}
 	JetBrainsGatewayConfigStore interface {
 		GetJetBrainsConfigPath() (string, error)
@@ -80,11 +87,28 @@ type (
 		WriteJetBrainsConfig(config string) error
 		GetPrivateKeyPath() string
 	}
+	// JetBrainsGatewayConfigsStore reaches the config of every installed
+	// Gateway
+	JetBrainsGatewayConfigsStore interface {
+		JetBrainsGatewayConfigStore
+		GetJetBrainsConfigPaths() ([]string, error)
+		GetJetBrainsConfigAt(path string) (string, error)
+		WriteJetBrainsConfigAt(path string, config string) error
+	}
+	// JetBrainsGatewayModeStore remembers whether the Gateway entries connect
+	// through the brev ssh config
+	JetBrainsGatewayModeStore interface {
+		GetJetBrainsGatewayUsesSSHConfig() (bool, error)
+		SetJetBrainsGatewayUsesSSHConfig(use bool) error
+	}
 	JetBrainsGatewayConfig struct {
 		config *JetbrainsGatewayConfigXML
 		Reader
 		Writer
 		store JetBrainsGatewayConfigStore
+		// useOpenSSHConfig makes entries name the workspace's host in the ssh
+		// config instead of a localhost port forward
+		useOpenSSHConfig bool
 	}
 	JetbrainsGatewayConfigXMLSSHOption struct {
 		Name  string `xml:"name,attr,omitempty"`
@@ -270,11 +294,29 @@ func (s SSHConfig) GetBrevHostValues() []entity.WorkspaceLocalID {
 }
 
 func (s *SSHConfig) Sync(identifierPortMapping IdentityPortMap) error {
-	sshConfigStr := s.sshConfig.String()
+	// entries whose port changed are pruned and written again
+	unchanged := make(IdentityPortMap)
 	brevhosts := s.GetBrevHostValueSet()
-
 	for key, value := range identifierPortMapping {
 		if !brevhosts[key] {
+			continue
+		}
+		port, err := s.GetConfiguredWorkspacePort(key)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		if port == value {
+			unchanged[key] = value
+		}
+	}
+	err := s.PruneInactiveWorkspaces(unchanged)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+
+	sshConfigStr := s.sshConfig.String()
+	for key, value := range identifierPortMapping {
+		if _, ok := unchanged[key]; !ok {
 			entry, err2 := MakeSSHEntry(key, value, s.privateKey)
 			if err2 != nil {
 				return breverrors.WrapAndTrace(err2)
@@ -283,16 +325,10 @@ func (s *SSHConfig) Sync(identifierPortMapping IdentityPortMap) error {
 		}
 	}
 
-	var err error
 	s.sshConfig, err = ssh_config.Decode(strings.NewReader(sshConfigStr))
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
 	}
-
-	err = s.PruneInactiveWorkspaces(identifierPortMapping)
-	if err != nil {
-		return breverrors.WrapAndTrace(err)
-	}
 	err = s.store.WriteUserSSHConfig(s.sshConfig.String())
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
@@ -345,37 +381,55 @@ func NewSSHConfigurer(workspaces []entity.WorkspaceWithMeta, reader Reader, writ
 		Writers:    writers,
 		store:      store,
 		privateKey: privateKey,
+		ports:      localports.NewAssigner(localports.NewStore(afero.NewMemMapFs(), "ports.json"), localports.IsPortFree),
 	}
 }
 
+// WithPortAssigner persists the ports workspaces are given, the default
+// keeps them in memory
+func (sshConfigurer *SSHConfigurer) WithPortAssigner(ports PortAssigner) *SSHConfigurer {
+	sshConfigurer.ports = ports
+	return sshConfigurer
+}
+
+// GetIdentityPortMap gives each workspace its port in the port registry.
+// Workspaces new to the registry keep the port their config entry has, or
+// are given a free one that no other entry uses.
 func (sshConfigurer *SSHConfigurer) GetIdentityPortMap() (IdentityPortMap, error) {
-	activeWorkspaces := sshConfigurer.GetActiveWorkspaceIdentifiers()
+	workspaces := WorkspacesFromWorkspaceWithMeta(sshConfigurer.workspaces)
 	brevHostValuesSet := sshConfigurer.Reader.GetBrevHostValueSet()
-	ports, err := sshConfigurer.Reader.GetBrevPorts()
+	configuredPorts, err := sshConfigurer.Reader.GetBrevPorts()
 	if err != nil {
 		return nil, breverrors.WrapAndTrace(err)
 	}
-	port := 2222
-	identifierPortMapping := make(map[entity.WorkspaceLocalID]string)
-	for _, workspaceIdentifier := range activeWorkspaces {
-		if !brevHostValuesSet[workspaceIdentifier] {
-			for ports[fmt.Sprint(port)] {
-				port++
-			}
-			identifierPortMapping[workspaceIdentifier] = strconv.Itoa(port)
-			ports[fmt.Sprint(port)] = true
-		} else {
-			if err != nil {
-				return nil, breverrors.WrapAndTrace(err)
-			}
+	taken := make(map[int]bool)
+	for p := range configuredPorts {
+		if port, err := strconv.Atoi(p); err == nil {
+			taken[port] = true
+		}
+	}
+
+	var toAssign []localports.Workspace
+	for _, w := range workspaces {
+		workspace := localports.Workspace{ID: w.ID, OrganizationID: w.OrganizationID}
+		workspaceIdentifier := w.GetLocalIdentifier(workspaces)
+		if brevHostValuesSet[workspaceIdentifier] {
 			p, err := sshConfigurer.GetConfiguredWorkspacePort(workspaceIdentifier)
 			if err != nil {
 				return nil, breverrors.WrapAndTrace(err)
 			}
-			identifierPortMapping[workspaceIdentifier] = p
-			ports[fmt.Sprint(port)] = true
-
+			workspace.ConfiguredPort, _ = strconv.Atoi(p)
 		}
+		toAssign = append(toAssign, workspace)
+	}
+	ports, err := sshConfigurer.ports.AssignPorts(toAssign, taken)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+
+	identifierPortMapping := make(IdentityPortMap)
+	for _, w := range workspaces {
+		identifierPortMapping[w.GetLocalIdentifier(workspaces)] = strconv.Itoa(ports[w.ID])
 	}
 	return identifierPortMapping, nil
 }
@@ -401,6 +455,16 @@ func (sshConfigurer *SSHConfigurer) Sync() error {
 	return nil
 }
 
+// SyncWorkspaces replaces the set of workspaces and syncs the config for it
+func (sshConfigurer *SSHConfigurer) SyncWorkspaces(workspaces []entity.WorkspaceWithMeta) error {
+	sshConfigurer.workspaces = workspaces
+	err := sshConfigurer.Sync()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
 // NADER IS SO FUCKING SORRY FOR DOING THIS TWICE BUT I HAVE NO CLUE WHERE THIS HELPER FUNCTION SHOULD GO SO ITS COPY/PASTED ELSEWHERE
 // IF YOU MODIFY IT MODIFY IT EVERYWHERE OR PLEASE PUT IT IN ITS PROPER PLACE. thank you you're the best <3
 func WorkspacesFromWorkspaceWithMeta(wwm []entity.WorkspaceWithMeta) []entity.Workspace {
@@ -429,7 +493,6 @@ func WorkspacesFromWorkspaceWithMeta(wwm []entity.WorkspaceWithMeta) []entity.Wo
 func (sshConfigurer *SSHConfigurer) GetActiveWorkspaceIdentifiers() []entity.WorkspaceLocalID {
 	var workspaceIdentifiers []entity.WorkspaceLocalID
 	for _, workspace := range sshConfigurer.workspaces {
-		fmt.Println(workspace.Name)
 		workspaceIdentifiers = append(workspaceIdentifiers, workspace.GetLocalIdentifier(WorkspacesFromWorkspaceWithMeta(sshConfigurer.workspaces)))
 	}
 	return workspaceIdentifiers
@@ -469,26 +532,83 @@ func NewJetBrainsGatewayConfig(store JetBrainsGatewayConfigStore) (*JetBrainsGat
 	}, nil
 }
 
+// NewJetBrainsGatewayConfigs returns the config of every installed Gateway.
+// With useOpenSSHConfig, Sync writes entries that connect through the ssh
+// config's ProxyCommand hosts, so Gateway does not need brev jetbrains to
+// keep port forwards alive.
+func NewJetBrainsGatewayConfigs(store JetBrainsGatewayConfigsStore, useOpenSSHConfig bool) ([]*JetBrainsGatewayConfig, error) {
+	paths, err := store.GetJetBrainsConfigPaths()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	var configs []*JetBrainsGatewayConfig
+	for _, path := range paths {
+		config, err := NewJetBrainsGatewayConfig(jetBrainsGatewayConfigAtPath{store, path})
+		if err != nil {
+			return nil, breverrors.WrapAndTrace(err)
+		}
+		config.useOpenSSHConfig = useOpenSSHConfig
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// jetBrainsGatewayConfigAtPath is the store of one of the Gateway configs
+type jetBrainsGatewayConfigAtPath struct {
+	JetBrainsGatewayConfigsStore
+	path string
+}
+
+func (s jetBrainsGatewayConfigAtPath) GetJetBrainsConfigPath() (string, error) {
+	return s.path, nil
+}
+
+func (s jetBrainsGatewayConfigAtPath) GetJetBrainsConfig() (string, error) {
+	config, err := s.GetJetBrainsConfigAt(s.path)
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	return config, nil
+}
+
+func (s jetBrainsGatewayConfigAtPath) WriteJetBrainsConfig(config string) error {
+	err := s.WriteJetBrainsConfigAt(s.path, config)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func (jbgc *JetBrainsGatewayConfig) makeSSHConfig(workspaceIdentifier entity.WorkspaceLocalID, port string) JetbrainsGatewayConfigXMLSSHConfig {
+	conf := JetbrainsGatewayConfigXMLSSHConfig{
+		Host:       "localhost",
+		Port:       port,
+		KeyPath:    jbgc.store.GetPrivateKeyPath(),
+		Username:   "brev",
+		CustomName: workspaceIdentifier,
+		NameFormat: "CUSTOM",
+		Options: []JetbrainsGatewayConfigXMLSSHOption{
+			{
+				Name:  "CustomName",
+				Value: string(workspaceIdentifier),
+			},
+		},
+	}
+	if jbgc.useOpenSSHConfig {
+		conf.Host = string(workspaceIdentifier)
+		conf.Port = ""
+		conf.UseOpenSSHConfig = "true"
+	}
+	return conf
+}
+
 func (jbgc *JetBrainsGatewayConfig) Sync(identifierPortMapping IdentityPortMap) error {
 	brevhosts := jbgc.GetBrevHostValueSet()
 	activeWorkspaces := make(map[entity.WorkspaceLocalID]bool)
 	privateKeyPath := jbgc.store.GetPrivateKeyPath()
 	for key, value := range identifierPortMapping {
 		if !brevhosts[key] {
-			jbgc.config.Component.Configs.SSHConfigs = append(jbgc.config.Component.Configs.SSHConfigs, JetbrainsGatewayConfigXMLSSHConfig{
-				Host:       "localhost",
-				Port:       value,
-				KeyPath:    privateKeyPath,
-				Username:   "brev",
-				CustomName: (key),
-				NameFormat: "CUSTOM",
-				Options: []JetbrainsGatewayConfigXMLSSHOption{
-					{
-						Name:  "CustomName",
-						Value: string(key),
-					},
-				},
-			})
+			jbgc.config.Component.Configs.SSHConfigs = append(jbgc.config.Component.Configs.SSHConfigs, jbgc.makeSSHConfig(key, value))
 		}
 		activeWorkspaces[(key)] = true
 	}
@@ -499,6 +619,13 @@ func (jbgc *JetBrainsGatewayConfig) Sync(identifierPortMapping IdentityPortMap)
 		if !isBrevHost {
 			sshConfigs = append(sshConfigs, conf)
 		} else if isBrevHost && isActiveWorkspace {
+			// entries from a different port or mode are rewritten, keeping
+			// the id Gateway gave them
+			want := jbgc.makeSSHConfig(conf.CustomName, identifierPortMapping[conf.CustomName])
+			if conf.Host != want.Host || conf.Port != want.Port || conf.UseOpenSSHConfig != want.UseOpenSSHConfig {
+				want.ID = conf.ID
+				conf = want
+			}
 			sshConfigs = append(sshConfigs, conf)
 		}
 	}
@@ -517,7 +644,9 @@ func (jbgc *JetBrainsGatewayConfig) Sync(identifierPortMapping IdentityPortMap)
 func (jbgc *JetBrainsGatewayConfig) GetBrevPorts() (BrevPorts, error) {
 	ports := make(BrevPorts)
 	for _, sshConf := range jbgc.config.Component.Configs.SSHConfigs {
-		ports[sshConf.Port] = true
+		if sshConf.Port != "" {
+			ports[sshConf.Port] = true
+		}
 	}
 	return ports, nil
 }
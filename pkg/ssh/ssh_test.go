@@ -2,11 +2,13 @@ package ssh
 
 import (
 	"fmt"
+	"os"
 	"testing"
 
 	"github.com/brevdev/brev-cli/pkg/entity"
 	breverrors "github.com/brevdev/brev-cli/pkg/errors"
 	"github.com/brevdev/brev-cli/pkg/files"
+	"github.com/brevdev/brev-cli/pkg/localports"
 	"github.com/brevdev/brev-cli/pkg/store"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
@@ -539,3 +541,119 @@ func TestParseJetbrainsGatewayXml(t *testing.T) {
 	assert.Equal(t, someWorkspaces[0].GetLocalIdentifier(nil), xml.Component.Configs.SSHConfigs[0].CustomName)
 	assert.Equal(t, "2222", xml.Component.Configs.SSHConfigs[0].Port)
 }
+
+func TestJetBrainsGatewayConfigurerUsesSSHConfigHosts(t *testing.T) {
+	err := os.Setenv(store.JetBrainsGatewayConfigEnv, "/gateway")
+	assert.Nil(t, err)
+	defer os.Unsetenv(store.JetBrainsGatewayConfigEnv) //nolint:errcheck // test cleanup
+	mockJetbrainsGatewayStore := makeMockJetBrainsGateWayStore()
+	privateKeyPath := mockJetbrainsGatewayStore.GetPrivateKeyPath()
+	alias := someWorkspaces[0].GetLocalIdentifier(nil)
+	// an entry written by brev jetbrains, which forwards a port
+	err = mockJetbrainsGatewayStore.WriteJetBrainsConfig(fmt.Sprintf(`<application>
+  <component name="SshConfigs">
+    <configs>
+      <sshConfig host="localhost" id="f72d6499-1376-47df-b274-94de782a7dd2" keyPath="%s" port="2222" customName="%s" nameFormat="CUSTOM" username="brev">
+        <option name="CustomName" value="%s" />
+      </sshConfig>
+    </configs>
+  </component>
+</application>
+`, privateKeyPath, alias, alias))
+	assert.Nil(t, err)
+
+	err = mockJetbrainsGatewayStore.SetJetBrainsGatewayUsesSSHConfig(true)
+	assert.Nil(t, err)
+	configurer := NewJetBrainsGatewayConfigurer(mockJetbrainsGatewayStore)
+	err = configurer.Update([]entity.Workspace{someWorkspaces[0].Workspace})
+	assert.Nil(t, err)
+	config, err := mockJetbrainsGatewayStore.GetJetBrainsConfigAt("/gateway/options/sshConfigs.xml")
+	assert.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf(`<application>
+  <component name="SshConfigs">
+    <configs>
+      <sshConfig id="f72d6499-1376-47df-b274-94de782a7dd2" customName="%[1]s" nameFormat="CUSTOM" useOpenSSHConfig="true" host="%[1]s" keyPath="%[2]s" username="brev">
+        <option name="CustomName" value="%[1]s"></option>
+      </sshConfig>
+    </configs>
+  </component>
+</application>`, alias, privateKeyPath), config)
+
+	jetBrainsGatewayConfigs, err := NewJetBrainsGatewayConfigs(mockJetbrainsGatewayStore, true)
+	assert.Nil(t, err)
+	if assert.Len(t, jetBrainsGatewayConfigs, 1) {
+		ports, err := jetBrainsGatewayConfigs[0].GetBrevPorts()
+		assert.Nil(t, err)
+		assert.Empty(t, ports)
+	}
+
+	err = configurer.Update(nil)
+	assert.Nil(t, err)
+	config, err = mockJetbrainsGatewayStore.GetJetBrainsConfigAt("/gateway/options/sshConfigs.xml")
+	assert.Nil(t, err)
+	assert.NotContains(t, config, "sshConfig ")
+}
+
+func TestJetBrainsGatewayConfigurerKeepsForwardsUnlessChosen(t *testing.T) {
+	err := os.Setenv(store.JetBrainsGatewayConfigEnv, "/gateway")
+	assert.Nil(t, err)
+	defer os.Unsetenv(store.JetBrainsGatewayConfigEnv) //nolint:errcheck // test cleanup
+	mockJetbrainsGatewayStore := makeMockJetBrainsGateWayStore()
+	alias := someWorkspaces[0].GetLocalIdentifier(nil)
+	forwarded := fmt.Sprintf(`<application>
+  <component name="SshConfigs">
+    <configs>
+      <sshConfig host="localhost" id="f72d6499-1376-47df-b274-94de782a7dd2" keyPath="%s" port="2222" customName="%s" nameFormat="CUSTOM" username="brev">
+        <option name="CustomName" value="%s" />
+      </sshConfig>
+    </configs>
+  </component>
+</application>
+`, mockJetbrainsGatewayStore.GetPrivateKeyPath(), alias, alias)
+	err = mockJetbrainsGatewayStore.WriteJetBrainsConfig(forwarded)
+	assert.Nil(t, err)
+
+	// brev jetbrains without --use-ssh-config owns the entries
+	err = NewJetBrainsGatewayConfigurer(mockJetbrainsGatewayStore).Update(nil)
+	assert.Nil(t, err)
+	config, err := mockJetbrainsGatewayStore.GetJetBrainsConfigAt("/gateway/options/sshConfigs.xml")
+	assert.Nil(t, err)
+	assert.Equal(t, forwarded, config)
+}
+
+func TestSSHConfigurerUsesPortRegistry(t *testing.T) {
+	mockStore, err := makeMockSSHStore()
+	assert.Nil(t, err)
+	sshConfig, err := makeTestSSHConfig(mockStore)
+	assert.Nil(t, err)
+	registry := localports.NewStore(afero.NewMemMapFs(), "/home/.brev/ports.json")
+	err = registry.Save(&localports.Registry{Ports: map[string]localports.Assignment{
+		someWorkspaces[0].ID: {Port: 2300, OrganizationID: someWorkspaces[0].OrganizationID},
+	}})
+	assert.Nil(t, err)
+	other := someWorkspaces[0]
+	other.ID = "other-id"
+	other.Name = "otherName"
+	other.DNS = "other-dns-org.brev.sh"
+	workspaces := []entity.WorkspaceWithMeta{someWorkspaces[0], other}
+	sshConfigurer := NewSSHConfigurer(workspaces, sshConfig, []Writer{sshConfig}, mockStore, WorkingRSAPrivateKey).
+		WithPortAssigner(localports.NewAssigner(registry, func(_ string, port int) bool { return port != 2225 }))
+
+	identityPortMap, err := sshConfigurer.GetIdentityPortMap()
+	assert.Nil(t, err)
+	ids := WorkspacesFromWorkspaceWithMeta(workspaces)
+	// brev entries in the config take 2222 to 2224, and 2225 is bound
+	assert.Equal(t, IdentityPortMap{
+		workspaces[0].GetLocalIdentifier(ids): "2300",
+		workspaces[1].GetLocalIdentifier(ids): "2226",
+	}, identityPortMap)
+
+	err = sshConfigurer.Sync()
+	assert.Nil(t, err)
+	sshConfig, err = NewSSHConfig(mockStore)
+	assert.Nil(t, err)
+	port, err := sshConfig.GetConfiguredWorkspacePort(workspaces[0].GetLocalIdentifier(ids))
+	assert.Nil(t, err)
+	assert.Equal(t, "2300", port)
+	assert.Len(t, sshConfig.GetBrevHostValues(), 2)
+}
@@ -2,10 +2,12 @@ package ssh
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/brevdev/brev-cli/pkg/entity"
 	breverrors "github.com/brevdev/brev-cli/pkg/errors"
@@ -21,14 +23,23 @@ type Config interface {
 	Update(workspaces []entity.Workspace) error
 }
 
+// ConfigUpdaterTaskName is the name the daemon runs ConfigUpdater under,
+// commands that change workspaces trigger it so the configs update right away
+const ConfigUpdaterTaskName = "ssh-config"
+
 type ConfigUpdater struct {
 	Store   ConfigUpdaterStore
 	Configs []Config
 }
 
-var _ tasks.Task = ConfigUpdater{}
+var _ tasks.ContextTask = ConfigUpdater{}
 
 func (c ConfigUpdater) Run() error {
+	return c.RunContext(context.Background())
+}
+
+// RunContext stops before updating the next config once ctx is done
+func (c ConfigUpdater) RunContext(ctx context.Context) error {
 	workspaces, err := c.Store.GetContextWorkspaces()
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
@@ -42,6 +53,10 @@ func (c ConfigUpdater) Run() error {
 
 	var res error
 	for _, c := range c.Configs {
+		if ctx.Err() != nil {
+			res = multierror.Append(res, ctx.Err())
+			break
+		}
 		err := c.Update(runningWorkspaces)
 		if err != nil {
 			res = multierror.Append(res, err)
@@ -55,7 +70,15 @@ func (c ConfigUpdater) Run() error {
 }
 
 func (c ConfigUpdater) GetTaskSpec() tasks.TaskSpec {
-	return tasks.TaskSpec{RunCronImmediately: true, Cron: "@every 3s"}
+	return tasks.TaskSpec{
+		RunCronImmediately: true,
+		Cron:               "@every 3s",
+		Name:               ConfigUpdaterTaskName,
+		Timeout:            time.Minute,
+		SkipIfRunning:      true,
+		Backoff:            3 * time.Second,
+		MaxBackoff:         5 * time.Minute,
+	}
 }
 
 // SSHConfigurerV2 speciallizes in configuring ssh config with ProxyCommand
@@ -200,3 +223,47 @@ func makeIncludeBrevStr(brevSSHConfigPath string) string {
 func (s SSHConfigurerV2) doesUserSSHConfigIncludeBrevConfig(conf string, brevConfigPath string) bool {
 	return strings.Contains(conf, makeIncludeBrevStr(brevConfigPath))
 }
+
+// JetBrainsGatewayConfigurer keeps an entry in every installed Gateway for
+// each running workspace, connecting through the host SSHConfigurerV2 writes
+// for it. It only does so once brev jetbrains --use-ssh-config chose that
+// mode, otherwise the entries are brev jetbrains' port forwards.
+type JetBrainsGatewayConfigurer struct {
+	store JetBrainsGatewayConfigurerStore
+}
+
+type JetBrainsGatewayConfigurerStore interface {
+	JetBrainsGatewayConfigsStore
+	JetBrainsGatewayModeStore
+}
+
+var _ Config = JetBrainsGatewayConfigurer{}
+
+func NewJetBrainsGatewayConfigurer(store JetBrainsGatewayConfigurerStore) *JetBrainsGatewayConfigurer {
+	return &JetBrainsGatewayConfigurer{store: store}
+}
+
+func (j JetBrainsGatewayConfigurer) Update(workspaces []entity.Workspace) error {
+	useSSHConfig, err := j.store.GetJetBrainsGatewayUsesSSHConfig()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if !useSSHConfig {
+		return nil
+	}
+	configs, err := NewJetBrainsGatewayConfigs(j.store, true)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	hosts := make(IdentityPortMap)
+	for _, w := range workspaces {
+		hosts[w.GetLocalIdentifier(workspaces)] = ""
+	}
+	for _, config := range configs {
+		err = config.Sync(hosts)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -121,3 +122,9 @@ func NewHTTPResponseError(response *resty.Response) *HTTPResponseError {
 func (e HTTPResponseError) Error() string {
 	return fmt.Sprintf("%s %s", e.response.Request.URL, e.response.Status())
 }
+
+// IsNotFoundError reports whether err is the api responding 404
+func IsNotFoundError(err error) bool {
+	var httpErr *HTTPResponseError
+	return errors.As(err, &httpErr) && httpErr.response.StatusCode() == http.StatusNotFound
+}
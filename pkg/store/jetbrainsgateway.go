@@ -1,49 +1,213 @@
 package store
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 
 	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
 	"github.com/spf13/afero"
 )
 
 const (
 	JetbrainsGatewayConfigFileName = "sshConfigs.xml"
+	// JetBrainsGatewayConfigEnv is a Gateway config directory, the one
+	// holding options/, to use instead of the discovered ones
+	JetBrainsGatewayConfigEnv = "JETBRAINS_GATEWAY_CONFIG"
+
+	jetBrainsGatewayDirPrefix = "JetBrainsGateway"
+	// legacyJetBrainsGatewayDir is used when no Gateway install is found
+	legacyJetBrainsGatewayDir = "JetBrainsGateway2021.3"
 )
 
-func getJebrainsConfigDir() (string, error) {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return "", breverrors.WrapAndTrace(err)
+// jetBrainsGatewayLocations are where Gateway keeps its config directories,
+// JetBrainsGateway<version>, and where Toolbox installs apps
+type jetBrainsGatewayLocations struct {
+	configRoot  string
+	toolboxApps string
+}
+
+func getJetBrainsGatewayLocations(goos, home string, getenv func(string) string) (jetBrainsGatewayLocations, error) {
+	orDefault := func(env string, elem ...string) string {
+		if v := getenv(env); v != "" {
+			return v
+		}
+		return filepath.Join(append([]string{home}, elem...)...)
 	}
-	var infix string
-	infixSuffix := filepath.Join("JetBrains", "JetBrainsGateway2021.3", "options")
-	switch runtime.GOOS {
-	case "windows":
-		return "", errors.New("windows not supported at this time")
+	switch goos {
 	case "linux":
-		infix = filepath.Join(".config", infixSuffix)
+		return jetBrainsGatewayLocations{
+			configRoot:  filepath.Join(orDefault("XDG_CONFIG_HOME", ".config"), "JetBrains"),
+			toolboxApps: filepath.Join(orDefault("XDG_DATA_HOME", ".local", "share"), "JetBrains", "Toolbox", "apps"),
+		}, nil
 	case "darwin":
-		infix = filepath.Join("Library", "Application Support", infixSuffix)
+		jetBrains := filepath.Join(home, "Library", "Application Support", "JetBrains")
+		return jetBrainsGatewayLocations{
+			configRoot:  jetBrains,
+			toolboxApps: filepath.Join(jetBrains, "Toolbox", "apps"),
+		}, nil
+	case "windows":
+		return jetBrainsGatewayLocations{
+			configRoot:  filepath.Join(orDefault("APPDATA", "AppData", "Roaming"), "JetBrains"),
+			toolboxApps: filepath.Join(orDefault("LOCALAPPDATA", "AppData", "Local"), "JetBrains", "Toolbox", "apps"),
+		}, nil
 	default:
-		return "", fmt.Errorf("invalid goos")
+		return jetBrainsGatewayLocations{}, fmt.Errorf("invalid goos")
+	}
+}
+
+// toolboxBuildFiles are where Toolbox installs keep build.txt, for both the
+// channel layout (apps/JetBrainsGateway/ch-0/<build>) and the flat layout of
+// Toolbox 2, with and without a macOS app bundle
+var toolboxBuildFiles = []string{
+	filepath.Join("*", "build.txt"),
+	filepath.Join("*", "*", "*", "build.txt"),
+	filepath.Join("*.app", "Contents", "Resources", "build.txt"),
+	filepath.Join("*", "*", "*", "*.app", "Contents", "Resources", "build.txt"),
+}
+
+// findJetBrainsGatewayConfigDirs returns the config directories of the
+// installed Gateway versions, newest first. A version installed by Toolbox
+// but never started has no config directory yet; its directory is returned
+// anyway so Gateway finds our entries on its first start.
+func findJetBrainsGatewayConfigDirs(fs afero.Fs, locations jetBrainsGatewayLocations) ([]string, error) {
+	versions := make(map[string]bool)
+
+	dirs, err := afero.Glob(fs, filepath.Join(locations.configRoot, jetBrainsGatewayDirPrefix+"*"))
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	for _, dir := range dirs {
+		version := strings.TrimPrefix(filepath.Base(dir), jetBrainsGatewayDirPrefix)
+		if isDir, _ := afero.IsDir(fs, dir); isDir && parseGatewayVersion(version) != nil {
+			versions[version] = true
+		}
 	}
-	return filepath.Join(home, infix), nil
+
+	for _, pattern := range toolboxBuildFiles {
+		buildFiles, err := afero.Glob(fs, filepath.Join(locations.toolboxApps, pattern))
+		if err != nil {
+			return nil, breverrors.WrapAndTrace(err)
+		}
+		for _, buildFile := range buildFiles {
+			rel, _ := filepath.Rel(locations.toolboxApps, buildFile)
+			if !strings.Contains(strings.ToLower(rel), "gateway") {
+				continue
+			}
+			build, err := afero.ReadFile(fs, buildFile)
+			if err != nil {
+				return nil, breverrors.WrapAndTrace(err)
+			}
+			if version := versionFromBuild(string(build)); version != "" {
+				versions[version] = true
+			}
+		}
+	}
+
+	var sorted []string
+	for v := range versions {
+		sorted = append(sorted, v)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := parseGatewayVersion(sorted[i]), parseGatewayVersion(sorted[j])
+		if a[0] != b[0] {
+			return a[0] > b[0]
+		}
+		return a[1] > b[1]
+	})
+	var res []string
+	for _, v := range sorted {
+		res = append(res, filepath.Join(locations.configRoot, jetBrainsGatewayDirPrefix+v))
+	}
+	return res, nil
 }
 
+// parseGatewayVersion parses versions like 2022.3, it returns nil for
+// anything else
+func parseGatewayVersion(version string) []int {
+	parts := strings.Split(version, ".")
+	if len(parts) != 2 {
+		return nil
+	}
+	var res []int
+	for _, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil
+		}
+		res = append(res, n)
+	}
+	return res
+}
+
+// versionFromBuild maps a build number such as GW-223.7571.176 to the
+// version its config directory is named after, 2022.3
+func versionFromBuild(build string) string {
+	build = strings.TrimSpace(build)
+	if i := strings.Index(build, "-"); i >= 0 {
+		build = build[i+1:]
+	}
+	branch, err := strconv.Atoi(strings.Split(build, ".")[0])
+	if err != nil || branch < 100 {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d", 2000+branch/10, branch%10)
+}
+
+func (f FileStore) getJetBrainsGatewayLocations() (jetBrainsGatewayLocations, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return jetBrainsGatewayLocations{}, breverrors.WrapAndTrace(err)
+	}
+	locations, err := getJetBrainsGatewayLocations(runtime.GOOS, home, os.Getenv)
+	if err != nil {
+		return jetBrainsGatewayLocations{}, breverrors.WrapAndTrace(err)
+	}
+	return locations, nil
+}
+
+// GetJetBrainsConfigPaths returns the ssh config file of every installed
+// Gateway, newest first, or only the one in $JETBRAINS_GATEWAY_CONFIG if it
+// is set. It is empty if Gateway is not installed.
+func (f FileStore) GetJetBrainsConfigPaths() ([]string, error) {
+	if dir := os.Getenv(JetBrainsGatewayConfigEnv); dir != "" {
+		return []string{filepath.Join(dir, "options", JetbrainsGatewayConfigFileName)}, nil
+	}
+	locations, err := f.getJetBrainsGatewayLocations()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	dirs, err := findJetBrainsGatewayConfigDirs(f.fs, locations)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	var paths []string
+	for _, dir := range dirs {
+		paths = append(paths, filepath.Join(dir, "options", JetbrainsGatewayConfigFileName))
+	}
+	return paths, nil
+}
+
+// GetJetBrainsConfigPath returns the ssh config file of the newest Gateway
 func (f FileStore) GetJetBrainsConfigPath() (string, error) {
-	configDir, err := getJebrainsConfigDir()
+	paths, err := f.GetJetBrainsConfigPaths()
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	if len(paths) > 0 {
+		return paths[0], nil
+	}
+	locations, err := f.getJetBrainsGatewayLocations()
 	if err != nil {
 		return "", breverrors.WrapAndTrace(err)
 	}
-	sshConfigPath := filepath.Join(configDir, JetbrainsGatewayConfigFileName)
-	return sshConfigPath, nil
+	return filepath.Join(locations.configRoot, legacyJetBrainsGatewayDir, "options", JetbrainsGatewayConfigFileName), nil
 }
 
 func (f FileStore) GetJetBrainsConfig() (string, error) {
@@ -51,10 +215,19 @@ func (f FileStore) GetJetBrainsConfig() (string, error) {
 	if err != nil {
 		return "", breverrors.WrapAndTrace(err)
 	}
+	config, err := f.GetJetBrainsConfigAt(path)
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	return config, nil
+}
+
+func (f FileStore) GetJetBrainsConfigAt(path string) (string, error) {
 	file, err := f.GetOrCreateFile(path)
 	if err != nil {
 		return "", breverrors.WrapAndTrace(err)
 	}
+	defer file.Close() //nolint:errcheck // read only
 	buf := new(strings.Builder)
 	_, err = io.Copy(buf, file)
 	if err != nil {
@@ -64,13 +237,11 @@ func (f FileStore) GetJetBrainsConfig() (string, error) {
 }
 
 func (f FileStore) DoesJetbrainsFilePathExist() (bool, error) {
-	path, err := getJebrainsConfigDir()
-	path = filepath.Join(path, "..")
+	paths, err := f.GetJetBrainsConfigPaths()
 	if err != nil {
 		return false, breverrors.WrapAndTrace(err)
 	}
-	_, err = os.Stat(path)
-	return !os.IsNotExist(err), nil
+	return len(paths) > 0, nil
 }
 
 func (f FileStore) WriteJetBrainsConfig(config string) error {
@@ -78,9 +249,61 @@ func (f FileStore) WriteJetBrainsConfig(config string) error {
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
 	}
+	err = f.WriteJetBrainsConfigAt(path, config)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func (f FileStore) WriteJetBrainsConfigAt(path string, config string) error {
+	err := f.fs.MkdirAll(filepath.Dir(path), 0o775)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
 	err = afero.WriteFile(f.fs, path, []byte(config), 0o644)
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
 	}
 	return nil
 }
+
+// jetBrainsGatewaySettings is how brev writes the Gateway entries
+type jetBrainsGatewaySettings struct {
+	// UseSSHConfig is set by brev jetbrains --use-ssh-config, the run-tasks
+	// daemon then keeps entries connecting through the brev ssh config
+	UseSSHConfig bool `json:"useSSHConfig"`
+}
+
+// GetJetBrainsGatewayUsesSSHConfig is false if no mode has been saved
+func (f FileStore) GetJetBrainsGatewayUsesSSHConfig() (bool, error) {
+	path, err := files.GetJetBrainsGatewaySettingsPath()
+	if err != nil {
+		return false, breverrors.WrapAndTrace(err)
+	}
+	exists, err := afero.Exists(f.fs, path)
+	if err != nil {
+		return false, breverrors.WrapAndTrace(err)
+	}
+	if !exists {
+		return false, nil
+	}
+	var settings jetBrainsGatewaySettings
+	err = files.ReadJSON(f.fs, path, &settings)
+	if err != nil {
+		return false, breverrors.WrapAndTrace(err)
+	}
+	return settings.UseSSHConfig, nil
+}
+
+func (f FileStore) SetJetBrainsGatewayUsesSSHConfig(use bool) error {
+	path, err := files.GetJetBrainsGatewaySettingsPath()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = files.WriteJSONAtomic(f.fs, path, jetBrainsGatewaySettings{UseSSHConfig: use}, 0o644)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetJetBrainsGatewayLocations(t *testing.T) {
+	noEnv := func(string) string { return "" }
+	locations, err := getJetBrainsGatewayLocations("linux", "/home/me", noEnv)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join("/home/me", ".config", "JetBrains"), locations.configRoot)
+	assert.Equal(t, filepath.Join("/home/me", ".local", "share", "JetBrains", "Toolbox", "apps"), locations.toolboxApps)
+
+	locations, err = getJetBrainsGatewayLocations("windows", "/home/me", func(env string) string {
+		return map[string]string{"APPDATA": "/roaming", "LOCALAPPDATA": "/local"}[env]
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join("/roaming", "JetBrains"), locations.configRoot)
+	assert.Equal(t, filepath.Join("/local", "JetBrains", "Toolbox", "apps"), locations.toolboxApps)
+
+	_, err = getJetBrainsGatewayLocations("plan9", "/home/me", noEnv)
+	assert.NotNil(t, err)
+}
+
+func TestVersionFromBuild(t *testing.T) {
+	assert.Equal(t, "2022.3", versionFromBuild("GW-223.7571.176\n"))
+	assert.Equal(t, "2023.1", versionFromBuild("231.8109.91"))
+	assert.Equal(t, "", versionFromBuild("GW-SNAPSHOT"))
+}
+
+func TestFindJetBrainsGatewayConfigDirs(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	locations := jetBrainsGatewayLocations{configRoot: "/config/JetBrains", toolboxApps: "/data/Toolbox/apps"}
+
+	dirs, err := findJetBrainsGatewayConfigDirs(fs, locations)
+	assert.Nil(t, err)
+	assert.Empty(t, dirs)
+
+	assert.Nil(t, fs.MkdirAll("/config/JetBrains/JetBrainsGateway2021.3/options", 0o755))
+	assert.Nil(t, fs.MkdirAll("/config/JetBrains/JetBrainsGateway2022.2", 0o755))
+	assert.Nil(t, fs.MkdirAll("/config/JetBrains/JetBrainsGatewayBackup", 0o755))
+	assert.Nil(t, fs.MkdirAll("/config/JetBrains/IntelliJIdea2022.3", 0o755))
+	// installed by toolbox but not started yet
+	assert.Nil(t, afero.WriteFile(fs, "/data/Toolbox/apps/JetBrainsGateway/ch-0/231.8109.91/build.txt", []byte("GW-231.8109.91"), 0o644))
+	// the same version as an existing config dir
+	assert.Nil(t, afero.WriteFile(fs, "/data/Toolbox/apps/jetbrains-gateway/build.txt", []byte("GW-222.4167.29"), 0o644))
+	assert.Nil(t, afero.WriteFile(fs, "/data/Toolbox/apps/IDEA-U/ch-0/223.8214.52/build.txt", []byte("IU-223.8214.52"), 0o644))
+
+	dirs, err = findJetBrainsGatewayConfigDirs(fs, locations)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"/config/JetBrains/JetBrainsGateway2023.1",
+		"/config/JetBrains/JetBrainsGateway2022.2",
+		"/config/JetBrains/JetBrainsGateway2021.3",
+	}, dirs)
+}
+
+func TestGetJetBrainsConfigPathsOverride(t *testing.T) {
+	assert.Nil(t, os.Setenv(JetBrainsGatewayConfigEnv, "/custom/gateway"))
+	defer os.Unsetenv(JetBrainsGatewayConfigEnv) //nolint:errcheck // test cleanup
+	fs := NewBasicStore().WithFileSystem(afero.NewMemMapFs())
+	paths, err := fs.GetJetBrainsConfigPaths()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join("/custom/gateway", "options", JetbrainsGatewayConfigFileName)}, paths)
+
+	exists, err := fs.DoesJetbrainsFilePathExist()
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	assert.Nil(t, fs.WriteJetBrainsConfig("<application></application>"))
+	config, err := fs.GetJetBrainsConfigAt(paths[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "<application></application>", config)
+}
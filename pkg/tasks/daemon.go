@@ -0,0 +1,128 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/sevlyar/go-daemon"
+)
+
+const (
+	// DaemonLogMaxSize is the size task_daemon.log is rotated at
+	DaemonLogMaxSize = 10 * 1024 * 1024
+	// DaemonLogBackups is how many rotated logs are kept
+	DaemonLogBackups = 3
+	// DaemonStopTimeout is how long StopDaemon waits for the daemon to exit
+	DaemonStopTimeout = 10 * time.Second
+)
+
+// ErrDaemonNotRunning is returned when stopping a daemon that is not running
+var ErrDaemonNotRunning = errors.New("the daemon is not running")
+
+// DaemonStatus is the state of the daemon according to its pid file
+type DaemonStatus struct {
+	PID     int // 0 if there is no pid file
+	Running bool
+	// Stale is true if the pid file was left behind by a daemon that is no
+	// longer running
+	Stale bool
+}
+
+// GetDaemonStatus reads the pid file. The daemon holds a lock on it while it
+// runs, so a pid that was reused by another process is not mistaken for the
+// daemon; where locks are not supported only the pid is checked.
+func GetDaemonStatus(brevHome string) DaemonStatus {
+	pidFile := GetDaemonPidFilePath(brevHome)
+	pid, err := daemon.ReadPidFile(pidFile)
+	if err != nil {
+		return DaemonStatus{}
+	}
+	if !isProcessAlive(pid) {
+		return DaemonStatus{PID: pid, Stale: true}
+	}
+	locked, err := isLocked(pidFile)
+	if err == nil && !locked {
+		return DaemonStatus{PID: pid, Stale: true}
+	}
+	return DaemonStatus{PID: pid, Running: true}
+}
+
+// IsDaemonRunning reports whether the daemon runs, detached with a pid file
+// or in the foreground, as the systemd service runs it, serving its socket
+func IsDaemonRunning(brevHome string) bool {
+	return GetDaemonStatus(brevHome).Running || isServing(GetDaemonSocketPath(brevHome))
+}
+
+func isProcessAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
+
+func isLocked(pidFile string) (bool, error) {
+	lock, err := daemon.OpenLockFile(pidFile, 0)
+	if err != nil {
+		return false, breverrors.WrapAndTrace(err)
+	}
+	defer lock.Close() //nolint:errcheck // only used to test the lock
+	err = lock.Lock()
+	if errors.Is(err, daemon.ErrWouldBlock) {
+		return true, nil
+	}
+	if err != nil {
+		return false, breverrors.WrapAndTrace(err)
+	}
+	_ = lock.Unlock()
+	return false, nil
+}
+
+// StopDaemon sends the daemon SIGTERM and waits up to timeout for it to
+// exit. It returns the pid of the stopped daemon.
+func StopDaemon(brevHome string, timeout time.Duration) (int, error) {
+	status := GetDaemonStatus(brevHome)
+	if status.Stale {
+		_ = os.Remove(GetDaemonPidFilePath(brevHome))
+	}
+	if !status.Running {
+		return 0, ErrDaemonNotRunning
+	}
+	p, err := os.FindProcess(status.PID)
+	if err != nil {
+		return 0, breverrors.WrapAndTrace(err)
+	}
+	err = p.Signal(syscall.SIGTERM)
+	if err != nil {
+		return 0, breverrors.WrapAndTrace(err)
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !isProcessAlive(status.PID) {
+			return status.PID, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return 0, fmt.Errorf("the daemon did not exit %s after SIGTERM, stop it with `kill -9 %d`", timeout, status.PID)
+}
+
+// RestartDaemon stops the daemon if it is running and starts a new one from
+// the current binary, so an upgraded brev takes over
+func RestartDaemon(tasks []Task, brevHome string) error {
+	// the new daemon runs the same command, it must not stop itself
+	if !daemon.WasReborn() {
+		_, err := StopDaemon(brevHome, DaemonStopTimeout)
+		if err != nil && !errors.Is(err, ErrDaemonNotRunning) {
+			return breverrors.WrapAndTrace(err)
+		}
+	}
+	err := RunTaskAsDaemon(tasks, brevHome)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package tasks
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sevlyar/go-daemon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetDaemonStatus(t *testing.T) {
+	home := t.TempDir()
+	assert.Equal(t, DaemonStatus{}, GetDaemonStatus(home))
+
+	pidFile := GetDaemonPidFilePath(home)
+	// our pid, but nothing holds the lock, as after a reboot reused the pid
+	assert.Nil(t, ioutil.WriteFile(pidFile, []byte(fmt.Sprint(os.Getpid())), 0o644))
+	assert.Equal(t, DaemonStatus{PID: os.Getpid(), Stale: true}, GetDaemonStatus(home))
+
+	lock, err := daemon.CreatePidFile(pidFile, 0o644)
+	assert.Nil(t, err)
+	assert.Equal(t, DaemonStatus{PID: os.Getpid(), Running: true}, GetDaemonStatus(home))
+	assert.True(t, IsDaemonRunning(home))
+	assert.Nil(t, lock.Remove())
+
+	_, err = StopDaemon(home, DaemonStopTimeout)
+	assert.Equal(t, ErrDaemonNotRunning, err)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "task_daemon.log")
+	f, err := NewRotatingFile(path, 10, 2)
+	assert.Nil(t, err)
+	defer f.Close() //nolint:errcheck // test
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		_, err = f.Write([]byte(line))
+		assert.Nil(t, err)
+	}
+	read := func(p string) string {
+		b, err := ioutil.ReadFile(p) //nolint:gosec // test
+		assert.Nil(t, err)
+		return string(b)
+	}
+	assert.Equal(t, "four\nfive\n", read(path))
+	assert.Equal(t, "three\n", read(path+".1"))
+	assert.Equal(t, "one\ntwo\n", read(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// another writer appending to the same file, like the daemon's stderr,
+	// keeps writing to the current log after a rotation
+	other, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o640)
+	assert.Nil(t, err)
+	defer other.Close() //nolint:errcheck // test
+	_, err = f.Write([]byte("sixsix\n"))
+	assert.Nil(t, err)
+	_, err = other.Write([]byte("panic\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "sixsix\npanic\n", read(path))
+	assert.Equal(t, "four\nfive\n", read(path+".1"))
+	assert.Equal(t, "three\n", read(path+".2"))
+}
@@ -0,0 +1,393 @@
+package tasks
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
+)
+
+// A connection to the daemon's socket starts with a single json line request.
+// List and trigger requests get a single json line response, subscribe
+// requests get one response per event until the connection is closed.
+
+type RequestType string
+
+const (
+	RequestList      RequestType = "list"
+	RequestTrigger   RequestType = "trigger"
+	RequestSubscribe RequestType = "subscribe"
+)
+
+type Request struct {
+	Type RequestType `json:"type"`
+	Task string      `json:"task,omitempty"` // for trigger
+	// Wait makes a trigger respond once the run is over instead of as soon
+	// as it started
+	Wait bool `json:"wait,omitempty"`
+}
+
+type Response struct {
+	Error string       `json:"error,omitempty"`
+	Tasks []TaskStatus `json:"tasks,omitempty"`
+	Event *Event       `json:"event,omitempty"`
+}
+
+var (
+	requestTimeout = 10 * time.Second
+	// nudgeTimeout bounds Nudge, commands nudge the daemon on their way out
+	// and should not hang on a daemon that does not answer
+	nudgeTimeout = 500 * time.Millisecond
+	// triggerWaitTimeout is how long a waiting trigger waits for the run
+	triggerWaitTimeout = 2 * time.Minute
+)
+
+// ListenAndServe serves the runner's api on a unix socket at socketPath until
+// ctx is done
+func (tr *TaskRunner) ListenAndServe(ctx context.Context, socketPath string) error {
+	err := removeStaleSocket(socketPath)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = os.Chmod(socketPath, 0o600)
+	if err != nil {
+		_ = l.Close()
+		return breverrors.WrapAndTrace(err)
+	}
+	log.Printf("daemon listening on %s", socketPath)
+
+	err = tr.Serve(ctx, l)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func removeStaleSocket(socketPath string) error {
+	if _, err := os.Stat(socketPath); os.IsNotExist(err) {
+		return nil
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("another daemon is already serving [socket=%s]", socketPath)
+	}
+	err = os.Remove(socketPath)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func (tr *TaskRunner) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return breverrors.WrapAndTrace(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tr.handle(ctx, conn)
+		}()
+	}
+}
+
+func (tr *TaskRunner) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close() //nolint:errcheck // nothing to do once the request is served
+
+	err := conn.SetDeadline(time.Now().Add(requestTimeout))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	reader := bufio.NewReader(conn)
+	var req Request
+	err = readLine(reader, &req)
+	if errors.Is(err, io.EOF) {
+		// IsDaemonRunning connects and hangs up
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	switch req.Type {
+	case RequestList:
+		err = writeLine(conn, Response{Tasks: tr.ListTasks()})
+	case RequestTrigger:
+		err = tr.handleTrigger(ctx, conn, req)
+	case RequestSubscribe:
+		err = tr.handleSubscribe(ctx, conn, reader)
+	default:
+		err = writeLine(conn, Response{Error: fmt.Sprintf("unknown request type %q", req.Type)})
+	}
+	// clients that do not wait for the response, like Nudge, may have hung up
+	if err != nil && !errors.Is(err, syscall.EPIPE) {
+		log.Print(err)
+	}
+}
+
+func (tr *TaskRunner) handleTrigger(ctx context.Context, conn net.Conn, req Request) error {
+	done, err := tr.Trigger(req.Task)
+	if err != nil {
+		return writeLine(conn, Response{Error: err.Error()})
+	}
+	if !req.Wait {
+		return writeLine(conn, Response{})
+	}
+	err = conn.SetDeadline(time.Now().Add(triggerWaitTimeout))
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	var res Response
+	select {
+	case <-ctx.Done():
+		res.Error = "the daemon is stopping"
+	case <-time.After(triggerWaitTimeout):
+		res.Error = fmt.Sprintf("%s did not finish in %s", req.Task, triggerWaitTimeout)
+	case err = <-done:
+		if err != nil {
+			res.Error = err.Error()
+		}
+	}
+	return writeLine(conn, res)
+}
+
+func (tr *TaskRunner) handleSubscribe(ctx context.Context, conn net.Conn, reader *bufio.Reader) error {
+	err := conn.SetDeadline(time.Time{})
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	events, unsubscribe := tr.Subscribe()
+	defer unsubscribe()
+
+	// the client sends nothing more, a read returns once it hangs up
+	closed := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, reader)
+		close(closed)
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-closed:
+			return nil
+		case e := <-events:
+			err = conn.SetWriteDeadline(time.Now().Add(requestTimeout))
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+			err = writeLine(conn, Response{Event: &e})
+			if err != nil {
+				return breverrors.WrapAndTrace(err)
+			}
+		}
+	}
+}
+
+func writeLine(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	_, err = w.Write(append(b, '\n'))
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func readLine(r *bufio.Reader, v interface{}) error {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = json.Unmarshal(line, v)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+type DaemonNotRunningError struct {
+	Err error
+}
+
+func (e *DaemonNotRunningError) Error() string {
+	return fmt.Sprintf("the daemon is not running: %v", e.Err)
+}
+
+func (e *DaemonNotRunningError) Directive() string {
+	return "run `brev run-tasks -d` to start it"
+}
+
+func (e *DaemonNotRunningError) Unwrap() error {
+	return e.Err
+}
+
+// isServing reports whether a daemon accepts connections on socketPath
+func isServing(socketPath string) bool {
+	conn, err := net.DialTimeout("unix", socketPath, nudgeTimeout)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+func request(socketPath string, req Request) (net.Conn, *bufio.Reader, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, nil, &DaemonNotRunningError{Err: err}
+	}
+	err = conn.SetDeadline(time.Now().Add(requestTimeout))
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, breverrors.WrapAndTrace(err)
+	}
+	err = writeLine(conn, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, breverrors.WrapAndTrace(err)
+	}
+	return conn, bufio.NewReader(conn), nil
+}
+
+// ListTasks asks the daemon listening on socketPath for the status of its
+// tasks
+func ListTasks(socketPath string) ([]TaskStatus, error) {
+	conn, reader, err := request(socketPath, Request{Type: RequestList})
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	defer conn.Close() //nolint:errcheck // the response is read
+	var res Response
+	err = readLine(reader, &res)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	if res.Error != "" {
+		return nil, errors.New(res.Error)
+	}
+	return res.Tasks, nil
+}
+
+// TriggerTask asks the daemon listening on socketPath to run the task now. If
+// wait is set it returns once the run is over, with the run's error.
+func TriggerTask(socketPath string, name string, wait bool) error {
+	conn, reader, err := request(socketPath, Request{Type: RequestTrigger, Task: name, Wait: wait})
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer conn.Close() //nolint:errcheck // the response is read
+	if wait {
+		err = conn.SetDeadline(time.Now().Add(triggerWaitTimeout + requestTimeout))
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+	}
+	var res Response
+	err = readLine(reader, &res)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if res.Error != "" {
+		return fmt.Errorf("daemon: %s", res.Error)
+	}
+	return nil
+}
+
+// SubscribeEvents calls fn with the events of the daemon listening on
+// socketPath until ctx is done or the daemon stops
+func SubscribeEvents(ctx context.Context, socketPath string, fn func(Event)) error {
+	conn, reader, err := request(socketPath, Request{Type: RequestSubscribe})
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer conn.Close() //nolint:errcheck // closing ends the subscription
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-stopped:
+		}
+	}()
+	for {
+		var res Response
+		err = readLine(reader, &res)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				return nil
+			}
+			return breverrors.WrapAndTrace(err)
+		}
+		if res.Error != "" {
+			return fmt.Errorf("daemon: %s", res.Error)
+		}
+		if res.Event != nil {
+			fn(*res.Event)
+		}
+	}
+}
+
+// Nudge asks the daemon, if it is running, to run the task now rather than
+// on its next scheduled run. It does not wait for the run, nor for the
+// daemon's response.
+func Nudge(name string) {
+	socketPath, err := files.GetDaemonSocketPath()
+	if err != nil {
+		return
+	}
+	_ = nudge(socketPath, name)
+}
+
+func nudge(socketPath string, name string) error {
+	conn, err := net.DialTimeout("unix", socketPath, nudgeTimeout)
+	if err != nil {
+		return &DaemonNotRunningError{Err: err}
+	}
+	defer conn.Close() //nolint:errcheck // the response is not read
+	err = conn.SetDeadline(time.Now().Add(nudgeTimeout))
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = writeLine(conn, Request{Type: RequestTrigger, Task: name})
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
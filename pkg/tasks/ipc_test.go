@@ -0,0 +1,133 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingTask struct{}
+
+func (failingTask) Run() error { return errors.New("boom") }
+
+func (failingTask) GetTaskSpec() TaskSpec { return TaskSpec{Name: "failing"} }
+
+func serve(t *testing.T, tr *TaskRunner) string {
+	socketPath := filepath.Join(t.TempDir(), "d.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- tr.ListenAndServe(ctx, socketPath) }()
+	t.Cleanup(func() {
+		cancel()
+		assert.Nil(t, <-served)
+	})
+	assert.Eventually(t, func() bool {
+		_, err := ListTasks(socketPath)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	return socketPath
+}
+
+func TestTriggerOverSocket(t *testing.T) {
+	dt := &DummyTask{TaskSpec: TaskSpec{Cron: "@every 3s", Name: "dummy"}}
+	tr := NewTaskRunner([]Task{dt, failingTask{}})
+	socketPath := serve(t, tr)
+
+	err := TriggerTask(socketPath, "dummy", true)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, dt.Ran)
+
+	err = TriggerTask(socketPath, "failing", true)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "boom")
+
+	err = TriggerTask(socketPath, "missing", false)
+	assert.EqualError(t, err, `daemon: no task named "missing", the tasks are dummy, failing`)
+
+	statuses, err := ListTasks(socketPath)
+	assert.Nil(t, err)
+	assert.Len(t, statuses, 2)
+	assert.Equal(t, "dummy", statuses[0].Name)
+	assert.Equal(t, "@every 3s", statuses[0].Cron)
+	assert.Equal(t, 1, statuses[0].Runs)
+	assert.Equal(t, "", statuses[0].LastError)
+	assert.Equal(t, "failing", statuses[1].Name)
+	assert.Equal(t, "boom", statuses[1].LastError)
+}
+
+func TestSubscribeEvents(t *testing.T) {
+	tr := NewTaskRunner([]Task{failingTask{}})
+	socketPath := serve(t, tr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan Event, 2)
+	subscribed := make(chan error, 1)
+	go func() {
+		subscribed <- SubscribeEvents(ctx, socketPath, func(e Event) { events <- e })
+	}()
+	// the subscription is registered once the server handles the request
+	assert.Eventually(t, func() bool {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		return len(tr.subscribers) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	_, err := tr.Trigger("failing")
+	assert.Nil(t, err)
+	started, finished := <-events, <-events
+	assert.Equal(t, EventStarted, started.Type)
+	assert.Equal(t, EventFinished, finished.Type)
+	assert.Equal(t, "failing", finished.Task)
+	assert.Equal(t, "boom", finished.Error)
+
+	cancel()
+	assert.Nil(t, <-subscribed)
+}
+
+func TestNudge(t *testing.T) {
+	dt := &DummyTask{TaskSpec: TaskSpec{Cron: "@every 1h", Name: "dummy"}}
+	tr := NewTaskRunner([]Task{dt})
+	socketPath := serve(t, tr)
+
+	err := nudge(socketPath, "dummy")
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return tr.ListTasks()[0].Runs == 1
+	}, time.Second, 10*time.Millisecond)
+
+	err = nudge(filepath.Join(t.TempDir(), "d.sock"), "dummy")
+	var notRunning *DaemonNotRunningError
+	assert.True(t, errors.As(err, &notRunning))
+}
+
+func TestIsDaemonRunningInForeground(t *testing.T) {
+	home := t.TempDir()
+	assert.False(t, IsDaemonRunning(home))
+
+	// as the systemd service runs it, without a pid file
+	tr := NewTaskRunner([]Task{&DummyTask{}})
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- tr.ListenAndServe(ctx, GetDaemonSocketPath(home)) }()
+	assert.Eventually(t, func() bool { return IsDaemonRunning(home) }, time.Second, 10*time.Millisecond)
+	cancel()
+	assert.Nil(t, <-served)
+	assert.False(t, IsDaemonRunning(home))
+}
+
+func TestNotRunning(t *testing.T) {
+	err := TriggerTask(filepath.Join(t.TempDir(), "d.sock"), "dummy", false)
+	var notRunning *DaemonNotRunningError
+	assert.True(t, errors.As(err, &notRunning))
+}
+
+func TestDefaultTaskNames(t *testing.T) {
+	tr := NewTaskRunner([]Task{&DummyTask{}, failingTask{}})
+	statuses := tr.ListTasks()
+	assert.Equal(t, "task-0", statuses[0].Name)
+	assert.Equal(t, "failing", statuses[1].Name)
+}
@@ -0,0 +1,110 @@
+package tasks
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+)
+
+// RotatingFile is a log file that is rotated once it grows past maxSize,
+// keeping backups rotated files as path.1 (the newest) to path.<backups>.
+// It rotates by copying the file and truncating it rather than renaming it,
+// so the daemon's stdout and stderr, which point at the same file, keep
+// going to the current log.
+type RotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	f       *os.File
+}
+
+var _ io.WriteCloser = &RotatingFile{}
+
+func NewRotatingFile(path string, maxSize int64, backups int) (*RotatingFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640) //nolint:gosec // the daemon's own log
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return &RotatingFile{path: path, maxSize: maxSize, backups: backups, f: f}, nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info, err := r.f.Stat()
+	if err != nil {
+		return 0, breverrors.WrapAndTrace(err)
+	}
+	if info.Size() > 0 && info.Size()+int64(len(p)) > r.maxSize {
+		err = r.rotate()
+		if err != nil {
+			return 0, breverrors.WrapAndTrace(err)
+		}
+	}
+	n, err := r.f.Write(p)
+	if err != nil {
+		return n, breverrors.WrapAndTrace(err)
+	}
+	return n, nil
+}
+
+func (r *RotatingFile) rotate() error {
+	if r.backups > 0 {
+		for i := r.backups - 1; i >= 1; i-- {
+			err := os.Rename(backupPath(r.path, i), backupPath(r.path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return breverrors.WrapAndTrace(err)
+			}
+		}
+		err := copyFile(r.path, backupPath(r.path, 1))
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+	}
+	err := r.f.Truncate(0)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func backupPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from) //nolint:gosec // the daemon's own log
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer src.Close() //nolint:errcheck // read only
+
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640) //nolint:gosec // the daemon's own log
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		_ = dst.Close()
+		return breverrors.WrapAndTrace(err)
+	}
+	err = dst.Close()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.f.Close()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
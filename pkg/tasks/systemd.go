@@ -0,0 +1,220 @@
+package tasks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/brevdev/brev-cli/pkg/files"
+	"github.com/spf13/afero"
+)
+
+// SystemdUnitName is the systemd user service brev run-tasks install --systemd
+// creates. It runs the tasks in the foreground, systemd supervises it in
+// place of the forked daemon.
+const SystemdUnitName = "brev-tasks.service"
+
+// SystemdServiceEnv is set in the environment of the service, so run-tasks
+// can tell it is the service rather than a second runner next to it
+const SystemdServiceEnv = "BREV_RUN_TASKS_SERVICE"
+
+// ErrSystemdServiceNotInstalled is returned when removing a service that is
+// not installed
+var ErrSystemdServiceNotInstalled = errors.New("the systemd service is not installed")
+
+var systemdUnitTemplate = template.Must(template.New("unit").Parse(`# Generated by brev run-tasks install --systemd, remove it with brev run-tasks uninstall
+[Unit]
+Description=brev run-tasks, keeps the ssh config, forwards and syncs of brev workspaces up to date
+
+[Service]
+Type=simple
+Environment={{ .Env }}=1
+ExecStart={{ .Executable }} run-tasks
+Restart=on-failure
+RestartSec=10
+
+[Install]
+WantedBy=default.target
+`))
+
+// MakeSystemdUnit returns the unit running executable's run-tasks
+func MakeSystemdUnit(executable string) (string, error) {
+	var b bytes.Buffer
+	err := systemdUnitTemplate.Execute(&b, struct{ Executable, Env string }{systemdQuote(executable), SystemdServiceEnv})
+	if err != nil {
+		return "", breverrors.WrapAndTrace(err)
+	}
+	return b.String(), nil
+}
+
+// systemdQuote quotes a word of a unit's command line, escaping the
+// specifiers systemd would otherwise expand
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "%", "%%")
+	return `"` + s + `"`
+}
+
+// GetSystemdUserUnitDir is where systemd looks for the units of the user
+func GetSystemdUserUnitDir(home string, getenv func(string) string) string {
+	configHome := getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		configHome = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configHome, "systemd", "user")
+}
+
+// Systemctl runs systemctl --user with args and returns its output
+type Systemctl func(args ...string) (string, error)
+
+func RunSystemctl(args ...string) (string, error) {
+	out, err := exec.Command("systemctl", append([]string{"--user"}, args...)...).CombinedOutput() // #nosec G204
+	if err != nil {
+		return string(out), fmt.Errorf("systemctl --user %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// SystemdStatus is the state of the service according to systemd
+type SystemdStatus struct {
+	Installed bool
+	UnitPath  string
+	Active    string // as reported by systemctl is-active, e.g. active or inactive
+	Enabled   string // as reported by systemctl is-enabled, e.g. enabled or disabled
+}
+
+func (s SystemdStatus) IsActive() bool {
+	return s.Active == "active"
+}
+
+// SystemdService installs and removes the service
+type SystemdService struct {
+	fs        afero.Fs
+	unitDir   string
+	systemctl Systemctl
+}
+
+func NewSystemdService(fs afero.Fs, unitDir string, systemctl Systemctl) *SystemdService {
+	return &SystemdService{fs: fs, unitDir: unitDir, systemctl: systemctl}
+}
+
+func NewDefaultSystemdService() (*SystemdService, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	return NewSystemdService(files.AppFs, GetSystemdUserUnitDir(home, os.Getenv), RunSystemctl), nil
+}
+
+func (s SystemdService) UnitPath() string {
+	return filepath.Join(s.unitDir, SystemdUnitName)
+}
+
+func (s SystemdService) IsInstalled() (bool, error) {
+	exists, err := afero.Exists(s.fs, s.UnitPath())
+	if err != nil {
+		return false, breverrors.WrapAndTrace(err)
+	}
+	return exists, nil
+}
+
+// Install writes the unit, replacing an existing one, then enables and
+// (re)starts it
+func (s SystemdService) Install(executable string) error {
+	unit, err := MakeSystemdUnit(executable)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = s.fs.MkdirAll(s.unitDir, 0o755)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = afero.WriteFile(s.fs, s.UnitPath(), []byte(unit), 0o644)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	for _, args := range [][]string{{"daemon-reload"}, {"enable", SystemdUnitName}, {"restart", SystemdUnitName}} {
+		_, err = s.systemctl(args...)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+	}
+	return nil
+}
+
+// Uninstall stops and disables the service and removes its unit
+func (s SystemdService) Uninstall() error {
+	installed, err := s.IsInstalled()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if !installed {
+		return ErrSystemdServiceNotInstalled
+	}
+	_, err = s.systemctl("disable", "--now", SystemdUnitName)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = s.fs.Remove(s.UnitPath())
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	_, err = s.systemctl("daemon-reload")
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// Status asks systemd about the service if it is installed
+func (s SystemdService) Status() (SystemdStatus, error) {
+	installed, err := s.IsInstalled()
+	if err != nil {
+		return SystemdStatus{}, breverrors.WrapAndTrace(err)
+	}
+	status := SystemdStatus{Installed: installed, UnitPath: s.UnitPath()}
+	if !installed {
+		return status, nil
+	}
+	// both exit non zero for an inactive or disabled unit, the output still
+	// holds the state
+	active, _ := s.systemctl("is-active", SystemdUnitName)
+	enabled, _ := s.systemctl("is-enabled", SystemdUnitName)
+	status.Active = unitState(active)
+	status.Enabled = unitState(enabled)
+	return status, nil
+}
+
+// Stop stops the service without disabling it
+func (s SystemdService) Stop() error {
+	_, err := s.systemctl("stop", SystemdUnitName)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func (s SystemdService) Restart() error {
+	_, err := s.systemctl("restart", SystemdUnitName)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// unitState is the state systemctl printed, unknown if it printed an error
+// instead
+func unitState(out string) string {
+	fields := strings.Fields(out)
+	if len(fields) != 1 {
+		return "unknown"
+	}
+	return fields[0]
+}
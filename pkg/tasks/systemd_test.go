@@ -0,0 +1,99 @@
+package tasks
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakeSystemdUnit(t *testing.T) {
+	unit, err := MakeSystemdUnit("/home/me/bin/brev")
+	assert.Nil(t, err)
+	assert.Equal(t, `# Generated by brev run-tasks install --systemd, remove it with brev run-tasks uninstall
+[Unit]
+Description=brev run-tasks, keeps the ssh config, forwards and syncs of brev workspaces up to date
+
+[Service]
+Type=simple
+Environment=BREV_RUN_TASKS_SERVICE=1
+ExecStart="/home/me/bin/brev" run-tasks
+Restart=on-failure
+RestartSec=10
+
+[Install]
+WantedBy=default.target
+`, unit)
+
+	unit, err = MakeSystemdUnit(`/home/me/my "apps"/100%/brev`)
+	assert.Nil(t, err)
+	assert.Contains(t, unit, `ExecStart="/home/me/my \"apps\"/100%%/brev" run-tasks`+"\n")
+}
+
+func TestGetSystemdUserUnitDir(t *testing.T) {
+	noEnv := func(string) string { return "" }
+	assert.Equal(t, "/home/me/.config/systemd/user", GetSystemdUserUnitDir("/home/me", noEnv))
+	xdg := func(string) string { return "/xdg" }
+	assert.Equal(t, "/xdg/systemd/user", GetSystemdUserUnitDir("/home/me", xdg))
+}
+
+type fakeSystemctl struct {
+	calls  []string
+	states map[string]string
+}
+
+func (f *fakeSystemctl) run(args ...string) (string, error) {
+	call := strings.Join(args, " ")
+	f.calls = append(f.calls, call)
+	if state, ok := f.states[args[0]]; ok {
+		if state != "active" && state != "enabled" {
+			return state + "\n", errors.New("exit status 3")
+		}
+		return state + "\n", nil
+	}
+	return "", nil
+}
+
+func TestSystemdServiceInstallAndUninstall(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	systemctl := &fakeSystemctl{}
+	svc := NewSystemdService(fs, "/home/me/.config/systemd/user", systemctl.run)
+
+	status, err := svc.Status()
+	assert.Nil(t, err)
+	assert.False(t, status.Installed)
+	assert.Empty(t, systemctl.calls)
+
+	err = svc.Install("/usr/local/bin/brev")
+	assert.Nil(t, err)
+	unit, err := afero.ReadFile(fs, "/home/me/.config/systemd/user/brev-tasks.service")
+	assert.Nil(t, err)
+	assert.Contains(t, string(unit), `ExecStart="/usr/local/bin/brev" run-tasks`)
+	assert.Equal(t, []string{"daemon-reload", "enable brev-tasks.service", "restart brev-tasks.service"}, systemctl.calls)
+
+	systemctl.calls = nil
+	systemctl.states = map[string]string{"is-active": "inactive", "is-enabled": "enabled"}
+	status, err = svc.Status()
+	assert.Nil(t, err)
+	assert.Equal(t, SystemdStatus{Installed: true, UnitPath: "/home/me/.config/systemd/user/brev-tasks.service", Active: "inactive", Enabled: "enabled"}, status)
+	assert.False(t, status.IsActive())
+
+	systemctl.calls = nil
+	err = svc.Uninstall()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"disable --now brev-tasks.service", "daemon-reload"}, systemctl.calls)
+	exists, err := afero.Exists(fs, "/home/me/.config/systemd/user/brev-tasks.service")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	err = svc.Uninstall()
+	assert.True(t, errors.Is(err, ErrSystemdServiceNotInstalled))
+}
+
+func TestUnitState(t *testing.T) {
+	assert.Equal(t, "active", unitState("active\n"))
+	assert.Equal(t, "unknown", unitState("Failed to connect to bus: No medium found\n"))
+	assert.Equal(t, "unknown", unitState(""))
+}
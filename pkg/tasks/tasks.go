@@ -5,9 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	breverrors "github.com/brevdev/brev-cli/pkg/errors"
 	"github.com/brevdev/brev-cli/pkg/files"
@@ -15,13 +19,39 @@ import (
 	"github.com/sevlyar/go-daemon"
 )
 
+func GetDaemonPidFilePath(brevHome string) string {
+	return fmt.Sprintf("%s/task_daemon.pid", brevHome)
+}
+
+func GetDaemonLogFilePath(brevHome string) string {
+	return fmt.Sprintf("%s/task_daemon.log", brevHome)
+}
+
+func GetDaemonSocketPath(brevHome string) string {
+	return fmt.Sprintf("%s/daemon.sock", brevHome)
+}
+
 func RunTaskAsDaemon(tasks []Task, brevHome string) error {
 	err := files.MakeBrevHome()
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
 	}
-	pidFile := fmt.Sprintf("%s/task_daemon.pid", brevHome)
-	logFile := fmt.Sprintf("%s/task_daemon.log", brevHome)
+	pidFile := GetDaemonPidFilePath(brevHome)
+	logFile := GetDaemonLogFilePath(brevHome)
+
+	status := GetDaemonStatus(brevHome)
+	if status.Running {
+		log.Printf("daemon already running [pid=%d]", status.PID)
+		return nil
+	}
+	if status.Stale {
+		log.Printf("removing stale pid file of stopped daemon [pid=%d]", status.PID)
+		err = os.Remove(pidFile)
+		if err != nil && !os.IsNotExist(err) {
+			return breverrors.WrapAndTrace(err)
+		}
+	}
+
 	cntxt := &daemon.Context{
 		PidFileName: pidFile,
 		PidFilePerm: 0o644,
@@ -47,6 +77,13 @@ func RunTaskAsDaemon(tasks []Task, brevHome string) error {
 		return nil
 	}
 
+	logs, err := NewRotatingFile(logFile, DaemonLogMaxSize, DaemonLogBackups)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer logs.Close() //nolint:errcheck // nothing left to log to
+	log.SetOutput(logs)
+
 	log.Print("- - - - - - - - - - - - - - -")
 	log.Print("daemon started")
 
@@ -64,8 +101,13 @@ func RunTaskAsDaemon(tasks []Task, brevHome string) error {
 
 func RunTasks(tasks []Task) error {
 	d := NewTaskRunner(tasks)
+	socketPath, err := files.GetDaemonSocketPath()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	d.SocketPath = socketPath
 
-	err := d.Run()
+	err = d.Run()
 	if err != nil {
 		return breverrors.WrapAndTrace(err)
 	}
@@ -78,21 +120,131 @@ type Task interface {
 	GetTaskSpec() TaskSpec
 }
 
+// ContextTask is a Task whose runs can be cancelled. The runner calls
+// RunContext instead of Run with a context that is done once the run's
+// Timeout passes or the runner stops.
+type ContextTask interface {
+	Task
+	RunContext(ctx context.Context) error
+}
+
+// StoppableTask is a Task that leaves work running between runs, Stop is
+// called when the runner stops
+type StoppableTask interface {
+	Task
+	Stop()
+}
+
 type TaskSpec struct {
 	Cron               string // can be "" if want to run once // https://pkg.go.dev/github.com/robfig/cron?utm_source=godoc#hdr-CRON_Expression_Format
 	RunCronImmediately bool   // only applied if cron not ""
+	// Name is how the task is triggered over the daemon's socket, defaults
+	// to task-<index>
+	Name string
+	// Timeout fails runs that take longer, 0 for no timeout. A run that
+	// times out is cancelled if the task is a ContextTask, otherwise the
+	// runner stops waiting for it.
+	Timeout time.Duration
+	// SkipIfRunning skips scheduled runs while the previous run is still
+	// going instead of queueing them behind it
+	SkipIfRunning bool
+	// Backoff is how long scheduled runs are skipped after a failure. It
+	// doubles with each consecutive failure up to MaxBackoff and is jittered
+	// so tasks failing together do not retry together. 0 retries on the next
+	// scheduled run.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// TaskStatus is what the runner knows about a task's runs
+type TaskStatus struct {
+	Name         string        `json:"name"`
+	Cron         string        `json:"cron,omitempty"`
+	Running      bool          `json:"running"`
+	Runs         int           `json:"runs"`
+	Failures     int           `json:"failures"`
+	LastRun      time.Time     `json:"lastRun,omitempty"`
+	LastDuration time.Duration `json:"lastDuration,omitempty"`
+	LastError    string        `json:"lastError,omitempty"`
+	// ConsecutiveFailures is reset by a successful run
+	ConsecutiveFailures int `json:"consecutiveFailures,omitempty"`
+	// RetryAt is when scheduled runs resume after a failure, zero if the
+	// task is not backing off
+	RetryAt time.Time `json:"retryAt,omitempty"`
+	// Skipped counts the scheduled runs skipped while the task was running
+	// or backing off
+	Skipped int `json:"skipped,omitempty"`
+}
+
+type EventType string
+
+const (
+	EventStarted  EventType = "started"
+	EventFinished EventType = "finished"
+)
+
+// Event is published when a task starts or finishes running
+type Event struct {
+	Time     time.Time     `json:"time"`
+	Task     string        `json:"task"`
+	Type     EventType     `json:"type"`
+	Duration time.Duration `json:"duration,omitempty"` // only set when finished
+	Error    string        `json:"error,omitempty"`
+}
+
+const (
+	// subscriberBuffer is how many events a slow subscriber may fall behind
+	// before events are dropped for it
+	subscriberBuffer = 64
+	// backoffJitter is the fraction a backoff is randomly shortened or
+	// lengthened by
+	backoffJitter = 0.2
+)
+
+type taskState struct {
+	task Task
+	spec TaskSpec
+	// done is closed when the run in progress returns, nil if there is none
+	done   chan struct{}
+	status TaskStatus
 }
 
 type TaskRunner struct {
 	Tasks       []Task
 	StopSignals chan os.Signal
+	// SocketPath is where the runner serves its api, see ListenAndServe.
+	// Nothing is served if it is "".
+	SocketPath string
+
+	// ctx is cancelled when the runner stops, cancelling the runs in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mu guards the task states, subscribers and random
+	mu          sync.Mutex
+	states      []*taskState
+	subscribers map[chan Event]struct{}
+	random      *rand.Rand
 }
 
 func NewTaskRunner(tasks []Task) *TaskRunner {
-	return &TaskRunner{
-		tasks,
-		make(chan os.Signal, 1),
+	ctx, cancel := context.WithCancel(context.Background())
+	tr := &TaskRunner{
+		Tasks:       tasks,
+		StopSignals: make(chan os.Signal, 1),
+		ctx:         ctx,
+		cancel:      cancel,
+		subscribers: make(map[chan Event]struct{}),
+		random:      rand.New(rand.NewSource(time.Now().UnixNano())), //nolint:gosec // jitter does not need a secure source
+	}
+	for i, t := range tasks {
+		spec := t.GetTaskSpec()
+		if spec.Name == "" {
+			spec.Name = fmt.Sprintf("task-%d", i)
+		}
+		tr.states = append(tr.states, &taskState{task: t, spec: spec, status: TaskStatus{Name: spec.Name, Cron: spec.Cron}})
 	}
+	return tr
 }
 
 func LogErr(f func() error) func() {
@@ -104,21 +256,39 @@ func LogErr(f func() error) func() {
 	}
 }
 
-func (tr TaskRunner) Run() error {
+func (tr *TaskRunner) Run() error {
+	served := make(chan struct{})
+	if tr.SocketPath != "" {
+		go func() {
+			defer close(served)
+			err := tr.ListenAndServe(tr.ctx, tr.SocketPath)
+			if err != nil {
+				log.Printf("not serving the daemon api: %v", err)
+			}
+		}()
+	} else {
+		close(served)
+	}
+	defer func() {
+		tr.cancel()
+		<-served
+	}()
+
 	c := cron.New()
-	for _, t := range tr.Tasks {
-		spec := t.GetTaskSpec()
-		if spec.Cron != "" {
-			e, err := c.AddFunc(spec.Cron, LogErr(t.Run))
+	for _, s := range tr.states {
+		s := s
+		run := LogErr(func() error { return tr.runTask(s, false) })
+		if s.spec.Cron != "" {
+			e, err := c.AddFunc(s.spec.Cron, run)
 			if err != nil {
 				return breverrors.WrapAndTrace(err)
 			}
-			if spec.RunCronImmediately {
+			if s.spec.RunCronImmediately {
 				c.Entry(e).Job.Run()
 			}
 		} else {
 			// we do this so that the context still applies
-			e, err := c.AddFunc("@yearly", LogErr(t.Run))
+			e, err := c.AddFunc("@yearly", run)
 			if err != nil {
 				return breverrors.WrapAndTrace(err)
 			}
@@ -129,13 +299,207 @@ func (tr TaskRunner) Run() error {
 
 	c.Start()
 
-	tr.WaitTillSignal(c.Stop)
+	tr.WaitTillSignal(func() context.Context {
+		tr.cancel()
+		return c.Stop()
+	})
+	for _, s := range tr.states {
+		if stoppable, ok := s.task.(StoppableTask); ok {
+			stoppable.Stop()
+		}
+	}
 	log.Print("stopped")
 
 	return nil
 }
 
-func (tr TaskRunner) WaitTillSignal(ctxfn func() context.Context) {
+// runTask runs the task unless the run is skipped because of its spec.
+// Triggered runs are never skipped, they wait for the run in progress and
+// ignore the backoff.
+func (tr *TaskRunner) runTask(s *taskState, triggered bool) error {
+	name := s.spec.Name
+	tr.mu.Lock()
+	for s.done != nil {
+		if s.spec.SkipIfRunning && !triggered {
+			s.status.Skipped++
+			tr.mu.Unlock()
+			return nil
+		}
+		done := s.done
+		tr.mu.Unlock()
+		select {
+		case <-done:
+		case <-tr.ctx.Done():
+			return fmt.Errorf("%s: the runner stopped", name)
+		}
+		tr.mu.Lock()
+	}
+	if !triggered && time.Now().Before(s.status.RetryAt) {
+		s.status.Skipped++
+		tr.mu.Unlock()
+		return nil
+	}
+	done := make(chan struct{})
+	s.done = done
+	s.status.Running = true
+	tr.mu.Unlock()
+
+	start := time.Now()
+	tr.publish(Event{Time: start, Task: name, Type: EventStarted})
+	err := tr.call(s, done)
+	duration := time.Since(start)
+
+	var errMessage string
+	var retryIn time.Duration
+	tr.mu.Lock()
+	s.status.Runs++
+	s.status.LastRun = start
+	s.status.LastDuration = duration
+	if err != nil {
+		errMessage = err.Error()
+		s.status.Failures++
+		s.status.ConsecutiveFailures++
+		retryIn = backoffDelay(s.spec, s.status.ConsecutiveFailures, tr.random.Float64())
+		if retryIn > 0 {
+			s.status.RetryAt = time.Now().Add(retryIn)
+		}
+	} else {
+		s.status.ConsecutiveFailures = 0
+		s.status.RetryAt = time.Time{}
+	}
+	s.status.LastError = errMessage
+	failures := s.status.ConsecutiveFailures
+	tr.mu.Unlock()
+	tr.publish(Event{Time: time.Now(), Task: name, Type: EventFinished, Duration: duration, Error: errMessage})
+
+	if err != nil {
+		if retryIn > 0 {
+			return fmt.Errorf("%s failed %d times in a row, retrying in %s: %w", name, failures, retryIn.Round(time.Second), err)
+		}
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// call runs the task and closes done once it returns. If the run times out
+// or the runner stops it returns early, leaving the run in progress until the
+// task notices.
+func (tr *TaskRunner) call(s *taskState, done chan struct{}) error {
+	ctx, cancel := tr.ctx, context.CancelFunc(func() {})
+	if s.spec.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(tr.ctx, s.spec.Timeout)
+	}
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		var err error
+		if t, ok := s.task.(ContextTask); ok {
+			err = t.RunContext(ctx)
+		} else {
+			err = s.task.Run()
+		}
+		tr.mu.Lock()
+		s.done = nil
+		s.status.Running = false
+		tr.mu.Unlock()
+		close(done)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%s timed out after %s", s.spec.Name, s.spec.Timeout)
+		}
+		return fmt.Errorf("%s was cancelled, the runner stopped", s.spec.Name)
+	}
+}
+
+// backoffDelay is how long to wait after the given number of consecutive
+// failures, random in [0, 1) picks the jitter
+func backoffDelay(spec TaskSpec, failures int, random float64) time.Duration {
+	if spec.Backoff <= 0 || failures <= 0 {
+		return 0
+	}
+	delay := spec.Backoff
+	for i := 1; i < failures; i++ {
+		if spec.MaxBackoff > 0 && delay >= spec.MaxBackoff {
+			break
+		}
+		delay *= 2
+	}
+	if spec.MaxBackoff > 0 && delay > spec.MaxBackoff {
+		delay = spec.MaxBackoff
+	}
+	jitter := 1 + backoffJitter*(2*random-1)
+	return time.Duration(float64(delay) * jitter)
+}
+
+// Trigger runs the task now instead of waiting for its next scheduled run.
+// The returned channel receives the run's result.
+func (tr *TaskRunner) Trigger(name string) (<-chan error, error) {
+	var state *taskState
+	var names []string
+	for _, s := range tr.states {
+		if s.spec.Name == name {
+			state = s
+		}
+		names = append(names, s.spec.Name)
+	}
+	if state == nil {
+		return nil, fmt.Errorf("no task named %q, the tasks are %s", name, strings.Join(names, ", "))
+	}
+	done := make(chan error, 1)
+	go func() {
+		err := tr.runTask(state, true)
+		if err != nil {
+			log.Print(err)
+		}
+		done <- err
+	}()
+	return done, nil
+}
+
+// ListTasks returns the status of every task in the order they were added
+func (tr *TaskRunner) ListTasks() []TaskStatus {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	statuses := make([]TaskStatus, 0, len(tr.states))
+	for _, s := range tr.states {
+		statuses = append(statuses, s.status)
+	}
+	return statuses
+}
+
+// Subscribe returns a channel of the events published until unsubscribe is
+// called. Events are dropped for subscribers that fall behind.
+func (tr *TaskRunner) Subscribe() (events <-chan Event, unsubscribe func()) {
+	ch := make(chan Event, subscriberBuffer)
+	tr.mu.Lock()
+	tr.subscribers[ch] = struct{}{}
+	tr.mu.Unlock()
+	return ch, func() {
+		tr.mu.Lock()
+		delete(tr.subscribers, ch)
+		tr.mu.Unlock()
+	}
+}
+
+func (tr *TaskRunner) publish(e Event) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for ch := range tr.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (tr *TaskRunner) WaitTillSignal(ctxfn func() context.Context) {
 	signal.Notify(tr.StopSignals, syscall.SIGQUIT)
 	signal.Notify(tr.StopSignals, syscall.SIGTERM)
 	signal.Notify(tr.StopSignals, syscall.SIGHUP)
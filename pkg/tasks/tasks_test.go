@@ -1,6 +1,7 @@
 package tasks
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"testing"
@@ -72,3 +73,131 @@ func TestNotRunImmediateAndCron(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 1, dt.Ran)
 }
+
+func TestBackoffDelay(t *testing.T) {
+	spec := TaskSpec{Backoff: time.Second, MaxBackoff: 10 * time.Second}
+	assert.Equal(t, time.Duration(0), backoffDelay(spec, 0, 0.5))
+	assert.Equal(t, time.Second, backoffDelay(spec, 1, 0.5))
+	assert.Equal(t, 2*time.Second, backoffDelay(spec, 2, 0.5))
+	assert.Equal(t, 8*time.Second, backoffDelay(spec, 4, 0.5))
+	assert.Equal(t, 10*time.Second, backoffDelay(spec, 5, 0.5))
+	assert.Equal(t, 10*time.Second, backoffDelay(spec, 1000, 0.5))
+	assert.Equal(t, 800*time.Millisecond, backoffDelay(spec, 1, 0))
+	assert.Equal(t, 1200*time.Millisecond, backoffDelay(spec, 1, 1))
+	assert.Equal(t, time.Duration(0), backoffDelay(TaskSpec{}, 3, 0.5))
+}
+
+// blockingTask runs until release is closed or its context is done
+type blockingTask struct {
+	spec      TaskSpec
+	started   chan struct{}
+	release   chan struct{}
+	cancelled chan struct{}
+	stopped   bool
+}
+
+func newBlockingTask(spec TaskSpec) *blockingTask {
+	return &blockingTask{spec: spec, started: make(chan struct{}, 10), release: make(chan struct{}), cancelled: make(chan struct{}, 10)}
+}
+
+func (b *blockingTask) Run() error {
+	return b.RunContext(context.Background())
+}
+
+func (b *blockingTask) RunContext(ctx context.Context) error {
+	b.started <- struct{}{}
+	select {
+	case <-b.release:
+		return nil
+	case <-ctx.Done():
+		b.cancelled <- struct{}{}
+		return ctx.Err()
+	}
+}
+
+func (b *blockingTask) GetTaskSpec() TaskSpec { return b.spec }
+
+func (b *blockingTask) Stop() { b.stopped = true }
+
+func TestTimeoutCancelsRun(t *testing.T) {
+	bt := newBlockingTask(TaskSpec{Name: "slow", Timeout: 50 * time.Millisecond})
+	tr := NewTaskRunner([]Task{bt})
+	err := tr.runTask(tr.states[0], false)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "slow timed out after 50ms")
+	<-bt.cancelled
+	status := tr.ListTasks()[0]
+	assert.Equal(t, 1, status.Failures)
+	assert.Equal(t, "slow timed out after 50ms", status.LastError)
+}
+
+func TestSkipIfRunning(t *testing.T) {
+	bt := newBlockingTask(TaskSpec{Name: "slow", SkipIfRunning: true})
+	tr := NewTaskRunner([]Task{bt})
+	first := make(chan error, 1)
+	go func() { first <- tr.runTask(tr.states[0], false) }()
+	<-bt.started
+
+	assert.Nil(t, tr.runTask(tr.states[0], false))
+	assert.Equal(t, 1, tr.ListTasks()[0].Skipped)
+	assert.True(t, tr.ListTasks()[0].Running)
+
+	// a trigger waits for the run in progress instead
+	triggered, err := tr.Trigger("slow")
+	assert.Nil(t, err)
+	close(bt.release)
+	assert.Nil(t, <-first)
+	assert.Nil(t, <-triggered)
+	assert.Equal(t, 2, tr.ListTasks()[0].Runs)
+}
+
+type countingFailingTask struct {
+	spec TaskSpec
+	runs int
+}
+
+func (c *countingFailingTask) Run() error {
+	c.runs++
+	return fmt.Errorf("run %d failed", c.runs)
+}
+
+func (c *countingFailingTask) GetTaskSpec() TaskSpec { return c.spec }
+
+func TestBackoffSkipsScheduledRuns(t *testing.T) {
+	ft := &countingFailingTask{spec: TaskSpec{Name: "flaky", Backoff: time.Hour}}
+	tr := NewTaskRunner([]Task{ft})
+	err := tr.runTask(tr.states[0], false)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "flaky failed 1 times in a row, retrying in")
+
+	assert.Nil(t, tr.runTask(tr.states[0], false))
+	assert.Equal(t, 1, ft.runs)
+	status := tr.ListTasks()[0]
+	assert.Equal(t, 1, status.Skipped)
+	assert.Equal(t, 1, status.ConsecutiveFailures)
+	assert.True(t, status.RetryAt.After(time.Now().Add(40*time.Minute)))
+
+	// triggered runs ignore the backoff
+	assert.NotNil(t, tr.runTask(tr.states[0], true))
+	assert.Equal(t, 2, ft.runs)
+	status = tr.ListTasks()[0]
+	assert.Equal(t, 2, status.Failures)
+	assert.Equal(t, 2, status.ConsecutiveFailures)
+	assert.Equal(t, "run 2 failed", status.LastError)
+}
+
+func TestStopCancelsRunsAndStopsTasks(t *testing.T) {
+	bt := newBlockingTask(TaskSpec{Name: "slow", Cron: "@every 1h"})
+	tr := NewTaskRunner([]Task{bt})
+	ran := make(chan error, 1)
+	go func() { ran <- tr.Run() }()
+	// the task started by a trigger is cancelled when the runner stops
+	triggered, err := tr.Trigger("slow")
+	assert.Nil(t, err)
+	<-bt.started
+	tr.SendStop()
+	assert.Nil(t, <-ran)
+	<-bt.cancelled
+	assert.NotNil(t, <-triggered)
+	assert.True(t, bt.stopped)
+}
@@ -0,0 +1,648 @@
+// Package transfer copies files to and from a workspace over an sftp session
+// on the workspace's ssh connection. Files are written to a partial file
+// first and renamed when complete, so an interrupted copy resumes where it
+// stopped when rerun, as long as the source did not change in between.
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	breverrors "github.com/brevdev/brev-cli/pkg/errors"
+	"github.com/pkg/sftp"
+)
+
+const (
+	// PartialSuffix is appended to files while they are copied
+	PartialSuffix = ".brevpart"
+	// stampSuffix is appended to a partial file for the empty file that
+	// carries the modification time of the partial's source
+	stampSuffix = ".mtime"
+)
+
+// IsPartial is true for the partial files of copies and their stamps
+func IsPartial(p string) bool {
+	return strings.HasSuffix(p, PartialSuffix) || strings.HasSuffix(p, PartialSuffix+stampSuffix)
+}
+
+// Progress is told how many of the total bytes have been copied
+type Progress func(done, total int64)
+
+type Copier struct {
+	client    *sftp.Client
+	recursive bool
+	progress  Progress
+	skipped   []string
+}
+
+// NewCopier copies over client, which portforward.SSHTunnel.SFTP opens
+func NewCopier(client *sftp.Client) *Copier {
+	return &Copier{client: client, progress: func(int64, int64) {}}
+}
+
+// WithRecursive allows copying directories
+func (c *Copier) WithRecursive(recursive bool) *Copier {
+	c.recursive = recursive
+	return c
+}
+
+func (c *Copier) WithProgress(progress Progress) *Copier {
+	c.progress = progress
+	return c
+}
+
+// Skipped returns the paths the last Download or Upload did not copy because
+// they are neither regular files nor directories, like symlinks and sockets
+func (c *Copier) Skipped() []string {
+	return c.skipped
+}
+
+// Entry is a file or directory, Path is relative to the listed root and
+// uses forward slashes
+type Entry struct {
+	Path    string
+	Dir     bool
+	Mode    os.FileMode
+	Size    int64
+	ModTime time.Time
+}
+
+// job copies one entry from src to dst
+type job struct {
+	Entry
+	src string
+	dst string
+}
+
+// Download copies the remote sources, which may be globs, to dst on this
+// machine with the same semantics as cp: with several sources or an existing
+// directory as dst, each source is copied into dst
+func (c *Copier) Download(srcs []string, dst string) error {
+	c.skipped = nil
+	var sources []string
+	for _, src := range srcs {
+		matches, err := c.remoteGlob(remotePath(src))
+		if err != nil {
+			return err
+		}
+		sources = append(sources, matches...)
+	}
+
+	info, err := os.Stat(dst)
+	into := err == nil && info.IsDir()
+	if len(sources) > 1 && !into {
+		return fmt.Errorf("copying %d files needs %s to be an existing directory", len(sources), dst)
+	}
+
+	var jobs []job
+	for _, src := range sources {
+		entries, err := c.listRemote(src)
+		if err != nil {
+			return err
+		}
+		root := dst
+		if into {
+			root = filepath.Join(dst, path.Base(src))
+		}
+		for _, e := range entries {
+			jobs = append(jobs, job{Entry: e, src: joinRemote(src, e.Path), dst: filepath.Join(root, filepath.FromSlash(e.Path))})
+		}
+	}
+	return c.execute(jobs, c.download)
+}
+
+// Upload copies the local sources, which may contain globs, to dst on the
+// workspace with the same semantics as Download
+func (c *Copier) Upload(srcs []string, dst string) error {
+	c.skipped = nil
+	var sources []string
+	for _, src := range srcs {
+		matches, err := filepath.Glob(src)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("%s: no such file or directory", src)
+		}
+		sources = append(sources, matches...)
+	}
+
+	dst = remotePath(dst)
+	into, err := c.remoteIsDir(dst)
+	if err != nil {
+		return err
+	}
+	if len(sources) > 1 && !into {
+		return fmt.Errorf("copying %d files needs %s to be an existing directory on the workspace", len(sources), dst)
+	}
+
+	var jobs []job
+	for _, src := range sources {
+		entries, err := c.listLocal(src)
+		if err != nil {
+			return err
+		}
+		root := dst
+		if into {
+			root = joinRemote(dst, filepath.Base(src))
+		}
+		for _, e := range entries {
+			jobs = append(jobs, job{Entry: e, src: filepath.Join(src, filepath.FromSlash(e.Path)), dst: joinRemote(root, e.Path)})
+		}
+	}
+	return c.execute(jobs, c.upload)
+}
+
+// execute creates directories before the files in them and reports
+// progress over all files
+func (c *Copier) execute(jobs []job, copyFile func(j job, done func(int64)) error) error {
+	var total, done int64
+	for _, j := range jobs {
+		total += j.Size
+	}
+	c.progress(0, total)
+	for _, j := range jobs {
+		err := copyFile(j, func(n int64) {
+			done += n
+			c.progress(done, total)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Copier) listLocal(root string) ([]Entry, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	if info.IsDir() && !c.recursive {
+		return nil, fmt.Errorf("%s is a directory, use -r to copy directories", root)
+	}
+	var entries []Entry
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			rel = ""
+		}
+		e, ok := entryOf(rel, info)
+		if !ok {
+			c.skipped = append(c.skipped, p)
+			return nil
+		}
+		if !e.Dir && IsPartial(p) {
+			return nil
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (c *Copier) listRemote(root string) ([]Entry, error) {
+	entries, skipped, err := c.walkRemote(root, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.skipped = append(c.skipped, skipped...)
+	if len(entries) > 0 && entries[0].Dir && !c.recursive {
+		return nil, fmt.Errorf("%s is a directory, use -r to copy directories", root)
+	}
+	return entries, nil
+}
+
+// Ignore tells whether a listing leaves out the entry at rel, a path relative
+// to the listed root, and, for a directory, everything under it
+type Ignore func(rel string, dir bool) bool
+
+// ListRemote lists root on the workspace and, if it is a directory,
+// everything under it that ignore, which may be nil, does not leave out,
+// sorted so that directories come before their contents. Ignored directories
+// are not walked. Symlinks are not followed, and like other entries that are
+// neither files nor directories left out.
+func (c *Copier) ListRemote(root string, ignore Ignore) ([]Entry, error) {
+	entries, _, err := c.walkRemote(root, ignore)
+	return entries, err
+}
+
+// walkRemote is ListRemote, also returning the paths of the entries that are
+// neither files nor directories
+func (c *Copier) walkRemote(root string, ignore Ignore) ([]Entry, []string, error) {
+	root = remotePath(root)
+	var entries []Entry
+	var skipped []string
+	walker := c.client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, nil, breverrors.WrapAndTrace(err)
+		}
+		rel := relRemote(root, walker.Path())
+		info := walker.Stat()
+		if rel != "" && ignore != nil && ignore(rel, info.IsDir()) {
+			if info.IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+		e, ok := entryOf(rel, info)
+		if !ok {
+			skipped = append(skipped, walker.Path())
+			continue
+		}
+		if !e.Dir && IsPartial(rel) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries, skipped, nil
+}
+
+// entryOf is the entry of a directory or regular file, and false for
+// anything else
+func entryOf(rel string, info os.FileInfo) (Entry, bool) {
+	switch {
+	case info.IsDir():
+		return Entry{Path: rel, Dir: true, Mode: info.Mode().Perm(), ModTime: info.ModTime()}, true
+	case info.Mode().IsRegular():
+		return Entry{Path: rel, Mode: info.Mode().Perm(), Size: info.Size(), ModTime: info.ModTime()}, true
+	default:
+		return Entry{}, false
+	}
+}
+
+// remoteGlob expands a glob in src on the workspace
+func (c *Copier) remoteGlob(src string) ([]string, error) {
+	if !strings.ContainsAny(src, "*?[") {
+		return []string{src}, nil
+	}
+	matches, err := c.client.Glob(src)
+	if err != nil {
+		return nil, breverrors.WrapAndTrace(err)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("%s: no such file or directory on the workspace", src)
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func (c *Copier) remoteIsDir(p string) (bool, error) {
+	info, err := c.client.Stat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, breverrors.WrapAndTrace(err)
+	}
+	return info.IsDir(), nil
+}
+
+// resumeOffset is how much of a partial file can be kept. A partial file is
+// only resumed if it is no bigger than the source and its stamp carries the
+// source's modification time, otherwise the source changed since and the
+// copy starts over. The stamp is an empty file next to the partial, set
+// before the copy starts: the partial's own time changes with every write,
+// and a copy cut off with its connection can not set it anymore.
+func resumeOffset(partial, stamp os.FileInfo, j job) int64 {
+	if partial == nil || stamp == nil || partial.Size() > j.Size || !sameModTime(stamp.ModTime(), j.ModTime) {
+		return 0
+	}
+	return partial.Size()
+}
+
+// statOrNil is info, or nil if the file could not be stat'ed
+func statOrNil(info os.FileInfo, err error) os.FileInfo {
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
+// sameModTime compares to the second, which is all sftp carries
+func sameModTime(a, b time.Time) bool {
+	return a.Unix() == b.Unix()
+}
+
+func (c *Copier) download(j job, done func(int64)) error {
+	if j.Dir {
+		err := os.MkdirAll(j.dst, j.Mode|0o700)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		return nil
+	}
+
+	partial := j.dst + PartialSuffix
+	stamp := partial + stampSuffix
+	offset := resumeOffset(statOrNil(os.Stat(partial)), statOrNil(os.Stat(stamp)), j)
+	err := ioutil.WriteFile(stamp, nil, 0o600)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = os.Chtimes(stamp, j.ModTime, j.ModTime)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE, j.Mode|0o600) //nolint:gosec // the user picked the destination
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer f.Close() //nolint:errcheck // closed below, this is for early returns
+	err = f.Truncate(offset)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	done(offset)
+
+	if offset < j.Size {
+		err = c.copyFrom(j.src, offset, &countingWriter{w: f, done: done})
+		if err != nil {
+			return fmt.Errorf("copying %s, rerun to resume: %w", j.src, err)
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = os.Chmod(partial, j.Mode)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = os.Chtimes(partial, j.ModTime, j.ModTime)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = os.Rename(partial, j.dst)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = os.Remove(stamp)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// copyFrom writes the remote file from offset on to w
+func (c *Copier) copyFrom(src string, offset int64, w io.Writer) error {
+	f, err := c.client.Open(src)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer f.Close() //nolint:errcheck // only read
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	_, err = io.Copy(w, f)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+func (c *Copier) upload(j job, done func(int64)) error {
+	if j.Dir {
+		err := c.client.MkdirAll(j.dst)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		err = c.client.Chmod(j.dst, j.Mode)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		return nil
+	}
+
+	partial := j.dst + PartialSuffix
+	stamp := partial + stampSuffix
+	offset := resumeOffset(statOrNil(c.client.Stat(partial)), statOrNil(c.client.Stat(stamp)), j)
+	err := c.writeStamp(stamp, j.ModTime)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(j.src)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer src.Close() //nolint:errcheck // only read
+	_, err = src.Seek(offset, io.SeekStart)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	done(offset)
+
+	err = c.copyTo(partial, offset, &countingReader{r: io.LimitReader(src, j.Size-offset), done: done})
+	if err != nil {
+		return fmt.Errorf("copying %s, rerun to resume: %w", j.src, err)
+	}
+	err = c.client.Chmod(partial, j.Mode)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = c.client.Chtimes(partial, j.ModTime, j.ModTime)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = c.client.PosixRename(partial, j.dst)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = c.client.Remove(stamp)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// writeStamp creates the empty stamp of a partial file on the workspace with
+// the source's modification time
+func (c *Copier) writeStamp(stamp string, modTime time.Time) error {
+	f, err := c.client.Create(stamp)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = f.Close()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = c.client.Chtimes(stamp, modTime, modTime)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// copyTo writes r to the remote file from offset on, dropping anything after
+func (c *Copier) copyTo(dst string, offset int64, r io.Reader) error {
+	f, err := c.client.OpenFile(dst, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	defer f.Close() //nolint:errcheck // closed below, this is for early returns
+	err = f.Truncate(offset)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	err = f.Close()
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// Put copies a local file or creates a directory at dst on the workspace,
+// creating missing parent directories
+func (c *Copier) Put(src string, e Entry, dst string) error {
+	dst = remotePath(dst)
+	if !e.Dir {
+		err := c.client.MkdirAll(path.Dir(dst))
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+	}
+	return c.upload(job{Entry: e, src: src, dst: dst}, func(int64) {})
+}
+
+// Get copies a file or creates a directory from src on the workspace at dst,
+// creating missing parent directories
+func (c *Copier) Get(src string, e Entry, dst string) error {
+	if !e.Dir {
+		err := os.MkdirAll(filepath.Dir(dst), 0o755)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+	}
+	return c.download(job{Entry: e, src: remotePath(src), dst: dst}, func(int64) {})
+}
+
+// RemoveRemote removes a file or directory from the workspace, doing nothing
+// if it does not exist
+func (c *Copier) RemoveRemote(p string) error {
+	p = remotePath(p)
+	info, err := c.client.Lstat(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	if !info.IsDir() {
+		err = c.client.Remove(p)
+		if err != nil {
+			return breverrors.WrapAndTrace(err)
+		}
+		return nil
+	}
+	children, err := c.client.ReadDir(p)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	for _, child := range children {
+		err = c.RemoveRemote(path.Join(p, child.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	err = c.client.RemoveDirectory(p)
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+// MkdirRemote creates a directory and its parents on the workspace
+func (c *Copier) MkdirRemote(p string) error {
+	err := c.client.MkdirAll(remotePath(p))
+	if err != nil {
+		return breverrors.WrapAndTrace(err)
+	}
+	return nil
+}
+
+type countingWriter struct {
+	w    io.Writer
+	done func(int64)
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.done(int64(n))
+	return n, err //nolint:wrapcheck // io passthrough
+}
+
+type countingReader struct {
+	r    io.Reader
+	done func(int64)
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.done(int64(n))
+	return n, err //nolint:wrapcheck // io passthrough
+}
+
+// joinRemote joins workspace paths, which always use forward slashes
+func joinRemote(dir, name string) string {
+	if name == "" {
+		return dir
+	}
+	return path.Join(dir, name)
+}
+
+// relRemote is p, which the walk of root found, relative to root
+func relRemote(root, p string) string {
+	if p == root {
+		return ""
+	}
+	if clean := path.Clean(root); clean != "." {
+		return strings.TrimPrefix(path.Clean(p), clean+"/")
+	}
+	return path.Clean(p)
+}
+
+// remotePath drops a leading ~/, sftp paths are already relative to the
+// home directory
+func remotePath(p string) string {
+	if p == "~" {
+		return "."
+	}
+	if strings.HasPrefix(p, "~/") {
+		return "./" + strings.TrimPrefix(p, "~/")
+	}
+	return p
+}
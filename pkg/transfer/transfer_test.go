@@ -0,0 +1,288 @@
+package transfer
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveSFTP serves this machine's files over sftp in process, standing in
+// for a workspace. The server resolves relative paths against the working
+// directory, so the test runs in dir as sftp-server runs in the home
+// directory. drop cuts the connection.
+func serveSFTP(t *testing.T, dir string) (client *sftp.Client, drop func()) {
+	wd, err := os.Getwd()
+	if !assert.Nil(t, err) || !assert.Nil(t, os.Chdir(dir)) {
+		t.FailNow()
+	}
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverReader, serverWriter})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	served := make(chan struct{})
+	go func() {
+		_ = server.Serve() // ends when the client closes
+		close(served)
+	}()
+	client, err = sftp.NewClientPipe(clientReader, clientWriter)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		// closing the server's end first ends the client's read loop
+		_ = server.Close()
+		_ = client.Close()
+		_ = os.Chdir(wd)
+	})
+	return client, func() {
+		_ = server.Close()
+		<-served
+	}
+}
+
+func writeFile(t *testing.T, p, content string, mode os.FileMode) {
+	assert.Nil(t, os.MkdirAll(filepath.Dir(p), 0o755))
+	assert.Nil(t, ioutil.WriteFile(p, []byte(content), mode))
+	assert.Nil(t, os.Chmod(p, mode))
+}
+
+func assertFile(t *testing.T, p, content string, mode os.FileMode) {
+	b, err := ioutil.ReadFile(p) //nolint:gosec // test
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, content, string(b))
+	info, err := os.Stat(p)
+	if assert.Nil(t, err) {
+		assert.Equal(t, mode, info.Mode().Perm(), p)
+	}
+}
+
+func setup(t *testing.T) (string, string, *Copier) {
+	local, err := ioutil.TempDir("", "brev-cp-local")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	remote, err := ioutil.TempDir("", "brev-cp-remote")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(local)
+		_ = os.RemoveAll(remote)
+	})
+	client, _ := serveSFTP(t, remote)
+	return local, remote, NewCopier(client)
+}
+
+// stampPartial marks a partial file as left by a copy of a source modified
+// at modTime
+func stampPartial(t *testing.T, partial string, modTime time.Time) {
+	writeFile(t, partial+stampSuffix, "", 0o600)
+	assert.Nil(t, os.Chtimes(partial+stampSuffix, modTime, modTime))
+}
+
+func TestUploadAndDownloadDirectory(t *testing.T) {
+	local, remote, c := setup(t)
+	writeFile(t, filepath.Join(local, "src", "a.txt"), "a", 0o644)
+	writeFile(t, filepath.Join(local, "src", "bin", "run.sh"), "#!/bin/sh", 0o755)
+	writeFile(t, filepath.Join(local, "src", "it's quoted"), "q", 0o600)
+
+	err := c.Upload([]string{filepath.Join(local, "src")}, "dst")
+	assert.NotNil(t, err, "directories need -r")
+
+	var done, total int64
+	c.WithRecursive(true).WithProgress(func(d, tot int64) {
+		done, total = d, tot
+	})
+	err = c.Upload([]string{filepath.Join(local, "src")}, "dst")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, int64(11), total)
+	assert.Equal(t, total, done)
+	assertFile(t, filepath.Join(remote, "dst", "a.txt"), "a", 0o644)
+	assertFile(t, filepath.Join(remote, "dst", "bin", "run.sh"), "#!/bin/sh", 0o755)
+	assertFile(t, filepath.Join(remote, "dst", "it's quoted"), "q", 0o600)
+	assertSameModTime(t, filepath.Join(local, "src", "a.txt"), filepath.Join(remote, "dst", "a.txt"))
+
+	// dst exists now, so the directory is copied into it
+	err = c.Download([]string{"dst"}, local)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assertFile(t, filepath.Join(local, "dst", "bin", "run.sh"), "#!/bin/sh", 0o755)
+	assertFile(t, filepath.Join(local, "dst", "it's quoted"), "q", 0o600)
+	assertSameModTime(t, filepath.Join(remote, "dst", "a.txt"), filepath.Join(local, "dst", "a.txt"))
+}
+
+func assertSameModTime(t *testing.T, a, b string) {
+	aInfo, err := os.Stat(a)
+	assert.Nil(t, err)
+	bInfo, err := os.Stat(b)
+	assert.Nil(t, err)
+	assert.True(t, sameModTime(aInfo.ModTime(), bInfo.ModTime()), "%s %s", aInfo.ModTime(), bInfo.ModTime())
+}
+
+func TestGlobs(t *testing.T) {
+	local, remote, c := setup(t)
+	writeFile(t, filepath.Join(remote, "logs", "a.log"), "a", 0o644)
+	writeFile(t, filepath.Join(remote, "logs", "b.log"), "b", 0o644)
+	writeFile(t, filepath.Join(remote, "logs", "c.txt"), "c", 0o644)
+
+	err := c.Download([]string{"logs/*.log"}, local)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assertFile(t, filepath.Join(local, "a.log"), "a", 0o644)
+	assertFile(t, filepath.Join(local, "b.log"), "b", 0o644)
+	_, err = os.Stat(filepath.Join(local, "c.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	err = c.Download([]string{"logs/*.log"}, filepath.Join(local, "missing"))
+	assert.NotNil(t, err, "several files need an existing directory")
+
+	assert.Nil(t, os.Mkdir(filepath.Join(remote, "up"), 0o755))
+	err = c.Upload([]string{filepath.Join(local, "*.log")}, "up")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assertFile(t, filepath.Join(remote, "up", "a.log"), "a", 0o644)
+	assertFile(t, filepath.Join(remote, "up", "b.log"), "b", 0o644)
+}
+
+func TestResume(t *testing.T) {
+	local, remote, c := setup(t)
+	then := time.Now().Add(-time.Hour)
+	writeFile(t, filepath.Join(remote, "big"), "0123456789", 0o640)
+	assert.Nil(t, os.Chtimes(filepath.Join(remote, "big"), then, then))
+	writeFile(t, filepath.Join(local, "big"+PartialSuffix), "01234", 0o600)
+	stampPartial(t, filepath.Join(local, "big"+PartialSuffix), then)
+
+	var first int64 = -1
+	c.WithProgress(func(done, total int64) {
+		if first < 0 && done > 0 {
+			first = done
+		}
+	})
+	err := c.Download([]string{"big"}, filepath.Join(local, "big"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, int64(5), first, "the partial file counts as done")
+	assertFile(t, filepath.Join(local, "big"), "0123456789", 0o640)
+	_, err = os.Stat(filepath.Join(local, "big"+PartialSuffix))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(local, "big"+PartialSuffix+stampSuffix))
+	assert.True(t, os.IsNotExist(err))
+
+	writeFile(t, filepath.Join(remote, "up"+PartialSuffix), "01234", 0o600)
+	stampPartial(t, filepath.Join(remote, "up"+PartialSuffix), then)
+	err = c.Upload([]string{filepath.Join(local, "big")}, "up")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assertFile(t, filepath.Join(remote, "up"), "0123456789", 0o640)
+}
+
+func TestStalePartialRestarts(t *testing.T) {
+	local, remote, c := setup(t)
+	then := time.Now().Add(-time.Hour)
+	writeFile(t, filepath.Join(remote, "big"), "0123456789", 0o640)
+	assert.Nil(t, os.Chtimes(filepath.Join(remote, "big"), then, then))
+	// left by a copy of an earlier version of the file
+	writeFile(t, filepath.Join(local, "big"+PartialSuffix), "abcde", 0o600)
+	stampPartial(t, filepath.Join(local, "big"+PartialSuffix), then.Add(-time.Minute))
+
+	err := c.Download([]string{"big"}, filepath.Join(local, "big"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assertFile(t, filepath.Join(local, "big"), "0123456789", 0o640)
+
+	writeFile(t, filepath.Join(remote, "up"+PartialSuffix), "0123456789abc", 0o600)
+	stampPartial(t, filepath.Join(remote, "up"+PartialSuffix), then)
+	err = c.Upload([]string{filepath.Join(local, "big")}, "up")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assertFile(t, filepath.Join(remote, "up"), "0123456789", 0o640)
+}
+
+func TestResumeAfterDroppedConnection(t *testing.T) {
+	local := t.TempDir()
+	remoteDir := t.TempDir()
+
+	content := strings.Repeat("0123456789", 100000)
+	writeFile(t, filepath.Join(local, "big"), content, 0o644)
+	client, drop := serveSFTP(t, remoteDir)
+	c := NewCopier(client).WithProgress(func(done, total int64) {
+		// past the first chunks, which the server has written by now
+		if done > total/4 {
+			drop()
+		}
+	})
+	err := c.Upload([]string{filepath.Join(local, "big")}, "big")
+	if !assert.NotNil(t, err) {
+		return
+	}
+	assert.Contains(t, err.Error(), "rerun to resume")
+	partial, err := os.Stat(filepath.Join(remoteDir, "big"+PartialSuffix))
+	if !assert.Nil(t, err) || !assert.NotZero(t, partial.Size()) {
+		return
+	}
+
+	client, _ = serveSFTP(t, remoteDir)
+	var first int64 = -1
+	c = NewCopier(client).WithProgress(func(done, total int64) {
+		if first < 0 && done > 0 {
+			first = done
+		}
+	})
+	err = c.Upload([]string{filepath.Join(local, "big")}, "big")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, partial.Size(), first, "the upload resumes after the partial file")
+	assertFile(t, filepath.Join(remoteDir, "big"), content, 0o644)
+}
+
+func TestListRemoteIgnore(t *testing.T) {
+	_, remote, c := setup(t)
+	writeFile(t, filepath.Join(remote, "dir", "a.txt"), "a", 0o644)
+	writeFile(t, filepath.Join(remote, "dir", "node_modules", "m", "index.js"), "m", 0o644)
+
+	// only the directory is ignored, what is under it is not walked
+	entries, err := c.ListRemote("dir", func(rel string, dir bool) bool {
+		return dir && rel == "node_modules"
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	var paths []string
+	for _, e := range entries {
+		paths = append(paths, e.Path)
+	}
+	assert.Equal(t, []string{"", "a.txt"}, paths)
+}
+
+func TestRemotePath(t *testing.T) {
+	assert.Equal(t, ".", remotePath("~"))
+	assert.Equal(t, "./x", remotePath("~/x"))
+	assert.Equal(t, "/tmp/x", remotePath("/tmp/x"))
+	assert.Equal(t, "", relRemote("dir", "dir"))
+	assert.Equal(t, "a/b", relRemote("dir/", "dir/a/b"))
+	assert.Equal(t, "a", relRemote(".", "a"))
+}